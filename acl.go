@@ -0,0 +1,534 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// Everything an ACL selector can refer to
+type aclState struct {
+	Peers   map[string]types.Peer
+	Members map[string][]string
+}
+
+func loadACLState() (aclState, error) {
+	state := aclState{
+		Peers:   map[string]types.Peer{},
+		Members: map[string][]string{},
+	}
+
+	peers, err := db.GetPeers()
+	if err != nil {
+		return state, err
+	}
+	for _, peer := range peers {
+		state.Peers[peer.UUID] = peer
+	}
+
+	groups, err := db.GetGroups()
+	if err != nil {
+		return state, err
+	}
+	for _, group := range groups {
+		state.Members[group.Name] = group.Members
+	}
+
+	return state, nil
+}
+
+// Resolves selectors to prefixes. all is set when the selectors match every address.
+func (s aclState) resolve(selectors []string) (prefixes []netip.Prefix, all bool) {
+	for _, selector := range selectors {
+		kind, value, _ := strings.Cut(selector, ":")
+		switch kind {
+		case "any":
+			return nil, true
+		case "peer":
+			prefixes = append(prefixes, peerPrefixes(s.Peers[value])...)
+		case "group":
+			for _, uuid := range s.Members[value] {
+				prefixes = append(prefixes, peerPrefixes(s.Peers[uuid])...)
+			}
+		default:
+			prefix, err := netip.ParsePrefix(selector)
+			if err == nil {
+				prefixes = append(prefixes, prefix.Masked())
+			}
+		}
+	}
+	return prefixes, false
+}
+
+// Returns the prefixes of an enabled peer
+func peerPrefixes(peer types.Peer) []netip.Prefix {
+	if !peer.Enabled {
+		return nil
+	}
+	var prefixes []netip.Prefix
+	for _, subnet := range peerDestinations(peer) {
+		prefix, err := netip.ParsePrefix(subnet)
+		if err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes
+}
+
+func ValidateACLRule(rule *types.ACLRule) error {
+	if rule.Action != ACLAllow && rule.Action != ACLDeny {
+		return errors.New("action must be allow or deny")
+	}
+	if len(rule.Sources) == 0 || len(rule.Destinations) == 0 {
+		return errors.New("sources and destinations are required")
+	}
+	for _, selector := range append(append([]string{}, rule.Sources...), rule.Destinations...) {
+		kind, value, _ := strings.Cut(selector, ":")
+		switch kind {
+		case "any":
+		case "peer":
+			_, err := db.GetPeer(value)
+			if err != nil {
+				return fmt.Errorf("peer %s not found", value)
+			}
+		case "group":
+			_, err := db.GetGroup(value)
+			if err != nil {
+				return fmt.Errorf("group %s not found", value)
+			}
+		default:
+			_, err := netip.ParsePrefix(selector)
+			if err != nil {
+				return fmt.Errorf("invalid selector %s", selector)
+			}
+		}
+	}
+
+	rule.Protocol = strings.ToLower(rule.Protocol)
+	if rule.Protocol == "" {
+		rule.Protocol = "any"
+	}
+	switch rule.Protocol {
+	case "tcp", "udp":
+	case "icmp", "any":
+		if len(rule.Ports) > 0 {
+			return errors.New("ports can only be set for tcp and udp")
+		}
+	default:
+		return errors.New("protocol must be tcp, udp, icmp or any")
+	}
+
+	if rule.Ports == nil {
+		rule.Ports = []string{}
+	}
+	for _, port := range rule.Ports {
+		_, err := parsePortRange(port)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compiles the ACL rules into forwarding rules for the traffic of the tunnel
+// interfaces. Allowed flows return to the isolation and policy rules, denied
+// flows are dropped.
+func aclRules(interfaces []string) ([]ForwardRule, error) {
+	rules, err := db.GetACLRules()
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadACLState()
+	if err != nil {
+		return nil, err
+	}
+	if len(interfaces) == 0 {
+		return nil, nil
+	}
+
+	// Replies to allowed flows are allowed
+	forward := []ForwardRule{{Established: true, Action: FirewallReturn}}
+
+	// Only traffic entering or leaving a tunnel interface is subject to the ACL
+	scoped := func(rule ForwardRule) {
+		for _, iface := range interfaces {
+			in, out := rule, rule
+			in.InInterface = iface
+			out.OutInterface = iface
+			forward = append(forward, in, out)
+		}
+	}
+
+	for _, rule := range rules {
+		action := FirewallReturn
+		if rule.Action == ACLDeny {
+			action = FirewallDrop
+		}
+		protocol := rule.Protocol
+		if protocol == "any" {
+			protocol = ""
+		}
+		var ports []string
+		for _, port := range rule.Ports {
+			spec, err := parsePortRange(port)
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, spec)
+		}
+
+		// An empty CIDR matches any address
+		src, srcAny := state.resolve(rule.Sources)
+		dst, dstAny := state.resolve(rule.Destinations)
+		sources := prefixStrings(src, srcAny)
+		destinations := prefixStrings(dst, dstAny)
+		for _, source := range sources {
+			for _, destination := range destinations {
+				if source != "" && destination != "" && sameFamily(source, true) != sameFamily(destination, true) {
+					continue
+				}
+				scoped(ForwardRule{
+					Source:      source,
+					Destination: destination,
+					Protocol:    protocol,
+					Ports:       ports,
+					Action:      action,
+				})
+			}
+		}
+	}
+
+	if ENV.ACL_DEFAULT == ACLDeny {
+		scoped(ForwardRule{Action: FirewallDrop})
+	}
+
+	return forward, nil
+}
+
+// Formats resolved prefixes, or a single empty CIDR matching any address when all is set
+func prefixStrings(prefixes []netip.Prefix, all bool) []string {
+	if all {
+		return []string{""}
+	}
+	var cidrs []string
+	for _, prefix := range prefixes {
+		cidrs = append(cidrs, prefix.String())
+	}
+	return cidrs
+}
+
+// Evaluates the ACL rules for a single flow and reports the rule that matched
+func TestACL(req types.ACLTestRequest) (types.ACLTestResult, error) {
+	rules, err := db.GetACLRules()
+	if err != nil {
+		return types.ACLTestResult{}, err
+	}
+	state, err := loadACLState()
+	if err != nil {
+		return types.ACLTestResult{}, err
+	}
+
+	src, err := state.testAddress(req.Source)
+	if err != nil {
+		return types.ACLTestResult{}, fmt.Errorf("source: %v", err)
+	}
+	dst, err := state.testAddress(req.Destination)
+	if err != nil {
+		return types.ACLTestResult{}, fmt.Errorf("destination: %v", err)
+	}
+	if src.Is4() != dst.Is4() {
+		return types.ACLTestResult{}, errors.New("source and destination must be the same address family")
+	}
+	req.Protocol = strings.ToLower(req.Protocol)
+	switch req.Protocol {
+	case "tcp", "udp":
+		if req.Port < 1 || req.Port > 65535 {
+			return types.ACLTestResult{}, errors.New("invalid port")
+		}
+	case "icmp":
+	default:
+		return types.ACLTestResult{}, errors.New("protocol must be tcp, udp or icmp")
+	}
+
+	for _, rule := range rules {
+		if !state.matches(rule.Sources, src) || !state.matches(rule.Destinations, dst) {
+			continue
+		}
+		if rule.Protocol != "any" && rule.Protocol != req.Protocol {
+			continue
+		}
+		if !portMatches(rule.Ports, req.Port) {
+			continue
+		}
+		return types.ACLTestResult{
+			Allowed:  rule.Action == ACLAllow,
+			RuleUUID: rule.UUID,
+			Reason:   fmt.Sprintf("matched rule %s (priority %d, %s)", rule.UUID, rule.Priority, rule.Action),
+		}, nil
+	}
+
+	return types.ACLTestResult{
+		Allowed: ENV.ACL_DEFAULT == ACLAllow,
+		Reason:  "no rule matched, default action is " + ENV.ACL_DEFAULT,
+	}, nil
+}
+
+// Parses an address or a "peer:<uuid>" selector into the address to test
+func (s aclState) testAddress(value string) (netip.Addr, error) {
+	kind, uuid, _ := strings.Cut(value, ":")
+	if kind == "peer" {
+		peer, ok := s.Peers[uuid]
+		if !ok {
+			return netip.Addr{}, errors.New("peer not found")
+		}
+		return netip.ParseAddr(peer.RemoteTunAddress)
+	}
+	return netip.ParseAddr(value)
+}
+
+func (s aclState) matches(selectors []string, addr netip.Addr) bool {
+	prefixes, all := s.resolve(selectors)
+	if all {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the ACL allows all traffic from src to dst. Rules allowing
+// only some protocols or ports do not restrict what a later rule allows.
+func (s aclState) allowsAll(rules []types.ACLRule, src netip.Addr, dst netip.Addr) bool {
+	for _, rule := range rules {
+		if !s.matches(rule.Sources, src) || !s.matches(rule.Destinations, dst) {
+			continue
+		}
+		if rule.Action == ACLDeny {
+			return false
+		}
+		if rule.Protocol == "any" && len(rule.Ports) == 0 {
+			return true
+		}
+	}
+	return ENV.ACL_DEFAULT == ACLAllow
+}
+
+func portMatches(ports []string, port int) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	for _, p := range ports {
+		var first, last int
+		if _, err := fmt.Sscanf(p, "%d-%d", &first, &last); err != nil {
+			fmt.Sscanf(p, "%d", &first)
+			last = first
+		}
+		if port >= first && port <= last {
+			return true
+		}
+	}
+	return false
+}
+
+func GET_ACLRules(c *gin.Context) {
+	rules, err := db.GetACLRules()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, rules)
+}
+
+func PUT_ACLRule(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	// Parse the rule request body
+	var rule types.ACLRule
+	err := c.BindJSON(&rule)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	rule.UUID = uuid
+
+	err = ValidateACLRule(&rule)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Insert rule into database
+	err = db.InsertACLRule(rule)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = SyncFirewall()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Direct sessions bypass the ACL
+	FanoutMesh()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func PATCH_ACLRule(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	// Parse the rule request body
+	var rule types.ACLRule
+	err := c.BindJSON(&rule)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	rule.UUID = uuid
+
+	_, err = db.GetACLRule(uuid)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+
+	err = ValidateACLRule(&rule)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = db.UpdateACLRule(rule)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = SyncFirewall()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Direct sessions bypass the ACL
+	FanoutMesh()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_ACLRule(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	err := db.DeleteACLRule(uuid)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = SyncFirewall()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Direct sessions bypass the ACL
+	FanoutMesh()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func POST_ACLTest(c *gin.Context) {
+	var req types.ACLTestRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	result, err := TestACL(req)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, result)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+func TestAllowsAll(t *testing.T) {
+	state := aclState{
+		Peers: map[string]types.Peer{
+			"a": {UUID: "a", Enabled: true, RemoteTunAddress: "10.0.0.2"},
+			"b": {UUID: "b", Enabled: true, RemoteTunAddress: "10.0.0.3", RemoteSubnets: []string{"192.168.1.0/24", "0.0.0.0/0"}},
+			"c": {UUID: "c", Enabled: false, RemoteTunAddress: "10.0.0.4"},
+		},
+		Members: map[string][]string{
+			"servers": {"b", "c"},
+		},
+	}
+	allow := func(sources []string, destinations []string) types.ACLRule {
+		return types.ACLRule{Action: ACLAllow, Sources: sources, Destinations: destinations, Protocol: "any"}
+	}
+	deny := func(sources []string, destinations []string) types.ACLRule {
+		return types.ACLRule{Action: ACLDeny, Sources: sources, Destinations: destinations, Protocol: "any"}
+	}
+	sshOnly := allow([]string{"peer:a"}, []string{"group:servers"})
+	sshOnly.Protocol = "tcp"
+	sshOnly.Ports = []string{"22"}
+
+	tests := []struct {
+		name        string
+		rules       []types.ACLRule
+		defaultRule string
+		src         string
+		dst         string
+		want        bool
+	}{
+		{"no rules, default allow", nil, ACLAllow, "10.0.0.2", "10.0.0.3", true},
+		{"no rules, default deny", nil, ACLDeny, "10.0.0.2", "10.0.0.3", false},
+		{"peer to group", []types.ACLRule{allow([]string{"peer:a"}, []string{"group:servers"})}, ACLDeny, "10.0.0.2", "10.0.0.3", true},
+		{"peer to group subnet", []types.ACLRule{allow([]string{"peer:a"}, []string{"group:servers"})}, ACLDeny, "10.0.0.2", "192.168.1.10", true},
+		{"default route is not a destination", []types.ACLRule{allow([]string{"peer:a"}, []string{"group:servers"})}, ACLDeny, "10.0.0.2", "8.8.8.8", false},
+		{"disabled group member", []types.ACLRule{allow([]string{"peer:a"}, []string{"group:servers"})}, ACLDeny, "10.0.0.2", "10.0.0.4", false},
+		{"reverse direction", []types.ACLRule{allow([]string{"peer:a"}, []string{"group:servers"})}, ACLDeny, "10.0.0.3", "10.0.0.2", false},
+		{"first matching rule wins", []types.ACLRule{deny([]string{"any"}, []string{"peer:b"}), allow([]string{"any"}, []string{"any"})}, ACLAllow, "10.0.0.2", "10.0.0.3", false},
+		{"earlier allow wins", []types.ACLRule{allow([]string{"any"}, []string{"any"}), deny([]string{"any"}, []string{"peer:b"})}, ACLDeny, "10.0.0.2", "10.0.0.3", true},
+		{"CIDR selectors", []types.ACLRule{allow([]string{"10.0.0.0/24"}, []string{"192.168.0.0/16"})}, ACLDeny, "10.0.0.2", "192.168.1.10", true},
+		{"port rule does not allow all", []types.ACLRule{sshOnly}, ACLDeny, "10.0.0.2", "10.0.0.3", false},
+		{"port rule falls through", []types.ACLRule{sshOnly, allow([]string{"any"}, []string{"any"})}, ACLDeny, "10.0.0.2", "10.0.0.3", true},
+		{"port deny restricts", []types.ACLRule{{Action: ACLDeny, Sources: []string{"any"}, Destinations: []string{"any"}, Protocol: "tcp", Ports: []string{"22"}}}, ACLAllow, "10.0.0.2", "10.0.0.3", false},
+	}
+	defaultAction := ENV.ACL_DEFAULT
+	defer func() { ENV.ACL_DEFAULT = defaultAction }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ENV.ACL_DEFAULT = tt.defaultRule
+			got := state.allowsAll(tt.rules, netip.MustParseAddr(tt.src), netip.MustParseAddr(tt.dst))
+			if got != tt.want {
+				t.Errorf("allowsAll(%s, %s) = %v, want %v", tt.src, tt.dst, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortMatches(t *testing.T) {
+	tests := []struct {
+		ports []string
+		port  int
+		want  bool
+	}{
+		{nil, 22, true},
+		{[]string{"22"}, 22, true},
+		{[]string{"22"}, 23, false},
+		{[]string{"80", "443"}, 443, true},
+		{[]string{"8000-8100"}, 8000, true},
+		{[]string{"8000-8100"}, 8100, true},
+		{[]string{"8000-8100"}, 8101, false},
+	}
+	for _, tt := range tests {
+		if got := portMatches(tt.ports, tt.port); got != tt.want {
+			t.Errorf("portMatches(%v, %d) = %v, want %v", tt.ports, tt.port, got, tt.want)
+		}
+	}
+}
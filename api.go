@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"log"
-	"strings"
+	"net/http"
 
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
@@ -12,6 +16,9 @@ import (
 	"github.com/wg-controller/wg-controller/types"
 )
 
+var apiServer *http.Server
+
+// Registers the routes and starts serving the API in the background
 func StartAPI() {
 	// Set Gin to release mode
 	gin.SetMode(gin.ReleaseMode)
@@ -23,14 +30,21 @@ func StartAPI() {
 	public := router.Group("/api/v1")
 	private := router.Group("/api/v1")
 
+	// Only trust forwarded headers from the configured reverse proxies
+	err := router.SetTrustedProxies(ENV.TRUSTED_PROXIES)
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+
 	// Middleware
-	private.Use(AuthMiddleware)
+	private.Use(AuthMiddleware, AuditMiddleware)
 
 	// Public Endpoints
 	public.GET("/health", GET_Health)
 	public.POST("/prelogin", POST_PreLogin)
 	public.POST("/login", POST_Login)
 	public.POST("/logout", POST_Logout)
+	public.POST("/enroll", POST_Enroll)
 
 	// Private Endpoints
 	private.GET("/peers", GET_Peers)
@@ -39,36 +53,148 @@ func StartAPI() {
 	private.PATCH("/peers/:uuid", PATCH_Peer)
 	private.DELETE("/peers/:uuid", DELETE_Peer)
 	private.GET("/peers/init", GET_InitPeer)
+	private.GET("/peers/:uuid/config", GET_PeerConfig)
+	private.GET("/peers/:uuid/rotation", GET_PeerRotation)
+	private.POST("/peers/:uuid/rotation", POST_PeerRotation)
+	private.DELETE("/peers/:uuid/rotation", DELETE_PeerRotation)
+	private.GET("/peers/:uuid/rotation/config", GET_PeerRotationConfig)
+	private.POST("/peers/:uuid/rotation/ack", POST_PeerRotationAck)
+	private.PUT("/peers/:uuid/mesh", PUT_PeerMesh)
 
 	private.GET("/accounts", GET_Accounts)
 	private.PUT("/accounts/:email", PUT_Account)
 	private.PATCH("/accounts/:email", PATCH_Account)
 	private.PATCH("/accounts/:email/password", PATCH_AccountPassword)
 	private.DELETE("/accounts/:email", DELETE_Account)
+	private.POST("/accounts/:email/unlock", POST_AccountUnlock)
+
+	private.GET("/lockouts", GET_IPLockouts)
+	private.DELETE("/lockouts/:ip", DELETE_IPLockout)
 
 	private.GET("/apikeys", GET_APIKeys)
 	private.PUT("/apikeys/:uuid", PUT_APIKey)
 	private.PATCH("/apikeys/:uuid", PATCH_APIKey)
 	private.DELETE("/apikeys/:uuid", DELETE_APIKey)
+	private.POST("/apikeys/:uuid/rotate", POST_APIKeyRotate)
 	private.GET("/apikeys/init", GET_InitAPIKey)
 
+	private.GET("/enrollments", GET_Enrollments)
+	private.POST("/enrollments", POST_Enrollment)
+	private.DELETE("/enrollments/:uuid", DELETE_Enrollment)
+
+	private.GET("/ipam/pools", GET_Pools)
+	private.PUT("/ipam/pools/:name", PUT_Pool)
+	private.PATCH("/ipam/pools/:name", PATCH_Pool)
+	private.DELETE("/ipam/pools/:name", DELETE_Pool)
+	private.GET("/ipam/reservations", GET_Reservations)
+	private.PUT("/ipam/reservations/:uuid", PUT_Reservation)
+	private.DELETE("/ipam/reservations/:uuid", DELETE_Reservation)
+	private.GET("/ipam/leases", GET_Leases)
+	private.GET("/ipam/utilization", GET_PoolUtilization)
+
+	private.GET("/networks", GET_Networks)
+	private.PUT("/networks/:name", PUT_Network)
+	private.PATCH("/networks/:name", PATCH_Network)
+	private.DELETE("/networks/:name", DELETE_Network)
+	private.GET("/networks/:name/keyrotations", GET_ServerKeyRotations)
+	private.POST("/networks/:name/keyrotations", POST_ServerKeyRotation)
+	private.POST("/networks/:name/keyrotations/complete", POST_ServerKeyRotationComplete)
+	private.DELETE("/networks/:name/keyrotations", DELETE_ServerKeyRotation)
+	private.GET("/networks/:name/mesh", GET_NetworkMesh)
+
+	private.GET("/routes", GET_Routes)
+
+	private.GET("/groups", GET_Groups)
+	private.PUT("/groups/:name", PUT_Group)
+	private.PATCH("/groups/:name", PATCH_Group)
+	private.DELETE("/groups/:name", DELETE_Group)
+	private.PUT("/groups/:name/members/:uuid", PUT_GroupMember)
+	private.DELETE("/groups/:name/members/:uuid", DELETE_GroupMember)
+
+	private.GET("/policies", GET_Policies)
+	private.PUT("/policies/:uuid", PUT_Policy)
+	private.PATCH("/policies/:uuid", PATCH_Policy)
+	private.DELETE("/policies/:uuid", DELETE_Policy)
+
+	private.GET("/acl", GET_ACLRules)
+	private.PUT("/acl/:uuid", PUT_ACLRule)
+	private.PATCH("/acl/:uuid", PATCH_ACLRule)
+	private.DELETE("/acl/:uuid", DELETE_ACLRule)
+	private.POST("/acl/test", POST_ACLTest)
+
+	private.GET("/dns/records", GET_DNSRecords)
+	private.PUT("/dns/records/:uuid", PUT_DNSRecord)
+	private.PATCH("/dns/records/:uuid", PATCH_DNSRecord)
+	private.DELETE("/dns/records/:uuid", DELETE_DNSRecord)
+
+	private.GET("/dns/upstreams", GET_DNSUpstreams)
+	private.GET("/dns/querylog", GET_DNSQueryLog)
+
+	private.GET("/sessions", GET_Sessions)
+	private.DELETE("/sessions", DELETE_Sessions)
+	private.DELETE("/sessions/:id", DELETE_Session)
+
+	private.GET("/audit", GET_Audit)
+	private.GET("/audit/export", GET_AuditExport)
+
 	private.GET("/serverinfo", GET_ServerInfo)
 
 	private.GET("/poll", GET_LongPoll)
 
+	registerAPITopics(router.Routes())
+
 	// Static server
 	router.Use(static.Serve("/", static.LocalFile("/var/www", true)))
 
-	// Start Listening
+	// Start Listening. The server is created before serving in the background,
+	// so StopAPI always sees it.
 	log.Println("Starting web server at: http://0.0.0.0:" + ENV.API_PORT)
-	err := router.Run(":" + ENV.API_PORT)
+	server := &http.Server{
+		Addr:    ":" + ENV.API_PORT,
+		Handler: router,
+	}
+	apiServer = server
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Error starting API:", err)
+		}
+	}()
+}
+
+// Stops accepting requests and waits for the ones in flight
+func StopAPI(ctx context.Context) {
+	if apiServer == nil {
+		return
+	}
+	err := apiServer.Shutdown(ctx)
 	if err != nil {
-		log.Fatal("Error starting API:", err)
+		log.Println("Error stopping API:", err)
 	}
 }
 
 func GET_Health(c *gin.Context) {
-	_, err := wg.Device(ENV.WG_INTERFACE)
+	networks, err := db.GetNetworks()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Report the active wireguard backend
+	backends := WireguardBackends()
+	backend := ""
+	for _, b := range backends {
+		if backend != "" && backend != b {
+			backend = "mixed"
+			break
+		}
+		backend = b
+	}
+
+	interfaces, err := NetworkInterfaces(networks)
 	if err != nil {
 		log.Println(err)
 		c.JSON(500, gin.H{
@@ -77,8 +203,41 @@ func GET_Health(c *gin.Context) {
 		return
 	}
 
+	// Report supervised children that are not running, such as a crashed
+	// wireguard-go process waiting to be restarted
+	processes := SupervisedStatus()
+	for _, process := range processes {
+		if process.State != ChildRunning {
+			c.JSON(503, gin.H{
+				"status":     "degraded",
+				"error":      process.Name + " is " + process.State + ": " + process.LastError,
+				"backend":    backend,
+				"interfaces": backends,
+				"processes":  processes,
+			})
+			return
+		}
+	}
+
+	// Check every network's wireguard interfaces
+	for _, network := range networks {
+		for _, iface := range interfaces[network.Name] {
+			_, err := wg.Device(iface)
+			if err != nil {
+				log.Println(err)
+				c.JSON(500, gin.H{
+					"error": network.Name + ": " + err.Error(),
+				})
+				return
+			}
+		}
+	}
+
 	c.JSON(200, gin.H{
-		"status": "ok",
+		"status":     "ok",
+		"backend":    backend,
+		"interfaces": backends,
+		"processes":  processes,
 	})
 }
 
@@ -160,24 +319,126 @@ func PUT_Peer(c *gin.Context) {
 		return
 	}
 
+	// The path decides which peer is written
+	if peer.UUID != uuid {
+		c.JSON(400, gin.H{
+			"error": "uuid does not match path",
+		})
+		return
+	}
+
+	// Check the peer doesn't exist, its addresses would be released on failure
+	_, err = db.GetPeer(uuid)
+	if err == nil {
+		c.JSON(409, gin.H{
+			"error": "peer already exists",
+		})
+		return
+	}
+
+	// Check the peer's keys
+	err = ValidatePeerKeys(peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's conditional DNS forwarders
+	err = ValidateDNSForwarders(&peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's network exists
+	peer.Network = PeerNetworkName(peer)
+	_, err = db.GetNetwork(peer.Network)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": "network not found",
+		})
+		return
+	}
+
+	// Check the peer's egress mode and exit peer
+	err = ValidatePeerEgress(peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's remote subnets and their metrics
+	err = ValidateRemoteSubnets(&peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's DNS names are unique
+	err = ValidatePeerNames(&peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Bind the tunnel addresses to the peer, dropping any held from /peers/init on failure
+	_, err = ClaimPeerAddresses(peer)
+	if err != nil {
+		releaseErr := ReleaseAddresses(peer.UUID)
+		if releaseErr != nil {
+			log.Println(releaseErr)
+		}
+	}
+	if errors.Is(err, ErrAddressInUse) {
+		c.JSON(409, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
 	// Insert peer into database
 	err = db.InsertPeer(peer)
 	if err != nil {
 		log.Println(err)
+		ReleaseAddresses(peer.UUID)
 		c.JSON(500, gin.H{
 			"error": err.Error(),
 		})
 		return
 	}
 
+	PeerCreated(peer)
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+// Applies a newly inserted peer to wireguard, DNS and routing, and notifies clients
+func PeerCreated(peer types.Peer) {
 	// Resync wireguard configuration
-	err = SyncWireguardConfiguration()
+	err := SyncWireguardConfiguration()
 	if err != nil {
 		log.Println(err)
 	}
 
 	// Resync peers DNS entries
-	err = SyncPeersDNS(true)
+	err = SyncPeersDNS()
 	if err != nil {
 		log.Println(err)
 	}
@@ -188,16 +449,86 @@ func PUT_Peer(c *gin.Context) {
 		log.Println(err)
 	}
 
+	// Resync firewall, the peer may send its internet traffic through an exit peer
+	err = SyncFirewall()
+	if err != nil {
+		log.Println(err)
+	}
+
 	// Push config to peer
 	PushPeerConfig(peer)
 	FanoutPeers()
 
 	// Trigger alert
 	peerCreatedAlert(peer.Hostname)
+}
 
-	c.JSON(200, gin.H{
-		"status": "ok",
-	})
+// Overlays the fields present in a PATCH body onto the stored peer. A PATCH
+// never blanks the peer's private or pre-shared key.
+func mergePeer(existing types.Peer, body []byte) (types.Peer, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return types.Peer{}, err
+	}
+
+	// Decode onto a copy so the stored peer's slices and maps aren't modified
+	var peer types.Peer
+	stored, err := json.Marshal(existing)
+	if err != nil {
+		return types.Peer{}, err
+	}
+	err = json.Unmarshal(stored, &peer)
+	if err != nil {
+		return types.Peer{}, err
+	}
+
+	// Maps are decoded by merging keys, the body's route metrics replace them
+	if _, ok := fields["routeMetrics"]; ok {
+		peer.RouteMetrics = nil
+	}
+	err = json.Unmarshal(body, &peer)
+	if err != nil {
+		return types.Peer{}, err
+	}
+
+	if peer.PrivateKey == "" {
+		peer.PrivateKey = existing.PrivateKey
+	}
+	if peer.PreSharedKey == "" {
+		peer.PreSharedKey = existing.PreSharedKey
+	}
+	return peer, nil
+}
+
+// Copies the details a device reports about itself onto the stored peer.
+// Credentials scoped to a peer can't change its network, routes or access.
+func selfUpdatePeer(existing types.Peer, patched types.Peer) types.Peer {
+	existing.Hostname = patched.Hostname
+	existing.OS = patched.OS
+	existing.ClientVersion = patched.ClientVersion
+	existing.ClientType = patched.ClientType
+	return existing
+}
+
+// Applies a PATCH request's body to the stored peer. The path decides which
+// peer is written, and a peer's own credential only reports the device's details.
+func patchPeer(c *gin.Context, existing types.Peer) (types.Peer, error) {
+	body, err := c.GetRawData()
+	if err != nil {
+		return types.Peer{}, err
+	}
+	peer, err := mergePeer(existing, body)
+	if err != nil {
+		return types.Peer{}, err
+	}
+	if peer.UUID != existing.UUID {
+		return types.Peer{}, errors.New("uuid does not match path")
+	}
+	if c.GetBool("resourceScoped") {
+		peer = selfUpdatePeer(existing, peer)
+	}
+	return peer, nil
 }
 
 func PATCH_Peer(c *gin.Context) {
@@ -209,11 +540,85 @@ func PATCH_Peer(c *gin.Context) {
 		return
 	}
 
-	var peer types.Peer
-	peer.UUID = uuid
-	err := c.BindJSON(&peer)
+	existing, err := db.GetPeer(uuid)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "peer not found",
+		})
+		return
+	}
+
+	peer, err := patchPeer(c, existing)
 	if err != nil {
-		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's keys
+	err = ValidatePeerKeys(peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's conditional DNS forwarders
+	err = ValidateDNSForwarders(&peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's network exists
+	peer.Network = PeerNetworkName(peer)
+	_, err = db.GetNetwork(peer.Network)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": "network not found",
+		})
+		return
+	}
+
+	// Check the peer's egress mode and exit peer
+	err = ValidatePeerEgress(peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's remote subnets and their metrics
+	err = ValidateRemoteSubnets(&peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the peer's DNS names are unique
+	err = ValidatePeerNames(&peer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Bind the tunnel addresses to the peer, releasing any it no longer uses
+	previous, err := ClaimPeerAddresses(peer)
+	if errors.Is(err, ErrAddressInUse) {
+		c.JSON(409, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
 		c.JSON(400, gin.H{
 			"error": err.Error(),
 		})
@@ -223,6 +628,10 @@ func PATCH_Peer(c *gin.Context) {
 	err = db.UpdatePeer(peer)
 	if err != nil {
 		log.Println(err)
+		restoreErr := RestoreAddresses(peer.UUID, previous)
+		if restoreErr != nil {
+			log.Println(restoreErr)
+		}
 		c.JSON(500, gin.H{
 			"error": err.Error(),
 		})
@@ -236,7 +645,7 @@ func PATCH_Peer(c *gin.Context) {
 	}
 
 	// Resync peers DNS entries
-	err = SyncPeersDNS(true)
+	err = SyncPeersDNS()
 	if err != nil {
 		log.Println(err)
 	}
@@ -247,8 +656,8 @@ func PATCH_Peer(c *gin.Context) {
 		log.Println(err)
 	}
 
-	// Push config to peer
-	PushPeerConfig(peer)
+	// Reapply group policies, which also pushes the peer's config
+	ApplyGroupPolicies()
 	FanoutPeers()
 
 	c.JSON(200, gin.H{
@@ -285,8 +694,29 @@ func DELETE_Peer(c *gin.Context) {
 		return
 	}
 
+	// Release the peer's tunnel address
+	err = ReleaseAddresses(uuid)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Remove the peer from its groups
+	err = db.DeletePeerMemberships(uuid)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Cancel any pending key rotation
+	err = db.DeleteKeyRotation(uuid)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Println(err)
+	}
+
 	// Prune wireguard configuration
-	err = PruneWireguardPeers([]string{peer.PublicKey})
+	network, err := GetPeerNetwork(peer)
+	if err == nil {
+		err = PruneWireguardPeers(network.Interface, []string{peer.PublicKey})
+	}
 	if err != nil {
 		log.Println(err)
 		c.JSON(500, gin.H{
@@ -295,7 +725,7 @@ func DELETE_Peer(c *gin.Context) {
 	}
 
 	// Resync peers DNS entries
-	err = SyncPeersDNS(true)
+	err = SyncPeersDNS()
 	if err != nil {
 		log.Println(err)
 	}
@@ -306,6 +736,7 @@ func DELETE_Peer(c *gin.Context) {
 		log.Println(err)
 	}
 
+	ApplyGroupPolicies()
 	FanoutPeers()
 
 	c.JSON(200, gin.H{
@@ -316,26 +747,45 @@ func DELETE_Peer(c *gin.Context) {
 func GET_InitPeer(c *gin.Context) {
 	InitPeer := types.PeerInit{}
 
-	// Generate UUID
+	// Generate UUID, or use the one given so a static assignment for it applies
 	InitPeer.UUID = uuid.New().String()
-
-	// Generate private key
-	privKey, err := NewWireguardPrivateKey()
-	if err != nil {
-		log.Println(err)
-		c.Status(500)
-		return
+	if v := c.Query("uuid"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": "invalid uuid",
+			})
+			return
+		}
+		_, err = db.GetPeer(id.String())
+		if err == nil {
+			c.JSON(409, gin.H{
+				"error": "peer already exists",
+			})
+			return
+		}
+		InitPeer.UUID = id.String()
 	}
-	InitPeer.PrivateKey = privKey
 
-	// Generate public key
-	pubKey, err := GetWireguardPublicKey(privKey)
-	if err != nil {
-		log.Println(err)
-		c.Status(500)
-		return
+	// Generate a key pair, unless the client generates its own and only
+	// sends its public key when the peer is created
+	if !ENV.CLIENT_KEYS_ONLY && c.Query("clientKeys") != "true" {
+		privKey, err := NewWireguardPrivateKey()
+		if err != nil {
+			log.Println(err)
+			c.Status(500)
+			return
+		}
+		InitPeer.PrivateKey = privKey
+
+		pubKey, err := GetWireguardPublicKey(privKey)
+		if err != nil {
+			log.Println(err)
+			c.Status(500)
+			return
+		}
+		InitPeer.PublicKey = pubKey
 	}
-	InitPeer.PublicKey = pubKey
 
 	// Generate pre-shared key
 	preSharedKey, err := NewWireguardPreSharedKey()
@@ -346,30 +796,47 @@ func GET_InitPeer(c *gin.Context) {
 	}
 	InitPeer.PreSharedKey = preSharedKey
 
-	// Get current peers to generate a unique localTunAddress
-	peers, err := db.GetPeers()
+	// Get the network the peer will join
+	network, err := db.GetNetwork(c.DefaultQuery("network", DefaultNetworkName))
 	if err != nil {
 		log.Println(err)
-		c.Status(500)
+		c.JSON(400, gin.H{
+			"error": "network not found",
+		})
 		return
 	}
+	InitPeer.Network = network.Name
 
-	// Extract used addresses
-	var usedAddresses []string
-	for _, peer := range peers {
-		usedAddresses = append(usedAddresses, peer.RemoteTunAddress)
-	}
-
-	// Generate a unique address
-	address, err := GetUniqueAddress(usedAddresses, ENV.SERVER_CIDR)
+	// Allocate a tunnel address and hold it until the peer is created
+	pool := c.DefaultQuery("pool", NetworkPoolName(network.Name, false))
+	lease, err := AllocateAddress(network.Name, pool, InitPeer.UUID)
 	if err != nil {
 		log.Println(err)
-		c.Status(500)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
 		return
 	}
-	InitPeer.RemoteTunAddress = address
+	InitPeer.RemoteTunAddress = lease.Address
+	InitPeer.Pool = lease.Pool
+	InitPeer.LeaseExpires = lease.ExpiresUnixMillis
+
+	InitPeer.ServerCIDR = network.CIDR
 
-	InitPeer.ServerCIDR = ENV.SERVER_CIDR
+	// Allocate an IPv6 tunnel address when dual-stack is enabled
+	if network.CIDR6 != "" {
+		pool6 := c.DefaultQuery("pool6", NetworkPoolName(network.Name, true))
+		lease6, err := AllocateAddress(network.Name, pool6, InitPeer.UUID)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		InitPeer.RemoteTunAddress6 = lease6.Address
+		InitPeer.ServerCIDR6 = network.CIDR6
+	}
 
 	c.JSON(200, InitPeer)
 }
@@ -612,6 +1079,22 @@ func PUT_APIKey(c *gin.Context) {
 	}
 	apiKey.UUID = uuid
 
+	apiKeyWithoutToken := types.APIKey{
+		UUID:              apiKey.UUID,
+		Name:              apiKey.Name,
+		ExpiresUnixMillis: apiKey.ExpiresUnixMillis,
+		Attributes:        apiKey.Attributes,
+	}
+
+	// Validate expiry and scopes
+	err = ValidateAPIKey(apiKeyWithoutToken)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
 	// Decode token from base64
 	tokenBytes, err := base64.URLEncoding.DecodeString(apiKey.Token)
 	if err != nil {
@@ -628,13 +1111,6 @@ func PUT_APIKey(c *gin.Context) {
 		return
 	}
 
-	apiKeyWithoutToken := types.APIKey{
-		UUID:              apiKey.UUID,
-		Name:              apiKey.Name,
-		ExpiresUnixMillis: apiKey.ExpiresUnixMillis,
-		Attributes:        apiKey.Attributes,
-	}
-
 	// Insert api key
 	err = db.InsertApiKey(apiKeyWithoutToken, hash)
 	if err != nil {
@@ -671,6 +1147,15 @@ func PATCH_APIKey(c *gin.Context) {
 	}
 	apiKey.UUID = uuid
 
+	// Validate expiry and scopes
+	err = ValidateAPIKey(apiKey)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
 	// Update api key
 	err = db.UpdateApiKey(apiKey)
 	if err != nil {
@@ -730,31 +1215,57 @@ func GET_InitAPIKey(c *gin.Context) {
 }
 
 func GET_ServerInfo(c *gin.Context) {
-	// Generate public key
-	pubKey, err := GetWireguardPublicKey(ENV.WG_PRIVATE_KEY)
+	// Use the requested network, or the network of the requesting peer
+	networkName := c.Query("network")
+	if networkName == "" {
+		networkName = DefaultNetworkName
+		if peer, err := db.GetPeer(c.Query("uuid")); err == nil {
+			networkName = PeerNetworkName(peer)
+		}
+	}
+
+	network, err := db.GetNetwork(networkName)
 	if err != nil {
 		log.Println(err)
-		c.Status(500)
+		c.Status(404)
 		return
 	}
 
-	// Get server netmask
-	mask, err := GetMask(ENV.SERVER_CIDR)
+	serverInfo, err := GetServerInfo(network)
 	if err != nil {
 		log.Println(err)
 		c.Status(500)
 		return
 	}
 
-	serverInfo := types.ServerInfo{
-		PublicKey:          pubKey,
-		PublicEndpoint:     ENV.PUBLIC_HOST + ":" + ENV.WG_PORT,
-		PublicHost:         ENV.PUBLIC_HOST,
-		NameServers:        []string{strings.Split(ENV.SERVER_ADDRESS, "/")[0]},
-		Netmask:            mask,
-		ServerInternalIP:   strings.Split(ENV.SERVER_ADDRESS, "/")[0],
-		ServerInternalName: ENV.SERVER_HOSTNAME,
+	c.JSON(200, serverInfo)
+}
+
+func GET_PeerConfig(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
 	}
 
-	c.JSON(200, serverInfo)
+	peer, err := db.GetPeer(uuid)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+
+	config, err := GenerateClientConfig(peer)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+peer.Hostname+".conf\"")
+	c.String(200, config)
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Legacy attribute granting full access to the peers, poll and serverinfo topics
+const WGClientAttribute = "wg-client"
+
+// Grace period of a rotated token when none is requested
+const DefaultRotationGracePeriod = 24 * time.Hour
+
+// How often a key's last used time is written to the database
+const APIKeyTouchInterval = time.Minute
+
+var apiKeyOperations = map[string]bool{"read": true, "write": true, "delete": true, "*": true}
+
+// Topics of the registered API routes, filled in by StartAPI
+var apiTopics = map[string]bool{"*": true}
+
+// A parsed API key scope, "<operation>-<topic>[:<resource id>]". The operation
+// and topic may be "*". Without a resource ID the scope covers every resource.
+type apiKeyScope struct {
+	Operation string
+	Topic     string
+	Resource  string
+}
+
+func parseScope(attribute string) (apiKeyScope, error) {
+	var scope apiKeyScope
+	permission, resource, _ := strings.Cut(attribute, ":")
+	operation, topic, found := strings.Cut(permission, "-")
+	if !found || operation == "" || topic == "" {
+		return scope, errors.New("invalid scope " + attribute + ", expected <operation>-<topic>[:<resource id>]")
+	}
+
+	scope.Operation = operation
+	scope.Topic = topic
+	scope.Resource = resource
+	return scope, nil
+}
+
+func (s apiKeyScope) allows(operation string, topic string, resource string) bool {
+	return (s.Operation == "*" || s.Operation == operation) &&
+		(s.Topic == "*" || s.Topic == topic) &&
+		(s.Resource == "" || s.Resource == resource)
+}
+
+// Reports whether any of a key's attributes permit the request. Requests only
+// permitted by a resource scoped attribute are marked "resourceScoped".
+func apiKeyAllows(attributes []string, c *gin.Context) (bool, error) {
+	permission, topic, err := PermissionString(c)
+	if err != nil {
+		return false, err
+	}
+	operation := strings.SplitN(permission, "-", 2)[0]
+	resource := routeResource(c, topic)
+
+	scoped := false
+	for _, attribute := range attributes {
+		if attribute == WGClientAttribute {
+			// "wg-client" has full access to "peers" and "poll" topics
+			if topic == "peers" || topic == "poll" || topic == "serverinfo" {
+				return true, nil
+			}
+			continue
+		}
+
+		scope, err := parseScope(attribute)
+		if err != nil {
+			continue
+		}
+		if scope.allows(operation, topic, resource) {
+			if scope.Resource == "" {
+				return true, nil
+			}
+			scoped = true
+		}
+	}
+	if scoped {
+		c.Set("resourceScoped", true)
+	}
+	return scoped, nil
+}
+
+// Returns the ID of the resource a request acts on: its first route parameter,
+// or the "uuid" query parameter of the poll and serverinfo endpoints. Routes
+// without a resource return "", which resource scoped keys never match.
+func routeResource(c *gin.Context, topic string) string {
+	if len(c.Params) > 0 {
+		return c.Params[0].Value
+	}
+	if topic == "poll" || topic == "serverinfo" {
+		return c.Query("uuid")
+	}
+	return ""
+}
+
+// Records the topics of the registered routes for scope validation
+func registerAPITopics(routes gin.RoutesInfo) {
+	for _, route := range routes {
+		parts := strings.Split(route.Path, "/")
+		if len(parts) > 3 && parts[1] == "api" {
+			apiTopics[parts[3]] = true
+		}
+	}
+}
+
+func ValidateAPIKey(key types.APIKey) error {
+	if key.ExpiresUnixMillis != 0 && key.ExpiresUnixMillis < time.Now().UnixMilli() {
+		return errors.New("expiry must be in the future")
+	}
+
+	for _, attribute := range key.Attributes {
+		if attribute == WGClientAttribute {
+			continue
+		}
+		scope, err := parseScope(attribute)
+		if err != nil {
+			return err
+		}
+		if !apiKeyOperations[scope.Operation] {
+			return errors.New("invalid operation " + scope.Operation + " in scope " + attribute)
+		}
+		if !apiTopics[scope.Topic] {
+			return errors.New("unknown topic " + scope.Topic + " in scope " + attribute)
+		}
+		if strings.Contains(scope.Resource, ",") {
+			return errors.New("invalid resource in scope " + attribute)
+		}
+	}
+
+	return nil
+}
+
+// Records the key's use at most once per touch interval
+func touchAPIKey(c *gin.Context, key types.APIKey) {
+	now := time.Now().UnixMilli()
+	if now-key.LastUsedUnixMillis < APIKeyTouchInterval.Milliseconds() && key.LastUsedIP == c.ClientIP() {
+		return
+	}
+
+	err := db.TouchApiKey(key.UUID, c.ClientIP(), now)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Issues a new token for a key. The old token keeps working for the grace period,
+// given as a duration in the "grace" query parameter (default 24h, "0s" for none).
+func POST_APIKeyRotate(c *gin.Context) {
+	uuid := c.Param("uuid")
+
+	grace := DefaultRotationGracePeriod
+	if v := c.Query("grace"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			c.JSON(400, gin.H{
+				"error": "invalid grace period",
+			})
+			return
+		}
+		grace = d
+	}
+
+	// Generate random token
+	tokenBytes, err := GenerateRandomBytes(32)
+	if err != nil {
+		log.Println(err)
+		c.Status(500)
+		return
+	}
+
+	// Generate hash
+	hash, err := GenerateDeterministicHash(tokenBytes, []byte{})
+	if err != nil {
+		log.Println(err)
+		c.Status(500)
+		return
+	}
+
+	rotation := types.APIKeyRotation{
+		UUID:  uuid,
+		Token: base64.URLEncoding.EncodeToString(tokenBytes),
+	}
+	if grace > 0 {
+		rotation.PreviousExpiresUnixMillis = time.Now().Add(grace).UnixMilli()
+	}
+
+	err = db.RotateApiKey(uuid, hash, rotation.PreviousExpiresUnixMillis)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{
+			"error": "api key not found",
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	log.Println("API key rotated:", uuid, "old token valid for:", grace)
+	c.JSON(200, rotation)
+}
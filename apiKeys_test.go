@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		attribute string
+		want      apiKeyScope
+		wantErr   bool
+	}{
+		{"read-peers", apiKeyScope{"read", "peers", ""}, false},
+		{"write-peers:abc", apiKeyScope{"write", "peers", "abc"}, false},
+		{"*-*", apiKeyScope{"*", "*", ""}, false},
+		{"read-network-mesh", apiKeyScope{"read", "network-mesh", ""}, false},
+		{"peers", apiKeyScope{}, true},
+		{"-peers", apiKeyScope{}, true},
+		{"read-", apiKeyScope{}, true},
+		{":abc", apiKeyScope{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.attribute, func(t *testing.T) {
+			got, err := parseScope(tt.attribute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseScope(%q) error = %v, wantErr %v", tt.attribute, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseScope(%q) = %+v, want %+v", tt.attribute, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		scope     string
+		operation string
+		topic     string
+		resource  string
+		want      bool
+	}{
+		{"read-peers", "read", "peers", "", true},
+		{"read-peers", "read", "peers", "abc", true},
+		{"read-peers", "write", "peers", "abc", false},
+		{"read-peers", "read", "poll", "", false},
+		{"*-peers", "delete", "peers", "abc", true},
+		{"read-*", "read", "networks", "wg0", true},
+		{"*-*", "write", "accounts", "", true},
+		{"read-peers:abc", "read", "peers", "abc", true},
+		{"read-peers:abc", "read", "peers", "def", false},
+		{"read-peers:abc", "read", "peers", "", false},
+		{"*-*:abc", "write", "apikeys", "abc", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope+"/"+tt.operation+"-"+tt.topic+":"+tt.resource, func(t *testing.T) {
+			scope, err := parseScope(tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := scope.allows(tt.operation, tt.topic, tt.resource); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAllows(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	handler := func(c *gin.Context) {
+		attributes := c.QueryArray("scope")
+		allowed, err := apiKeyAllows(attributes, c)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.String(200, strconv.FormatBool(allowed))
+	}
+	router.GET("/api/v1/peers", handler)
+	router.GET("/api/v1/peers/:uuid", handler)
+	router.PUT("/api/v1/peers/:uuid", handler)
+	router.GET("/api/v1/poll", handler)
+	router.GET("/api/v1/serverinfo", handler)
+	router.GET("/api/v1/networks", handler)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		scopes []string
+		want   bool
+	}{
+		{"own peer", "GET", "/api/v1/peers/a", []string{"read-peers:a"}, true},
+		{"other peer", "GET", "/api/v1/peers/b", []string{"read-peers:a"}, false},
+		{"write own peer", "PUT", "/api/v1/peers/a", []string{"write-peers:a"}, true},
+		{"write with read scope", "PUT", "/api/v1/peers/a", []string{"read-peers:a"}, false},
+		{"list peers with resource scope", "GET", "/api/v1/peers", []string{"read-peers:a"}, false},
+		{"list peers with resource query", "GET", "/api/v1/peers?uuid=a", []string{"read-peers:a"}, false},
+		{"list peers unscoped", "GET", "/api/v1/peers", []string{"read-peers"}, true},
+		{"poll own uuid", "GET", "/api/v1/poll?uuid=a", []string{"read-poll:a"}, true},
+		{"poll other uuid", "GET", "/api/v1/poll?uuid=b", []string{"read-poll:a"}, false},
+		{"serverinfo own uuid", "GET", "/api/v1/serverinfo?uuid=a", []string{"read-serverinfo:a"}, true},
+		{"networks with resource scope", "GET", "/api/v1/networks", []string{"read-networks:wg0"}, false},
+		{"wg-client peers", "GET", "/api/v1/peers", []string{WGClientAttribute}, true},
+		{"wg-client networks", "GET", "/api/v1/networks", []string{WGClientAttribute}, false},
+		{"invalid scope ignored", "GET", "/api/v1/peers/a", []string{"peers", "read-peers:a"}, true},
+		{"no scopes", "GET", "/api/v1/peers/a", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			for _, scope := range tt.scopes {
+				sep := "?"
+				if strings.Contains(path, "?") {
+					sep = "&"
+				}
+				path += sep + "scope=" + scope
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, path, nil))
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Body.String(); got != strconv.FormatBool(tt.want) {
+				t.Errorf("apiKeyAllows(%v) on %s %s = %s, want %v", tt.scopes, tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
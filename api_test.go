@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+func TestMergePeer(t *testing.T) {
+	existing := types.Peer{
+		UUID:            "a",
+		Hostname:        "laptop",
+		Enabled:         true,
+		PrivateKey:      "private",
+		PreSharedKey:    "psk",
+		RemoteSubnets:   []string{"192.168.1.0/24", "192.168.2.0/24"},
+		RouteMetrics:    map[string]int{"192.168.1.0/24": 10, "192.168.2.0/24": 20},
+		KeyRotationDays: 30,
+		Attributes:      []string{"managed"},
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		modify func(p *types.Peer)
+	}{
+		{"empty body", `{}`, func(p *types.Peer) {}},
+		{"single field", `{"hostname":"desktop"}`, func(p *types.Peer) { p.Hostname = "desktop" }},
+		{"disable", `{"enabled":false}`, func(p *types.Peer) { p.Enabled = false }},
+		{"blank keys are kept", `{"privateKey":"","preSharedKey":""}`, func(p *types.Peer) {}},
+		{"new key", `{"privateKey":"other"}`, func(p *types.Peer) { p.PrivateKey = "other" }},
+		{
+			"route metrics are replaced",
+			`{"remoteSubnets":["192.168.1.0/24"],"routeMetrics":{"192.168.1.0/24":5}}`,
+			func(p *types.Peer) {
+				p.RemoteSubnets = []string{"192.168.1.0/24"}
+				p.RouteMetrics = map[string]int{"192.168.1.0/24": 5}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := existing
+			want.RemoteSubnets = []string{"192.168.1.0/24", "192.168.2.0/24"}
+			want.RouteMetrics = map[string]int{"192.168.1.0/24": 10, "192.168.2.0/24": 20}
+			tt.modify(&want)
+
+			got, err := mergePeer(existing, []byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("mergePeer(%s) = %+v, want %+v", tt.body, got, want)
+			}
+			if len(existing.RemoteSubnets) != 2 || existing.RemoteSubnets[1] != "192.168.2.0/24" || len(existing.RouteMetrics) != 2 {
+				t.Errorf("mergePeer(%s) modified the stored peer: %+v", tt.body, existing)
+			}
+		})
+	}
+
+	if _, err := mergePeer(existing, []byte(`[]`)); err == nil {
+		t.Error("mergePeer([]) succeeded, want an error")
+	}
+}
+
+func TestPatchPeerScopes(t *testing.T) {
+	existing := types.Peer{
+		UUID:          "a",
+		Hostname:      "laptop",
+		Enabled:       true,
+		Network:       "wg0",
+		OS:            "linux",
+		RemoteSubnets: []string{"192.168.1.0/24"},
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.PATCH("/api/v1/peers/:uuid", func(c *gin.Context) {
+		allowed, err := apiKeyAllows(c.QueryArray("scope"), c)
+		if err != nil || !allowed {
+			c.Status(403)
+			return
+		}
+		peer, err := patchPeer(c, existing)
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		c.JSON(200, peer)
+	})
+
+	body := `{"hostname":"desktop","os":"windows","network":"office","enabled":false,"remoteSubnets":["0.0.0.0/0","10.9.0.0/16"]}`
+	tests := []struct {
+		name   string
+		scopes []string
+		want   types.Peer
+	}{
+		{
+			name:   "peer scoped key only reports device details",
+			scopes: []string{"write-peers:a"},
+			want: types.Peer{
+				UUID:          "a",
+				Hostname:      "desktop",
+				Enabled:       true,
+				Network:       "wg0",
+				OS:            "windows",
+				RemoteSubnets: []string{"192.168.1.0/24"},
+			},
+		},
+		{
+			name:   "unscoped key writes every field",
+			scopes: []string{"write-peers:a", "write-peers"},
+			want: types.Peer{
+				UUID:          "a",
+				Hostname:      "desktop",
+				Enabled:       false,
+				Network:       "office",
+				OS:            "windows",
+				RemoteSubnets: []string{"0.0.0.0/0", "10.9.0.0/16"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/api/v1/peers/a?scope=" + strings.Join(tt.scopes, "&scope=")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("PATCH", path, strings.NewReader(body)))
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			var got types.Peer
+			err := json.Unmarshal(w.Body.Bytes(), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patchPeer() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Replaces the value of secret fields in audit diffs
+const AuditRedacted = "[redacted]"
+
+// Field names containing any of these are treated as secrets
+var auditSecretFields = []string{"privatekey", "presharedkey", "password", "token", "secret", "hash", "salt"}
+
+// An audited route. Load returns the current state of the route's target,
+// and is called before and after the request to build the diff.
+type auditRoute struct {
+	Action string
+	Load   func(c *gin.Context) (any, error)
+}
+
+// Audited routes, keyed by method and route pattern. Writes to routes that
+// are not listed are still recorded, but without a diff.
+var auditRoutes = map[string]auditRoute{
+	"PUT /api/v1/peers/:uuid":    {"peer.create", auditLoadPeer},
+	"PATCH /api/v1/peers/:uuid":  {"peer.update", auditLoadPeer},
+	"DELETE /api/v1/peers/:uuid": {"peer.delete", auditLoadPeer},
+
+	"POST /api/v1/peers/:uuid/rotation":     {"peer.rotation.start", nil},
+	"DELETE /api/v1/peers/:uuid/rotation":   {"peer.rotation.cancel", nil},
+	"POST /api/v1/peers/:uuid/rotation/ack": {"peer.rotation.apply", auditLoadPeer},
+
+	"PUT /api/v1/accounts/:email":            {"account.create", auditLoadAccount},
+	"PATCH /api/v1/accounts/:email":          {"account.update", auditLoadAccount},
+	"PATCH /api/v1/accounts/:email/password": {"account.password", nil},
+	"DELETE /api/v1/accounts/:email":         {"account.delete", auditLoadAccount},
+	"POST /api/v1/accounts/:email/unlock":    {"account.unlock", auditLoadAccount},
+	"DELETE /api/v1/lockouts/:ip":            {"lockout.clear", nil},
+
+	"PUT /api/v1/apikeys/:uuid":         {"apikey.create", auditLoadAPIKey},
+	"PATCH /api/v1/apikeys/:uuid":       {"apikey.update", auditLoadAPIKey},
+	"DELETE /api/v1/apikeys/:uuid":      {"apikey.delete", auditLoadAPIKey},
+	"POST /api/v1/apikeys/:uuid/rotate": {"apikey.rotate", auditLoadAPIKey},
+
+	"POST /api/v1/enrollments":         {"enrollment.create", auditLoadEnrollment},
+	"DELETE /api/v1/enrollments/:uuid": {"enrollment.delete", auditLoadEnrollment},
+
+	"PUT /api/v1/ipam/pools/:name":           {"pool.create", auditLoadPool},
+	"PATCH /api/v1/ipam/pools/:name":         {"pool.update", auditLoadPool},
+	"DELETE /api/v1/ipam/pools/:name":        {"pool.delete", auditLoadPool},
+	"PUT /api/v1/ipam/reservations/:uuid":    {"reservation.create", auditLoadReservation},
+	"DELETE /api/v1/ipam/reservations/:uuid": {"reservation.delete", auditLoadReservation},
+
+	"PUT /api/v1/networks/:name":    {"network.create", auditLoadNetwork},
+	"PATCH /api/v1/networks/:name":  {"network.update", auditLoadNetwork},
+	"DELETE /api/v1/networks/:name": {"network.delete", auditLoadNetwork},
+
+	"POST /api/v1/networks/:name/keyrotations":          {"network.keyrotation.start", nil},
+	"POST /api/v1/networks/:name/keyrotations/complete": {"network.keyrotation.complete", auditLoadNetwork},
+	"DELETE /api/v1/networks/:name/keyrotations":        {"network.keyrotation.abort", nil},
+
+	"PUT /api/v1/groups/:name":                  {"group.create", auditLoadGroup},
+	"PATCH /api/v1/groups/:name":                {"group.update", auditLoadGroup},
+	"DELETE /api/v1/groups/:name":               {"group.delete", auditLoadGroup},
+	"PUT /api/v1/groups/:name/members/:uuid":    {"group.member.add", auditLoadGroup},
+	"DELETE /api/v1/groups/:name/members/:uuid": {"group.member.remove", auditLoadGroup},
+
+	"PUT /api/v1/policies/:uuid":    {"policy.create", auditLoadPolicy},
+	"PATCH /api/v1/policies/:uuid":  {"policy.update", auditLoadPolicy},
+	"DELETE /api/v1/policies/:uuid": {"policy.delete", auditLoadPolicy},
+
+	"PUT /api/v1/acl/:uuid":    {"acl.create", auditLoadACLRule},
+	"PATCH /api/v1/acl/:uuid":  {"acl.update", auditLoadACLRule},
+	"DELETE /api/v1/acl/:uuid": {"acl.delete", auditLoadACLRule},
+	"POST /api/v1/acl/test":    {"acl.test", nil},
+
+	"DELETE /api/v1/sessions":     {"session.revoke_others", nil},
+	"DELETE /api/v1/sessions/:id": {"session.revoke", nil},
+
+	"PUT /api/v1/dns/records/:uuid":    {"dns.record.create", auditLoadDNSRecord},
+	"PATCH /api/v1/dns/records/:uuid":  {"dns.record.update", auditLoadDNSRecord},
+	"DELETE /api/v1/dns/records/:uuid": {"dns.record.delete", auditLoadDNSRecord},
+}
+
+// Status reports sent by clients, which are not administrative changes
+var unauditedRoutes = map[string]bool{
+	"PUT /api/v1/peers/:uuid/mesh": true,
+}
+
+func auditLoadPeer(c *gin.Context) (any, error) {
+	return db.GetPeer(c.Param("uuid"))
+}
+
+func auditLoadAccount(c *gin.Context) (any, error) {
+	return db.GetAccount(c.Param("email"))
+}
+
+func auditLoadAPIKey(c *gin.Context) (any, error) {
+	keys, err := db.GetApiKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.UUID == c.Param("uuid") {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+func auditLoadEnrollment(c *gin.Context) (any, error) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		uuid = c.GetString("auditTarget")
+	}
+	return db.GetEnrollment(uuid)
+}
+
+func auditLoadPool(c *gin.Context) (any, error) {
+	return db.GetPool(c.Param("name"))
+}
+
+func auditLoadReservation(c *gin.Context) (any, error) {
+	reservations, err := db.GetReservations()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range reservations {
+		if r.UUID == c.Param("uuid") {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+func auditLoadNetwork(c *gin.Context) (any, error) {
+	return db.GetNetwork(c.Param("name"))
+}
+
+func auditLoadGroup(c *gin.Context) (any, error) {
+	return db.GetGroup(c.Param("name"))
+}
+
+func auditLoadPolicy(c *gin.Context) (any, error) {
+	policies, err := db.GetPolicies()
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		if policy.UUID == c.Param("uuid") {
+			return policy, nil
+		}
+	}
+	return nil, nil
+}
+
+func auditLoadACLRule(c *gin.Context) (any, error) {
+	return db.GetACLRule(c.Param("uuid"))
+}
+
+func auditLoadDNSRecord(c *gin.Context) (any, error) {
+	return db.GetDNSRecord(c.Param("uuid"))
+}
+
+// Records every write request made through the private API
+func AuditMiddleware(c *gin.Context) {
+	if c.Request.Method == "GET" || unauditedRoutes[c.Request.Method+" "+c.FullPath()] {
+		c.Next()
+		return
+	}
+
+	route, ok := auditRoutes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		route.Action = strings.ToLower(c.Request.Method) + " " + c.FullPath()
+	}
+
+	// Capture the state of the target before the request. A missing target
+	// (e.g. on create) is recorded as null.
+	var before any
+	if route.Load != nil {
+		b, err := route.Load(c)
+		if err == nil {
+			before = b
+		}
+	}
+
+	c.Next()
+
+	var after any
+	if route.Load != nil && c.Writer.Status() < 400 {
+		a, err := route.Load(c)
+		if err == nil {
+			after = a
+		}
+	} else {
+		after = before
+	}
+
+	RecordAuditEvent(c, route.Action, auditTarget(c), before, after)
+}
+
+// The target of a request is its route parameters, e.g. "<group>/<peer uuid>",
+// or the "auditTarget" value set by a handler that creates its target
+func auditTarget(c *gin.Context) string {
+	if target := c.GetString("auditTarget"); target != "" {
+		return target
+	}
+	var values []string
+	for _, p := range c.Params {
+		values = append(values, p.Value)
+	}
+	return strings.Join(values, "/")
+}
+
+// Writes an audit event for the request. The actor is taken from the
+// context set by AuthMiddleware, or from the "actor" value set by the caller.
+func RecordAuditEvent(c *gin.Context, action string, target string, before any, after any) {
+	changes, err := auditDiff(before, after)
+	if err != nil {
+		log.Println("Failed to diff audit event:", err)
+		changes = []types.AuditChange{}
+	}
+
+	event := types.AuditEvent{
+		TimestampUnixMillis: time.Now().UnixMilli(),
+		Actor:               c.GetString("actor"),
+		ActorType:           c.GetString("actorType"),
+		IP:                  c.ClientIP(),
+		Action:              action,
+		Target:              target,
+		Status:              c.Writer.Status(),
+		Changes:             changes,
+	}
+	if event.ActorType == "" {
+		event.ActorType = "anonymous"
+	}
+
+	err = db.InsertAuditEvent(event)
+	if err != nil {
+		log.Println("Failed to write audit event:", err)
+	}
+}
+
+// Returns the top level fields that differ between two objects, with secrets redacted
+func auditDiff(before any, after any) ([]types.AuditChange, error) {
+	b, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]bool{}
+	for field := range b {
+		fields[field] = true
+	}
+	for field := range a {
+		fields[field] = true
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	changes := []types.AuditChange{}
+	for _, field := range names {
+		bv, bok := b[field]
+		av, aok := a[field]
+		if bok == aok && reflect.DeepEqual(bv, av) {
+			continue
+		}
+		if isSecretField(field) {
+			if bok {
+				bv = AuditRedacted
+			}
+			if aok {
+				av = AuditRedacted
+			}
+		}
+		changes = append(changes, types.AuditChange{Field: field, Before: bv, After: av})
+	}
+
+	return changes, nil
+}
+
+// Converts an object to a map of its JSON fields
+func auditFields(v any) (map[string]any, error) {
+	if v == nil {
+		return map[string]any{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]any{}
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, errors.New("audit targets must be objects")
+	}
+	return fields, nil
+}
+
+func isSecretField(field string) bool {
+	field = strings.ToLower(field)
+	return slices.ContainsFunc(auditSecretFields, func(secret string) bool {
+		return strings.Contains(field, secret)
+	})
+}
+
+// Parses the audit query filters
+func auditFilter(c *gin.Context) (db.AuditFilter, error) {
+	filter := db.AuditFilter{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Target: c.Query("target"),
+	}
+
+	for param, dest := range map[string]*int64{
+		"since":  &filter.SinceMillis,
+		"until":  &filter.UntilMillis,
+		"before": &filter.BeforeID,
+	} {
+		if v := c.Query(param); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return filter, errors.New("invalid " + param)
+			}
+			*dest = n
+		}
+	}
+
+	return filter, nil
+}
+
+func GET_Audit(c *gin.Context) {
+	filter, err := auditFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	filter.Limit = 100
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			c.JSON(400, gin.H{
+				"error": "limit must be between 1 and 1000",
+			})
+			return
+		}
+		filter.Limit = l
+	}
+
+	events, err := db.GetAuditEvents(filter)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, events)
+}
+
+// Streams matching events as JSON lines, oldest first
+func GET_AuditExport(c *gin.Context) {
+	filter, err := auditFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	c.Status(200)
+
+	encoder := json.NewEncoder(c.Writer)
+	err = db.ExportAuditEvents(filter, func(event types.AuditEvent) error {
+		return encoder.Encode(event)
+	})
+	if err != nil {
+		// Headers have already been sent
+		log.Println(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"log"
+	"net/http"
 	"strings"
 	"time"
 
@@ -14,8 +15,6 @@ import (
 	"github.com/wg-controller/wg-controller/types"
 )
 
-const MaxFailedAttempts = 5
-
 func GenerateDeterministicHash(input []byte, salt []byte) (hash []byte, err error) {
 	// Check for empty input
 	if len(input) == 0 {
@@ -70,24 +69,7 @@ func AuthMiddleware(c *gin.Context) {
 
 	// If sessionId cookie is present, check the session
 	if session != "" {
-		// Decode Base64
-		tokenBytes, err := base64.URLEncoding.DecodeString(session)
-		if err != nil {
-			log.Println(err)
-			c.AbortWithStatus(500)
-			return
-		}
-
-		// Hash the session token
-		tokenHash, err := GenerateDeterministicHash(tokenBytes, []byte{})
-		if err != nil {
-			log.Println(err)
-			c.AbortWithStatus(500)
-			return
-		}
-
-		// Check for the hashed session token in the DB
-		expires, email, err := db.GetSession(tokenHash)
+		hash, session, csrfHash, err := loadSession(c)
 		if err != nil {
 			c.AbortWithStatus(403)
 			log.Println(err)
@@ -95,18 +77,20 @@ func AuthMiddleware(c *gin.Context) {
 			return
 		}
 
-		// Check if the session is expired
-		if expires < time.Now().UnixMilli() {
-			c.AbortWithStatus(403)
+		// Cookie authenticated writes must carry the CSRF token
+		if !checkCSRF(c, csrfHash) {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error": "invalid csrf token",
+			})
+			log.Println("Missing or invalid CSRF token for user:", session.Email, "from IP:", c.ClientIP())
 			return
 		}
 
-		// Update last active time for user
-		err = db.UpdateAccountLastActive(email, time.Now().UnixMilli())
-		if err != nil {
-			log.Println(err)
-		}
+		refreshSession(c, hash, session)
 
+		c.Set("actor", session.Email)
+		c.Set("actorType", "user")
+		c.Set("sessionId", session.ID)
 		c.Next()
 		return
 	}
@@ -136,7 +120,7 @@ func AuthMiddleware(c *gin.Context) {
 		}
 
 		// Check for the api key in the DB
-		expires, attributes, err := db.GetApiKey(hash)
+		key, err := db.GetApiKey(hash)
 		if err != nil {
 			c.AbortWithStatus(403)
 			log.Println("Invalid token from IP:", c.ClientIP(), err)
@@ -144,36 +128,33 @@ func AuthMiddleware(c *gin.Context) {
 		}
 
 		// Check if the api key is expired
-		if expires < time.Now().UnixMilli() && expires != 0 {
+		if key.ExpiresUnixMillis < time.Now().UnixMilli() && key.ExpiresUnixMillis != 0 {
 			c.AbortWithStatus(403)
+			log.Println("Expired token", key.UUID, "from IP:", c.ClientIP())
 			return
 		}
 
-		// Get permission string for current route
-		permission, topic, err := PermissionString(c)
+		touchAPIKey(c, key)
+		c.Set("actor", key.UUID)
+		c.Set("actorType", "apikey")
+
+		// Check if the api key has a scope permitting the request
+		allowed, err := apiKeyAllows(key.Attributes, c)
 		if err != nil {
 			c.AbortWithStatus(500)
 			log.Println(err)
 			return
 		}
-
-		// Check if the api key has the required permission
-		for i := 0; i < len(attributes); i++ {
-			if attributes[i] == permission {
-				c.Next()
-				return
-			} else if attributes[i] == "wg-client" {
-				// "wg-client" has full access to "peers" and "poll" topics
-				if topic == "peers" || topic == "poll" || topic == "serverinfo" {
-					c.Next()
-					return
-				}
-			}
+		if allowed {
+			c.Next()
+			return
 		}
-		log.Println("Insufficient permissions for token from IP:", c.ClientIP(), "required:", permission, "actual:", attributes)
+		permission, topic, _ := PermissionString(c)
+		log.Println("Insufficient permissions for token from IP:", c.ClientIP(), "required:", permission, "resource:", routeResource(c, topic), "actual:", key.Attributes)
 
 		// Default to 403
 		c.AbortWithStatus(403)
+		return
 	}
 
 	// Default to 403
@@ -187,9 +168,7 @@ func PermissionString(c *gin.Context) (permission string, topic string, err erro
 	switch method {
 	case "GET":
 		operation = "read"
-	case "POST":
-	case "PUT":
-	case "PATCH":
+	case "POST", "PUT", "PATCH":
 		operation = "write"
 	case "DELETE":
 		operation = "delete"
@@ -224,38 +203,19 @@ func PermissionString(c *gin.Context) (permission string, topic string, err erro
 }
 
 func POST_PreLogin(c *gin.Context) {
-	// Check for session cookie
-	session, err := c.Cookie("sessionId")
-	if err != nil {
+	// Check the session cookie
+	hash, session, _, err := loadSession(c)
+	if errors.Is(err, http.ErrNoCookie) {
 		c.JSON(401, gin.H{
 			"error": "not logged in",
 		})
 		return
-	}
-
-	// Decode Base64
-	sessionBytes, err := base64.URLEncoding.DecodeString(session)
-	if err != nil {
-		log.Println(err)
-		c.JSON(500, gin.H{
-			"error": "internal server error",
-		})
-		return
-	}
-
-	// Hash the session token
-	hash, err := GenerateDeterministicHash(sessionBytes, []byte{})
-	if err != nil {
-		log.Println(err)
-		c.JSON(500, gin.H{
-			"error": "internal server error",
+	} else if errors.Is(err, ErrSessionExpired) {
+		c.JSON(401, gin.H{
+			"error": "session expired",
 		})
 		return
-	}
-
-	// Check for the hashed session token in the DB
-	expires, email, err := db.GetSession(hash)
-	if err != nil {
+	} else if err != nil {
 		log.Println(err)
 		c.JSON(401, gin.H{
 			"error": "invalid session",
@@ -263,23 +223,11 @@ func POST_PreLogin(c *gin.Context) {
 		return
 	}
 
-	// Check if the session token is expired
-	if expires < time.Now().UnixMilli() {
-		c.JSON(401, gin.H{
-			"error": "session expired",
-		})
-		return
-	}
-
-	// Update last active time for user
-	err = db.UpdateAccountLastActive(email, time.Now().UnixMilli())
-	if err != nil {
-		log.Println(err)
-	}
+	refreshSession(c, hash, session)
 
 	c.JSON(200, gin.H{
 		"status": "ok",
-		"email":  email,
+		"email":  session.Email,
 	})
 }
 
@@ -304,6 +252,13 @@ func POST_Login(c *gin.Context) {
 		return
 	}
 
+	// Check if the client IP is locked out
+	if until := ipLockedUntil(c.ClientIP()); time.Now().Before(until) {
+		log.Println("Login from locked IP:", c.ClientIP())
+		loginLockedResponse(c, until)
+		return
+	}
+
 	// Check if the user exists
 	account, err := db.GetAccount(login.Email)
 	if err != nil {
@@ -313,15 +268,18 @@ func POST_Login(c *gin.Context) {
 		c.JSON(401, gin.H{
 			"error": "invalid email or password",
 		})
+		loginFailed(c, login.Email, false)
 		return
 	}
 
-	// Check if the user is suspended
-	if account.FailedAttempts >= MaxFailedAttempts {
-		log.Println("User is suspended:", login.Email, "from IP:", c.ClientIP())
+	// Check if the user is locked out. The response matches an unknown email, so
+	// lockouts don't reveal which accounts exist.
+	if until := time.UnixMilli(account.LockedUntilUnixMillis); time.Now().Before(until) {
+		log.Println("User is locked:", login.Email, "from IP:", c.ClientIP())
 		c.JSON(401, gin.H{
-			"error": "account suspended",
+			"error": "invalid email or password",
 		})
+		loginFailed(c, login.Email, false)
 		return
 	}
 
@@ -355,14 +313,19 @@ func POST_Login(c *gin.Context) {
 			})
 
 			// Increment the failed attempts
-			err := db.IncrementAccountFailedAttempts(login.Email)
-			if err != nil {
-				log.Println(err)
-			}
+			loginFailed(c, login.Email, true)
 			return
 		}
 	}
 
+	// Reset the failed attempts
+	if account.FailedAttempts > 0 || account.LockedUntilUnixMillis > 0 {
+		err = db.UnlockAccount(login.Email)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
 	// Generate a session token
 	tokenBytes, err := GenerateRandomBytes(32)
 	if err != nil {
@@ -383,8 +346,8 @@ func POST_Login(c *gin.Context) {
 		return
 	}
 
-	// Store the hashed session token
-	err = db.CreateSession(tokenHash, login.Email, time.Now().Add(time.Hour*12).UnixMilli())
+	// Generate a CSRF token for the session
+	csrfToken, err := GenerateRandomBytes(32)
 	if err != nil {
 		log.Println(err)
 		c.JSON(500, gin.H{
@@ -392,31 +355,17 @@ func POST_Login(c *gin.Context) {
 		})
 		return
 	}
-
-	// Base64 encode the session token
-	tokenBase64 := base64.URLEncoding.EncodeToString(tokenBytes)
-
-	// Set cookie
-	c.SetCookie("sessionId", tokenBase64, 0, "", "", false, true)
-	log.Println("User logged in:", login.Email, "from IP:", c.ClientIP())
-	c.JSON(200, gin.H{
-		"status": "ok",
-		"email":  login.Email,
-	})
-}
-
-func POST_Logout(c *gin.Context) {
-	// Check for session cookie
-	session, err := c.Cookie("sessionId")
+	csrfBase64 := base64.URLEncoding.EncodeToString(csrfToken)
+	csrfHash, err := GenerateDeterministicHash([]byte(csrfBase64), []byte{})
 	if err != nil {
-		c.JSON(401, gin.H{
-			"error": "not logged in",
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": "internal server error",
 		})
 		return
 	}
 
-	// Decode Base64
-	sessionBytes, err := base64.URLEncoding.DecodeString(session)
+	sessionID, err := newSessionID()
 	if err != nil {
 		log.Println(err)
 		c.JSON(500, gin.H{
@@ -425,8 +374,18 @@ func POST_Logout(c *gin.Context) {
 		return
 	}
 
-	// Hash the session token
-	hash, err := GenerateDeterministicHash(sessionBytes, []byte{})
+	// Store the hashed session token
+	now := time.Now()
+	err = db.CreateSession(tokenHash, csrfHash, types.Session{
+		ID:                    sessionID,
+		Email:                 login.Email,
+		IP:                    c.ClientIP(),
+		UserAgent:             c.Request.UserAgent(),
+		CreatedUnixMillis:     now.UnixMilli(),
+		LastActiveUnixMillis:  now.UnixMilli(),
+		ExpiresUnixMillis:     now.Add(ENV.SESSION_TIMEOUT).UnixMilli(),
+		IdleExpiresUnixMillis: now.Add(ENV.SESSION_IDLE_TIMEOUT).UnixMilli(),
+	})
 	if err != nil {
 		log.Println(err)
 		c.JSON(500, gin.H{
@@ -435,15 +394,47 @@ func POST_Logout(c *gin.Context) {
 		return
 	}
 
-	// Check that the session token exists
-	_, email, err := db.GetSession(hash)
-	if err != nil {
+	// Base64 encode the session token
+	tokenBase64 := base64.URLEncoding.EncodeToString(tokenBytes)
+
+	// Set cookies
+	setSessionCookies(c, tokenBase64, csrfBase64, 0)
+	log.Println("User logged in:", login.Email, "from IP:", c.ClientIP())
+	c.JSON(200, gin.H{
+		"status":    "ok",
+		"email":     login.Email,
+		"csrfToken": csrfBase64,
+	})
+
+	c.Set("actor", login.Email)
+	c.Set("actorType", "user")
+	RecordAuditEvent(c, "auth.login", login.Email, nil, nil)
+}
+
+func POST_Logout(c *gin.Context) {
+	// Check the session cookie
+	hash, session, csrfHash, err := loadSession(c)
+	if errors.Is(err, http.ErrNoCookie) {
+		c.JSON(401, gin.H{
+			"error": "not logged in",
+		})
+		return
+	} else if err != nil {
 		log.Println(err)
+		setSessionCookies(c, "", "", -1)
 		c.JSON(401, gin.H{
 			"error": "invalid session",
 		})
 		return
 	}
+	email := session.Email
+
+	if !checkCSRF(c, csrfHash) {
+		c.JSON(403, gin.H{
+			"error": "invalid csrf token",
+		})
+		return
+	}
 
 	// Delete the session from the DB
 	err = db.DeleteSession(hash)
@@ -455,10 +446,14 @@ func POST_Logout(c *gin.Context) {
 		return
 	}
 
-	// Delete the session cookie
-	c.SetCookie("sessionId", "", -1, "", "", false, true)
+	// Delete the session cookies
+	setSessionCookies(c, "", "", -1)
 	log.Println("User logged out:", email, "from IP:", c.ClientIP())
 	c.JSON(200, gin.H{
 		"status": "ok",
 	})
+
+	c.Set("actor", email)
+	c.Set("actorType", "user")
+	RecordAuditEvent(c, "auth.logout", email, nil, nil)
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Collects the server details clients of a network need to build their configuration
+func GetServerInfo(network types.Network) (types.ServerInfo, error) {
+	// New configs use the new key of a server key rotation in progress
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		return types.ServerInfo{}, err
+	}
+	if r, ok := rotations[network.Name]; ok {
+		network = rotationNetwork(network, r)
+	}
+
+	// Get server netmask
+	mask, err := GetMask(network.CIDR)
+	if err != nil {
+		return types.ServerInfo{}, err
+	}
+
+	serverInfo := types.ServerInfo{
+		PublicKey:          network.PublicKey,
+		PublicEndpoint:     ENV.PUBLIC_HOST + ":" + strconv.Itoa(network.ListenPort),
+		PublicHost:         ENV.PUBLIC_HOST,
+		NameServers:        []string{strings.Split(network.ServerAddress, "/")[0]},
+		SearchDomains:      []string{},
+		Netmask:            mask,
+		ServerInternalIP:   strings.Split(network.ServerAddress, "/")[0],
+		ServerInternalName: ENV.SERVER_HOSTNAME,
+	}
+
+	// Add IPv6 details when dual-stack is enabled
+	if network.CIDR6 != "" {
+		mask6, err := GetMask(network.CIDR6)
+		if err != nil {
+			return types.ServerInfo{}, err
+		}
+		serverInfo.Netmask6 = mask6
+		serverInfo.ServerInternalIP6 = strings.Split(network.ServerAddress6, "/")[0]
+		serverInfo.NameServers = append(serverInfo.NameServers, serverInfo.ServerInternalIP6)
+	}
+
+	// Let clients resolve bare hostnames within the network's zone
+	if network.DNSZone != "" {
+		serverInfo.SearchDomains = append(serverInfo.SearchDomains, strings.Trim(network.DNSZone, "."))
+	}
+
+	// Send queries for domains forwarded by peers to the server
+	domains, err := networkForwardDomains(network.Name)
+	if err != nil {
+		return types.ServerInfo{}, err
+	}
+	serverInfo.SearchDomains = append(serverInfo.SearchDomains, domains...)
+
+	return serverInfo, nil
+}
+
+// Renders a wg-quick configuration file for a peer
+func GenerateClientConfig(peer types.Peer) (string, error) {
+	network, err := GetPeerNetwork(peer)
+	if err != nil {
+		return "", err
+	}
+
+	serverInfo, err := GetServerInfo(network)
+	if err != nil {
+		return "", err
+	}
+
+	// Include the destinations granted by group policies
+	allowedSubnets, err := EffectiveAllowedSubnets(peer)
+	if err != nil {
+		return "", err
+	}
+
+	// Tunnel addresses
+	addresses := []string{peer.RemoteTunAddress + serverInfo.Netmask}
+	if peer.RemoteTunAddress6 != "" && serverInfo.Netmask6 != "" {
+		addresses = append(addresses, peer.RemoteTunAddress6+serverInfo.Netmask6)
+	}
+
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	if peer.PrivateKey != "" {
+		b.WriteString("PrivateKey = " + peer.PrivateKey + "\n")
+	} else {
+		b.WriteString("# PrivateKey is held by the device\n")
+	}
+	b.WriteString("Address = " + strings.Join(addresses, ", ") + "\n")
+	b.WriteString("DNS = " + strings.Join(append(serverInfo.NameServers, serverInfo.SearchDomains...), ", ") + "\n")
+	b.WriteString("\n")
+	b.WriteString("[Peer]\n")
+	b.WriteString("PublicKey = " + serverInfo.PublicKey + "\n")
+	b.WriteString("PresharedKey = " + peer.PreSharedKey + "\n")
+	b.WriteString("AllowedIPs = " + strings.Join(allowedSubnets, ", ") + "\n")
+	b.WriteString("PersistentKeepalive = " + strconv.Itoa(peer.KeepAliveSeconds) + "\n")
+	b.WriteString("Endpoint = " + serverInfo.PublicEndpoint + "\n")
+
+	return b.String(), nil
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Returns the ACL rules in evaluation order
+func GetACLRules() ([]types.ACLRule, error) {
+	// Query the database
+	query := `SELECT
+		uuid,
+		priority,
+		action,
+		sources,
+		destinations,
+		protocol,
+		ports,
+		description
+		FROM acl_rules
+		ORDER BY priority, uuid`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	var rules []types.ACLRule
+	for rows.Next() {
+		var rule types.ACLRule
+		var sources, destinations, ports string
+		err = rows.Scan(
+			&rule.UUID,
+			&rule.Priority,
+			&rule.Action,
+			&sources,
+			&destinations,
+			&rule.Protocol,
+			&ports,
+			&rule.Description,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// Split arrays
+		rule.Sources = splitList(sources)
+		rule.Destinations = splitList(destinations)
+		rule.Ports = splitList(ports)
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func GetACLRule(uuid string) (types.ACLRule, error) {
+	rules, err := GetACLRules()
+	if err != nil {
+		return types.ACLRule{}, err
+	}
+	for _, rule := range rules {
+		if rule.UUID == uuid {
+			return rule, nil
+		}
+	}
+	return types.ACLRule{}, sql.ErrNoRows
+}
+
+func InsertACLRule(rule types.ACLRule) error {
+	query := `INSERT INTO acl_rules (
+		uuid,
+		priority,
+		action,
+		sources,
+		destinations,
+		protocol,
+		ports,
+		description
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		rule.UUID,
+		rule.Priority,
+		rule.Action,
+		strings.Join(rule.Sources, ","),
+		strings.Join(rule.Destinations, ","),
+		rule.Protocol,
+		strings.Join(rule.Ports, ","),
+		rule.Description,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func UpdateACLRule(rule types.ACLRule) error {
+	query := `UPDATE acl_rules SET
+		priority = ?,
+		action = ?,
+		sources = ?,
+		destinations = ?,
+		protocol = ?,
+		ports = ?,
+		description = ?
+		WHERE uuid = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		rule.Priority,
+		rule.Action,
+		strings.Join(rule.Sources, ","),
+		strings.Join(rule.Destinations, ","),
+		rule.Protocol,
+		strings.Join(rule.Ports, ","),
+		rule.Description,
+		rule.UUID,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func DeleteACLRule(uuid string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM acl_rules WHERE uuid = ?`, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Splits a comma separated column into a non-nil slice
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
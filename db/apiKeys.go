@@ -1,36 +1,47 @@
 package db
 
 import (
+	"database/sql"
 	"strings"
+	"time"
 
 	"github.com/wg-controller/wg-controller/types"
 )
 
-func GetApiKey(hash []byte) (expiresUnixMillis int64, attributes []string, err error) {
+// Returns the key with the given token hash. The token replaced by the last
+// rotation matches until its grace period ends.
+func GetApiKey(hash []byte) (types.APIKey, error) {
 	// Query the database
 	query := `SELECT
+		uuid,
+		name,
 		expires_unixmillis,
-		attributes
+		attributes,
+		last_used_unixmillis,
+		last_used_ip,
+		previous_expires_unixmillis
 		FROM api_keys
-		WHERE hash = ?`
-	row := DB.QueryRow(query, hash)
+		WHERE hash = ? OR (previous_hash = ? AND previous_expires_unixmillis > ?)`
+	row := DB.QueryRow(query, hash, hash, time.Now().UnixMilli())
 
 	// Scan the row
-	attributesString := ""
-	err = row.Scan(&expiresUnixMillis, &attributesString)
+	var key types.APIKey
+	var attributes string
+	err := row.Scan(
+		&key.UUID,
+		&key.Name,
+		&key.ExpiresUnixMillis,
+		&attributes,
+		&key.LastUsedUnixMillis,
+		&key.LastUsedIP,
+		&key.PreviousExpiresUnixMillis,
+	)
 	if err != nil {
-		return 0, []string{}, err
-	}
-
-	// Split the attributes
-	attributes = strings.Split(attributesString, ",")
-	if len(attributes) == 1 {
-		if attributes[0] == "" {
-			attributes = []string{}
-		}
+		return types.APIKey{}, err
 	}
+	key.Attributes = splitList(attributes)
 
-	return expiresUnixMillis, attributes, nil
+	return key, nil
 }
 
 func GetApiKeys() ([]types.APIKey, error) {
@@ -39,12 +50,16 @@ func GetApiKeys() ([]types.APIKey, error) {
 		uuid,
 		name,
 		expires_unixmillis,
-		attributes
+		attributes,
+		last_used_unixmillis,
+		last_used_ip,
+		previous_expires_unixmillis
 		FROM api_keys`
 	rows, err := DB.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	// Loop through the rows
 	var keys []types.APIKey
@@ -56,18 +71,14 @@ func GetApiKeys() ([]types.APIKey, error) {
 			&key.Name,
 			&key.ExpiresUnixMillis,
 			&attributes,
+			&key.LastUsedUnixMillis,
+			&key.LastUsedIP,
+			&key.PreviousExpiresUnixMillis,
 		)
 		if err != nil {
 			return nil, err
 		}
-
-		// Split the attributes
-		key.Attributes = strings.Split(attributes, ",")
-		if len(key.Attributes) == 1 {
-			if key.Attributes[0] == "" {
-				key.Attributes = []string{}
-			}
-		}
+		key.Attributes = splitList(attributes)
 
 		keys = append(keys, key)
 	}
@@ -132,3 +143,47 @@ func DeleteApiKey(uuid string) error {
 
 	return tx.Commit()
 }
+
+// Records the time and client IP of a request made with the key
+func TouchApiKey(uuid string, ip string, unixMillis int64) error {
+	query := `UPDATE api_keys
+		SET last_used_unixmillis = ?, last_used_ip = ?
+		WHERE uuid = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, unixMillis, ip, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Replaces the key's token hash, keeping the old one valid until previousExpiresUnixMillis
+func RotateApiKey(uuid string, hash []byte, previousExpiresUnixMillis int64) error {
+	query := `UPDATE api_keys
+		SET previous_hash = hash, previous_expires_unixmillis = ?, hash = ?
+		WHERE uuid = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(query, previousExpiresUnixMillis, hash, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
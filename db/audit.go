@@ -0,0 +1,149 @@
+package db
+
+import (
+	"encoding/json"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Filters for querying audit events. Empty fields match everything.
+type AuditFilter struct {
+	Actor       string
+	Action      string
+	Target      string
+	SinceMillis int64 // Inclusive
+	UntilMillis int64 // Exclusive, 0 for no limit
+	BeforeID    int64 // Pagination cursor, 0 for the newest events
+	Limit       int   // 0 for no limit
+}
+
+func InsertAuditEvent(event types.AuditEvent) error {
+	changes, err := json.Marshal(event.Changes)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO audit_events (
+		timestamp_unixmillis,
+		actor,
+		actor_type,
+		ip,
+		action,
+		target,
+		status,
+		changes
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		event.TimestampUnixMillis,
+		event.Actor,
+		event.ActorType,
+		event.IP,
+		event.Action,
+		event.Target,
+		event.Status,
+		string(changes),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns matching events, newest first
+func GetAuditEvents(filter AuditFilter) ([]types.AuditEvent, error) {
+	events := []types.AuditEvent{}
+	err := scanAuditEvents(filter, "DESC", func(event types.AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	return events, err
+}
+
+// Calls fn for every matching event, oldest first, without loading them all into memory
+func ExportAuditEvents(filter AuditFilter, fn func(types.AuditEvent) error) error {
+	return scanAuditEvents(filter, "ASC", fn)
+}
+
+func scanAuditEvents(filter AuditFilter, order string, fn func(types.AuditEvent) error) error {
+	limit := filter.Limit
+	if limit == 0 {
+		limit = -1
+	}
+
+	// Query the database
+	query := `SELECT
+		id,
+		timestamp_unixmillis,
+		actor,
+		actor_type,
+		ip,
+		action,
+		target,
+		status,
+		changes
+		FROM audit_events
+		WHERE (? = '' OR actor = ?)
+		AND (? = '' OR action = ? OR action LIKE ? || '.%')
+		AND (? = '' OR target = ?)
+		AND timestamp_unixmillis >= ?
+		AND (? = 0 OR timestamp_unixmillis < ?)
+		AND (? = 0 OR id < ?)
+		ORDER BY id ` + order + `
+		LIMIT ?`
+	rows, err := DB.Query(query,
+		filter.Actor, filter.Actor,
+		filter.Action, filter.Action, filter.Action,
+		filter.Target, filter.Target,
+		filter.SinceMillis,
+		filter.UntilMillis, filter.UntilMillis,
+		filter.BeforeID, filter.BeforeID,
+		limit,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	for rows.Next() {
+		var event types.AuditEvent
+		var changes string
+		err = rows.Scan(
+			&event.ID,
+			&event.TimestampUnixMillis,
+			&event.Actor,
+			&event.ActorType,
+			&event.IP,
+			&event.Action,
+			&event.Target,
+			&event.Status,
+			&changes,
+		)
+		if err != nil {
+			return err
+		}
+
+		event.Changes = []types.AuditChange{}
+		if changes != "" {
+			err = json.Unmarshal([]byte(changes), &event.Changes)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = fn(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -51,7 +51,20 @@ func InitDB(EncryptionKey []byte) {
 		os TEXT,
 		client_version TEXT,
 		client_type TEXT,
-		attributes TEXT
+		attributes TEXT,
+		remote_tun_address6 TEXT DEFAULT "",
+		network TEXT DEFAULT "default",
+		dns_forward_domains TEXT DEFAULT "",
+		dns_forward_resolver TEXT DEFAULT "",
+		dns_query_logging BOOLEAN DEFAULT false,
+		aliases TEXT DEFAULT "",
+		key_rotation_days INTEGER DEFAULT 0,
+		psk_rotation_days INTEGER DEFAULT 0,
+		key_rotated_unixmillis INTEGER DEFAULT 0,
+		psk_rotated_unixmillis INTEGER DEFAULT 0,
+		egress TEXT DEFAULT "",
+		exit_peer TEXT DEFAULT "",
+		route_metrics TEXT DEFAULT "{}"
 	)`)
 	if err != nil {
 		log.Fatal(err)
@@ -62,6 +75,35 @@ func InitDB(EncryptionKey []byte) {
 	db.Exec(`ALTER TABLE peers ADD COLUMN client_version TEXT DEFAULT ""`)
 	db.Exec(`ALTER TABLE peers ADD COLUMN client_type TEXT DEFAULT ""`)
 
+	// Migration: Add the "remote_tun_address6" column
+	db.Exec(`ALTER TABLE peers ADD COLUMN remote_tun_address6 TEXT DEFAULT ""`)
+
+	// Migration: Add the "network" column
+	db.Exec(`ALTER TABLE peers ADD COLUMN network TEXT DEFAULT "default"`)
+
+	// Migration: Add the "dns_forward_domains" and "dns_forward_resolver" columns
+	db.Exec(`ALTER TABLE peers ADD COLUMN dns_forward_domains TEXT DEFAULT ""`)
+	db.Exec(`ALTER TABLE peers ADD COLUMN dns_forward_resolver TEXT DEFAULT ""`)
+
+	// Migration: Add the "dns_query_logging" column
+	db.Exec(`ALTER TABLE peers ADD COLUMN dns_query_logging BOOLEAN DEFAULT false`)
+
+	// Migration: Add the "aliases" column
+	db.Exec(`ALTER TABLE peers ADD COLUMN aliases TEXT DEFAULT ""`)
+
+	// Migration: Add the key rotation columns
+	db.Exec(`ALTER TABLE peers ADD COLUMN key_rotation_days INTEGER DEFAULT 0`)
+	db.Exec(`ALTER TABLE peers ADD COLUMN psk_rotation_days INTEGER DEFAULT 0`)
+	db.Exec(`ALTER TABLE peers ADD COLUMN key_rotated_unixmillis INTEGER DEFAULT 0`)
+	db.Exec(`ALTER TABLE peers ADD COLUMN psk_rotated_unixmillis INTEGER DEFAULT 0`)
+
+	// Migration: Add the egress columns
+	db.Exec(`ALTER TABLE peers ADD COLUMN egress TEXT DEFAULT ""`)
+	db.Exec(`ALTER TABLE peers ADD COLUMN exit_peer TEXT DEFAULT ""`)
+
+	// Migration: Add the "route_metrics" column
+	db.Exec(`ALTER TABLE peers ADD COLUMN route_metrics TEXT DEFAULT "{}"`)
+
 	// Create the user_accounts table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_accounts (
 		email TEXT PRIMARY KEY,
@@ -69,40 +111,300 @@ func InitDB(EncryptionKey []byte) {
 		failed_attempts INTEGER,
 		password_hash BLOB,
 		password_salt BLOB,
-		last_active_unixmillis INTEGER
+		last_active_unixmillis INTEGER,
+		locked_until_unixmillis INTEGER DEFAULT 0
 	)`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Migration: Add the "locked_until_unixmillis" column
+	db.Exec(`ALTER TABLE user_accounts ADD COLUMN locked_until_unixmillis INTEGER DEFAULT 0`)
+
 	// Create the sessions table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
 		hash BLOB PRIMARY KEY,
 		expires_unixmillis INTEGER,
 		user_email TEXT,
-		role TEXT
+		role TEXT,
+		id TEXT DEFAULT "",
+		csrf_hash BLOB,
+		created_unixmillis INTEGER DEFAULT 0,
+		last_active_unixmillis INTEGER DEFAULT 0,
+		idle_expires_unixmillis INTEGER DEFAULT 0,
+		ip TEXT DEFAULT "",
+		user_agent TEXT DEFAULT ""
 	)`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Migration: Add the session metadata columns. Existing sessions have no
+	// idle expiry and are removed by the garbage collector.
+	db.Exec(`ALTER TABLE sessions ADD COLUMN id TEXT DEFAULT ""`)
+	db.Exec(`ALTER TABLE sessions ADD COLUMN csrf_hash BLOB`)
+	db.Exec(`ALTER TABLE sessions ADD COLUMN created_unixmillis INTEGER DEFAULT 0`)
+	db.Exec(`ALTER TABLE sessions ADD COLUMN last_active_unixmillis INTEGER DEFAULT 0`)
+	db.Exec(`ALTER TABLE sessions ADD COLUMN idle_expires_unixmillis INTEGER DEFAULT 0`)
+	db.Exec(`ALTER TABLE sessions ADD COLUMN ip TEXT DEFAULT ""`)
+	db.Exec(`ALTER TABLE sessions ADD COLUMN user_agent TEXT DEFAULT ""`)
+
 	// Create the api_keys table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_keys (
 		uuid TEXT PRIMARY KEY,
 		name TEXT,
 		expires_unixmillis INTEGER,
 		attributes TEXT,
-		hash BLOB
+		hash BLOB,
+		previous_hash BLOB,
+		previous_expires_unixmillis INTEGER DEFAULT 0,
+		last_used_unixmillis INTEGER DEFAULT 0,
+		last_used_ip TEXT DEFAULT ""
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Migration: Add the key rotation and usage columns
+	db.Exec(`ALTER TABLE api_keys ADD COLUMN previous_hash BLOB`)
+	db.Exec(`ALTER TABLE api_keys ADD COLUMN previous_expires_unixmillis INTEGER DEFAULT 0`)
+	db.Exec(`ALTER TABLE api_keys ADD COLUMN last_used_unixmillis INTEGER DEFAULT 0`)
+	db.Exec(`ALTER TABLE api_keys ADD COLUMN last_used_ip TEXT DEFAULT ""`)
+
+	// Create the networks table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS networks (
+		name TEXT PRIMARY KEY,
+		description TEXT,
+		interface TEXT UNIQUE,
+		listen_port INTEGER,
+		private_key TEXT,
+		public_key TEXT,
+		cidr TEXT,
+		cidr6 TEXT,
+		server_address TEXT,
+		server_address6 TEXT,
+		dns_zone TEXT,
+		mesh BOOLEAN DEFAULT false
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Migration: Add the "mesh" column to networks
+	db.Exec(`ALTER TABLE networks ADD COLUMN mesh BOOLEAN DEFAULT false`)
+
+	// Create the ip_pools table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ip_pools (
+		name TEXT PRIMARY KEY,
+		cidr TEXT,
+		description TEXT,
+		network TEXT DEFAULT "default"
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Migration: Add the "network" column to ip_pools
+	db.Exec(`ALTER TABLE ip_pools ADD COLUMN network TEXT DEFAULT "default"`)
+
+	// Create the ip_reservations table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ip_reservations (
+		uuid TEXT PRIMARY KEY,
+		pool TEXT,
+		start_address TEXT,
+		end_address TEXT,
+		type TEXT,
+		peer_uuid TEXT,
+		description TEXT
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the ip_leases table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ip_leases (
+		address TEXT PRIMARY KEY,
+		pool TEXT,
+		peer_uuid TEXT,
+		expires_unixmillis INTEGER
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the peer_groups table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS peer_groups (
+		name TEXT PRIMARY KEY,
+		description TEXT,
+		egress TEXT DEFAULT "",
+		exit_peer TEXT DEFAULT ""
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Migration: Add the group egress columns
+	db.Exec(`ALTER TABLE peer_groups ADD COLUMN egress TEXT DEFAULT ""`)
+	db.Exec(`ALTER TABLE peer_groups ADD COLUMN exit_peer TEXT DEFAULT ""`)
+
+	// Create the peer_group_members table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS peer_group_members (
+		group_name TEXT,
+		peer_uuid TEXT,
+		PRIMARY KEY (group_name, peer_uuid)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the group_policies table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS group_policies (
+		uuid TEXT PRIMARY KEY,
+		source_group TEXT,
+		destination_group TEXT,
+		protocol TEXT,
+		ports TEXT,
+		description TEXT
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the acl_rules table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS acl_rules (
+		uuid TEXT PRIMARY KEY,
+		priority INTEGER,
+		action TEXT,
+		sources TEXT,
+		destinations TEXT,
+		protocol TEXT,
+		ports TEXT,
+		description TEXT
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the dns_records table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS dns_records (
+		uuid TEXT PRIMARY KEY,
+		name TEXT,
+		type TEXT,
+		value TEXT,
+		ttl INTEGER,
+		description TEXT
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the dns_query_log table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS dns_query_log (
+		peer_uuid TEXT,
+		name TEXT,
+		type TEXT,
+		rcode TEXT,
+		result TEXT,
+		timestamp_unixmillis INTEGER
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.Exec(`CREATE INDEX IF NOT EXISTS dns_query_log_peer ON dns_query_log (peer_uuid, timestamp_unixmillis)`)
+
+	// Create the enrollments table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS enrollments (
+		uuid TEXT PRIMARY KEY,
+		hash BLOB UNIQUE,
+		description TEXT,
+		peer_uuid TEXT,
+		template TEXT,
+		created_by TEXT,
+		created_unixmillis INTEGER,
+		expires_unixmillis INTEGER,
+		used_unixmillis INTEGER DEFAULT 0,
+		used_ip TEXT DEFAULT "",
+		used_by_peer_uuid TEXT DEFAULT ""
 	)`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Create the key_rotations table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS key_rotations (
+		peer_uuid TEXT PRIMARY KEY,
+		id TEXT,
+		rotate_key BOOLEAN,
+		rotate_psk BOOLEAN,
+		private_key TEXT,
+		public_key TEXT,
+		pre_shared_key TEXT,
+		created_unixmillis INTEGER,
+		pushed_unixmillis INTEGER DEFAULT 0,
+		alerted_unixmillis INTEGER DEFAULT 0
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the server_key_rotations table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS server_key_rotations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		network TEXT,
+		private_key TEXT,
+		public_key TEXT,
+		interface TEXT,
+		listen_port INTEGER,
+		started_unixmillis INTEGER,
+		completed_unixmillis INTEGER DEFAULT 0,
+		aborted_unixmillis INTEGER DEFAULT 0
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the server_key_migrations table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS server_key_migrations (
+		rotation_id INTEGER,
+		peer_uuid TEXT,
+		migrated_unixmillis INTEGER,
+		PRIMARY KEY (rotation_id, peer_uuid)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the audit_events table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp_unixmillis INTEGER,
+		actor TEXT,
+		actor_type TEXT,
+		ip TEXT,
+		action TEXT,
+		target TEXT,
+		status INTEGER,
+		changes TEXT
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.Exec(`CREATE INDEX IF NOT EXISTS audit_events_timestamp ON audit_events (timestamp_unixmillis)`)
+
+	// Audit events are append-only
+	db.Exec(`CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END`)
+	db.Exec(`CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END`)
+
 	// Update the global DB variable
 	DB = db
 
 	// Init sessions garbage collector
 	go SessionsGarbageCollector()
 
+	// Init IP leases garbage collector
+	go LeasesGarbageCollector()
+
 	log.Println("Database initialized")
 }
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Inserts a batch of query log entries in one transaction
+func InsertDNSQueries(entries []types.DNSQueryLogEntry) error {
+	query := `INSERT INTO dns_query_log (
+		peer_uuid,
+		name,
+		type,
+		rcode,
+		result,
+		timestamp_unixmillis
+	) VALUES (?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		_, err = tx.Exec(query, e.PeerUUID, e.Name, e.Type, e.Rcode, e.Result, e.TimestampUnixMillis)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Returns the newest entries first, optionally for a single peer
+func GetDNSQueries(peerUUID string, beforeUnixMillis int64, limit int) ([]types.DNSQueryLogEntry, error) {
+	// Query the database
+	query := `SELECT
+		peer_uuid,
+		name,
+		type,
+		rcode,
+		result,
+		timestamp_unixmillis
+		FROM dns_query_log
+		WHERE (? = '' OR peer_uuid = ?) AND timestamp_unixmillis < ?
+		ORDER BY timestamp_unixmillis DESC
+		LIMIT ?`
+	rows, err := DB.Query(query, peerUUID, peerUUID, beforeUnixMillis, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	entries := []types.DNSQueryLogEntry{}
+	for rows.Next() {
+		var e types.DNSQueryLogEntry
+		err = rows.Scan(&e.PeerUUID, &e.Name, &e.Type, &e.Rcode, &e.Result, &e.TimestampUnixMillis)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Deletes entries older than the given time
+func DeleteDNSQueriesBefore(unixMillis int64) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM dns_query_log WHERE timestamp_unixmillis < ?`, unixMillis)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"github.com/wg-controller/wg-controller/types"
+)
+
+func GetDNSRecords() ([]types.DNSRecord, error) {
+	// Query the database
+	query := `SELECT
+		uuid,
+		name,
+		type,
+		value,
+		ttl,
+		description
+		FROM dns_records`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	var records []types.DNSRecord
+	for rows.Next() {
+		var record types.DNSRecord
+		err = rows.Scan(
+			&record.UUID,
+			&record.Name,
+			&record.Type,
+			&record.Value,
+			&record.TTL,
+			&record.Description,
+		)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func GetDNSRecord(uuid string) (types.DNSRecord, error) {
+	// Query the database
+	query := `SELECT
+		uuid,
+		name,
+		type,
+		value,
+		ttl,
+		description
+		FROM dns_records
+		WHERE uuid = ?`
+	row := DB.QueryRow(query, uuid)
+
+	// Scan the row
+	var record types.DNSRecord
+	err := row.Scan(
+		&record.UUID,
+		&record.Name,
+		&record.Type,
+		&record.Value,
+		&record.TTL,
+		&record.Description,
+	)
+	if err != nil {
+		return types.DNSRecord{}, err
+	}
+
+	return record, nil
+}
+
+func InsertDNSRecord(record types.DNSRecord) error {
+	query := `INSERT INTO dns_records (
+		uuid,
+		name,
+		type,
+		value,
+		ttl,
+		description
+	) VALUES (?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, record.UUID, record.Name, record.Type, record.Value, record.TTL, record.Description)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func UpdateDNSRecord(record types.DNSRecord) error {
+	query := `UPDATE dns_records SET
+		name = ?,
+		type = ?,
+		value = ?,
+		ttl = ?,
+		description = ?
+		WHERE uuid = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, record.Name, record.Type, record.Value, record.TTL, record.Description, record.UUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func DeleteDNSRecord(uuid string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM dns_records WHERE uuid = ?`, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
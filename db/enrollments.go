@@ -0,0 +1,204 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+const enrollmentColumns = `uuid,
+		description,
+		peer_uuid,
+		template,
+		created_by,
+		created_unixmillis,
+		expires_unixmillis,
+		used_unixmillis,
+		used_ip,
+		used_by_peer_uuid`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanEnrollment(row rowScanner) (types.Enrollment, error) {
+	var e types.Enrollment
+	var template string
+	err := row.Scan(
+		&e.UUID,
+		&e.Description,
+		&e.PeerUUID,
+		&template,
+		&e.CreatedBy,
+		&e.CreatedUnixMillis,
+		&e.ExpiresUnixMillis,
+		&e.UsedUnixMillis,
+		&e.UsedIP,
+		&e.UsedByPeerUUID,
+	)
+	if err != nil {
+		return types.Enrollment{}, err
+	}
+
+	if template != "" {
+		err = json.Unmarshal([]byte(template), &e.Template)
+		if err != nil {
+			return types.Enrollment{}, err
+		}
+	}
+
+	return e, nil
+}
+
+func GetEnrollments() ([]types.Enrollment, error) {
+	// Query the database
+	query := `SELECT ` + enrollmentColumns + `
+		FROM enrollments
+		ORDER BY created_unixmillis DESC`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	enrollments := []types.Enrollment{}
+	for rows.Next() {
+		e, err := scanEnrollment(rows)
+		if err != nil {
+			return nil, err
+		}
+		enrollments = append(enrollments, e)
+	}
+
+	return enrollments, nil
+}
+
+func GetEnrollment(uuid string) (types.Enrollment, error) {
+	query := `SELECT ` + enrollmentColumns + `
+		FROM enrollments
+		WHERE uuid = ?`
+	return scanEnrollment(DB.QueryRow(query, uuid))
+}
+
+func InsertEnrollment(e types.Enrollment, hash []byte) error {
+	template, err := json.Marshal(e.Template)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO enrollments (
+		uuid,
+		hash,
+		description,
+		peer_uuid,
+		template,
+		created_by,
+		created_unixmillis,
+		expires_unixmillis
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		e.UUID,
+		hash,
+		e.Description,
+		e.PeerUUID,
+		string(template),
+		e.CreatedBy,
+		e.CreatedUnixMillis,
+		e.ExpiresUnixMillis,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Marks the unused, unexpired enrollment with the given code hash as used and
+// returns it. Returns sql.ErrNoRows if there is no such enrollment, so a code
+// can only be exchanged once.
+func ConsumeEnrollment(hash []byte, ip string, nowUnixMillis int64) (types.Enrollment, error) {
+	query := `UPDATE enrollments SET
+		used_unixmillis = ?,
+		used_ip = ?
+		WHERE hash = ? AND used_unixmillis = 0 AND expires_unixmillis > ?
+		RETURNING ` + enrollmentColumns
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return types.Enrollment{}, err
+	}
+
+	e, err := scanEnrollment(tx.QueryRow(query, nowUnixMillis, ip, hash, nowUnixMillis))
+	if err != nil {
+		tx.Rollback()
+		return types.Enrollment{}, err
+	}
+
+	return e, tx.Commit()
+}
+
+// Records the peer enrolled by a consumed enrollment
+func CompleteEnrollment(uuid string, peerUUID string) error {
+	query := `UPDATE enrollments SET used_by_peer_uuid = ? WHERE uuid = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, peerUUID, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Makes a consumed enrollment usable again after a failed exchange
+func ReleaseEnrollment(uuid string) error {
+	query := `UPDATE enrollments SET used_unixmillis = 0, used_ip = '' WHERE uuid = ? AND used_by_peer_uuid = ''`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func DeleteEnrollment(uuid string) error {
+	query := `DELETE FROM enrollments WHERE uuid = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(query, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
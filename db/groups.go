@@ -0,0 +1,350 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+func GetGroups() ([]types.PeerGroup, error) {
+	// Query the database
+	query := `SELECT
+		name,
+		description,
+		egress,
+		exit_peer
+		FROM peer_groups`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Loop through the rows
+	var groups []types.PeerGroup
+	for rows.Next() {
+		var group types.PeerGroup
+		err = rows.Scan(&group.Name, &group.Description, &group.Egress, &group.ExitPeer)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		group.Members = []string{}
+		groups = append(groups, group)
+	}
+	rows.Close()
+
+	// Attach the members
+	members, err := getGroupMembers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		if m, ok := members[groups[i].Name]; ok {
+			groups[i].Members = m
+		}
+	}
+
+	return groups, nil
+}
+
+func GetGroup(name string) (types.PeerGroup, error) {
+	// Query the database
+	query := `SELECT
+		name,
+		description,
+		egress,
+		exit_peer
+		FROM peer_groups
+		WHERE name = ?`
+	row := DB.QueryRow(query, name)
+
+	// Scan the row
+	var group types.PeerGroup
+	err := row.Scan(&group.Name, &group.Description, &group.Egress, &group.ExitPeer)
+	if err != nil {
+		return types.PeerGroup{}, err
+	}
+
+	// Attach the members
+	members, err := getGroupMembers()
+	if err != nil {
+		return types.PeerGroup{}, err
+	}
+	group.Members = members[group.Name]
+	if group.Members == nil {
+		group.Members = []string{}
+	}
+
+	return group, nil
+}
+
+// Returns a map of group names to member peer UUIDs
+func getGroupMembers() (map[string][]string, error) {
+	rows, err := DB.Query(`SELECT group_name, peer_uuid FROM peer_group_members`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := map[string][]string{}
+	for rows.Next() {
+		var group, peer string
+		err = rows.Scan(&group, &peer)
+		if err != nil {
+			return nil, err
+		}
+		members[group] = append(members[group], peer)
+	}
+
+	return members, nil
+}
+
+func InsertGroup(group types.PeerGroup) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO peer_groups (name, description, egress, exit_peer) VALUES (?, ?, ?, ?)`, group.Name, group.Description, group.Egress, group.ExitPeer)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, member := range group.Members {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO peer_group_members (group_name, peer_uuid) VALUES (?, ?)`, group.Name, member)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Updates a group's description and egress and replaces its members
+func UpdateGroup(group types.PeerGroup) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE peer_groups SET description = ?, egress = ?, exit_peer = ? WHERE name = ?`, group.Description, group.Egress, group.ExitPeer, group.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM peer_group_members WHERE group_name = ?`, group.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, member := range group.Members {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO peer_group_members (group_name, peer_uuid) VALUES (?, ?)`, group.Name, member)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Deletes a group along with its memberships and policies
+func DeleteGroup(name string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM peer_group_members WHERE group_name = ?`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM group_policies WHERE source_group = ? OR destination_group = ?`, name, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM peer_groups WHERE name = ?`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func AddGroupMember(group string, peerUUID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO peer_group_members (group_name, peer_uuid) VALUES (?, ?)`, group, peerUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func RemoveGroupMember(group string, peerUUID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM peer_group_members WHERE group_name = ? AND peer_uuid = ?`, group, peerUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Removes a peer from every group
+func DeletePeerMemberships(peerUUID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM peer_group_members WHERE peer_uuid = ?`, peerUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func GetPolicies() ([]types.GroupPolicy, error) {
+	// Query the database
+	query := `SELECT
+		uuid,
+		source_group,
+		destination_group,
+		protocol,
+		ports,
+		description
+		FROM group_policies`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	var policies []types.GroupPolicy
+	for rows.Next() {
+		var policy types.GroupPolicy
+		var ports string
+		err = rows.Scan(
+			&policy.UUID,
+			&policy.SourceGroup,
+			&policy.DestinationGroup,
+			&policy.Protocol,
+			&ports,
+			&policy.Description,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// Split arrays
+		policy.Ports = strings.Split(ports, ",")
+		if len(policy.Ports) == 1 {
+			if policy.Ports[0] == "" {
+				policy.Ports = []string{}
+			}
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+func InsertPolicy(policy types.GroupPolicy) error {
+	query := `INSERT INTO group_policies (
+		uuid,
+		source_group,
+		destination_group,
+		protocol,
+		ports,
+		description
+	) VALUES (?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		policy.UUID,
+		policy.SourceGroup,
+		policy.DestinationGroup,
+		policy.Protocol,
+		strings.Join(policy.Ports, ","),
+		policy.Description,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func DeletePolicy(uuid string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM group_policies WHERE uuid = ?`, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func UpdatePolicy(policy types.GroupPolicy) error {
+	query := `UPDATE group_policies SET
+		source_group = ?,
+		destination_group = ?,
+		protocol = ?,
+		ports = ?,
+		description = ?
+		WHERE uuid = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		policy.SourceGroup,
+		policy.DestinationGroup,
+		policy.Protocol,
+		strings.Join(policy.Ports, ","),
+		policy.Description,
+		policy.UUID,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
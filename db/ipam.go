@@ -0,0 +1,342 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+func GetPools() ([]types.IPPool, error) {
+	// Query the database
+	query := `SELECT
+		name,
+		cidr,
+		description,
+		network
+		FROM ip_pools`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	var pools []types.IPPool
+	for rows.Next() {
+		var pool types.IPPool
+		err = rows.Scan(&pool.Name, &pool.CIDR, &pool.Description, &pool.Network)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+func GetPool(name string) (types.IPPool, error) {
+	// Query the database
+	query := `SELECT
+		name,
+		cidr,
+		description,
+		network
+		FROM ip_pools
+		WHERE name = ?`
+	row := DB.QueryRow(query, name)
+
+	// Scan the row
+	var pool types.IPPool
+	err := row.Scan(&pool.Name, &pool.CIDR, &pool.Description, &pool.Network)
+	if err != nil {
+		return types.IPPool{}, err
+	}
+
+	return pool, nil
+}
+
+func InsertPool(pool types.IPPool) error {
+	query := `INSERT INTO ip_pools (name, cidr, description, network) VALUES (?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, pool.Name, pool.CIDR, pool.Description, pool.Network)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func UpdatePool(pool types.IPPool) error {
+	query := `UPDATE ip_pools SET cidr = ?, description = ? WHERE name = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, pool.CIDR, pool.Description, pool.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deletes a pool along with its reservations
+func DeletePool(name string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ip_reservations WHERE pool = ?`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ip_pools WHERE name = ?`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func GetReservations() ([]types.IPReservation, error) {
+	// Query the database
+	query := `SELECT
+		uuid,
+		pool,
+		start_address,
+		end_address,
+		type,
+		peer_uuid,
+		description
+		FROM ip_reservations`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	var reservations []types.IPReservation
+	for rows.Next() {
+		var r types.IPReservation
+		err = rows.Scan(
+			&r.UUID,
+			&r.Pool,
+			&r.StartAddress,
+			&r.EndAddress,
+			&r.Type,
+			&r.PeerUUID,
+			&r.Description,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+
+	return reservations, nil
+}
+
+func InsertReservation(r types.IPReservation) error {
+	query := `INSERT INTO ip_reservations (
+		uuid,
+		pool,
+		start_address,
+		end_address,
+		type,
+		peer_uuid,
+		description
+	) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, r.UUID, r.Pool, r.StartAddress, r.EndAddress, r.Type, r.PeerUUID, r.Description)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func DeleteReservation(uuid string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ip_reservations WHERE uuid = ?`, uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns all leases that are bound to a peer or have not yet expired
+func GetActiveLeases() ([]types.IPLease, error) {
+	// Query the database
+	query := `SELECT
+		address,
+		pool,
+		peer_uuid,
+		expires_unixmillis
+		FROM ip_leases
+		WHERE expires_unixmillis = 0 OR expires_unixmillis > ?`
+	rows, err := DB.Query(query, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	var leases []types.IPLease
+	for rows.Next() {
+		var lease types.IPLease
+		err = rows.Scan(&lease.Address, &lease.Pool, &lease.PeerUUID, &lease.ExpiresUnixMillis)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, lease)
+	}
+
+	return leases, nil
+}
+
+// Inserts or replaces the lease for an address
+func UpsertLease(lease types.IPLease) error {
+	query := `INSERT OR REPLACE INTO ip_leases (
+		address,
+		pool,
+		peer_uuid,
+		expires_unixmillis
+	) VALUES (?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, lease.Address, lease.Pool, lease.PeerUUID, lease.ExpiresUnixMillis)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Binds an address to a peer with no expiry
+func BindLease(lease types.IPLease) error {
+	lease.ExpiresUnixMillis = 0
+	return UpsertLease(lease)
+}
+
+func DeleteLease(address string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ip_leases WHERE address = ?`, address)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func DeletePeerLeases(peerUUID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ip_leases WHERE peer_uuid = ?`, peerUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Replaces all leases of a peer with the given leases in one transaction
+func ReplacePeerLeases(peerUUID string, leases []types.IPLease) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ip_leases WHERE peer_uuid = ?`, peerUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query := `INSERT OR REPLACE INTO ip_leases (
+		address,
+		pool,
+		peer_uuid,
+		expires_unixmillis
+	) VALUES (?, ?, ?, ?)`
+	for _, lease := range leases {
+		_, err = tx.Exec(query, lease.Address, lease.Pool, peerUUID, lease.ExpiresUnixMillis)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func GarbageCollectLeases() {
+	// Query the database
+	query := `DELETE FROM ip_leases WHERE expires_unixmillis != 0 AND expires_unixmillis < ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	_, err = tx.Exec(query, time.Now().UnixMilli())
+	if err != nil {
+		tx.Rollback()
+		log.Println(err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+}
+
+func LeasesGarbageCollector() {
+	for {
+		GarbageCollectLeases()
+		time.Sleep(5 * time.Minute)
+	}
+}
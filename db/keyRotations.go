@@ -0,0 +1,173 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+const keyRotationColumns = `peer_uuid,
+		id,
+		rotate_key,
+		rotate_psk,
+		private_key,
+		public_key,
+		pre_shared_key,
+		created_unixmillis,
+		pushed_unixmillis,
+		alerted_unixmillis`
+
+func scanKeyRotation(row rowScanner) (types.KeyRotation, error) {
+	var r types.KeyRotation
+	err := row.Scan(
+		&r.PeerUUID,
+		&r.ID,
+		&r.RotateKey,
+		&r.RotatePSK,
+		&r.PrivateKey,
+		&r.PublicKey,
+		&r.PreSharedKey,
+		&r.CreatedUnixMillis,
+		&r.PushedUnixMillis,
+		&r.AlertedUnixMillis,
+	)
+	if err != nil {
+		return types.KeyRotation{}, err
+	}
+
+	// Decrypt the keys
+	if r.PrivateKey != "" {
+		r.PrivateKey, err = DecryptAES(r.PrivateKey, AES_KEY)
+		if err != nil {
+			return types.KeyRotation{}, err
+		}
+	}
+	if r.PreSharedKey != "" {
+		r.PreSharedKey, err = DecryptAES(r.PreSharedKey, AES_KEY)
+		if err != nil {
+			return types.KeyRotation{}, err
+		}
+	}
+
+	return r, nil
+}
+
+func GetKeyRotations() ([]types.KeyRotation, error) {
+	query := `SELECT ` + keyRotationColumns + `
+		FROM key_rotations
+		ORDER BY created_unixmillis`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rotations := []types.KeyRotation{}
+	for rows.Next() {
+		r, err := scanKeyRotation(rows)
+		if err != nil {
+			return nil, err
+		}
+		rotations = append(rotations, r)
+	}
+
+	return rotations, nil
+}
+
+func GetKeyRotation(peerUUID string) (types.KeyRotation, error) {
+	query := `SELECT ` + keyRotationColumns + `
+		FROM key_rotations
+		WHERE peer_uuid = ?`
+	return scanKeyRotation(DB.QueryRow(query, peerUUID))
+}
+
+// Stores a pending rotation. A peer has at most one pending rotation.
+// Keys that are not rotated are left empty.
+func InsertKeyRotation(r types.KeyRotation) (err error) {
+	// Encrypt the keys
+	if r.PrivateKey != "" {
+		r.PrivateKey, err = EncryptAES(r.PrivateKey, AES_KEY)
+		if err != nil {
+			log.Println(err)
+			return errors.New("encryption error")
+		}
+	}
+	if r.PreSharedKey != "" {
+		r.PreSharedKey, err = EncryptAES(r.PreSharedKey, AES_KEY)
+		if err != nil {
+			log.Println(err)
+			return errors.New("encryption error")
+		}
+	}
+
+	query := `INSERT INTO key_rotations (` + keyRotationColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		r.PeerUUID,
+		r.ID,
+		r.RotateKey,
+		r.RotatePSK,
+		r.PrivateKey,
+		r.PublicKey,
+		r.PreSharedKey,
+		r.CreatedUnixMillis,
+		r.PushedUnixMillis,
+		r.AlertedUnixMillis,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func SetKeyRotationPushed(peerUUID string, pushedUnixMillis int64) error {
+	return updateKeyRotation(`UPDATE key_rotations SET pushed_unixmillis = ? WHERE peer_uuid = ?`, pushedUnixMillis, peerUUID)
+}
+
+func SetKeyRotationAlerted(peerUUID string, alertedUnixMillis int64) error {
+	return updateKeyRotation(`UPDATE key_rotations SET alerted_unixmillis = ? WHERE peer_uuid = ?`, alertedUnixMillis, peerUUID)
+}
+
+func updateKeyRotation(query string, args ...any) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func DeleteKeyRotation(peerUUID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`DELETE FROM key_rotations WHERE peer_uuid = ?`, peerUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"errors"
+	"log"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+func GetNetworks() ([]types.Network, error) {
+	// Query the database
+	query := `SELECT
+		name,
+		description,
+		interface,
+		listen_port,
+		private_key,
+		public_key,
+		cidr,
+		cidr6,
+		server_address,
+		server_address6,
+		dns_zone,
+		mesh
+		FROM networks`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	var networks []types.Network
+	for rows.Next() {
+		var network types.Network
+		err = rows.Scan(
+			&network.Name,
+			&network.Description,
+			&network.Interface,
+			&network.ListenPort,
+			&network.PrivateKey,
+			&network.PublicKey,
+			&network.CIDR,
+			&network.CIDR6,
+			&network.ServerAddress,
+			&network.ServerAddress6,
+			&network.DNSZone,
+			&network.Mesh,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// Decrypt the private_key
+		network.PrivateKey, err = DecryptAES(network.PrivateKey, AES_KEY)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func GetNetwork(name string) (types.Network, error) {
+	// Query the database
+	query := `SELECT
+		name,
+		description,
+		interface,
+		listen_port,
+		private_key,
+		public_key,
+		cidr,
+		cidr6,
+		server_address,
+		server_address6,
+		dns_zone,
+		mesh
+		FROM networks
+		WHERE name = ?`
+	row := DB.QueryRow(query, name)
+
+	// Scan the row
+	var network types.Network
+	err := row.Scan(
+		&network.Name,
+		&network.Description,
+		&network.Interface,
+		&network.ListenPort,
+		&network.PrivateKey,
+		&network.PublicKey,
+		&network.CIDR,
+		&network.CIDR6,
+		&network.ServerAddress,
+		&network.ServerAddress6,
+		&network.DNSZone,
+		&network.Mesh,
+	)
+	if err != nil {
+		return types.Network{}, err
+	}
+
+	// Decrypt the private_key
+	network.PrivateKey, err = DecryptAES(network.PrivateKey, AES_KEY)
+	if err != nil {
+		return types.Network{}, err
+	}
+
+	return network, nil
+}
+
+func InsertNetwork(network types.Network) (err error) {
+	// Encrypt the private_key
+	network.PrivateKey, err = EncryptAES(network.PrivateKey, AES_KEY)
+	if err != nil {
+		log.Println(err)
+		return errors.New("encryption error")
+	}
+
+	query := `INSERT INTO networks (
+		name,
+		description,
+		interface,
+		listen_port,
+		private_key,
+		public_key,
+		cidr,
+		cidr6,
+		server_address,
+		server_address6,
+		dns_zone,
+		mesh
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		network.Name,
+		network.Description,
+		network.Interface,
+		network.ListenPort,
+		network.PrivateKey,
+		network.PublicKey,
+		network.CIDR,
+		network.CIDR6,
+		network.ServerAddress,
+		network.ServerAddress6,
+		network.DNSZone,
+		network.Mesh,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func UpdateNetwork(network types.Network) (err error) {
+	// Encrypt the private_key
+	network.PrivateKey, err = EncryptAES(network.PrivateKey, AES_KEY)
+	if err != nil {
+		log.Println(err)
+		return errors.New("encryption error")
+	}
+
+	query := `UPDATE networks SET
+		description = ?,
+		interface = ?,
+		listen_port = ?,
+		private_key = ?,
+		public_key = ?,
+		cidr = ?,
+		cidr6 = ?,
+		server_address = ?,
+		server_address6 = ?,
+		dns_zone = ?,
+		mesh = ?
+		WHERE name = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		network.Description,
+		network.Interface,
+		network.ListenPort,
+		network.PrivateKey,
+		network.PublicKey,
+		network.CIDR,
+		network.CIDR6,
+		network.ServerAddress,
+		network.ServerAddress6,
+		network.DNSZone,
+		network.Mesh,
+		network.Name,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deletes a network along with its address pools
+func DeleteNetwork(name string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ip_reservations WHERE pool IN (SELECT name FROM ip_pools WHERE network = ?)`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ip_pools WHERE network = ?`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM networks WHERE name = ?`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"strings"
@@ -27,7 +28,20 @@ func GetPeers() ([]types.Peer, error) {
 		os,
 		client_version,
 		client_type,
-		attributes
+		attributes,
+		remote_tun_address6,
+		network,
+		dns_forward_domains,
+		dns_forward_resolver,
+		dns_query_logging,
+		aliases,
+		key_rotation_days,
+		psk_rotation_days,
+		key_rotated_unixmillis,
+		psk_rotated_unixmillis,
+		egress,
+		exit_peer,
+		route_metrics
 		FROM peers`
 	rows, err := DB.Query(query)
 	if err != nil {
@@ -41,6 +55,9 @@ func GetPeers() ([]types.Peer, error) {
 		var remoteSubnets string
 		var allowedSubnets string
 		var attributes string
+		var routeMetrics string
+		var aliases string
+		var dnsForwardDomains string
 		err = rows.Scan(
 			&peer.UUID,
 			&peer.Hostname,
@@ -59,6 +76,19 @@ func GetPeers() ([]types.Peer, error) {
 			&peer.ClientVersion,
 			&peer.ClientType,
 			&attributes,
+			&peer.RemoteTunAddress6,
+			&peer.Network,
+			&dnsForwardDomains,
+			&peer.DNSForwardResolver,
+			&peer.DNSQueryLogging,
+			&aliases,
+			&peer.KeyRotationDays,
+			&peer.PSKRotationDays,
+			&peer.KeyRotatedUnixMillis,
+			&peer.PSKRotatedUnixMillis,
+			&peer.Egress,
+			&peer.ExitPeer,
+			&routeMetrics,
 		)
 		if err != nil {
 			return nil, err
@@ -83,11 +113,26 @@ func GetPeers() ([]types.Peer, error) {
 				peer.Attributes = []string{}
 			}
 		}
+		peer.DNSForwardDomains = strings.Split(dnsForwardDomains, ",")
+		if len(peer.DNSForwardDomains) == 1 {
+			if peer.DNSForwardDomains[0] == "" {
+				peer.DNSForwardDomains = []string{}
+			}
+		}
+		peer.Aliases = strings.Split(aliases, ",")
+		if len(peer.Aliases) == 1 {
+			if peer.Aliases[0] == "" {
+				peer.Aliases = []string{}
+			}
+		}
+		peer.RouteMetrics = decodeRouteMetrics(routeMetrics)
 
-		// Decrypt the private_key
-		peer.PrivateKey, err = DecryptAES(peer.PrivateKey, AES_KEY)
-		if err != nil {
-			return nil, err
+		// Decrypt the private_key. Peers with client-held keys have none.
+		if peer.PrivateKey != "" {
+			peer.PrivateKey, err = DecryptAES(peer.PrivateKey, AES_KEY)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		// Decrypt the pre_shared_key
@@ -121,7 +166,20 @@ func GetPeer(uuid string) (types.Peer, error) {
 		os,
 		client_version,
 		client_type,
-		attributes
+		attributes,
+		remote_tun_address6,
+		network,
+		dns_forward_domains,
+		dns_forward_resolver,
+		dns_query_logging,
+		aliases,
+		key_rotation_days,
+		psk_rotation_days,
+		key_rotated_unixmillis,
+		psk_rotated_unixmillis,
+		egress,
+		exit_peer,
+		route_metrics
 		FROM peers
 		WHERE uuid = @p1`
 
@@ -132,6 +190,9 @@ func GetPeer(uuid string) (types.Peer, error) {
 	var remoteSubnets string
 	var allowedSubnets string
 	var attributes string
+	var routeMetrics string
+	var aliases string
+	var dnsForwardDomains string
 	err := row.Scan(
 		&peer.UUID,
 		&peer.Hostname,
@@ -150,6 +211,19 @@ func GetPeer(uuid string) (types.Peer, error) {
 		&peer.ClientVersion,
 		&peer.ClientType,
 		&attributes,
+		&peer.RemoteTunAddress6,
+		&peer.Network,
+		&dnsForwardDomains,
+		&peer.DNSForwardResolver,
+		&peer.DNSQueryLogging,
+		&aliases,
+		&peer.KeyRotationDays,
+		&peer.PSKRotationDays,
+		&peer.KeyRotatedUnixMillis,
+		&peer.PSKRotatedUnixMillis,
+		&peer.Egress,
+		&peer.ExitPeer,
+		&routeMetrics,
 	)
 	if err != nil {
 		return types.Peer{}, err
@@ -174,11 +248,26 @@ func GetPeer(uuid string) (types.Peer, error) {
 			peer.Attributes = []string{}
 		}
 	}
+	peer.DNSForwardDomains = strings.Split(dnsForwardDomains, ",")
+	if len(peer.DNSForwardDomains) == 1 {
+		if peer.DNSForwardDomains[0] == "" {
+			peer.DNSForwardDomains = []string{}
+		}
+	}
+	peer.Aliases = strings.Split(aliases, ",")
+	if len(peer.Aliases) == 1 {
+		if peer.Aliases[0] == "" {
+			peer.Aliases = []string{}
+		}
+	}
+	peer.RouteMetrics = decodeRouteMetrics(routeMetrics)
 
-	// Decrypt the private_key
-	peer.PrivateKey, err = DecryptAES(peer.PrivateKey, AES_KEY)
-	if err != nil {
-		return types.Peer{}, err
+	// Decrypt the private_key. Peers with client-held keys have none.
+	if peer.PrivateKey != "" {
+		peer.PrivateKey, err = DecryptAES(peer.PrivateKey, AES_KEY)
+		if err != nil {
+			return types.Peer{}, err
+		}
 	}
 
 	// Decrypt the pre_shared_key
@@ -191,11 +280,13 @@ func GetPeer(uuid string) (types.Peer, error) {
 }
 
 func InsertPeer(peer types.Peer) (err error) {
-	// Encrypt the private_key
-	peer.PrivateKey, err = EncryptAES(peer.PrivateKey, AES_KEY)
-	if err != nil {
-		log.Println(err)
-		return errors.New("encryption error")
+	// Encrypt the private_key. Peers with client-held keys have none.
+	if peer.PrivateKey != "" {
+		peer.PrivateKey, err = EncryptAES(peer.PrivateKey, AES_KEY)
+		if err != nil {
+			log.Println(err)
+			return errors.New("encryption error")
+		}
 	}
 
 	// Encrypt the pre_shared_key
@@ -228,7 +319,20 @@ func InsertPeer(peer types.Peer) (err error) {
 		os,
 		client_version,
 		client_type,
-		attributes) VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, @p9, @p10, @p11, @p12, @p13, @p14, @p15, @p16, @p17)`
+		attributes,
+		remote_tun_address6,
+		network,
+		dns_forward_domains,
+		dns_forward_resolver,
+		dns_query_logging,
+		aliases,
+		key_rotation_days,
+		psk_rotation_days,
+		key_rotated_unixmillis,
+		psk_rotated_unixmillis,
+		egress,
+		exit_peer,
+		route_metrics) VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, @p9, @p10, @p11, @p12, @p13, @p14, @p15, @p16, @p17, @p18, @p19, @p20, @p21, @p22, @p23, @p24, @p25, @p26, @p27, @p28, @p29, @p30)`
 
 	_, err = tx.Exec(query,
 		peer.UUID,
@@ -247,7 +351,20 @@ func InsertPeer(peer types.Peer) (err error) {
 		peer.OS,
 		peer.ClientVersion,
 		peer.ClientType,
-		strings.Join(peer.Attributes, ","))
+		strings.Join(peer.Attributes, ","),
+		peer.RemoteTunAddress6,
+		peer.Network,
+		strings.Join(peer.DNSForwardDomains, ","),
+		peer.DNSForwardResolver,
+		peer.DNSQueryLogging,
+		strings.Join(peer.Aliases, ","),
+		peer.KeyRotationDays,
+		peer.PSKRotationDays,
+		peer.KeyRotatedUnixMillis,
+		peer.PSKRotatedUnixMillis,
+		peer.Egress,
+		peer.ExitPeer,
+		encodeRouteMetrics(peer.RouteMetrics))
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -257,11 +374,13 @@ func InsertPeer(peer types.Peer) (err error) {
 }
 
 func UpdatePeer(peer types.Peer) (err error) {
-	// Encrypt the private_key
-	peer.PrivateKey, err = EncryptAES(peer.PrivateKey, AES_KEY)
-	if err != nil {
-		log.Println(err)
-		return errors.New("encryption error")
+	// Encrypt the private_key. Peers with client-held keys have none.
+	if peer.PrivateKey != "" {
+		peer.PrivateKey, err = EncryptAES(peer.PrivateKey, AES_KEY)
+		if err != nil {
+			log.Println(err)
+			return errors.New("encryption error")
+		}
 	}
 
 	// Encrypt the pre_shared_key
@@ -293,8 +412,19 @@ func UpdatePeer(peer types.Peer) (err error) {
 		os=@p13,
 		client_version=@p14,
 		client_type=@p15,
-		attributes=@p16
-		WHERE uuid=@p17`
+		attributes=@p16,
+		remote_tun_address6=@p17,
+		network=@p18,
+		dns_forward_domains=@p19,
+		dns_forward_resolver=@p20,
+		dns_query_logging=@p21,
+		aliases=@p22,
+		key_rotation_days=@p23,
+		psk_rotation_days=@p24,
+		egress=@p25,
+		exit_peer=@p26,
+		route_metrics=@p27
+		WHERE uuid=@p28`
 
 	_, err = tx.Exec(query,
 		peer.Hostname,
@@ -313,6 +443,17 @@ func UpdatePeer(peer types.Peer) (err error) {
 		peer.ClientVersion,
 		peer.ClientType,
 		strings.Join(peer.Attributes, ","),
+		peer.RemoteTunAddress6,
+		peer.Network,
+		strings.Join(peer.DNSForwardDomains, ","),
+		peer.DNSForwardResolver,
+		peer.DNSQueryLogging,
+		strings.Join(peer.Aliases, ","),
+		peer.KeyRotationDays,
+		peer.PSKRotationDays,
+		peer.Egress,
+		peer.ExitPeer,
+		encodeRouteMetrics(peer.RouteMetrics),
 		peer.UUID)
 
 	if err != nil {
@@ -323,6 +464,68 @@ func UpdatePeer(peer types.Peer) (err error) {
 	return tx.Commit()
 }
 
+// Replaces a peer's keys after a rotation and records when they were rotated.
+// Rotation times of zero are left unchanged.
+func RotatePeerKeys(uuid string, privateKey string, publicKey string, preSharedKey string, keyRotatedUnixMillis int64, pskRotatedUnixMillis int64) (err error) {
+	if privateKey != "" {
+		privateKey, err = EncryptAES(privateKey, AES_KEY)
+		if err != nil {
+			log.Println(err)
+			return errors.New("encryption error")
+		}
+	}
+	preSharedKey, err = EncryptAES(preSharedKey, AES_KEY)
+	if err != nil {
+		log.Println(err)
+		return errors.New("encryption error")
+	}
+
+	query := `UPDATE peers SET
+		private_key = ?,
+		public_key = ?,
+		pre_shared_key = ?,
+		key_rotated_unixmillis = CASE WHEN ? > 0 THEN ? ELSE key_rotated_unixmillis END,
+		psk_rotated_unixmillis = CASE WHEN ? > 0 THEN ? ELSE psk_rotated_unixmillis END
+		WHERE uuid = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, privateKey, publicKey, preSharedKey,
+		keyRotatedUnixMillis, keyRotatedUnixMillis,
+		pskRotatedUnixMillis, pskRotatedUnixMillis,
+		uuid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Starts the rotation clock of peers that have never been rotated
+func InitPeerRotationTimes(nowUnixMillis int64) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE peers SET key_rotated_unixmillis = ? WHERE key_rotated_unixmillis = 0`, nowUnixMillis)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`UPDATE peers SET psk_rotated_unixmillis = ? WHERE psk_rotated_unixmillis = 0`, nowUnixMillis)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func DeletePeer(uuid string) error {
 	tx, err := DB.Begin()
 	if err != nil {
@@ -337,3 +540,37 @@ func DeletePeer(uuid string) error {
 
 	return tx.Commit()
 }
+
+// Removes all server-held peer private keys and returns how many were removed
+func ClearPeerPrivateKeys() (int64, error) {
+	query := `UPDATE peers SET private_key = '' WHERE private_key != ''`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(query)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+
+	return n, tx.Commit()
+}
+
+// Route metrics are stored as a JSON object of subnet to metric
+func encodeRouteMetrics(metrics map[string]int) string {
+	if len(metrics) == 0 {
+		return "{}"
+	}
+	b, _ := json.Marshal(metrics)
+	return string(b)
+}
+
+func decodeRouteMetrics(s string) map[string]int {
+	metrics := map[string]int{}
+	json.Unmarshal([]byte(s), &metrics)
+	return metrics
+}
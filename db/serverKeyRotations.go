@@ -0,0 +1,235 @@
+package db
+
+import (
+	"errors"
+	"log"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+const serverKeyRotationColumns = `id,
+		network,
+		private_key,
+		public_key,
+		interface,
+		listen_port,
+		started_unixmillis,
+		completed_unixmillis,
+		aborted_unixmillis`
+
+func scanServerKeyRotation(row rowScanner) (types.ServerKeyRotation, error) {
+	var r types.ServerKeyRotation
+	err := row.Scan(
+		&r.ID,
+		&r.Network,
+		&r.PrivateKey,
+		&r.PublicKey,
+		&r.Interface,
+		&r.ListenPort,
+		&r.StartedUnixMillis,
+		&r.CompletedUnixMillis,
+		&r.AbortedUnixMillis,
+	)
+	if err != nil {
+		return types.ServerKeyRotation{}, err
+	}
+
+	// Decrypt the private_key
+	r.PrivateKey, err = DecryptAES(r.PrivateKey, AES_KEY)
+	if err != nil {
+		return types.ServerKeyRotation{}, err
+	}
+
+	r.Peers = []types.ServerKeyMigration{}
+	return r, nil
+}
+
+// Returns the rotations that are in progress, keyed by network
+func GetActiveServerKeyRotations() (map[string]types.ServerKeyRotation, error) {
+	query := `SELECT ` + serverKeyRotationColumns + `
+		FROM server_key_rotations
+		WHERE completed_unixmillis = 0 AND aborted_unixmillis = 0`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rotations := map[string]types.ServerKeyRotation{}
+	for rows.Next() {
+		r, err := scanServerKeyRotation(rows)
+		if err != nil {
+			return nil, err
+		}
+		rotations[r.Network] = r
+	}
+
+	return rotations, nil
+}
+
+// Returns a network's rotations, newest first
+func GetServerKeyRotations(network string) ([]types.ServerKeyRotation, error) {
+	query := `SELECT ` + serverKeyRotationColumns + `
+		FROM server_key_rotations
+		WHERE network = ?
+		ORDER BY id DESC`
+	rows, err := DB.Query(query, network)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rotations := []types.ServerKeyRotation{}
+	for rows.Next() {
+		r, err := scanServerKeyRotation(rows)
+		if err != nil {
+			return nil, err
+		}
+		rotations = append(rotations, r)
+	}
+
+	return rotations, nil
+}
+
+func InsertServerKeyRotation(r types.ServerKeyRotation) (id int64, err error) {
+	// Encrypt the private_key
+	r.PrivateKey, err = EncryptAES(r.PrivateKey, AES_KEY)
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("encryption error")
+	}
+
+	query := `INSERT INTO server_key_rotations (
+		network,
+		private_key,
+		public_key,
+		interface,
+		listen_port,
+		started_unixmillis
+	) VALUES (?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(query,
+		r.Network,
+		r.PrivateKey,
+		r.PublicKey,
+		r.Interface,
+		r.ListenPort,
+		r.StartedUnixMillis,
+	)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// Marks a rotation as completed and moves the network to the new key,
+// interface and port in one transaction
+func CompleteServerKeyRotation(r types.ServerKeyRotation, completedUnixMillis int64) error {
+	privateKey, err := EncryptAES(r.PrivateKey, AES_KEY)
+	if err != nil {
+		log.Println(err)
+		return errors.New("encryption error")
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE networks SET
+		interface = ?,
+		listen_port = ?,
+		private_key = ?,
+		public_key = ?
+		WHERE name = ?`,
+		r.Interface,
+		r.ListenPort,
+		privateKey,
+		r.PublicKey,
+		r.Network,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE server_key_rotations SET completed_unixmillis = ? WHERE id = ?`, completedUnixMillis, r.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func AbortServerKeyRotation(id int64, abortedUnixMillis int64) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE server_key_rotations SET aborted_unixmillis = ? WHERE id = ?`, abortedUnixMillis, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Reports whether a network has ever completed a rotation
+func HasCompletedServerKeyRotation(network string) (bool, error) {
+	var count int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM server_key_rotations WHERE network = ? AND completed_unixmillis != 0`, network).Scan(&count)
+	return count > 0, err
+}
+
+// Returns the time each migrated peer first used the new key, keyed by peer UUID
+func GetServerKeyMigrations(rotationID int64) (map[string]int64, error) {
+	rows, err := DB.Query(`SELECT peer_uuid, migrated_unixmillis FROM server_key_migrations WHERE rotation_id = ?`, rotationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	migrations := map[string]int64{}
+	for rows.Next() {
+		var uuid string
+		var migrated int64
+		err = rows.Scan(&uuid, &migrated)
+		if err != nil {
+			return nil, err
+		}
+		migrations[uuid] = migrated
+	}
+
+	return migrations, nil
+}
+
+func InsertServerKeyMigration(rotationID int64, peerUUID string, migratedUnixMillis int64) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO server_key_migrations (rotation_id, peer_uuid, migrated_unixmillis) VALUES (?, ?, ?)`,
+		rotationID, peerUUID, migratedUnixMillis)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
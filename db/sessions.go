@@ -3,39 +3,136 @@ package db
 import (
 	"log"
 	"time"
+
+	"github.com/wg-controller/wg-controller/types"
 )
 
-func GetSession(hash []byte) (expiresUnixMillis int64, email string, err error) {
+func GetSession(hash []byte) (session types.Session, csrfHash []byte, err error) {
 	// Query the database
 	query := `SELECT
+		id,
+		user_email,
+		ip,
+		user_agent,
+		created_unixmillis,
+		last_active_unixmillis,
 		expires_unixmillis,
-		user_email
+		idle_expires_unixmillis,
+		csrf_hash
 		FROM sessions
 		WHERE hash = ?`
 	row := DB.QueryRow(query, hash)
 
 	// Scan the row
-	err = row.Scan(&expiresUnixMillis, &email)
+	err = row.Scan(
+		&session.ID,
+		&session.Email,
+		&session.IP,
+		&session.UserAgent,
+		&session.CreatedUnixMillis,
+		&session.LastActiveUnixMillis,
+		&session.ExpiresUnixMillis,
+		&session.IdleExpiresUnixMillis,
+		&csrfHash,
+	)
 	if err != nil {
-		return 0, "", err
+		return types.Session{}, nil, err
 	}
 
-	return expiresUnixMillis, email, nil
+	return session, csrfHash, nil
 }
 
-func CreateSession(hash []byte, userEmail string, expiresUnixMillis int64) error {
+func GetUserSessions(userEmail string) ([]types.Session, error) {
+	// Query the database
+	query := `SELECT
+		id,
+		user_email,
+		ip,
+		user_agent,
+		created_unixmillis,
+		last_active_unixmillis,
+		expires_unixmillis,
+		idle_expires_unixmillis
+		FROM sessions
+		WHERE user_email = ? AND expires_unixmillis >= ? AND idle_expires_unixmillis >= ?
+		ORDER BY last_active_unixmillis DESC`
+	now := time.Now().UnixMilli()
+	rows, err := DB.Query(query, userEmail, now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through the rows
+	sessions := []types.Session{}
+	for rows.Next() {
+		var session types.Session
+		err = rows.Scan(
+			&session.ID,
+			&session.Email,
+			&session.IP,
+			&session.UserAgent,
+			&session.CreatedUnixMillis,
+			&session.LastActiveUnixMillis,
+			&session.ExpiresUnixMillis,
+			&session.IdleExpiresUnixMillis,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func CreateSession(hash []byte, csrfHash []byte, session types.Session) error {
 	// Insert the session into the database
 	query := `INSERT INTO sessions
-		(hash, user_email, expires_unixmillis)
-		VALUES (?, ?, ?)`
+		(hash, csrf_hash, id, user_email, ip, user_agent, created_unixmillis, last_active_unixmillis, expires_unixmillis, idle_expires_unixmillis)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query,
+		hash,
+		csrfHash,
+		session.ID,
+		session.Email,
+		session.IP,
+		session.UserAgent,
+		session.CreatedUnixMillis,
+		session.LastActiveUnixMillis,
+		session.ExpiresUnixMillis,
+		session.IdleExpiresUnixMillis,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Records activity on a session and slides its idle expiry forward
+func TouchSession(hash []byte, ip string, lastActiveUnixMillis int64, idleExpiresUnixMillis int64) error {
+	query := `UPDATE sessions SET
+		ip = ?,
+		last_active_unixmillis = ?,
+		idle_expires_unixmillis = ?
+		WHERE hash = ?`
 
 	tx, err := DB.Begin()
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(query, hash, userEmail, expiresUnixMillis)
+	_, err = tx.Exec(query, ip, lastActiveUnixMillis, idleExpiresUnixMillis, hash)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
@@ -59,6 +156,42 @@ func DeleteUserSessions(userEmail string) error {
 	return tx.Commit()
 }
 
+// Deletes one of a user's sessions by its public ID
+func DeleteUserSession(userEmail string, id string) error {
+	query := `DELETE FROM sessions WHERE user_email = ? AND id = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, userEmail, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deletes all of a user's sessions except the one with the given ID
+func DeleteOtherUserSessions(userEmail string, exceptID string) error {
+	query := `DELETE FROM sessions WHERE user_email = ? AND id != ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, userEmail, exceptID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func DeleteSession(hash []byte) error {
 	// Delete the session from the database
 	query := `DELETE FROM sessions WHERE hash = ?`
@@ -78,7 +211,7 @@ func DeleteSession(hash []byte) error {
 
 func GarbageCollectSessions() {
 	// Query the database
-	query := `DELETE FROM sessions WHERE expires_unixmillis < ?`
+	query := `DELETE FROM sessions WHERE expires_unixmillis < ? OR idle_expires_unixmillis < ?`
 
 	tx, err := DB.Begin()
 	if err != nil {
@@ -86,7 +219,8 @@ func GarbageCollectSessions() {
 		return
 	}
 
-	_, err = tx.Exec(query, time.Now().UnixMilli())
+	now := time.Now().UnixMilli()
+	_, err = tx.Exec(query, now, now)
 	if err != nil {
 		log.Println(err)
 		return
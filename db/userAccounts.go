@@ -10,6 +10,7 @@ func GetAccounts() ([]types.UserAccount, error) {
 		email,
 		role,
 		failed_attempts,
+		locked_until_unixmillis,
 		last_active_unixmillis
 		FROM user_accounts`
 	rows, err := DB.Query(query)
@@ -25,6 +26,7 @@ func GetAccounts() ([]types.UserAccount, error) {
 			&account.Email,
 			&account.Role,
 			&account.FailedAttempts,
+			&account.LockedUntilUnixMillis,
 			&account.LastActiveUnixMillis,
 		)
 		if err != nil {
@@ -42,6 +44,7 @@ func GetAccount(email string) (types.UserAccount, error) {
 		email,
 		role,
 		failed_attempts,
+		locked_until_unixmillis,
 		last_active_unixmillis
 		FROM user_accounts
 		WHERE email = ?`
@@ -53,6 +56,7 @@ func GetAccount(email string) (types.UserAccount, error) {
 		&account.Email,
 		&account.Role,
 		&account.FailedAttempts,
+		&account.LockedUntilUnixMillis,
 		&account.LastActiveUnixMillis,
 	)
 	if err != nil {
@@ -188,9 +192,51 @@ func UpdateAccountPasswordHash(email string, hash []byte, salt []byte) error {
 	return tx.Commit()
 }
 
-func IncrementAccountFailedAttempts(email string) error {
+// Increments the failed login counter and returns the new count
+func IncrementAccountFailedAttempts(email string) (failedAttempts int, err error) {
 	query := `UPDATE user_accounts SET
 		failed_attempts = failed_attempts + 1
+		WHERE email = ?
+		RETURNING failed_attempts`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.QueryRow(query, email).Scan(&failedAttempts)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return failedAttempts, tx.Commit()
+}
+
+func LockAccount(email string, lockedUntilUnixMillis int64) error {
+	query := `UPDATE user_accounts SET
+		locked_until_unixmillis = ?
+		WHERE email = ?`
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, lockedUntilUnixMillis, email)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Clears the failed login counter and any lockout
+func UnlockAccount(email string) error {
+	query := `UPDATE user_accounts SET
+		failed_attempts = 0,
+		locked_until_unixmillis = 0
 		WHERE email = ?`
 
 	tx, err := DB.Begin()
@@ -1,180 +1,995 @@
 package main
 
 import (
-	"bufio"
+	"errors"
+	"fmt"
 	"log"
-	"os"
-	"os/exec"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
 	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
 )
 
+// TTL of records served from the index
+const DNSRecordTTL = 60
+
+// Maximum number of upstream responses kept in the cache
+const DNSCacheSize = 10000
+
+// Upper bound on how long an upstream response is cached
+const DNSMaxCacheTTL = time.Hour
+
+// The records served on one network's listeners. Peers only see the names of their own network.
+type dnsView struct {
+	Index       map[string][]dns.RR // Records by lowercase FQDN
+	Zones       []string            // Zones the server is authoritative for
+	ReverseNets []netip.Prefix      // Tunnel networks the server answers reverse lookups for
+	Forwarders  map[string]string   // Resolver addresses by forwarded domain
+}
+
+var dnsViews = map[string]*dnsView{} // Views by network name
+var dnsIndexMutex sync.RWMutex
+
+var dnsRecordTypes = map[string]bool{"A": true, "AAAA": true, "CNAME": true, "SRV": true, "TXT": true}
+
+var dnsServers []*Supervised
+var dnsServersMutex sync.Mutex
+
+type dnsCacheEntry struct {
+	Msg     *dns.Msg
+	Expires time.Time
+}
+
+var dnsCache = map[string]dnsCacheEntry{}
+var dnsCacheMutex sync.Mutex
+
 func InitDNS() {
-	// Write the upstream DNS server to the dnsmasq configuration
-	err := AppendNameserver(ENV.UPSTREAM_DNS)
+	// Parse the upstream servers
+	var err error
+	dnsUpstreams, err = ParseUpstreams(ENV.UPSTREAM_DNS)
 	if err != nil {
 		log.Fatal(err)
 	}
+	go DNSHealthChecker()
+
+	// Load the blocklists
+	if len(ENV.DNS_BLOCKLISTS) > 0 {
+		err = LoadBlocklists(ENV.DNS_BLOCKLISTS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go BlocklistWatcher(ENV.DNS_BLOCKLISTS)
+	}
 
-	// Sync the DNS configuration
-	err = SyncPeersDNS(false)
+	go DNSQueryLogWriter()
+
+	// Build the record index
+	err = SyncPeersDNS()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Get server address without mask
-	serverAddress := strings.Split(ENV.SERVER_ADDRESS, "/")[0]
-
-	// Start the DNS server
-	startDNS(serverAddress)
+	// Start the DNS server. Listeners that fail to bind are retried in the background.
+	err = startDNS()
+	if err != nil {
+		log.Println("Error starting DNS server:", err)
+	}
 }
 
-func startDNS(serverAddress string) {
+// Starts UDP and TCP listeners on the server address of every network
+func startDNS() error {
 	log.Println("Starting DNS server...")
-	cmd := exec.Command("dnsmasq", "--listen-address="+serverAddress, "--hostsdir=/etc/dnsmasq.d", "--conf-file=/etc/wg-dnsmasq.conf")
-	err := cmd.Run()
+	networks, err := db.GetNetworks()
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
+
+	dnsServersMutex.Lock()
+	defer dnsServersMutex.Unlock()
+	var errs []error
+	for _, network := range networks {
+		listenAddresses := []string{strings.Split(network.ServerAddress, "/")[0]}
+		if network.ServerAddress6 != "" {
+			listenAddresses = append(listenAddresses, strings.Split(network.ServerAddress6, "/")[0])
+		}
+
+		// Queries are answered from the view of the network they arrive on
+		handler := dnsHandler(network.Name)
+		for _, address := range listenAddresses {
+			for _, proto := range []string{"udp", "tcp"} {
+				server, err := superviseDNSListener(net.JoinHostPort(address, "53"), proto, handler)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", server.Name, err))
+				}
+				dnsServers = append(dnsServers, server)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-// Synchronises peers from the database with the dnsmasq configuration
-func SyncPeersDNS(restart bool) error {
-	log.Println("Syncing hostnames with DNS server")
-	// Get all peers from the database
-	peers, err := db.GetPeers()
+// Serves DNS on an address, restarting the listener if it stops. The listener
+// is ready once its port is bound.
+func superviseDNSListener(addr string, proto string, handler dns.Handler) (*Supervised, error) {
+	var current atomic.Pointer[dns.Server]
+
+	start := func() (func() error, error) {
+		server := &dns.Server{
+			Addr:    addr,
+			Net:     proto,
+			Handler: handler,
+		}
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		current.Store(server)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- server.ListenAndServe()
+		}()
+
+		select {
+		case <-started:
+			return func() error { return <-done }, nil
+		case err := <-done:
+			return nil, err
+		}
+	}
+
+	stop := func() {
+		server := current.Load()
+		if server != nil {
+			server.Shutdown()
+		}
+	}
+
+	return Supervise("dns "+proto+" "+addr, start, stop, nil)
+}
+
+// Stops every DNS listener
+func stopDNS() {
+	dnsServersMutex.Lock()
+	defer dnsServersMutex.Unlock()
+	for _, server := range dnsServers {
+		server.Stop()
+	}
+	dnsServers = nil
+}
+
+// Rebuilds the index and restarts the listeners on the current set of networks
+func ReloadDNS() error {
+	err := SyncPeersDNS()
 	if err != nil {
 		return err
 	}
 
-	// Clear the dnsmasq hosts file
-	err = ClearDNS()
+	stopDNS()
+	return startDNS()
+}
+
+// Rebuilds the in-memory record views from the database
+func SyncPeersDNS() error {
+	log.Println("Syncing hostnames with DNS server")
+	records, err := db.GetDNSRecords()
 	if err != nil {
 		return err
 	}
 
-	// Write the server's IP address to the dnsmasq hosts file
-	serverAddress := strings.Split(ENV.SERVER_ADDRESS, "/")[0]
-	err = AppendHostname(ENV.SERVER_HOSTNAME, serverAddress)
+	views, err := buildDNSViews(records)
 	if err != nil {
 		return err
 	}
 
-	// Write the peers to the dnsmasq hosts file
+	// Collect the conditional forwarders of enabled peers, within their network
+	peers, err := db.GetPeers()
+	if err != nil {
+		return err
+	}
 	for _, peer := range peers {
-		if peer.Enabled {
-			err = AppendHostname(peer.Hostname, peer.RemoteTunAddress)
+		view, ok := views[PeerNetworkName(peer)]
+		if !ok || !peer.Enabled || peer.DNSForwardResolver == "" {
+			continue
+		}
+		for _, domain := range peer.DNSForwardDomains {
+			view.Forwarders[dns.Fqdn(strings.ToLower(domain))] = peer.DNSForwardResolver
+		}
+	}
+
+	dnsIndexMutex.Lock()
+	dnsViews = views
+	dnsIndexMutex.Unlock()
+
+	SyncDNSQueryLogging(peers)
+
+	return nil
+}
+
+// Builds a view per network from its server and peers, plus the custom records shared by all networks.
+// Every view is authoritative for the zones and reverse lookups of all networks, so names of
+// other networks are answered with NXDOMAIN rather than forwarded upstream.
+func buildDNSViews(records []types.DNSRecord) (map[string]*dnsView, error) {
+	// Get all peers from the database
+	peers, err := db.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	var zones []string
+	var reverseNets []netip.Prefix
+	for _, network := range networks {
+		if network.DNSZone != "" {
+			zones = append(zones, dns.Fqdn(strings.ToLower(strings.Trim(network.DNSZone, "."))))
+		}
+		for _, cidr := range []string{network.CIDR, network.CIDR6} {
+			if prefix, err := netip.ParsePrefix(cidr); err == nil {
+				reverseNets = append(reverseNets, prefix)
+			}
+		}
+	}
+
+	views := map[string]*dnsView{}
+	for _, network := range networks {
+		index := map[string][]dns.RR{}
+
+		// Index the server's addresses
+		names := hostNames(ENV.SERVER_HOSTNAME, network)
+		addIndexAddress(index, names, strings.Split(network.ServerAddress, "/")[0])
+		if network.ServerAddress6 != "" {
+			addIndexAddress(index, names, strings.Split(network.ServerAddress6, "/")[0])
+		}
+
+		// Index the network's peers
+		for _, peer := range peers {
+			if peer.Enabled && PeerNetworkName(peer) == network.Name {
+				for _, names := range peerNames(peer, network) {
+					addIndexAddress(index, names, peer.RemoteTunAddress)
+					if peer.RemoteTunAddress6 != "" {
+						addIndexAddress(index, names, peer.RemoteTunAddress6)
+					}
+				}
+			}
+		}
+
+		// Index the custom records
+		for _, record := range records {
+			rr, err := dnsRecordRR(record)
 			if err != nil {
-				log.Println(err)
+				log.Println("Skipping invalid DNS record", record.UUID+":", err)
 				continue
 			}
+			index[rr.Header().Name] = append(index[rr.Header().Name], rr)
+		}
+
+		views[network.Name] = &dnsView{
+			Index:       index,
+			Zones:       zones,
+			ReverseNets: reverseNets,
+			Forwarders:  map[string]string{},
 		}
 	}
 
-	// Restart the DNS server
-	if restart {
-		RestartDNS()
+	return views, nil
+}
+
+// Parses a custom record into a resource record
+func dnsRecordRR(record types.DNSRecord) (dns.RR, error) {
+	name := dns.Fqdn(strings.ToLower(record.Name))
+	return dns.NewRR(name + " " + strconv.Itoa(record.TTL) + " IN " + record.Type + " " + record.Value)
+}
+
+// Returns the names of a host: the FQDN in the network's zone followed by the bare hostname
+func hostNames(hostname string, network types.Network) []string {
+	if network.DNSZone == "" {
+		return []string{hostname}
 	}
+	return []string{hostname + "." + strings.Trim(network.DNSZone, "."), hostname}
+}
 
-	return nil
+// Returns the names of a peer's hostname followed by those of each alias
+func peerNames(peer types.Peer, network types.Network) [][]string {
+	names := [][]string{hostNames(peer.Hostname, network)}
+	for _, alias := range peer.Aliases {
+		names = append(names, hostNames(alias, network))
+	}
+	return names
 }
 
-func RestartDNS() {
-	// Get the PID of dnsmasq
-	pidCmd := exec.Command("pidof", "dnsmasq")
-	pidOutput, err := pidCmd.Output()
+// Adds an A or AAAA record for each name, and a PTR record pointing at the first name
+func addIndexAddress(index map[string][]dns.RR, names []string, address string) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		log.Println("Invalid address for DNS record:", address)
+		return
+	}
+
+	reverse, err := dns.ReverseAddr(address)
+	if err == nil && len(index[reverse]) == 0 {
+		index[reverse] = append(index[reverse], &dns.PTR{
+			Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: DNSRecordTTL},
+			Ptr: dns.Fqdn(strings.ToLower(names[0])),
+		})
+	}
+
+	for _, name := range names {
+		fqdn := dns.Fqdn(strings.ToLower(name))
+		var rr dns.RR
+		if ip.To4() != nil {
+			rr = &dns.A{
+				Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: DNSRecordTTL},
+				A:   ip.To4(),
+			}
+		} else {
+			rr = &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: fqdn, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: DNSRecordTTL},
+				AAAA: ip,
+			}
+		}
+		index[fqdn] = append(index[fqdn], rr)
+	}
+}
+
+// Returns the handler for the listeners of a network
+func dnsHandler(networkName string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		handleDNSRequest(networkName, w, req)
+	}
+}
+
+func handleDNSRequest(networkName string, w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(reply)
+		return
+	}
+
+	q := req.Question[0]
+	reply, result := resolve(networkName, req)
+	if peerUUID, ok := loggedPeer(w.RemoteAddr()); ok {
+		logDNSQuery(peerUUID, q, reply, result)
+	}
+	w.WriteMsg(reply)
+}
+
+// Resolves a query received on a network and reports how it was answered
+func resolve(networkName string, req *dns.Msg) (reply *dns.Msg, result string) {
+	q := req.Question[0]
+
+	// Answer from the network's view
+	reply, ok := resolveLocal(networkName, req)
+	if ok {
+		return reply, "local"
+	}
+
+	// Refuse blocked names
+	if isBlocked(q.Name) {
+		reply = new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeNameError)
+		return reply, "blocked"
+	}
+
+	// Forward everything else upstream, or to the peer resolving the domain
+	upstreams := dnsUpstreams
+	result = "upstream"
+	if resolver, ok := conditionalForwarder(networkName, q.Name); ok {
+		upstreams = []*dnsUpstream{forwarderUpstream(resolver)}
+		result = "forwarded"
+	}
+	reply, cached, err := resolveUpstream(networkName, req, upstreams)
 	if err != nil {
-		log.Fatalf("Failed to get dnsmasq PID: %v", err)
+		log.Println("DNS upstream error:", err)
+		reply = new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeServerFailure)
+		return reply, "failed"
+	}
+	if cached {
+		result = "cached"
+	}
+
+	return reply, result
+}
+
+// Answers a query from a network's view. ok is false when the query should be forwarded.
+func resolveLocal(networkName string, req *dns.Msg) (reply *dns.Msg, ok bool) {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	dnsIndexMutex.RLock()
+	defer dnsIndexMutex.RUnlock()
+	view, ok := dnsViews[networkName]
+	if !ok {
+		return nil, false
+	}
+	records, found := view.Index[name]
+	if !found {
+		records, found = wildcardRecords(view.Index, name)
+	}
+	_, forwarded := longestDomainMatch(name, view.Forwarders)
+	authoritative := found || (!forwarded && (inZones(name, view.Zones) || inReverseNets(name, view.ReverseNets)))
+
+	if !authoritative {
+		return nil, false
 	}
 
-	// Trim any whitespace or newline from the output
-	pid := strings.TrimSpace(string(pidOutput))
+	reply = new(dns.Msg)
+	reply.SetReply(req)
+	reply.Authoritative = true
+	if !found {
+		reply.Rcode = dns.RcodeNameError
+		return reply, true
+	}
+
+	// Follow CNAMEs that point at names in the index
+	for depth := 0; depth < 8; depth++ {
+		var target string
+		for _, rr := range records {
+			if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype {
+				reply.Answer = append(reply.Answer, dns.Copy(rr))
+			} else if cname, ok := rr.(*dns.CNAME); ok {
+				reply.Answer = append(reply.Answer, dns.Copy(rr))
+				target = cname.Target
+			}
+		}
+		if target == "" {
+			break
+		}
+		records = view.Index[strings.ToLower(target)]
+	}
 
-	// Send SIGHUP to dnsmasq
-	killCmd := exec.Command("kill", "-HUP", pid)
-	if err := killCmd.Run(); err != nil {
-		log.Fatalf("Failed to send SIGHUP to dnsmasq: %v", err)
+	// Answer with the case the client asked for
+	for _, rr := range reply.Answer {
+		if strings.EqualFold(rr.Header().Name, q.Name) {
+			rr.Header().Name = q.Name
+		}
 	}
 
-	log.Println("Successfully sent SIGHUP to dnsmasq")
+	return reply, true
 }
 
-func ClearDNS() error {
-	// Check if the file exists
-	if _, err := os.Stat("/etc/dnsmasq.d/wg-hosts"); os.IsNotExist(err) {
-		// File does not exist, nothing to delete
-		return nil
-	} else {
-		// File exists, delete it
-		err := os.Remove("/etc/dnsmasq.d/wg-hosts")
-		if err != nil {
-			return err
+// Returns the records of the closest wildcard in an index covering a name, owned by the name.
+// Callers hold dnsIndexMutex.
+func wildcardRecords(index map[string][]dns.RR, name string) ([]dns.RR, bool) {
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		wildcard, ok := index["*."+name[off:]]
+		if !ok {
+			continue
+		}
+		var records []dns.RR
+		for _, rr := range wildcard {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			records = append(records, rr)
 		}
+		return records, true
 	}
+	return nil, false
+}
 
-	return nil
+// Reports whether a reverse lookup name is for an address in one of the networks
+func inReverseNets(name string, nets []netip.Prefix) bool {
+	addr, ok := reverseNameAddr(name)
+	if !ok {
+		return false
+	}
+	for _, prefix := range nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
-func AppendNameserver(nameserver string) error {
-	// Open/Create the dnsmasq configuration file
-	file, err := os.OpenFile("/etc/wg-dnsmasq.conf", os.O_RDWR|os.O_CREATE, 0644)
+// Parses a full in-addr.arpa or ip6.arpa name into an address
+func reverseNameAddr(name string) (netip.Addr, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != 4 {
+			return netip.Addr{}, false
+		}
+		slices.Reverse(octets)
+		addr, err := netip.ParseAddr(strings.Join(octets, "."))
+		return addr, err == nil
+	}
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		slices.Reverse(nibbles)
+		var b strings.Builder
+		for i, nibble := range nibbles {
+			if i > 0 && i%4 == 0 {
+				b.WriteString(":")
+			}
+			b.WriteString(nibble)
+		}
+		addr, err := netip.ParseAddr(b.String())
+		return addr, err == nil
+	}
+	return netip.Addr{}, false
+}
+
+func ValidateDNSRecord(record *types.DNSRecord) error {
+	record.Name = strings.ToLower(strings.Trim(record.Name, "."))
+	if _, ok := dns.IsDomainName(record.Name); !ok || record.Name == "" {
+		return errors.New("invalid name")
+	}
+	record.Type = strings.ToUpper(record.Type)
+	if !dnsRecordTypes[record.Type] {
+		return errors.New("type must be A, AAAA, CNAME, SRV or TXT")
+	}
+	if record.TTL == 0 {
+		record.TTL = DNSRecordTTL
+	}
+	if record.TTL < 0 || record.TTL > 86400 {
+		return errors.New("ttl must be between 1 and 86400")
+	}
+	if _, err := dnsRecordRR(*record); err != nil {
+		return fmt.Errorf("invalid value: %v", err)
+	}
+
+	// A CNAME cannot share its name with other records
+	records, err := db.GetDNSRecords()
+	if err != nil {
+		return err
+	}
+	others := []types.DNSRecord{}
+	for _, r := range records {
+		if r.UUID != record.UUID {
+			others = append(others, r)
+		}
+	}
+	views, err := buildDNSViews(others)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	for _, view := range views {
+		for _, rr := range view.Index[dns.Fqdn(record.Name)] {
+			if record.Type == "CNAME" || rr.Header().Rrtype == dns.TypeCNAME {
+				return fmt.Errorf("%s already has records that conflict with a CNAME", record.Name)
+			}
+		}
+	}
 
-	// Split the file into lines
-	scanner := bufio.NewScanner(file)
-	var lines []string
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	// Peer aliases are exclusive
+	aliases, err := aliasOwners("")
+	if err != nil {
+		return err
+	}
+	if owner, ok := aliases[dns.Fqdn(record.Name)]; ok {
+		return fmt.Errorf("%s is an alias of %s", record.Name, owner)
 	}
 
-	// Append the new line
-	newEntry := "server=/" + nameserver + "/"
-	lines = append(lines, newEntry)
+	return nil
+}
 
-	// Write the lines back to the file
-	file.Truncate(0)
-	file.Seek(0, 0)
-	for _, line := range lines {
-		_, err = file.WriteString(line + "\n")
-		if err != nil {
-			return err
+// Returns the hostnames of the peers owning each alias name, except those of one peer
+func aliasOwners(excludePeer string) (map[string]string, error) {
+	peers, err := db.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]string{}
+	for _, network := range networks {
+		for _, peer := range peers {
+			if peer.UUID == excludePeer || PeerNetworkName(peer) != network.Name {
+				continue
+			}
+			for _, alias := range peer.Aliases {
+				for _, name := range hostNames(alias, network) {
+					owners[dns.Fqdn(strings.ToLower(name))] = peer.Hostname
+				}
+			}
 		}
 	}
-	return err
+
+	return owners, nil
 }
 
-func AppendHostname(hostname string, ip string) error {
-	// Open/Create the dnsmasq hosts file
-	file, err := os.OpenFile("/etc/dnsmasq.d/wg-hosts", os.O_RDWR|os.O_CREATE, 0644)
+// Checks a peer's aliases are valid and that neither its hostname nor its
+// aliases are used by another peer, the server or a custom record
+func ValidatePeerNames(peer *types.Peer) error {
+	if peer.Aliases == nil {
+		peer.Aliases = []string{}
+	}
+	for i, alias := range peer.Aliases {
+		alias = strings.ToLower(strings.Trim(alias, "."))
+		base := strings.TrimPrefix(alias, "*.")
+		if _, ok := dns.IsDomainName(base); !ok || base == "" || strings.Contains(base, "*") {
+			return fmt.Errorf("invalid alias %s", alias)
+		}
+		peer.Aliases[i] = alias
+	}
+
+	network, err := GetPeerNetwork(*peer)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	// Split the file into lines
-	scanner := bufio.NewScanner(file)
-	var lines []string
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	peers, err := db.GetPeers()
+	if err != nil {
+		return err
+	}
+	records, err := db.GetDNSRecords()
+	if err != nil {
+		return err
 	}
 
-	// Append the new line
-	newEntry := ip + " " + hostname
-	lines = append(lines, newEntry)
+	// Collect the names in use
+	taken := map[string]string{}
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		for _, name := range hostNames(ENV.SERVER_HOSTNAME, n) {
+			taken[dns.Fqdn(strings.ToLower(name))] = "the server"
+		}
+		for _, other := range peers {
+			if other.UUID == peer.UUID || PeerNetworkName(other) != n.Name {
+				continue
+			}
+			for _, names := range peerNames(other, n) {
+				for _, name := range names {
+					taken[dns.Fqdn(strings.ToLower(name))] = "peer " + other.Hostname
+				}
+			}
+		}
+	}
+	for _, record := range records {
+		taken[dns.Fqdn(strings.ToLower(record.Name))] = "a DNS record"
+	}
 
-	// Write the lines back to the file
-	file.Truncate(0)
-	file.Seek(0, 0)
-	for _, line := range lines {
-		_, err = file.WriteString(line + "\n")
-		if err != nil {
-			return err
+	// Check the peer's own names, which must also be distinct from each other
+	own := map[string]bool{}
+	for _, names := range peerNames(*peer, network) {
+		for _, name := range names {
+			fqdn := dns.Fqdn(strings.ToLower(name))
+			if owner, ok := taken[fqdn]; ok {
+				return fmt.Errorf("%s is already used by %s", name, owner)
+			}
+			if own[fqdn] {
+				return fmt.Errorf("%s is listed more than once", name)
+			}
+			own[fqdn] = true
 		}
 	}
 
 	return nil
 }
+
+// Returns the resolver of the most specific domain forwarded on a network containing a name
+func conditionalForwarder(networkName string, name string) (string, bool) {
+	dnsIndexMutex.RLock()
+	defer dnsIndexMutex.RUnlock()
+	view, ok := dnsViews[networkName]
+	if !ok {
+		return "", false
+	}
+	return longestDomainMatch(strings.ToLower(name), view.Forwarders)
+}
+
+func longestDomainMatch(name string, domains map[string]string) (string, bool) {
+	best := ""
+	value := ""
+	for domain, v := range domains {
+		if dns.IsSubDomain(domain, name) && len(domain) > len(best) {
+			best = domain
+			value = v
+		}
+	}
+	return value, best != ""
+}
+
+// Checks a peer's conditional forwarder settings
+func ValidateDNSForwarders(peer *types.Peer) error {
+	if peer.DNSForwardDomains == nil {
+		peer.DNSForwardDomains = []string{}
+	}
+	if len(peer.DNSForwardDomains) == 0 {
+		peer.DNSForwardResolver = ""
+		return nil
+	}
+
+	for i, domain := range peer.DNSForwardDomains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+			return fmt.Errorf("invalid forward domain %s", domain)
+		}
+		peer.DNSForwardDomains[i] = domain
+	}
+
+	// The resolver must be reachable through the peer
+	resolver, err := netip.ParseAddr(peer.DNSForwardResolver)
+	if err != nil {
+		return errors.New("dnsForwardResolver must be an IP address")
+	}
+	for _, subnet := range peer.RemoteSubnets {
+		prefix, err := netip.ParsePrefix(subnet)
+		if err == nil && prefix.Contains(resolver) {
+			return nil
+		}
+	}
+	return errors.New("dnsForwardResolver must be within the peer's remote subnets")
+}
+
+// Returns the domains forwarded by the peers of a network
+func networkForwardDomains(networkName string) ([]string, error) {
+	peers, err := db.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	domains := []string{}
+	for _, peer := range peers {
+		if peer.Enabled && peer.DNSForwardResolver != "" && PeerNetworkName(peer) == networkName {
+			domains = append(domains, peer.DNSForwardDomains...)
+		}
+	}
+
+	return domains, nil
+}
+
+// Reports whether a name is within one of the zones
+func inZones(name string, zones []string) bool {
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolves a query using the upstream servers, serving repeated queries from
+// the cache. Networks don't share cached answers.
+func resolveUpstream(networkName string, req *dns.Msg, upstreams []*dnsUpstream) (reply *dns.Msg, cached bool, err error) {
+	q := req.Question[0]
+	key := networkName + "/" + upstreams[0].Address + "/" + strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype] + "/" + dns.ClassToString[q.Qclass]
+
+	// Serve from the cache with the remaining TTL
+	dnsCacheMutex.Lock()
+	entry, ok := dnsCache[key]
+	dnsCacheMutex.Unlock()
+	if ok && time.Now().Before(entry.Expires) {
+		reply = entry.Msg.Copy()
+		reply.Id = req.Id
+		remaining := uint32(time.Until(entry.Expires).Seconds())
+		for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > remaining {
+					rr.Header().Ttl = remaining
+				}
+			}
+		}
+		return reply, true, nil
+	}
+
+	reply, err = exchangeFailover(req, upstreams)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if ttl, ok := cacheTTL(reply); ok {
+		dnsCacheMutex.Lock()
+		if len(dnsCache) >= DNSCacheSize {
+			pruneDNSCache()
+		}
+		dnsCache[key] = dnsCacheEntry{Msg: reply.Copy(), Expires: time.Now().Add(ttl)}
+		dnsCacheMutex.Unlock()
+	}
+
+	return reply, false, nil
+}
+
+// Returns how long a response may be cached: the lowest TTL of its records,
+// or the SOA minimum for negative answers
+func cacheTTL(msg *dns.Msg) (time.Duration, bool) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			t := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && len(msg.Answer) == 0 && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if !found || t < ttl {
+				ttl = t
+				found = true
+			}
+		}
+	}
+	if !found || ttl == 0 {
+		return 0, false
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if d > DNSMaxCacheTTL {
+		d = DNSMaxCacheTTL
+	}
+	return d, true
+}
+
+// Removes expired entries, or everything if the cache is still full. Callers hold dnsCacheMutex.
+func pruneDNSCache() {
+	now := time.Now()
+	for key, entry := range dnsCache {
+		if now.After(entry.Expires) {
+			delete(dnsCache, key)
+		}
+	}
+	if len(dnsCache) >= DNSCacheSize {
+		dnsCache = map[string]dnsCacheEntry{}
+	}
+}
+
+func GET_DNSRecords(c *gin.Context) {
+	records, err := db.GetDNSRecords()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, records)
+}
+
+func PUT_DNSRecord(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	// Parse the record request body
+	var record types.DNSRecord
+	err := c.BindJSON(&record)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	record.UUID = uuid
+
+	err = ValidateDNSRecord(&record)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Insert record into database
+	err = db.InsertDNSRecord(record)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Rebuild the DNS index
+	err = SyncPeersDNS()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func PATCH_DNSRecord(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	// Parse the record request body
+	var record types.DNSRecord
+	err := c.BindJSON(&record)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	record.UUID = uuid
+
+	_, err = db.GetDNSRecord(uuid)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+
+	err = ValidateDNSRecord(&record)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = db.UpdateDNSRecord(record)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Rebuild the DNS index
+	err = SyncPeersDNS()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_DNSRecord(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	err := db.DeleteDNSRecord(uuid)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Rebuild the DNS index
+	err = SyncPeersDNS()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How often blocklist files are checked for changes
+const BlocklistReloadInterval = time.Minute
+
+var blockedNames = map[string]bool{}   // Names blocked exactly (hosts format)
+var blockedDomains = map[string]bool{} // Names blocked with their subdomains (adblock format)
+var blocklistModTimes = map[string]time.Time{}
+var blocklistMutex sync.RWMutex
+
+// Loads the blocklist files. Lines may be in hosts format ("0.0.0.0 ads.example.com"),
+// adblock format ("||ads.example.com^") or plain domain names.
+func LoadBlocklists(paths []string) error {
+	names := map[string]bool{}
+	domains := map[string]bool{}
+	modTimes := map[string]time.Time{}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			name, subdomains, ok := parseBlocklistLine(scanner.Text())
+			if !ok {
+				continue
+			}
+			if subdomains {
+				domains[name] = true
+			} else {
+				names[name] = true
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	blocklistMutex.Lock()
+	blockedNames = names
+	blockedDomains = domains
+	blocklistModTimes = modTimes
+	blocklistMutex.Unlock()
+
+	log.Println("Loaded", len(names)+len(domains), "blocked DNS names")
+	return nil
+}
+
+// Parses a blocklist line into a lowercase FQDN. subdomains is set for adblock rules.
+func parseBlocklistLine(line string) (name string, subdomains bool, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+		return "", false, false
+	}
+
+	// Adblock rules, ignoring those with options or exceptions
+	if strings.HasPrefix(line, "||") {
+		rule := strings.TrimPrefix(line, "||")
+		rule, found := strings.CutSuffix(rule, "^")
+		if !found || strings.ContainsAny(rule, "/*$^|") {
+			return "", false, false
+		}
+		name, subdomains = rule, true
+	} else {
+		// Hosts format, or a bare domain
+		fields := strings.Fields(strings.SplitN(line, "#", 2)[0])
+		switch len(fields) {
+		case 1:
+			name = fields[0]
+		case 2:
+			name = fields[1]
+		default:
+			return "", false, false
+		}
+		if name == "localhost" {
+			return "", false, false
+		}
+	}
+
+	name = dns.Fqdn(strings.ToLower(name))
+	if _, valid := dns.IsDomainName(name); !valid || name == "." {
+		return "", false, false
+	}
+	return name, subdomains, true
+}
+
+// Reports whether a name is on a blocklist
+func isBlocked(name string) bool {
+	name = strings.ToLower(name)
+
+	blocklistMutex.RLock()
+	defer blocklistMutex.RUnlock()
+	if blockedNames[name] {
+		return true
+	}
+
+	// Check the name and each parent domain against the adblock rules
+	for off := 0; off < len(name); {
+		if blockedDomains[name[off:]] {
+			return true
+		}
+		next, end := dns.NextLabel(name, off)
+		if end {
+			break
+		}
+		off = next
+	}
+	return false
+}
+
+// Reloads the blocklists when any of the files change
+func BlocklistWatcher(paths []string) {
+	for {
+		time.Sleep(BlocklistReloadInterval)
+
+		changed := false
+		blocklistMutex.RLock()
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err == nil && !info.ModTime().Equal(blocklistModTimes[path]) {
+				changed = true
+			}
+		}
+		blocklistMutex.RUnlock()
+
+		if changed {
+			err := LoadBlocklists(paths)
+			if err != nil {
+				log.Println("Failed to reload blocklists:", err)
+			}
+		}
+	}
+}
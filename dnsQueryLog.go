@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Entries waiting to be written to the database
+var dnsQueryLogCh = make(chan types.DNSQueryLogEntry, 1000)
+
+var dnsLoggedPeers = map[netip.Addr]string{} // Peer UUIDs by tunnel address, for peers with query logging enabled
+var dnsLoggedPeersMutex sync.RWMutex
+
+// Rebuilds the set of peers whose queries are logged
+func SyncDNSQueryLogging(peers []types.Peer) {
+	logged := map[netip.Addr]string{}
+	for _, peer := range peers {
+		if !peer.DNSQueryLogging {
+			continue
+		}
+		for _, address := range []string{peer.RemoteTunAddress, peer.RemoteTunAddress6} {
+			if addr, err := netip.ParseAddr(address); err == nil {
+				logged[addr] = peer.UUID
+			}
+		}
+	}
+
+	dnsLoggedPeersMutex.Lock()
+	dnsLoggedPeers = logged
+	dnsLoggedPeersMutex.Unlock()
+}
+
+// Returns the UUID of the peer a query came from if its queries are logged
+func loggedPeer(remote net.Addr) (string, bool) {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return "", false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", false
+	}
+
+	dnsLoggedPeersMutex.RLock()
+	defer dnsLoggedPeersMutex.RUnlock()
+	uuid, ok := dnsLoggedPeers[addr.Unmap()]
+	return uuid, ok
+}
+
+// Queues a query for the log without blocking the resolver
+func logDNSQuery(peerUUID string, q dns.Question, reply *dns.Msg, result string) {
+	entry := types.DNSQueryLogEntry{
+		PeerUUID:            peerUUID,
+		Name:                q.Name,
+		Type:                dns.TypeToString[q.Qtype],
+		Rcode:               dns.RcodeToString[reply.Rcode],
+		Result:              result,
+		TimestampUnixMillis: time.Now().UnixMilli(),
+	}
+	select {
+	case dnsQueryLogCh <- entry:
+	default:
+		// Drop entries rather than slow down resolution
+	}
+}
+
+// Writes queued entries in batches and removes entries older than the retention period
+func DNSQueryLogWriter() {
+	flush := time.NewTicker(time.Second)
+	cleanup := time.NewTicker(time.Hour)
+	var batch []types.DNSQueryLogEntry
+	for {
+		select {
+		case entry := <-dnsQueryLogCh:
+			batch = append(batch, entry)
+			if len(batch) < 500 {
+				continue
+			}
+		case <-flush.C:
+		case <-cleanup.C:
+			err := db.DeleteDNSQueriesBefore(time.Now().Add(-ENV.DNS_QUERY_LOG_RETENTION).UnixMilli())
+			if err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		if len(batch) > 0 {
+			err := db.InsertDNSQueries(batch)
+			if err != nil {
+				log.Println(err)
+			}
+			batch = nil
+		}
+	}
+}
+
+func GET_DNSQueryLog(c *gin.Context) {
+	// Optional filters
+	peerUUID := c.Query("peer")
+	before := time.Now().UnixMilli() + 1
+	if v := c.Query("before"); v != "" {
+		b, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": "invalid before",
+			})
+			return
+		}
+		before = b
+	}
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > 1000 {
+			c.JSON(400, gin.H{
+				"error": "limit must be between 1 and 1000",
+			})
+			return
+		}
+		limit = l
+	}
+
+	entries, err := db.GetDNSQueries(peerUUID, before, limit)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, entries)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// How often upstream servers are health checked
+const DNSHealthCheckInterval = 30 * time.Second
+
+// Timeout of a single upstream exchange
+const DNSUpstreamTimeout = 3 * time.Second
+
+type dnsUpstream struct {
+	Address  string // As configured
+	Protocol string // "udp", "tls" or "https"
+	Target   string // host:port, or the URL for DNS over HTTPS
+
+	mutex     sync.Mutex
+	healthy   bool
+	lastCheck time.Time
+	lastError string
+}
+
+var dnsUpstreams []*dnsUpstream
+
+var dohClient = &http.Client{Timeout: DNSUpstreamTimeout}
+
+// Parses a comma separated list of upstreams. Entries are plain addresses
+// ("1.1.1.1", "1.1.1.1:53"), DNS over TLS ("tls://1.1.1.1", "tls://dns.google:853")
+// or DNS over HTTPS URLs ("https://cloudflare-dns.com/dns-query").
+func ParseUpstreams(list string) ([]*dnsUpstream, error) {
+	var upstreams []*dnsUpstream
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		upstream := &dnsUpstream{Address: address, healthy: true}
+		switch {
+		case strings.HasPrefix(address, "https://"):
+			if _, err := url.Parse(address); err != nil {
+				return nil, fmt.Errorf("invalid upstream %s", address)
+			}
+			upstream.Protocol = "https"
+			upstream.Target = address
+		case strings.HasPrefix(address, "tls://"):
+			upstream.Protocol = "tls"
+			upstream.Target = withDefaultPort(strings.TrimPrefix(address, "tls://"), "853")
+		default:
+			upstream.Protocol = "udp"
+			upstream.Target = withDefaultPort(address, "53")
+		}
+		if upstream.Protocol != "https" {
+			if _, _, err := net.SplitHostPort(upstream.Target); err != nil {
+				return nil, fmt.Errorf("invalid upstream %s", address)
+			}
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream DNS servers configured")
+	}
+
+	return upstreams, nil
+}
+
+// Appends a port to a host without one
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// Returns a plain DNS upstream for a conditional forwarder's resolver
+func forwarderUpstream(resolver string) *dnsUpstream {
+	return &dnsUpstream{
+		Address:  resolver,
+		Protocol: "udp",
+		Target:   withDefaultPort(resolver, "53"),
+		healthy:  true,
+	}
+}
+
+// Sends a query to the upstream
+func (u *dnsUpstream) exchange(req *dns.Msg) (*dns.Msg, error) {
+	switch u.Protocol {
+	case "https":
+		return u.exchangeHTTPS(req)
+	case "tls":
+		host, _, _ := net.SplitHostPort(u.Target)
+		client := &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   DNSUpstreamTimeout,
+			TLSConfig: &tls.Config{ServerName: host},
+		}
+		reply, _, err := client.Exchange(req, u.Target)
+		return reply, err
+	}
+
+	client := &dns.Client{Timeout: DNSUpstreamTimeout}
+	reply, _, err := client.Exchange(req, u.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retry over TCP when the response was truncated
+	if reply.Truncated {
+		client.Net = "tcp"
+		reply, _, err = client.Exchange(req, u.Target)
+	}
+	return reply, err
+}
+
+// Sends a query using DNS over HTTPS (RFC 8484)
+func (u *dnsUpstream) exchangeHTTPS(req *dns.Msg) (*dns.Msg, error) {
+	// The message ID is zero to make responses cacheable by HTTP caches
+	query := req.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", u.Target, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	resp, err := dohClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	err = reply.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	reply.Id = req.Id
+
+	return reply, nil
+}
+
+func (u *dnsUpstream) setHealth(err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.lastCheck = time.Now()
+	u.healthy = err == nil
+	if err != nil {
+		u.lastError = err.Error()
+	} else {
+		u.lastError = ""
+	}
+}
+
+func (u *dnsUpstream) isHealthy() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.healthy
+}
+
+func (u *dnsUpstream) status() types.DNSUpstreamStatus {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	status := types.DNSUpstreamStatus{
+		Address:   u.Address,
+		Protocol:  u.Protocol,
+		Healthy:   u.healthy,
+		LastError: u.lastError,
+	}
+	if !u.lastCheck.IsZero() {
+		status.LastCheckUnixMillis = u.lastCheck.UnixMilli()
+	}
+	return status
+}
+
+// Sends a query to the upstreams in order, preferring healthy ones, until one answers
+func exchangeFailover(req *dns.Msg, upstreams []*dnsUpstream) (*dns.Msg, error) {
+	var ordered []*dnsUpstream
+	for _, u := range upstreams {
+		if u.isHealthy() {
+			ordered = append(ordered, u)
+		}
+	}
+	for _, u := range upstreams {
+		if !u.isHealthy() {
+			ordered = append(ordered, u)
+		}
+	}
+
+	var err error
+	for _, u := range ordered {
+		var reply *dns.Msg
+		reply, err = u.exchange(req)
+		if err == nil && reply.Rcode != dns.RcodeServerFailure && reply.Rcode != dns.RcodeRefused {
+			if !u.isHealthy() {
+				u.setHealth(nil)
+			}
+			return reply, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s returned %s", u.Address, dns.RcodeToString[reply.Rcode])
+		}
+		u.setHealth(err)
+	}
+
+	return nil, err
+}
+
+// Periodically checks every upstream with a query for the root name servers
+func DNSHealthChecker() {
+	for {
+		for _, u := range dnsUpstreams {
+			req := new(dns.Msg)
+			req.SetQuestion(".", dns.TypeNS)
+			reply, err := u.exchange(req)
+			if err == nil && reply.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("returned %s", dns.RcodeToString[reply.Rcode])
+			}
+			if err != nil && u.isHealthy() {
+				log.Println("DNS upstream", u.Address, "is unhealthy:", err)
+			}
+			u.setHealth(err)
+		}
+		time.Sleep(DNSHealthCheckInterval)
+	}
+}
+
+func GET_DNSUpstreams(c *gin.Context) {
+	statuses := []types.DNSUpstreamStatus{}
+	for _, u := range dnsUpstreams {
+		statuses = append(statuses, u.status())
+	}
+
+	c.JSON(200, statuses)
+}
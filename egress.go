@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Egress modes. Peers without a mode of their own or from a group keep their
+// AllowedSubnets as configured.
+const EgressSplit = "split"           // Only internal networks are routed through the tunnel
+const EgressController = "controller" // Full tunnel, internet traffic leaves through the controller
+const EgressExit = "exit"             // Full tunnel, internet traffic leaves through an exit peer
+
+// Exit peers get a routing table each, numbered from ExitTableBase. Traffic
+// of the peers using an exit peer is marked with the number of its table.
+const ExitTableBase = 17100
+
+// Priority of the rules that send marked traffic to the exit tables
+const ExitRulePriority = 17100
+
+// The routing of internet traffic through an exit peer
+type exitRoute struct {
+	Exit      types.Peer
+	Interface string   // Server interface the exit peer is connected to
+	Table     int      // Routing table and firewall mark
+	Sources   []string // Tunnel addresses of the peers using the exit peer
+}
+
+// Checks an egress mode and its exit peer
+func validateEgress(mode string, exitPeer string) error {
+	switch mode {
+	case "", EgressSplit, EgressController:
+		if exitPeer != "" {
+			return errors.New("exitPeer requires the exit egress mode")
+		}
+		return nil
+	case EgressExit:
+		exit, err := db.GetPeer(exitPeer)
+		if err != nil {
+			return errors.New("exit peer not found")
+		}
+		if !hasDefaultRoute(exit.RemoteSubnets, false) {
+			return fmt.Errorf("exit peer %s does not advertise 0.0.0.0/0 in its remote subnets", exit.Hostname)
+		}
+		return nil
+	default:
+		return errors.New("egress must be split, controller or exit")
+	}
+}
+
+// Checks a peer's egress mode, and that its default route advertisements do
+// not clash with another peer of its network
+func ValidatePeerEgress(peer types.Peer) error {
+	err := validateEgress(peer.Egress, peer.ExitPeer)
+	if err != nil {
+		return err
+	}
+	if peer.Egress == EgressExit {
+		if peer.ExitPeer == peer.UUID {
+			return errors.New("a peer cannot be its own exit peer")
+		}
+		exit, _ := db.GetPeer(peer.ExitPeer)
+		if PeerNetworkName(exit) != PeerNetworkName(peer) {
+			return errors.New("exit peer must be in the same network")
+		}
+	}
+
+	// WireGuard sends a default route to a single peer of an interface
+	peers, err := db.GetPeers()
+	if err != nil {
+		return err
+	}
+	for _, is6 := range []bool{false, true} {
+		if !hasDefaultRoute(peer.RemoteSubnets, is6) {
+			continue
+		}
+		for _, other := range peers {
+			if other.UUID != peer.UUID && PeerNetworkName(other) == PeerNetworkName(peer) && hasDefaultRoute(other.RemoteSubnets, is6) {
+				return fmt.Errorf("a default route is already advertised by %s", other.Hostname)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns a peer's egress mode and exit peer. A peer without a mode of its own
+// takes it from the first of its groups by name that sets one.
+func effectiveEgress(peer types.Peer, groups []types.PeerGroup, peersByUUID map[string]types.Peer) (string, types.Peer) {
+	mode, exitPeer := peer.Egress, peer.ExitPeer
+	if mode == "" {
+		groups = slices.Clone(groups)
+		slices.SortFunc(groups, func(a, b types.PeerGroup) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+		for _, group := range groups {
+			if group.Egress != "" && slices.Contains(group.Members, peer.UUID) {
+				mode, exitPeer = group.Egress, group.ExitPeer
+				break
+			}
+		}
+	}
+	if mode != EgressExit {
+		return mode, types.Peer{}
+	}
+
+	// Send internet traffic through the controller while the exit peer is unavailable
+	exit, ok := peersByUUID[exitPeer]
+	if !ok || !exit.Enabled || exit.UUID == peer.UUID || PeerNetworkName(exit) != PeerNetworkName(peer) || !hasDefaultRoute(exit.RemoteSubnets, false) {
+		return EgressController, types.Peer{}
+	}
+	return EgressExit, exit
+}
+
+// Returns a peer's effective egress mode
+func EffectiveEgress(peer types.Peer) (string, error) {
+	groups, err := db.GetGroups()
+	if err != nil {
+		return "", err
+	}
+	peers, err := db.GetPeers()
+	if err != nil {
+		return "", err
+	}
+	peersByUUID := map[string]types.Peer{}
+	for _, p := range peers {
+		peersByUUID[p.UUID] = p
+	}
+
+	mode, _ := effectiveEgress(peer, groups, peersByUUID)
+	return mode, nil
+}
+
+// Adjusts the subnets a client routes through the tunnel to its egress mode
+func egressSubnets(peer types.Peer, subnets []string, mode string) ([]string, error) {
+	if mode == "" {
+		return subnets, nil
+	}
+	network, err := GetPeerNetwork(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == EgressSplit {
+		var internal []string
+		for _, subnet := range subnets {
+			if !isDefaultRoute(subnet) {
+				internal = append(internal, subnet)
+			}
+		}
+		if len(internal) == 0 {
+			internal = append(internal, network.CIDR)
+			if network.CIDR6 != "" {
+				internal = append(internal, network.CIDR6)
+			}
+		}
+		return internal, nil
+	}
+
+	// Full tunnel. IPv6 internet traffic leaves through the controller when
+	// the exit peer only advertises an IPv4 default route.
+	full := []string{"0.0.0.0/0"}
+	if network.CIDR6 != "" {
+		full = append(full, "::/0")
+	}
+	return full, nil
+}
+
+// Reports whether a subnet is a default route
+func isDefaultRoute(subnet string) bool {
+	prefix, err := netip.ParsePrefix(subnet)
+	return err == nil && prefix.Bits() == 0
+}
+
+// Reports whether the subnets include the default route of the IPv6 family
+// when is6 is set, or IPv4 otherwise
+func hasDefaultRoute(subnets []string, is6 bool) bool {
+	for _, subnet := range subnets {
+		if isDefaultRoute(subnet) && sameFamily(subnet, is6) {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups the peers that send their internet traffic through an exit peer by exit peer
+func compileExitRoutes() ([]exitRoute, error) {
+	peers, err := db.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := db.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	migrated, err := migratedPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	peersByUUID := map[string]types.Peer{}
+	for _, peer := range peers {
+		peersByUUID[peer.UUID] = peer
+	}
+	interfaces := map[string]string{}
+	for _, network := range networks {
+		interfaces[network.Name] = network.Interface
+	}
+
+	routes := map[string]*exitRoute{}
+	for _, peer := range peers {
+		if !peer.Enabled {
+			continue
+		}
+		mode, exit := effectiveEgress(peer, groups, peersByUUID)
+		if mode != EgressExit {
+			continue
+		}
+
+		route, ok := routes[exit.UUID]
+		if !ok {
+			// Exit peers that migrated to a new server key are reached on its interface
+			iface := interfaces[PeerNetworkName(exit)]
+			if r, ok := migrated[exit.UUID]; ok {
+				iface = r.Interface
+			}
+			route = &exitRoute{Exit: exit, Interface: iface}
+			routes[exit.UUID] = route
+		}
+		route.Sources = append(route.Sources, peer.RemoteTunAddress+"/32")
+		if peer.RemoteTunAddress6 != "" {
+			route.Sources = append(route.Sources, peer.RemoteTunAddress6+"/128")
+		}
+	}
+
+	var compiled []exitRoute
+	for _, route := range routes {
+		compiled = append(compiled, *route)
+	}
+	slices.SortFunc(compiled, func(a, b exitRoute) int {
+		return strings.Compare(a.Exit.UUID, b.Exit.UUID)
+	})
+	for i := range compiled {
+		compiled[i].Table = ExitTableBase + i
+	}
+
+	return compiled, nil
+}
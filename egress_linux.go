@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Routes the traffic marked for each exit peer through the exit peer's table.
+// The main table is consulted first for everything but its default route, so
+// internal destinations keep their routes.
+func syncExitRouting(routes []exitRoute) error {
+	for _, route := range routes {
+		link, err := netlink.LinkByName(route.Interface)
+		if err != nil {
+			return err
+		}
+		for _, subnet := range route.Exit.RemoteSubnets {
+			if !isDefaultRoute(subnet) {
+				continue
+			}
+			_, dst, err := net.ParseCIDR(subnet)
+			if err != nil {
+				return err
+			}
+			err = netlink.RouteReplace(&netlink.Route{
+				Dst:       dst,
+				LinkIndex: link.Attrs().Index,
+				Table:     route.Table,
+				Protocol:  171, // Identifies the route as a WireGuard route
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			suppress := netlink.NewRule()
+			suppress.Family = family
+			suppress.Priority = ExitRulePriority
+			suppress.Mark = uint32(route.Table)
+			suppress.Table = unix.RT_TABLE_MAIN
+			suppress.SuppressPrefixlen = 0
+
+			exit := netlink.NewRule()
+			exit.Family = family
+			exit.Priority = ExitRulePriority + 1
+			exit.Mark = uint32(route.Table)
+			exit.Table = route.Table
+
+			for _, rule := range []*netlink.Rule{suppress, exit} {
+				err = netlink.RuleAdd(rule)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Removes the rules that send traffic to the exit tables
+func removeExitRules() error {
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Priority == ExitRulePriority || rule.Priority == ExitRulePriority+1 {
+			err = netlink.RuleDel(&rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func syncExitRouting(routes []exitRoute) error {
+	if len(routes) > 0 {
+		return errors.New("exit peers are only supported on Linux")
+	}
+	return nil
+}
+
+func removeExitRules() error {
+	return nil
+}
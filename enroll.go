@@ -0,0 +1,492 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Lifetime of an enrollment code when none is requested, and the longest allowed
+const EnrollmentDefaultTTL = time.Hour
+const EnrollmentMaxTTL = 7 * 24 * time.Hour
+
+// Keep-alive of peers created from a template without one
+const DefaultKeepAliveSeconds = 25
+
+var hostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Generates a code like "ABCD-EFGH-IJKL-MNOP-QRST-UVWX"
+func newEnrollmentCode() (string, error) {
+	b, err := GenerateRandomBytes(15)
+	if err != nil {
+		return "", err
+	}
+	raw := base32.StdEncoding.EncodeToString(b)
+
+	var groups []string
+	for i := 0; i < len(raw); i += 4 {
+		groups = append(groups, raw[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// Hashes a code, ignoring case, spaces and dashes
+func enrollmentCodeHash(code string) ([]byte, error) {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return GenerateDeterministicHash([]byte(code), []byte{})
+}
+
+// Scopes of the credential issued to an enrolled peer
+func peerScopes(peerUUID string) []string {
+	return []string{
+		"read-peers:" + peerUUID,
+		"write-peers:" + peerUUID,
+		"read-poll:" + peerUUID,
+		"read-serverinfo:" + peerUUID,
+	}
+}
+
+func ValidateEnrollment(e *types.Enrollment) error {
+	if e.PeerUUID != "" {
+		_, err := db.GetPeer(e.PeerUUID)
+		if err != nil {
+			return errors.New("peer not found")
+		}
+		e.Template = types.PeerTemplate{}
+		return nil
+	}
+
+	// Enrollments without a peer create one from the template
+	t := &e.Template
+	if t.Network == "" {
+		t.Network = DefaultNetworkName
+	}
+	network, err := db.GetNetwork(t.Network)
+	if err != nil {
+		return errors.New("network not found")
+	}
+	if t.Pool == "" {
+		t.Pool = NetworkPoolName(network.Name, false)
+	}
+	if t.Pool6 == "" && network.CIDR6 != "" {
+		t.Pool6 = NetworkPoolName(network.Name, true)
+	}
+	for _, pool := range []string{t.Pool, t.Pool6} {
+		if pool == "" {
+			continue
+		}
+		p, err := db.GetPool(pool)
+		if err != nil || p.Network != network.Name {
+			return errors.New("pool " + pool + " not found in network " + network.Name)
+		}
+	}
+	if t.KeepAliveSeconds < 0 {
+		return errors.New("invalid keep-alive")
+	}
+	for _, subnet := range t.AllowedSubnets {
+		if _, err := netip.ParsePrefix(subnet); err != nil {
+			return errors.New("invalid allowed subnet " + subnet)
+		}
+	}
+	for _, group := range t.Groups {
+		_, err := db.GetGroup(group)
+		if err != nil {
+			return errors.New("group " + group + " not found")
+		}
+	}
+
+	return nil
+}
+
+// Creates a peer from an enrollment template
+func enrollTemplatePeer(t types.PeerTemplate, req types.EnrollRequest) (types.Peer, error) {
+	if !hostnameRegex.MatchString(req.Hostname) {
+		return types.Peer{}, errors.New("a valid hostname is required")
+	}
+
+	network, err := db.GetNetwork(t.Network)
+	if err != nil {
+		return types.Peer{}, errors.New("network not found")
+	}
+
+	peer := types.Peer{
+		UUID:             uuid.New().String(),
+		Hostname:         req.Hostname,
+		Enabled:          true,
+		Network:          network.Name,
+		KeepAliveSeconds: t.KeepAliveSeconds,
+		AllowedSubnets:   t.AllowedSubnets,
+		OS:               req.OS,
+		ClientType:       req.ClientType,
+		ClientVersion:    req.ClientVersion,
+	}
+	if peer.KeepAliveSeconds == 0 {
+		peer.KeepAliveSeconds = DefaultKeepAliveSeconds
+	}
+	if len(peer.AllowedSubnets) == 0 {
+		peer.AllowedSubnets = []string{network.CIDR}
+		if network.CIDR6 != "" {
+			peer.AllowedSubnets = append(peer.AllowedSubnets, network.CIDR6)
+		}
+	}
+
+	// Use the device's own key pair when it sends a public key, otherwise generate one
+	if req.PublicKey != "" {
+		peer.PublicKey = req.PublicKey
+	} else if ENV.CLIENT_KEYS_ONLY {
+		return types.Peer{}, errors.New("a public key is required")
+	} else {
+		peer.PrivateKey, err = NewWireguardPrivateKey()
+		if err != nil {
+			return types.Peer{}, err
+		}
+		peer.PublicKey, err = GetWireguardPublicKey(peer.PrivateKey)
+		if err != nil {
+			return types.Peer{}, err
+		}
+	}
+	err = ValidatePeerKeys(peer)
+	if err != nil {
+		return types.Peer{}, err
+	}
+	peer.PreSharedKey, err = NewWireguardPreSharedKey()
+	if err != nil {
+		return types.Peer{}, err
+	}
+
+	err = ValidatePeerNames(&peer)
+	if err != nil {
+		return types.Peer{}, err
+	}
+
+	// Allocate the tunnel addresses
+	lease, err := AllocateAddress(network.Name, t.Pool, peer.UUID)
+	if err != nil {
+		return types.Peer{}, err
+	}
+	peer.RemoteTunAddress = lease.Address
+	if network.CIDR6 != "" && t.Pool6 != "" {
+		lease6, err := AllocateAddress(network.Name, t.Pool6, peer.UUID)
+		if err != nil {
+			ReleaseAddresses(peer.UUID)
+			return types.Peer{}, err
+		}
+		peer.RemoteTunAddress6 = lease6.Address
+	}
+
+	_, err = ClaimPeerAddresses(peer)
+	if err != nil {
+		ReleaseAddresses(peer.UUID)
+		return types.Peer{}, err
+	}
+
+	err = db.InsertPeer(peer)
+	if err != nil {
+		ReleaseAddresses(peer.UUID)
+		return types.Peer{}, err
+	}
+
+	for _, group := range t.Groups {
+		err = db.AddGroupMember(group, peer.UUID)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	PeerCreated(peer)
+	if len(t.Groups) > 0 {
+		ApplyGroupPolicies()
+	}
+
+	return peer, nil
+}
+
+// Issues an API key that can only act on the given peer
+func issuePeerCredential(peer types.Peer) (keyUUID string, token string, err error) {
+	tokenBytes, err := GenerateRandomBytes(32)
+	if err != nil {
+		return "", "", err
+	}
+	hash, err := GenerateDeterministicHash(tokenBytes, []byte{})
+	if err != nil {
+		return "", "", err
+	}
+
+	key := types.APIKey{
+		UUID:       uuid.New().String(),
+		Name:       "enrollment: " + peer.Hostname,
+		Attributes: peerScopes(peer.UUID),
+	}
+	err = db.InsertApiKey(key, hash)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key.UUID, base64.URLEncoding.EncodeToString(tokenBytes), nil
+}
+
+func GET_Enrollments(c *gin.Context) {
+	enrollments, err := db.GetEnrollments()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, enrollments)
+}
+
+// Creates an enrollment code. The code is only returned in this response.
+func POST_Enrollment(c *gin.Context) {
+	var e types.Enrollment
+	err := c.BindJSON(&e)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Set the expiry
+	now := time.Now()
+	if e.ExpiresUnixMillis == 0 {
+		e.ExpiresUnixMillis = now.Add(EnrollmentDefaultTTL).UnixMilli()
+	}
+	if e.ExpiresUnixMillis <= now.UnixMilli() || e.ExpiresUnixMillis > now.Add(EnrollmentMaxTTL).UnixMilli() {
+		c.JSON(400, gin.H{
+			"error": "expiry must be in the future and within " + EnrollmentMaxTTL.String(),
+		})
+		return
+	}
+
+	err = ValidateEnrollment(&e)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	code, err := newEnrollmentCode()
+	if err != nil {
+		log.Println(err)
+		c.Status(500)
+		return
+	}
+	hash, err := enrollmentCodeHash(code)
+	if err != nil {
+		log.Println(err)
+		c.Status(500)
+		return
+	}
+
+	e.UUID = uuid.New().String()
+	e.CreatedBy = c.GetString("actor")
+	e.CreatedUnixMillis = now.UnixMilli()
+	e.UsedUnixMillis = 0
+	e.UsedIP = ""
+	e.UsedByPeerUUID = ""
+
+	err = db.InsertEnrollment(e, hash)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Record the new enrollment as the target of the audit event
+	c.Set("auditTarget", e.UUID)
+
+	c.JSON(200, types.EnrollmentWithCode{
+		Enrollment: e,
+		Code:       code,
+	})
+}
+
+func DELETE_Enrollment(c *gin.Context) {
+	err := db.DeleteEnrollment(c.Param("uuid"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{
+			"error": "enrollment not found",
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+// Exchanges an enrollment code for the peer's configuration and a credential scoped to the peer
+func POST_Enroll(c *gin.Context) {
+	// Check if the client IP is locked out
+	if until := ipLockedUntil(c.ClientIP()); time.Now().Before(until) {
+		loginLockedResponse(c, until)
+		return
+	}
+
+	var req types.EnrollRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	hash, err := enrollmentCodeHash(req.Code)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": "code is required",
+		})
+		return
+	}
+
+	// Consume the code so it can't be used again
+	e, err := db.ConsumeEnrollment(hash, c.ClientIP(), time.Now().UnixMilli())
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println(err)
+		}
+		log.Println("Invalid or used enrollment code from IP:", c.ClientIP())
+		c.JSON(401, gin.H{
+			"error": "invalid or expired enrollment code",
+		})
+		RecordAuditEvent(c, "enrollment.failed", "", nil, nil)
+		ipFailed(c)
+		return
+	}
+	c.Set("actor", e.UUID)
+	c.Set("actorType", "enrollment")
+
+	// Make the code usable again if the exchange fails
+	fail := func(status int, err error) {
+		log.Println("Enrollment", e.UUID, "failed:", err)
+		releaseErr := db.ReleaseEnrollment(e.UUID)
+		if releaseErr != nil {
+			log.Println(releaseErr)
+		}
+		c.JSON(status, gin.H{
+			"error": err.Error(),
+		})
+		RecordAuditEvent(c, "enrollment.failed", e.PeerUUID, nil, nil)
+	}
+
+	var before any
+	var peer types.Peer
+	if e.PeerUUID != "" {
+		// Bind the device to the pre-created peer
+		peer, err = db.GetPeer(e.PeerUUID)
+		if err != nil {
+			fail(404, errors.New("peer not found"))
+			return
+		}
+		before = peer
+		if req.OS != "" || req.ClientType != "" || req.ClientVersion != "" || req.PublicKey != "" {
+			peer.OS = req.OS
+			peer.ClientType = req.ClientType
+			peer.ClientVersion = req.ClientVersion
+
+			// Replace the peer's keys with the device's own key pair
+			if req.PublicKey != "" {
+				peer.PublicKey = req.PublicKey
+				peer.PrivateKey = ""
+				err = ValidatePeerKeys(peer)
+				if err != nil {
+					fail(400, err)
+					return
+				}
+			}
+
+			err = db.UpdatePeer(peer)
+			if err != nil {
+				fail(500, err)
+				return
+			}
+
+			if req.PublicKey != "" {
+				err = SyncWireguardConfiguration()
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	} else {
+		peer, err = enrollTemplatePeer(e.Template, req)
+		if err != nil {
+			fail(400, err)
+			return
+		}
+	}
+
+	err = db.CompleteEnrollment(e.UUID, peer.UUID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Build the response
+	network, err := GetPeerNetwork(peer)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	serverInfo, err := GetServerInfo(network)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	config, err := GenerateClientConfig(peer)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	keyUUID, token, err := issuePeerCredential(peer)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	log.Println("Peer", peer.Hostname, "enrolled with enrollment", e.UUID, "from IP:", c.ClientIP())
+	c.JSON(200, types.EnrollResponse{
+		Peer:       peer,
+		ServerInfo: serverInfo,
+		Config:     config,
+		APIKeyUUID: keyUUID,
+		Token:      token,
+	})
+	RecordAuditEvent(c, "enrollment.exchange", peer.UUID, before, peer)
+}
@@ -4,27 +4,48 @@ import (
 	"encoding/base64"
 	"log"
 	"net"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Env struct {
-	PUBLIC_HOST      string // Public host for web interface
-	ADMIN_EMAIL      string // Admin email
-	ADMIN_PASS       string // Admin password
-	WG_PRIVATE_KEY   string // Private key for wireguard
-	DB_AES_KEY       []byte // Base64 encoded 32 Byte AES key for encrypting private keys
-	SERVER_CIDR      string // CIDR Network for tunnel addresses (optional)
-	SERVER_ADDRESS   string // Internal IP address of the server
-	EGRESS_INTERFACE string // Server egress interface to masquerade traffic (optional)
-	WG_INTERFACE     string // Wireguard interface name (optional)
-	WG_PORT          string // Port for wireguard to listen on (optional)
-	API_PORT         string // Port for API to listen on (optional)
-	SERVER_HOSTNAME  string // Internal hostname of the server (optional)
-	UPSTREAM_DNS     string // Upstream DNS server (optional)
-	SLACK_WEBHOOK    string // Slack webhook URL (optional)
-	PING_MONITORING  bool   // Enable ping monitoring (optional)
+	PUBLIC_HOST             string        // Public host for web interface
+	ADMIN_EMAIL             string        // Admin email
+	ADMIN_PASS              string        // Admin password
+	WG_PRIVATE_KEY          string        // Initial private key of the default network, stored in the database on first start (optional)
+	DB_AES_KEY              []byte        // Base64 encoded 32 Byte AES key for encrypting private keys
+	SERVER_CIDR             string        // CIDR Network for tunnel addresses (optional)
+	SERVER_ADDRESS          string        // Internal IP address of the server
+	SERVER_CIDR6            string        // IPv6 ULA network for dual-stack tunnel addresses (optional)
+	SERVER_ADDRESS6         string        // Internal IPv6 address of the server (optional)
+	EGRESS_INTERFACE        string        // Server egress interface to masquerade traffic (optional)
+	WG_INTERFACE            string        // Wireguard interface name (optional)
+	WG_PORT                 string        // Port for wireguard to listen on (optional)
+	WG_BACKEND              string        // "auto", "kernel" or "wireguard-go" (optional)
+	FIREWALL_BACKEND        string        // "auto", "nftables" or "iptables" (optional)
+	NAT_MODE                string        // "masquerade", "snat" or "none" for routed mode (optional)
+	SNAT_ADDRESS            string        // Source address of tunnel traffic in snat mode
+	SNAT_ADDRESS6           string        // Source address of IPv6 tunnel traffic in snat mode (optional)
+	API_PORT                string        // Port for API to listen on (optional)
+	SERVER_HOSTNAME         string        // Internal hostname of the server (optional)
+	UPSTREAM_DNS            string        // Comma separated upstream DNS servers, DNS over TLS (tls://) or DNS over HTTPS (https://) (optional)
+	DNS_ZONE                string        // Internal DNS zone of the default network, e.g. vpn.corp (optional)
+	SLACK_WEBHOOK           string        // Slack webhook URL (optional)
+	PING_MONITORING         bool          // Enable ping monitoring (optional)
+	DNS_BLOCKLISTS          []string      // Comma separated blocklist files in hosts or adblock format (optional)
+	DNS_QUERY_LOG_RETENTION time.Duration // How long DNS query log entries are kept (optional)
+	ACL_DEFAULT             string        // Action for tunnel traffic that matches no ACL rule (optional)
+	SESSION_TIMEOUT         time.Duration // Absolute lifetime of a login session (optional)
+	SESSION_IDLE_TIMEOUT    time.Duration // Lifetime of an inactive login session (optional)
+	TRUSTED_PROXIES         []string      // Comma separated reverse proxy addresses or CIDRs (optional)
+	CLIENT_KEYS_ONLY        bool          // Forbid server-held peer private keys (optional)
+	KEY_ROTATION_DAYS       int           // Default days between peer key pair rotations (optional)
+	PSK_ROTATION_DAYS       int           // Default days between peer pre-shared key rotations (optional)
 }
 
 func LoadEnvVars() {
@@ -47,8 +68,10 @@ func LoadEnvVars() {
 	}
 
 	ENV.WG_PRIVATE_KEY = os.Getenv("WG_PRIVATE_KEY")
-	if ENV.WG_PRIVATE_KEY == "" {
-		log.Fatal("WG_PRIVATE_KEY env variable is required. Use `wg-controller generate-wg-key` to generate one")
+	if ENV.WG_PRIVATE_KEY != "" {
+		if _, err := GetWireguardPublicKey(ENV.WG_PRIVATE_KEY); err != nil {
+			log.Fatal("Invalid WG_PRIVATE_KEY. Use `wg-controller generate-wg-key` to generate one")
+		}
 	}
 
 	DB_AES_KEY := os.Getenv("DB_AES_KEY")
@@ -99,6 +122,32 @@ func LoadEnvVars() {
 		}
 	}
 
+	ENV.SERVER_CIDR6 = os.Getenv("SERVER_CIDR6")
+	if ENV.SERVER_CIDR6 != "" {
+		ip, _, err := net.ParseCIDR(ENV.SERVER_CIDR6)
+		if err != nil || ip.To4() != nil {
+			log.Fatal("Invalid SERVER_CIDR6")
+		}
+		if !ip.IsPrivate() {
+			log.Fatal("SERVER_CIDR6 must be a unique local (fc00::/7) prefix")
+		}
+
+		ENV.SERVER_ADDRESS6 = os.Getenv("SERVER_ADDRESS6")
+		if ENV.SERVER_ADDRESS6 == "" {
+			log.Println("SERVER_ADDRESS6 is not set. Defaulting to CIDR max address")
+			addr, mask, err := HighestIP(ENV.SERVER_CIDR6)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ENV.SERVER_ADDRESS6 = addr + mask
+		} else {
+			ip := net.ParseIP(strings.Split(ENV.SERVER_ADDRESS6, "/")[0])
+			if ip == nil || ip.To4() != nil {
+				log.Fatal("Invalid SERVER_ADDRESS6")
+			}
+		}
+	}
+
 	ENV.EGRESS_INTERFACE = os.Getenv("EGRESS_INTERFACE")
 	if ENV.EGRESS_INTERFACE == "" {
 		log.Println("EGRESS_INTERFACE is not set. Defaulting to eth0")
@@ -117,6 +166,44 @@ func LoadEnvVars() {
 		ENV.WG_PORT = "51820"
 	}
 
+	ENV.WG_BACKEND = os.Getenv("WG_BACKEND")
+	if ENV.WG_BACKEND == "" {
+		ENV.WG_BACKEND = BackendAuto
+	} else if ENV.WG_BACKEND != BackendAuto && ENV.WG_BACKEND != BackendKernel && ENV.WG_BACKEND != BackendUserspace {
+		log.Fatal("WG_BACKEND must be auto, kernel or wireguard-go")
+	}
+
+	ENV.FIREWALL_BACKEND = os.Getenv("FIREWALL_BACKEND")
+	if ENV.FIREWALL_BACKEND == "" {
+		ENV.FIREWALL_BACKEND = FirewallAuto
+	} else if ENV.FIREWALL_BACKEND != FirewallAuto && ENV.FIREWALL_BACKEND != FirewallNFTables && ENV.FIREWALL_BACKEND != FirewallIPTables {
+		log.Fatal("FIREWALL_BACKEND must be auto, nftables or iptables")
+	}
+
+	ENV.NAT_MODE = os.Getenv("NAT_MODE")
+	if ENV.NAT_MODE == "" {
+		ENV.NAT_MODE = NATMasquerade
+	} else if ENV.NAT_MODE != NATMasquerade && ENV.NAT_MODE != NATSNAT && ENV.NAT_MODE != NATNone {
+		log.Fatal("NAT_MODE must be masquerade, snat or none")
+	}
+
+	ENV.SNAT_ADDRESS = os.Getenv("SNAT_ADDRESS")
+	ENV.SNAT_ADDRESS6 = os.Getenv("SNAT_ADDRESS6")
+	if ENV.NAT_MODE == NATSNAT {
+		addr, err := netip.ParseAddr(ENV.SNAT_ADDRESS)
+		if err != nil || !addr.Is4() {
+			log.Fatal("SNAT_ADDRESS must be an IPv4 address when NAT_MODE is snat")
+		}
+		if ENV.SNAT_ADDRESS6 != "" {
+			addr, err = netip.ParseAddr(ENV.SNAT_ADDRESS6)
+			if err != nil || !addr.Is6() {
+				log.Fatal("SNAT_ADDRESS6 must be an IPv6 address")
+			}
+		} else {
+			log.Println("SNAT_ADDRESS6 is not set. IPv6 tunnel traffic will be masqueraded")
+		}
+	}
+
 	ENV.API_PORT = os.Getenv("API_PORT")
 	if ENV.API_PORT == "" {
 		log.Println("API_PORT is not set. Defaulting to 8081")
@@ -135,10 +222,80 @@ func LoadEnvVars() {
 		ENV.UPSTREAM_DNS = "8.8.8.8"
 	}
 
+	ENV.DNS_ZONE = strings.Trim(os.Getenv("DNS_ZONE"), ".")
+
+	if blocklists := os.Getenv("DNS_BLOCKLISTS"); blocklists != "" {
+		ENV.DNS_BLOCKLISTS = strings.Split(blocklists, ",")
+	}
+
+	ENV.DNS_QUERY_LOG_RETENTION = 7 * 24 * time.Hour
+	if retention := os.Getenv("DNS_QUERY_LOG_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid DNS_QUERY_LOG_RETENTION")
+		}
+		ENV.DNS_QUERY_LOG_RETENTION = d
+	}
+
 	ENV.SLACK_WEBHOOK = os.Getenv("SLACK_WEBHOOK")
 
 	ENV.PING_MONITORING = os.Getenv("PING_MONITORING") == "true"
 	if ENV.PING_MONITORING {
 		log.Println("Internal ping monitoring enabled")
 	}
+
+	ENV.CLIENT_KEYS_ONLY = os.Getenv("CLIENT_KEYS_ONLY") == "true"
+	if ENV.CLIENT_KEYS_ONLY {
+		log.Println("Client-generated keys only, server-held private keys are forbidden")
+	}
+
+	for name, dest := range map[string]*int{
+		"KEY_ROTATION_DAYS": &ENV.KEY_ROTATION_DAYS,
+		"PSK_ROTATION_DAYS": &ENV.PSK_ROTATION_DAYS,
+	} {
+		if days := os.Getenv(name); days != "" {
+			n, err := strconv.Atoi(days)
+			if err != nil || n < 0 {
+				log.Fatal("Invalid " + name)
+			}
+			*dest = n
+		}
+	}
+
+	ENV.ACL_DEFAULT = os.Getenv("ACL_DEFAULT")
+	if ENV.ACL_DEFAULT == "" {
+		ENV.ACL_DEFAULT = ACLAllow
+	} else if ENV.ACL_DEFAULT != ACLAllow && ENV.ACL_DEFAULT != ACLDeny {
+		log.Fatal("ACL_DEFAULT must be allow or deny")
+	}
+
+	ENV.SESSION_TIMEOUT = 12 * time.Hour
+	if timeout := os.Getenv("SESSION_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid SESSION_TIMEOUT")
+		}
+		ENV.SESSION_TIMEOUT = d
+	}
+
+	ENV.SESSION_IDLE_TIMEOUT = time.Hour
+	if timeout := os.Getenv("SESSION_IDLE_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid SESSION_IDLE_TIMEOUT")
+		}
+		ENV.SESSION_IDLE_TIMEOUT = d
+	}
+
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		for _, proxy := range strings.Split(proxies, ",") {
+			proxy = strings.TrimSpace(proxy)
+			if net.ParseIP(proxy) == nil {
+				if _, _, err := net.ParseCIDR(proxy); err != nil {
+					log.Fatal("Invalid TRUSTED_PROXIES entry: " + proxy)
+				}
+			}
+			ENV.TRUSTED_PROXIES = append(ENV.TRUSTED_PROXIES, proxy)
+		}
+	}
 }
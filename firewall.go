@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/wg-controller/wg-controller/db"
+)
+
+// Firewall backends
+const FirewallAuto = "auto"
+const FirewallNFTables = "nftables"
+const FirewallIPTables = "iptables"
+
+// NAT modes
+const NATMasquerade = "masquerade"
+const NATSNAT = "snat"
+const NATNone = "none" // Routed mode, the upstream router routes the tunnel CIDRs back
+
+// Actions of forwarding rules
+const FirewallAccept = "accept"
+const FirewallDrop = "drop"
+const FirewallReturn = "return" // Leaves the ACL rules, continuing with the isolation and policy rules
+
+// A forwarding rule. Empty fields match any packet, and a rule with addresses
+// only applies to the family of those addresses.
+type ForwardRule struct {
+	InInterface  string
+	OutInterface string
+	Source       string   // CIDR
+	Destination  string   // CIDR
+	Protocol     string   // "tcp", "udp" or "icmp"
+	Ports        []string // Destination ports of tcp and udp, e.g. "22" or "8000:8100"
+	Established  bool     // Only match established and related connections
+	Action       string
+}
+
+// Translates the source address of tunnel traffic leaving the server
+type NATRule struct {
+	Source       string // Tunnel CIDR
+	OutInterface string
+	Address      string // SNAT address, the traffic is masqueraded when empty
+}
+
+// Marks the packets of a tunnel address before routing, selecting the routing
+// table of an exit peer
+type MarkRule struct {
+	Source string // CIDR
+	Mark   uint32
+}
+
+// The complete set of forwarding, NAT and marking rules of the controller
+type FirewallRules struct {
+	ACL       []ForwardRule // Enforces the ACL rules, evaluated before the other forwarding rules
+	Isolation []ForwardRule // Drops traffic between networks
+	Policy    []ForwardRule // Enforces the group policies
+	NAT       []NATRule
+	Marks     []MarkRule // Sends the traffic of peers using an exit peer to its table
+}
+
+// A backend that owns the controller's forwarding and NAT rules
+type Firewall interface {
+	Name() string
+
+	// Replaces the controller's rules in a single transaction
+	Apply(rules FirewallRules) error
+
+	// Removes the controller's rules
+	Remove() error
+}
+
+var firewall Firewall
+var firewallMutex sync.Mutex
+
+// Selects the firewall backend. nftables is used through netlink when the
+// kernel supports it, otherwise iptables.
+func InitFirewall() error {
+	if ENV.FIREWALL_BACKEND != FirewallIPTables {
+		fw, err := newNFTablesFirewall()
+		if err == nil {
+			firewall = fw
+			log.Println("Using the nftables firewall backend")
+
+			// Remove the chains left by the iptables backend and the ACL table of earlier versions
+			(&iptablesFirewall{}).Remove()
+			removeLegacyACLTable()
+			return nil
+		}
+		if ENV.FIREWALL_BACKEND == FirewallNFTables {
+			return fmt.Errorf("nftables unavailable: %w", err)
+		}
+		log.Println("nftables unavailable, falling back to iptables:", err)
+	}
+
+	firewall = &iptablesFirewall{}
+	log.Println("Using the iptables firewall backend")
+	return nil
+}
+
+// Rebuilds the firewall rules from the networks, ACL, group policies and exit peers
+func SyncFirewall() error {
+	rules, err := CompileFirewallRules()
+	if err != nil {
+		return err
+	}
+
+	firewallMutex.Lock()
+	defer firewallMutex.Unlock()
+	return firewall.Apply(rules)
+}
+
+// Removes the forwarding and NAT rules
+func RemoveFirewall() error {
+	firewallMutex.Lock()
+	defer firewallMutex.Unlock()
+	if firewall == nil {
+		return nil
+	}
+	return firewall.Remove()
+}
+
+func CompileFirewallRules() (FirewallRules, error) {
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return FirewallRules{}, err
+	}
+	interfaces, err := NetworkInterfaces(networks)
+	if err != nil {
+		return FirewallRules{}, err
+	}
+	policies, err := CompileGroupPolicies()
+	if err != nil {
+		return FirewallRules{}, err
+	}
+	exits, err := compileExitRoutes()
+	if err != nil {
+		return FirewallRules{}, err
+	}
+
+	var rules FirewallRules
+
+	// The ACL applies to every tunnel interface
+	var tunnels []string
+	for _, network := range networks {
+		tunnels = append(tunnels, interfaces[network.Name]...)
+	}
+	rules.ACL, err = aclRules(tunnels)
+	if err != nil {
+		return FirewallRules{}, err
+	}
+
+	// Drop traffic between the interfaces of every pair of networks
+	for _, from := range networks {
+		for _, to := range networks {
+			if from.Name == to.Name {
+				continue
+			}
+			for _, in := range interfaces[from.Name] {
+				for _, out := range interfaces[to.Name] {
+					rules.Isolation = append(rules.Isolation, ForwardRule{
+						InInterface:  in,
+						OutInterface: out,
+						Action:       FirewallDrop,
+					})
+				}
+			}
+		}
+	}
+
+	rules.Policy = policyRules(policies)
+
+	for _, exit := range exits {
+		for _, source := range exit.Sources {
+			rules.Marks = append(rules.Marks, MarkRule{Source: source, Mark: uint32(exit.Table)})
+		}
+	}
+
+	// Only tunnel traffic leaving through the egress interface is translated.
+	// ULA tunnel addresses are not routable on the internet, so IPv6 is translated too.
+	if ENV.NAT_MODE != NATNone {
+		for _, network := range networks {
+			for _, cidr := range []string{network.CIDR, network.CIDR6} {
+				if cidr == "" {
+					continue
+				}
+				rule := NATRule{
+					Source:       cidr,
+					OutInterface: ENV.EGRESS_INTERFACE,
+				}
+				if ENV.NAT_MODE == NATSNAT {
+					if sameFamily(cidr, true) {
+						rule.Address = ENV.SNAT_ADDRESS6
+					} else {
+						rule.Address = ENV.SNAT_ADDRESS
+					}
+				}
+				rules.NAT = append(rules.NAT, rule)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// Traffic to a member of a destination group is only accepted from the sources
+// its policies allow
+func policyRules(policies []compiledPolicy) []ForwardRule {
+	var rules []ForwardRule
+	var drops []ForwardRule
+	protected := map[string]bool{}
+	established := map[string]bool{}
+	for _, policy := range policies {
+		protocol := policy.Protocol
+		if protocol == "any" {
+			protocol = ""
+		}
+
+		// Peers of a network may be split across its interfaces during a server key rotation
+		for _, in := range policy.Interfaces {
+			for _, out := range policy.Interfaces {
+				if !established[in+out] {
+					established[in+out] = true
+					rules = append(rules, ForwardRule{
+						InInterface:  in,
+						OutInterface: out,
+						Established:  true,
+						Action:       FirewallAccept,
+					})
+				}
+
+				for _, dst := range policy.Destinations {
+					is6 := sameFamily(dst, true)
+					if !is6 && !sameFamily(dst, false) {
+						continue
+					}
+					if !protected[in+out+dst] {
+						protected[in+out+dst] = true
+						drops = append(drops, ForwardRule{
+							InInterface:  in,
+							OutInterface: out,
+							Destination:  dst,
+							Action:       FirewallDrop,
+						})
+					}
+					for _, src := range policy.Sources {
+						if !sameFamily(src, is6) {
+							continue
+						}
+						rules = append(rules, ForwardRule{
+							InInterface:  in,
+							OutInterface: out,
+							Source:       src,
+							Destination:  dst,
+							Protocol:     protocol,
+							Ports:        policy.Ports,
+							Action:       FirewallAccept,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	// Accept rules are evaluated before the drops of protected destinations
+	return append(rules, drops...)
+}
+
+// Reports whether a rule applies to the IPv6 family when is6 is set, or IPv4 otherwise
+func (r ForwardRule) appliesTo(is6 bool) bool {
+	if r.Source != "" && !sameFamily(r.Source, is6) {
+		return false
+	}
+	if r.Destination != "" && !sameFamily(r.Destination, is6) {
+		return false
+	}
+	return true
+}
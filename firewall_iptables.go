@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// Applies the rules to the WG-ACL, WG-ISOLATION, WG-POLICY, WG-NAT and WG-MARK chains with
+// iptables-restore, which replaces the chains of a table in one commit
+type iptablesFirewall struct{}
+
+// Jumps from the built-in chains to the controller's chains. Each jump is
+// inserted at the top of its chain, so WG-ACL is evaluated first.
+var iptablesJumps = []struct{ Table, Chain, Target string }{
+	{"filter", "FORWARD", "WG-ISOLATION"},
+	{"filter", "FORWARD", "WG-POLICY"},
+	{"filter", "FORWARD", "WG-ACL"},
+	{"nat", "POSTROUTING", "WG-NAT"},
+	{"mangle", "PREROUTING", "WG-MARK"},
+}
+
+func (f *iptablesFirewall) Name() string {
+	return FirewallIPTables
+}
+
+func (f *iptablesFirewall) Apply(rules FirewallRules) error {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		err := f.apply(iptables, rules)
+		if err != nil {
+			if iptables == "ip6tables" {
+				log.Println("Unable to configure the IPv6 firewall:", err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) apply(iptables string, rules FirewallRules) error {
+	is6 := iptables == "ip6tables"
+
+	// Declaring a chain with --noflush creates or flushes only that chain
+	var b strings.Builder
+	b.WriteString("*filter\n:WG-ACL - [0:0]\n:WG-ISOLATION - [0:0]\n:WG-POLICY - [0:0]\n")
+	for _, chain := range []struct {
+		Name  string
+		Rules []ForwardRule
+	}{{"WG-ACL", rules.ACL}, {"WG-ISOLATION", rules.Isolation}, {"WG-POLICY", rules.Policy}} {
+		for _, rule := range chain.Rules {
+			if !rule.appliesTo(is6) {
+				continue
+			}
+			for _, args := range iptablesRule(rule, is6) {
+				b.WriteString("-A " + chain.Name + " " + strings.Join(args, " ") + "\n")
+			}
+		}
+	}
+	b.WriteString("COMMIT\n*nat\n:WG-NAT - [0:0]\n")
+	for _, rule := range rules.NAT {
+		if !sameFamily(rule.Source, is6) {
+			continue
+		}
+		target := "-j MASQUERADE"
+		if rule.Address != "" {
+			target = "-j SNAT --to-source " + rule.Address
+		}
+		b.WriteString("-A WG-NAT -s " + rule.Source + " -o " + rule.OutInterface + " " + target + "\n")
+	}
+	b.WriteString("COMMIT\n*mangle\n:WG-MARK - [0:0]\n")
+	for _, rule := range rules.Marks {
+		if !sameFamily(rule.Source, is6) {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("-A WG-MARK -s %s -j MARK --set-mark %d\n", rule.Source, rule.Mark))
+	}
+	b.WriteString("COMMIT\n")
+
+	cmd := exec.Command(iptables+"-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(b.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s-restore: %v: %s", iptables, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// Jump to the chains once
+	for _, jump := range iptablesJumps {
+		if exec.Command(iptables, "-t", jump.Table, "-C", jump.Chain, "-j", jump.Target).Run() != nil {
+			err = exec.Command(iptables, "-t", jump.Table, "-I", jump.Chain, "-j", jump.Target).Run()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *iptablesFirewall) Remove() error {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		for _, jump := range iptablesJumps {
+			for exec.Command(iptables, "-t", jump.Table, "-D", jump.Chain, "-j", jump.Target).Run() == nil {
+			}
+			exec.Command(iptables, "-t", jump.Table, "-F", jump.Target).Run()
+			exec.Command(iptables, "-t", jump.Table, "-X", jump.Target).Run()
+		}
+	}
+	return nil
+}
+
+// Expands a rule into iptables arguments, one set per multiport match
+func iptablesRule(rule ForwardRule, is6 bool) [][]string {
+	var args []string
+	if rule.InInterface != "" {
+		args = append(args, "-i", rule.InInterface)
+	}
+	if rule.OutInterface != "" {
+		args = append(args, "-o", rule.OutInterface)
+	}
+	if rule.Source != "" {
+		args = append(args, "-s", rule.Source)
+	}
+	if rule.Destination != "" {
+		args = append(args, "-d", rule.Destination)
+	}
+	if rule.Established {
+		args = append(args, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED")
+	}
+	target := []string{"-j", strings.ToUpper(rule.Action)}
+
+	switch rule.Protocol {
+	case "":
+		return [][]string{append(args, target...)}
+	case "icmp":
+		if is6 {
+			return [][]string{append(append(args, "-p", "ipv6-icmp"), target...)}
+		}
+		return [][]string{append(append(args, "-p", "icmp"), target...)}
+	}
+
+	args = append(args, "-p", rule.Protocol)
+	if len(rule.Ports) == 0 {
+		return [][]string{append(args, target...)}
+	}
+
+	// multiport accepts at most 15 ports, where a range counts as two
+	var matches [][]string
+	var chunk []string
+	size := 0
+	for _, port := range rule.Ports {
+		n := 1
+		if strings.Contains(port, ":") {
+			n = 2
+		}
+		if size+n > 15 {
+			matches = append(matches, append(append(append([]string{}, args...), "-m", "multiport", "--dports", strings.Join(chunk, ",")), target...))
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, port)
+		size += n
+	}
+	matches = append(matches, append(append(append([]string{}, args...), "-m", "multiport", "--dports", strings.Join(chunk, ",")), target...))
+
+	return matches
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Name of the table holding the forwarding, NAT and marking rules
+const NFTFirewallTable = "wg-controller-fw"
+
+// Name of the table earlier versions enforced the ACL in
+const NFTLegacyACLTable = "wg-controller"
+
+// Applies the rules to a table owned by the controller through netlink.
+// Every change is sent as a single batch, which the kernel applies atomically.
+type nftablesFirewall struct{}
+
+func newNFTablesFirewall() (Firewall, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	return &nftablesFirewall{}, nil
+}
+
+func (f *nftablesFirewall) Name() string {
+	return FirewallNFTables
+}
+
+func (f *nftablesFirewall) Apply(rules FirewallRules) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	// Creating then deleting the table makes the batch idempotent
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: NFTFirewallTable}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+
+	// The ACL is a regular chain so that allowed flows can return to the forward chain
+	acl := conn.AddChain(&nftables.Chain{
+		Name:  "acl",
+		Table: table,
+	})
+	for _, rule := range rules.ACL {
+		matches, err := nftForwardRule(rule)
+		if err != nil {
+			return err
+		}
+		for _, exprs := range matches {
+			conn.AddRule(&nftables.Rule{Table: table, Chain: acl, Exprs: exprs})
+		}
+	}
+
+	accept := nftables.ChainPolicyAccept
+	forward := conn.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &accept,
+	})
+	if len(rules.ACL) > 0 {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: forward, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: acl.Name},
+		}})
+	}
+	for _, rule := range append(rules.Isolation, rules.Policy...) {
+		matches, err := nftForwardRule(rule)
+		if err != nil {
+			return err
+		}
+		for _, exprs := range matches {
+			conn.AddRule(&nftables.Rule{Table: table, Chain: forward, Exprs: exprs})
+		}
+	}
+
+	postrouting := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+		Policy:   &accept,
+	})
+	for _, rule := range rules.NAT {
+		exprs, err := nftNATRule(rule)
+		if err != nil {
+			return err
+		}
+		conn.AddRule(&nftables.Rule{Table: table, Chain: postrouting, Exprs: exprs})
+	}
+
+	prerouting := conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityMangle,
+		Policy:   &accept,
+	})
+	for _, rule := range rules.Marks {
+		prefix, err := netip.ParsePrefix(rule.Source)
+		if err != nil {
+			return err
+		}
+		exprs := append(nftAddress(prefix, true),
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(rule.Mark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		)
+		conn.AddRule(&nftables.Rule{Table: table, Chain: prerouting, Exprs: exprs})
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("nftables: %w", err)
+	}
+	return nil
+}
+
+func (f *nftablesFirewall) Remove() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: NFTFirewallTable}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	return conn.Flush()
+}
+
+// Deletes the ACL table of earlier versions
+func removeLegacyACLTable() {
+	conn, err := nftables.New()
+	if err != nil {
+		return
+	}
+
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: NFTLegacyACLTable}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.Flush()
+}
+
+// Expands a rule into expressions, one rule per destination port
+func nftForwardRule(rule ForwardRule) ([][]expr.Any, error) {
+	var exprs []expr.Any
+	if rule.InInterface != "" {
+		exprs = append(exprs, nftInterface(expr.MetaKeyIIFNAME, rule.InInterface)...)
+	}
+	if rule.OutInterface != "" {
+		exprs = append(exprs, nftInterface(expr.MetaKeyOIFNAME, rule.OutInterface)...)
+	}
+
+	is6 := false
+	hasAddress := false
+	for i, cidr := range []string{rule.Source, rule.Destination} {
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		is6 = prefix.Addr().Is6()
+		hasAddress = true
+		exprs = append(exprs, nftAddress(prefix, i == 0)...)
+	}
+
+	if rule.Established {
+		exprs = append(exprs,
+			&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		)
+	}
+
+	verdict := &expr.Verdict{Kind: expr.VerdictAccept}
+	switch rule.Action {
+	case FirewallDrop:
+		verdict = &expr.Verdict{Kind: expr.VerdictDrop}
+	case FirewallReturn:
+		verdict = &expr.Verdict{Kind: expr.VerdictReturn}
+	}
+
+	switch rule.Protocol {
+	case "":
+		return [][]expr.Any{append(exprs, verdict)}, nil
+	case "icmp":
+		// Without addresses the rule applies to both families
+		if !hasAddress {
+			return [][]expr.Any{
+				append(append(append([]expr.Any{}, exprs...), nftProtocol(unix.IPPROTO_ICMP)...), verdict),
+				append(append(exprs, nftProtocol(unix.IPPROTO_ICMPV6)...), verdict),
+			}, nil
+		}
+		if is6 {
+			return [][]expr.Any{append(append(exprs, nftProtocol(unix.IPPROTO_ICMPV6)...), verdict)}, nil
+		}
+		return [][]expr.Any{append(append(exprs, nftProtocol(unix.IPPROTO_ICMP)...), verdict)}, nil
+	case "tcp":
+		exprs = append(exprs, nftProtocol(unix.IPPROTO_TCP)...)
+	case "udp":
+		exprs = append(exprs, nftProtocol(unix.IPPROTO_UDP)...)
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", rule.Protocol)
+	}
+	if len(rule.Ports) == 0 {
+		return [][]expr.Any{append(exprs, verdict)}, nil
+	}
+
+	var matches [][]expr.Any
+	for _, port := range rule.Ports {
+		match, err := nftPort(port)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, append(append(append([]expr.Any{}, exprs...), match...), verdict))
+	}
+	return matches, nil
+}
+
+func nftNATRule(rule NATRule) ([]expr.Any, error) {
+	prefix, err := netip.ParsePrefix(rule.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := nftInterface(expr.MetaKeyOIFNAME, rule.OutInterface)
+	exprs = append(exprs, nftAddress(prefix, true)...)
+	if rule.Address == "" {
+		return append(exprs, &expr.Masq{}), nil
+	}
+
+	addr, err := netip.ParseAddr(rule.Address)
+	if err != nil {
+		return nil, err
+	}
+	family := uint32(unix.NFPROTO_IPV4)
+	if addr.Is6() {
+		family = unix.NFPROTO_IPV6
+	}
+	return append(exprs,
+		&expr.Immediate{Register: 1, Data: addr.AsSlice()},
+		&expr.NAT{Type: expr.NATTypeSourceNAT, Family: family, RegAddrMin: 1},
+	), nil
+}
+
+// Matches the input or output interface name
+func nftInterface(key expr.MetaKey, name string) []expr.Any {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// Matches the family and the source or destination address of a packet
+func nftAddress(prefix netip.Prefix, source bool) []expr.Any {
+	prefix = prefix.Masked()
+	addr := prefix.Addr().AsSlice()
+
+	family := byte(unix.NFPROTO_IPV4)
+	offset := uint32(16)
+	if source {
+		offset = 12
+	}
+	if prefix.Addr().Is6() {
+		family = unix.NFPROTO_IPV6
+		offset = 24
+		if source {
+			offset = 8
+		}
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(addr)),
+			Mask:           net.CIDRMask(prefix.Bits(), len(addr)*8),
+			Xor:            make([]byte, len(addr)),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+	}
+}
+
+// Matches the layer 4 protocol
+func nftProtocol(protocol byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocol}},
+	}
+}
+
+// Matches a destination port or port range, e.g. "22" or "8000:8100"
+func nftPort(port string) ([]expr.Any, error) {
+	start, end, isRange := strings.Cut(port, ":")
+	first, err := strconv.ParseUint(start, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+
+	load := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}
+	if !isRange {
+		return []expr.Any{
+			load,
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(first))},
+		}, nil
+	}
+
+	last, err := strconv.ParseUint(end, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %s", port)
+	}
+	return []expr.Any{
+		load,
+		&expr.Range{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			FromData: binaryutil.BigEndian.PutUint16(uint16(first)),
+			ToData:   binaryutil.BigEndian.PutUint16(uint16(last)),
+		},
+	}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func newNFTablesFirewall() (Firewall, error) {
+	return nil, errors.New("nftables is only available on Linux")
+}
+
+func removeLegacyACLTable() {}
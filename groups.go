@@ -0,0 +1,623 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+var groupNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-_]*$`)
+
+// A group policy compiled for a single network
+type compiledPolicy struct {
+	Interfaces   []string // The network's interfaces, two during a server key rotation
+	Sources      []string // Tunnel addresses of the source group members
+	Destinations []string // Tunnel addresses and remote subnets of the destination group members
+	Protocol     string
+	Ports        []string // iptables port specs, e.g. "22" or "8000:8100"
+}
+
+func ValidateGroup(group *types.PeerGroup) error {
+	if !groupNameRegex.MatchString(group.Name) {
+		return errors.New("group name must be lowercase letters, numbers, dashes and underscores")
+	}
+	if group.Members == nil {
+		group.Members = []string{}
+	}
+
+	// Members must be existing peers
+	for _, member := range group.Members {
+		_, err := db.GetPeer(member)
+		if err != nil {
+			return fmt.Errorf("peer %s not found", member)
+		}
+	}
+
+	return validateEgress(group.Egress, group.ExitPeer)
+}
+
+func ValidatePolicy(policy *types.GroupPolicy) error {
+	_, err := db.GetGroup(policy.SourceGroup)
+	if err != nil {
+		return errors.New("source group not found")
+	}
+	_, err = db.GetGroup(policy.DestinationGroup)
+	if err != nil {
+		return errors.New("destination group not found")
+	}
+
+	policy.Protocol = strings.ToLower(policy.Protocol)
+	if policy.Protocol == "" {
+		policy.Protocol = "any"
+	}
+	switch policy.Protocol {
+	case "tcp", "udp":
+	case "icmp", "any":
+		if len(policy.Ports) > 0 {
+			return errors.New("ports can only be set for tcp and udp")
+		}
+	default:
+		return errors.New("protocol must be tcp, udp, icmp or any")
+	}
+
+	if policy.Ports == nil {
+		policy.Ports = []string{}
+	}
+	for _, port := range policy.Ports {
+		_, err := parsePortRange(port)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parses "22" or "8000-8100" into the iptables form "22" or "8000:8100"
+func parsePortRange(port string) (string, error) {
+	start, end, isRange := strings.Cut(port, "-")
+	first, err := strconv.Atoi(start)
+	if err != nil || first < 1 || first > 65535 {
+		return "", fmt.Errorf("invalid port %s", port)
+	}
+	if !isRange {
+		return start, nil
+	}
+	last, err := strconv.Atoi(end)
+	if err != nil || last < first || last > 65535 {
+		return "", fmt.Errorf("invalid port range %s", port)
+	}
+	return start + ":" + end, nil
+}
+
+// Returns the addresses a peer can be reached at, including the subnets behind it
+func peerDestinations(peer types.Peer) []string {
+	var destinations []string
+	if peer.RemoteTunAddress != "" {
+		destinations = append(destinations, peer.RemoteTunAddress+"/32")
+	}
+	if peer.RemoteTunAddress6 != "" {
+		destinations = append(destinations, peer.RemoteTunAddress6+"/128")
+	}
+	// Internet traffic routed through an exit peer is not a policy destination
+	for _, subnet := range peer.RemoteSubnets {
+		if !isDefaultRoute(subnet) {
+			destinations = append(destinations, subnet)
+		}
+	}
+	return destinations
+}
+
+// Compiles the group policies into per-network rules
+func CompileGroupPolicies() ([]compiledPolicy, error) {
+	groups, err := db.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+	policies, err := db.GetPolicies()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := db.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	interfaces, err := NetworkInterfaces(networks)
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[string][]string{}
+	for _, group := range groups {
+		members[group.Name] = group.Members
+	}
+	peersByUUID := map[string]types.Peer{}
+	for _, peer := range peers {
+		peersByUUID[peer.UUID] = peer
+	}
+
+	var compiled []compiledPolicy
+	for _, policy := range policies {
+		var ports []string
+		for _, port := range policy.Ports {
+			p, err := parsePortRange(port)
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, p)
+		}
+
+		// Only peers in the same network can reach each other
+		for _, network := range networks {
+			rule := compiledPolicy{
+				Interfaces: interfaces[network.Name],
+				Protocol:   policy.Protocol,
+				Ports:      ports,
+			}
+			for _, uuid := range members[policy.SourceGroup] {
+				peer, ok := peersByUUID[uuid]
+				if !ok || !peer.Enabled || PeerNetworkName(peer) != network.Name {
+					continue
+				}
+				rule.Sources = append(rule.Sources, peer.RemoteTunAddress+"/32")
+				if peer.RemoteTunAddress6 != "" {
+					rule.Sources = append(rule.Sources, peer.RemoteTunAddress6+"/128")
+				}
+			}
+			for _, uuid := range members[policy.DestinationGroup] {
+				peer, ok := peersByUUID[uuid]
+				if !ok || !peer.Enabled || PeerNetworkName(peer) != network.Name {
+					continue
+				}
+				rule.Destinations = append(rule.Destinations, peerDestinations(peer)...)
+			}
+			if len(rule.Sources) > 0 && len(rule.Destinations) > 0 {
+				compiled = append(compiled, rule)
+			}
+		}
+	}
+
+	return compiled, nil
+}
+
+// Returns the subnets a peer routes through the tunnel, including the
+// destinations granted to it by group policies, shaped by its egress mode
+func EffectiveAllowedSubnets(peer types.Peer) ([]string, error) {
+	policies, err := db.GetPolicies()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := db.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := db.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the groups the peer is a member of
+	memberOf := map[string]bool{}
+	members := map[string][]string{}
+	for _, group := range groups {
+		members[group.Name] = group.Members
+		for _, member := range group.Members {
+			if member == peer.UUID {
+				memberOf[group.Name] = true
+			}
+		}
+	}
+	peersByUUID := map[string]types.Peer{}
+	for _, p := range peers {
+		peersByUUID[p.UUID] = p
+	}
+
+	subnets := append([]string{}, peer.AllowedSubnets...)
+	seen := map[string]bool{}
+	for _, subnet := range subnets {
+		seen[subnet] = true
+	}
+	for _, policy := range policies {
+		if !memberOf[policy.SourceGroup] {
+			continue
+		}
+		for _, uuid := range members[policy.DestinationGroup] {
+			dst, ok := peersByUUID[uuid]
+			if !ok || !dst.Enabled || dst.UUID == peer.UUID || PeerNetworkName(dst) != PeerNetworkName(peer) {
+				continue
+			}
+			for _, subnet := range peerDestinations(dst) {
+				// Skip subnets the peer already routes
+				if seen[subnet] || coveredBy(subnet, subnets) {
+					continue
+				}
+				seen[subnet] = true
+				subnets = append(subnets, subnet)
+			}
+		}
+	}
+
+	mode, _ := effectiveEgress(peer, groups, peersByUUID)
+	return egressSubnets(peer, subnets, mode)
+}
+
+// Reports whether a subnet is contained in any of the given subnets
+func coveredBy(subnet string, subnets []string) bool {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return false
+	}
+	for _, s := range subnets {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			continue
+		}
+		if p.Bits() <= prefix.Bits() && p.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rebuilds the firewall and pushes the updated AllowedIPs to clients
+func ApplyGroupPolicies() {
+	// ACL selectors may refer to groups and peers
+	err := SyncFirewall()
+	if err != nil {
+		log.Println(err)
+	}
+
+	peers, err := db.GetPeers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, peer := range peers {
+		PushPeerConfig(peer)
+	}
+
+	// Peers protected by a policy are relayed through the server
+	FanoutMesh()
+}
+
+// Applies a change to the groups. Groups may send the internet traffic of
+// their members through an exit peer, so the routing table is rebuilt too.
+func ApplyGroups() {
+	err := SyncRoutingTable()
+	if err != nil {
+		log.Println(err)
+	}
+
+	ApplyGroupPolicies()
+}
+
+func GET_Groups(c *gin.Context) {
+	groups, err := db.GetGroups()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, groups)
+}
+
+func PUT_Group(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	// Parse the group request body
+	var group types.PeerGroup
+	err := c.BindJSON(&group)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	group.Name = name
+
+	err = ValidateGroup(&group)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Insert group into database
+	err = db.InsertGroup(group)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ApplyGroups()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func PATCH_Group(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	// Parse the group request body
+	var group types.PeerGroup
+	err := c.BindJSON(&group)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	group.Name = name
+
+	_, err = db.GetGroup(name)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+
+	err = ValidateGroup(&group)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = db.UpdateGroup(group)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ApplyGroups()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_Group(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	err := db.DeleteGroup(name)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ApplyGroups()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func PUT_GroupMember(c *gin.Context) {
+	name := c.Param("name")
+	uuid := c.Param("uuid")
+
+	_, err := db.GetGroup(name)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+	_, err = db.GetPeer(uuid)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": "peer not found",
+		})
+		return
+	}
+
+	err = db.AddGroupMember(name, uuid)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ApplyGroups()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_GroupMember(c *gin.Context) {
+	name := c.Param("name")
+	uuid := c.Param("uuid")
+
+	err := db.RemoveGroupMember(name, uuid)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ApplyGroups()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func GET_Policies(c *gin.Context) {
+	policies, err := db.GetPolicies()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, policies)
+}
+
+func PUT_Policy(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	// Parse the policy request body
+	var policy types.GroupPolicy
+	err := c.BindJSON(&policy)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	policy.UUID = uuid
+
+	err = ValidatePolicy(&policy)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Insert policy into database
+	err = db.InsertPolicy(policy)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ApplyGroupPolicies()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func PATCH_Policy(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	// Parse the policy request body
+	var policy types.GroupPolicy
+	err := c.BindJSON(&policy)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	policy.UUID = uuid
+
+	err = ValidatePolicy(&policy)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = db.UpdatePolicy(policy)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ApplyGroupPolicies()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_Policy(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	err := db.DeletePolicy(uuid)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ApplyGroupPolicies()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
@@ -0,0 +1,1064 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// How long an address handed out by /peers/init is held for the new peer
+const LeaseTime = 10 * time.Minute
+
+const (
+	ReservationReserved = "reserved" // Skipped by the allocator, but can be assigned explicitly
+	ReservationExcluded = "excluded" // Never assigned
+	ReservationStatic   = "static"   // Only assigned to the peer that owns it
+)
+
+var ErrAddressInUse = errors.New("address is already in use")
+
+var ipamMutex sync.Mutex                  // Serialises allocation and claiming of addresses
+var poolCursors = map[string]netip.Addr{} // Next address to try per pool
+
+type addrRange struct {
+	Start netip.Addr
+	End   netip.Addr
+}
+
+func (r addrRange) Contains(addr netip.Addr) bool {
+	return r.Start.Compare(addr) <= 0 && addr.Compare(r.End) <= 0
+}
+
+// Creates the pools of every network and binds the addresses of existing peers
+func InitIPAM() {
+	// Create or update the network pools
+	networks, err := db.GetNetworks()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, network := range networks {
+		err = EnsureNetworkPools(network)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Backfill leases for peers created before IPAM existed
+	peers, err := db.GetPeers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	leases, err := db.GetActiveLeases()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pools, err := db.GetPools()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, peer := range peers {
+		for _, address := range []string{peer.RemoteTunAddress, peer.RemoteTunAddress6} {
+			addr, err := netip.ParseAddr(address)
+			if err != nil {
+				continue
+			}
+
+			bound := false
+			for _, lease := range leases {
+				if lease.Address == addr.String() {
+					bound = true
+					break
+				}
+			}
+			if bound {
+				continue
+			}
+
+			lease := types.IPLease{
+				Address:  addr.String(),
+				PeerUUID: peer.UUID,
+			}
+			if pool, ok := poolForAddr(pools, addr); ok {
+				lease.Pool = pool.Name
+			}
+			err = db.BindLease(lease)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// Names of the pools created for a network's tunnel CIDRs. User created pools can't use these prefixes.
+const (
+	NetworkPoolPrefix  = "network:"
+	NetworkPool6Prefix = "network6:"
+)
+
+func NetworkPoolName(networkName string, ipv6 bool) string {
+	if ipv6 {
+		return NetworkPool6Prefix + networkName
+	}
+	return NetworkPoolPrefix + networkName
+}
+
+// Creates or updates the pools covering a network's tunnel CIDRs
+func EnsureNetworkPools(network types.Network) error {
+	err := ensureNetworkPool(network.Name, NetworkPoolName(network.Name, false), network.CIDR, "Network "+network.Name)
+	if err != nil {
+		return err
+	}
+	if network.CIDR6 != "" {
+		return ensureNetworkPool(network.Name, NetworkPoolName(network.Name, true), network.CIDR6, "Network "+network.Name+" IPv6")
+	}
+	return nil
+}
+
+func ensureNetworkPool(networkName string, name string, cidr string, description string) error {
+	pool, err := db.GetPool(name)
+	if err != nil {
+		return db.InsertPool(types.IPPool{
+			Name:        name,
+			Network:     networkName,
+			CIDR:        cidr,
+			Description: description,
+		})
+	}
+	if pool.Network != networkName {
+		return fmt.Errorf("pool %s belongs to network %s", name, pool.Network)
+	}
+	if pool.CIDR != cidr {
+		pool.CIDR = cidr
+		return db.UpdatePool(pool)
+	}
+	return nil
+}
+
+// Returns true for the pools created by EnsureNetworkPools
+func isNetworkPool(pool types.IPPool) bool {
+	return pool.Name == NetworkPoolName(pool.Network, false) || pool.Name == NetworkPoolName(pool.Network, true)
+}
+
+// Allocates a free address from the named pool and holds it for the peer for LeaseTime
+func AllocateAddress(networkName string, poolName string, peerUUID string) (types.IPLease, error) {
+	ipamMutex.Lock()
+	defer ipamMutex.Unlock()
+
+	pool, err := db.GetPool(poolName)
+	if err != nil {
+		return types.IPLease{}, fmt.Errorf("pool %s not found", poolName)
+	}
+	if pool.Network != networkName {
+		return types.IPLease{}, fmt.Errorf("pool %s does not belong to network %s", poolName, networkName)
+	}
+
+	pools, reservations, leases, err := loadIPAMState()
+	if err != nil {
+		return types.IPLease{}, err
+	}
+
+	prefix, err := netip.ParsePrefix(pool.CIDR)
+	if err != nil {
+		return types.IPLease{}, err
+	}
+	first, last := poolBounds(prefix)
+
+	// A static assignment for this peer within the pool, or a pool nested in it, takes precedence
+	var addr netip.Addr
+	for _, r := range reservations {
+		if r.Type != ReservationStatic || r.PeerUUID != peerUUID {
+			continue
+		}
+		static, err := netip.ParseAddr(r.StartAddress)
+		if err == nil && prefix.Contains(static) {
+			addr = static
+			break
+		}
+	}
+
+	if !addr.IsValid() {
+		// Collect addresses in use within this pool
+		used := map[netip.Addr]bool{}
+		for _, lease := range leases {
+			a, err := netip.ParseAddr(lease.Address)
+			if err == nil && prefix.Contains(a) {
+				used[a] = true
+			}
+		}
+
+		// Find the next free address after the pool cursor
+		start, ok := poolCursors[pool.Name]
+		if !ok || start.Compare(first) < 0 || start.Compare(last) > 0 {
+			start = first
+		}
+		addr, err = nextFreeAddress(first, last, start, blockedRanges(pool, pools, reservations), used)
+		if err != nil {
+			return types.IPLease{}, fmt.Errorf("pool %s: %w", pool.Name, err)
+		}
+		poolCursors[pool.Name] = addr.Next()
+	}
+
+	lease := types.IPLease{
+		Address:           addr.String(),
+		Pool:              pool.Name,
+		PeerUUID:          peerUUID,
+		ExpiresUnixMillis: time.Now().Add(LeaseTime).UnixMilli(),
+	}
+	err = db.UpsertLease(lease)
+	if err != nil {
+		return types.IPLease{}, err
+	}
+
+	return lease, nil
+}
+
+// Checks an address can be bound to a peer. Fails if the address is outside the peer's network,
+// excluded, assigned to another peer or held by another peer's pending lease.
+func checkAddress(address string, networkName string, peerUUID string, pools []types.IPPool, reservations []types.IPReservation, leases []types.IPLease) (types.IPLease, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return types.IPLease{}, fmt.Errorf("invalid tunnel address %q", address)
+	}
+
+	// Find the pool the address belongs to
+	pool, ok := poolForAddr(pools, addr)
+	if !ok {
+		return types.IPLease{}, fmt.Errorf("%s is not within any address pool", address)
+	}
+	if pool.Network != networkName {
+		return types.IPLease{}, fmt.Errorf("%s is not within network %s", address, networkName)
+	}
+	prefix, _ := netip.ParsePrefix(pool.CIDR)
+	first, last := poolBounds(prefix)
+	if addr.Compare(first) < 0 || addr.Compare(last) > 0 {
+		return types.IPLease{}, fmt.Errorf("%s is not a usable address in pool %s", address, pool.Name)
+	}
+
+	// The server's own addresses are never assignable
+	for _, serverAddr := range serverAddresses() {
+		if serverAddr == addr {
+			return types.IPLease{}, fmt.Errorf("%s: %w", address, ErrAddressInUse)
+		}
+	}
+
+	// Check reservations covering the address
+	for _, r := range reservations {
+		rng, err := parseRange(r.StartAddress, r.EndAddress)
+		if err != nil || !rng.Contains(addr) {
+			continue
+		}
+		switch r.Type {
+		case ReservationExcluded:
+			return types.IPLease{}, fmt.Errorf("%s is excluded from assignment", address)
+		case ReservationStatic:
+			if r.PeerUUID != peerUUID {
+				return types.IPLease{}, fmt.Errorf("%s is statically assigned to another peer: %w", address, ErrAddressInUse)
+			}
+		}
+	}
+
+	// Check for leases held by other peers
+	for _, lease := range leases {
+		if lease.Address == addr.String() && lease.PeerUUID != peerUUID {
+			return types.IPLease{}, fmt.Errorf("%s: %w", address, ErrAddressInUse)
+		}
+	}
+
+	return types.IPLease{
+		Address:  addr.String(),
+		Pool:     pool.Name,
+		PeerUUID: peerUUID,
+	}, nil
+}
+
+// Binds the IPv4 and, when set, IPv6 tunnel addresses of a peer and releases any other
+// address it held. Either both addresses are bound or nothing changes. Returns the leases
+// the peer held before, for RestoreAddresses to put back if the peer can't be saved.
+func ClaimPeerAddresses(peer types.Peer) ([]types.IPLease, error) {
+	addr, err := netip.ParseAddr(peer.RemoteTunAddress)
+	if err != nil || !addr.Is4() {
+		return nil, fmt.Errorf("invalid tunnel address %q", peer.RemoteTunAddress)
+	}
+	if peer.RemoteTunAddress6 != "" {
+		addr, err = netip.ParseAddr(peer.RemoteTunAddress6)
+		if err != nil || !addr.Is6() {
+			return nil, fmt.Errorf("invalid IPv6 tunnel address %q", peer.RemoteTunAddress6)
+		}
+	}
+
+	ipamMutex.Lock()
+	defer ipamMutex.Unlock()
+
+	pools, reservations, leases, err := loadIPAMState()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check every address before binding any of them
+	var claimed []types.IPLease
+	for _, address := range []string{peer.RemoteTunAddress, peer.RemoteTunAddress6} {
+		if address == "" {
+			continue
+		}
+		lease, err := checkAddress(address, PeerNetworkName(peer), peer.UUID, pools, reservations, leases)
+		if err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, lease)
+	}
+
+	var previous []types.IPLease
+	for _, lease := range leases {
+		if lease.PeerUUID == peer.UUID {
+			previous = append(previous, lease)
+		}
+	}
+
+	err = db.ReplacePeerLeases(peer.UUID, claimed)
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// Puts back the leases a peer held before ClaimPeerAddresses
+func RestoreAddresses(peerUUID string, leases []types.IPLease) error {
+	ipamMutex.Lock()
+	defer ipamMutex.Unlock()
+
+	return db.ReplacePeerLeases(peerUUID, leases)
+}
+
+// Releases all addresses held by a peer
+func ReleaseAddresses(peerUUID string) error {
+	ipamMutex.Lock()
+	defer ipamMutex.Unlock()
+
+	return db.DeletePeerLeases(peerUUID)
+}
+
+func GetPoolUtilization() ([]types.IPPoolUtilization, error) {
+	pools, reservations, leases, err := loadIPAMState()
+	if err != nil {
+		return nil, err
+	}
+
+	var utilization []types.IPPoolUtilization
+	for _, pool := range pools {
+		prefix, err := netip.ParsePrefix(pool.CIDR)
+		if err != nil {
+			continue
+		}
+		first, last := poolBounds(prefix)
+
+		// Addresses in nested pools are counted against those pools
+		total := rangeSize(addrRange{first, last})
+		children := childPrefixes(pool, pools)
+		for _, child := range children {
+			total.Sub(total, rangeSize(prefixRange(child)))
+		}
+		owns := func(addr netip.Addr) bool {
+			if addr.Compare(first) < 0 || addr.Compare(last) > 0 {
+				return false
+			}
+			for _, child := range children {
+				if child.Contains(addr) {
+					return false
+				}
+			}
+			return true
+		}
+
+		u := types.IPPoolUtilization{
+			Name:  pool.Name,
+			CIDR:  pool.CIDR,
+			Total: saturateUint64(total),
+		}
+
+		// Count leases
+		var leased []netip.Addr
+		for _, lease := range leases {
+			addr, err := netip.ParseAddr(lease.Address)
+			if err != nil || !owns(addr) {
+				continue
+			}
+			if lease.ExpiresUnixMillis == 0 {
+				u.Used++
+			} else {
+				u.Leased++
+			}
+			leased = append(leased, addr)
+		}
+
+		// Count reserved addresses that are not already leased
+		reserved := big.NewInt(0)
+		for _, r := range reservations {
+			if r.Pool != pool.Name {
+				continue
+			}
+			rng, err := parseRange(r.StartAddress, r.EndAddress)
+			if err != nil {
+				continue
+			}
+			reserved.Add(reserved, rangeSize(rng))
+			for _, addr := range leased {
+				if rng.Contains(addr) {
+					reserved.Sub(reserved, big.NewInt(1))
+				}
+			}
+		}
+		for _, serverAddr := range serverAddresses() {
+			if owns(serverAddr) {
+				reserved.Add(reserved, big.NewInt(1))
+			}
+		}
+		u.Reserved = saturateUint64(reserved)
+
+		free := new(big.Int).Set(total)
+		free.Sub(free, new(big.Int).SetUint64(u.Used+u.Leased))
+		free.Sub(free, reserved)
+		if free.Sign() > 0 {
+			u.Free = saturateUint64(free)
+		}
+
+		utilization = append(utilization, u)
+	}
+
+	return utilization, nil
+}
+
+func ValidatePool(pool types.IPPool) error {
+	if pool.Name == "" {
+		return errors.New("pool name is required")
+	}
+
+	prefix, err := netip.ParsePrefix(pool.CIDR)
+	if err != nil {
+		return fmt.Errorf("invalid pool CIDR %q", pool.CIDR)
+	}
+	if prefix != prefix.Masked() {
+		return fmt.Errorf("pool CIDR %s has host bits set", pool.CIDR)
+	}
+
+	// Pools must be routed to their network's wireguard interface
+	network, err := db.GetNetwork(pool.Network)
+	if err != nil {
+		return fmt.Errorf("network %s not found", pool.Network)
+	}
+	networkCIDR := network.CIDR
+	if prefix.Addr().Is6() {
+		networkCIDR = network.CIDR6
+	}
+	server, err := netip.ParsePrefix(networkCIDR)
+	if err != nil {
+		return fmt.Errorf("pool CIDR %s does not match the address family of network %s", pool.CIDR, network.Name)
+	}
+	if !server.Contains(prefix.Addr()) || prefix.Bits() < server.Bits() {
+		return fmt.Errorf("pool CIDR %s is not within network %s (%s)", pool.CIDR, network.Name, networkCIDR)
+	}
+
+	// Pools may be nested but not duplicated
+	pools, err := db.GetPools()
+	if err != nil {
+		return err
+	}
+	for _, p := range pools {
+		if p.Name != pool.Name && p.CIDR == prefix.String() {
+			return fmt.Errorf("pool %s already uses %s", p.Name, pool.CIDR)
+		}
+	}
+
+	return nil
+}
+
+func ValidateReservation(r *types.IPReservation) error {
+	pool, err := db.GetPool(r.Pool)
+	if err != nil {
+		return fmt.Errorf("pool %s not found", r.Pool)
+	}
+	prefix, err := netip.ParsePrefix(pool.CIDR)
+	if err != nil {
+		return err
+	}
+
+	if r.EndAddress == "" {
+		r.EndAddress = r.StartAddress
+	}
+	rng, err := parseRange(r.StartAddress, r.EndAddress)
+	if err != nil {
+		return err
+	}
+	if !prefix.Contains(rng.Start) || !prefix.Contains(rng.End) {
+		return fmt.Errorf("range %s-%s is not within pool %s", r.StartAddress, r.EndAddress, pool.Name)
+	}
+
+	switch r.Type {
+	case ReservationReserved, ReservationExcluded:
+	case ReservationStatic:
+		if r.PeerUUID == "" {
+			return errors.New("static assignments require a peerUUID")
+		}
+		if rng.Start != rng.End {
+			return errors.New("static assignments must be a single address")
+		}
+	default:
+		return fmt.Errorf("invalid reservation type %q", r.Type)
+	}
+
+	// Addresses leased to a peer can only be assigned to that peer
+	leases, err := db.GetActiveLeases()
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases {
+		addr, err := netip.ParseAddr(lease.Address)
+		if err != nil || !rng.Contains(addr) {
+			continue
+		}
+		if lease.PeerUUID != r.PeerUUID {
+			return fmt.Errorf("%s is leased to another peer: %w", lease.Address, ErrAddressInUse)
+		}
+	}
+
+	return nil
+}
+
+func loadIPAMState() ([]types.IPPool, []types.IPReservation, []types.IPLease, error) {
+	pools, err := db.GetPools()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reservations, err := db.GetReservations()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	leases, err := db.GetActiveLeases()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return pools, reservations, leases, nil
+}
+
+// Walks the pool from start, skipping blocked ranges and used addresses, wrapping once
+func nextFreeAddress(first, last, start netip.Addr, blocked []addrRange, used map[netip.Addr]bool) (netip.Addr, error) {
+	addr := start
+	wrapped := false
+	for {
+		skipped := false
+		for _, r := range blocked {
+			if r.Contains(addr) {
+				addr = r.End.Next()
+				skipped = true
+				break
+			}
+		}
+		if !skipped {
+			if !used[addr] {
+				return addr, nil
+			}
+			addr = addr.Next()
+		}
+
+		if !addr.IsValid() || addr.Compare(last) > 0 {
+			if wrapped {
+				return netip.Addr{}, errors.New("no free addresses")
+			}
+			wrapped = true
+			addr = first
+		}
+		if wrapped && addr.Compare(start) >= 0 {
+			return netip.Addr{}, errors.New("no free addresses")
+		}
+	}
+}
+
+// Ranges the allocator must skip in a pool: reservations, nested pools and the server address
+func blockedRanges(pool types.IPPool, pools []types.IPPool, reservations []types.IPReservation) []addrRange {
+	var blocked []addrRange
+	for _, r := range reservations {
+		if r.Pool != pool.Name {
+			continue
+		}
+		rng, err := parseRange(r.StartAddress, r.EndAddress)
+		if err == nil {
+			blocked = append(blocked, rng)
+		}
+	}
+	for _, child := range childPrefixes(pool, pools) {
+		blocked = append(blocked, prefixRange(child))
+	}
+	for _, serverAddr := range serverAddresses() {
+		blocked = append(blocked, addrRange{serverAddr, serverAddr})
+	}
+	return blocked
+}
+
+// Returns the server's own tunnel addresses in every network
+func serverAddresses() []netip.Addr {
+	networks, err := db.GetNetworks()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	var addrs []netip.Addr
+	for _, network := range networks {
+		for _, address := range []string{network.ServerAddress, network.ServerAddress6} {
+			addr, err := netip.ParseAddr(strings.Split(address, "/")[0])
+			if err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// Returns the outermost pools nested inside the given pool
+func childPrefixes(pool types.IPPool, pools []types.IPPool) []netip.Prefix {
+	parent, err := netip.ParsePrefix(pool.CIDR)
+	if err != nil {
+		return nil
+	}
+
+	var nested []netip.Prefix
+	for _, p := range pools {
+		prefix, err := netip.ParsePrefix(p.CIDR)
+		if err != nil || p.Name == pool.Name {
+			continue
+		}
+		if parent.Contains(prefix.Addr()) && prefix.Bits() > parent.Bits() {
+			nested = append(nested, prefix)
+		}
+	}
+
+	var outermost []netip.Prefix
+	for _, a := range nested {
+		inner := false
+		for _, b := range nested {
+			if a != b && b.Contains(a.Addr()) && b.Bits() < a.Bits() {
+				inner = true
+				break
+			}
+		}
+		if !inner {
+			outermost = append(outermost, a)
+		}
+	}
+	return outermost
+}
+
+// Returns the most specific pool containing the address
+func poolForAddr(pools []types.IPPool, addr netip.Addr) (types.IPPool, bool) {
+	var best types.IPPool
+	bestBits := -1
+	for _, pool := range pools {
+		prefix, err := netip.ParsePrefix(pool.CIDR)
+		if err != nil {
+			continue
+		}
+		if prefix.Contains(addr) && prefix.Bits() > bestBits {
+			best = pool
+			bestBits = prefix.Bits()
+		}
+	}
+	return best, bestBits >= 0
+}
+
+// Returns the first and last assignable addresses of a prefix
+func poolBounds(prefix netip.Prefix) (first, last netip.Addr) {
+	rng := prefixRange(prefix)
+	first, last = rng.Start, rng.End
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if prefix.Addr().Is4() && hostBits > 1 {
+		// Skip the network and broadcast addresses
+		return first.Next(), last.Prev()
+	}
+	if prefix.Addr().Is6() && hostBits > 1 {
+		// Skip the subnet-router anycast address
+		return first.Next(), last
+	}
+	return first, last
+}
+
+func prefixRange(prefix netip.Prefix) addrRange {
+	prefix = prefix.Masked()
+	bytes := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 1 << (7 - uint(i%8))
+	}
+	last, _ := netip.AddrFromSlice(bytes)
+	return addrRange{prefix.Addr(), last}
+}
+
+func parseRange(start string, end string) (addrRange, error) {
+	s, err := netip.ParseAddr(start)
+	if err != nil {
+		return addrRange{}, fmt.Errorf("invalid address %q", start)
+	}
+	if end == "" {
+		return addrRange{s, s}, nil
+	}
+	e, err := netip.ParseAddr(end)
+	if err != nil {
+		return addrRange{}, fmt.Errorf("invalid address %q", end)
+	}
+	if s.BitLen() != e.BitLen() || e.Compare(s) < 0 {
+		return addrRange{}, fmt.Errorf("invalid range %s-%s", start, end)
+	}
+	return addrRange{s, e}, nil
+}
+
+func rangeSize(r addrRange) *big.Int {
+	start := new(big.Int).SetBytes(r.Start.AsSlice())
+	end := new(big.Int).SetBytes(r.End.AsSlice())
+	size := end.Sub(end, start)
+	return size.Add(size, big.NewInt(1))
+}
+
+func saturateUint64(n *big.Int) uint64 {
+	if n.Sign() < 0 {
+		return 0
+	}
+	if !n.IsUint64() {
+		return math.MaxUint64
+	}
+	return n.Uint64()
+}
+
+func GET_Pools(c *gin.Context) {
+	pools, err := db.GetPools()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, pools)
+}
+
+func PUT_Pool(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	// Parse the pool request body
+	var pool types.IPPool
+	err := c.BindJSON(&pool)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	pool.Name = name
+	if pool.Network == "" {
+		pool.Network = DefaultNetworkName
+	}
+
+	// Network pools are only created by their network
+	if strings.HasPrefix(pool.Name, NetworkPoolPrefix) || strings.HasPrefix(pool.Name, NetworkPool6Prefix) {
+		c.JSON(400, gin.H{
+			"error": "pool names starting with " + NetworkPoolPrefix + " or " + NetworkPool6Prefix + " are reserved",
+		})
+		return
+	}
+
+	err = ValidatePool(pool)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = db.InsertPool(pool)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func PATCH_Pool(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	// Parse the pool request body
+	var patch types.IPPool
+	err := c.BindJSON(&patch)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Hold allocations while the pool's leases are checked
+	ipamMutex.Lock()
+	defer ipamMutex.Unlock()
+
+	pool, err := db.GetPool(name)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+
+	if patch.CIDR != pool.CIDR {
+		// Network pools always follow the network CIDRs
+		if isNetworkPool(pool) {
+			c.JSON(400, gin.H{
+				"error": "network pool CIDRs are set by their network",
+			})
+			return
+		}
+
+		// Refuse to move pools with addresses in use
+		leases, err := db.GetActiveLeases()
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		for _, lease := range leases {
+			if lease.Pool == name {
+				c.JSON(409, gin.H{
+					"error": "pool has addresses in use",
+				})
+				return
+			}
+		}
+	}
+	pool.CIDR = patch.CIDR
+	pool.Description = patch.Description
+
+	err = ValidatePool(pool)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = db.UpdatePool(pool)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_Pool(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	// Hold allocations while the pool's leases are checked
+	ipamMutex.Lock()
+	defer ipamMutex.Unlock()
+
+	pool, err := db.GetPool(name)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+
+	if isNetworkPool(pool) {
+		c.JSON(400, gin.H{
+			"error": "cannot delete a network pool",
+		})
+		return
+	}
+
+	// Refuse to delete pools with addresses in use
+	leases, err := db.GetActiveLeases()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	for _, lease := range leases {
+		if lease.Pool == name {
+			c.JSON(409, gin.H{
+				"error": "pool has addresses in use",
+			})
+			return
+		}
+	}
+
+	err = db.DeletePool(name)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func GET_Reservations(c *gin.Context) {
+	reservations, err := db.GetReservations()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, reservations)
+}
+
+func PUT_Reservation(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	// Parse the reservation request body
+	var reservation types.IPReservation
+	err := c.BindJSON(&reservation)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	reservation.UUID = uuid
+
+	// Hold allocations while the reservation is checked and stored
+	ipamMutex.Lock()
+	defer ipamMutex.Unlock()
+
+	err = ValidateReservation(&reservation)
+	if errors.Is(err, ErrAddressInUse) {
+		c.JSON(409, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = db.InsertReservation(reservation)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_Reservation(c *gin.Context) {
+	uuid := c.Param("uuid")
+	if uuid == "" {
+		c.JSON(400, gin.H{
+			"error": "uuid is required",
+		})
+		return
+	}
+
+	// Hold allocations while the reservation is removed
+	ipamMutex.Lock()
+	defer ipamMutex.Unlock()
+
+	err := db.DeleteReservation(uuid)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func GET_Leases(c *gin.Context) {
+	leases, err := db.GetActiveLeases()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, leases)
+}
+
+func GET_PoolUtilization(c *gin.Context) {
+	utilization, err := GetPoolUtilization()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, utilization)
+}
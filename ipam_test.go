@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Opens an empty database in a temporary directory with a dual-stack network "wg0"
+func newTestIPAM(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db.InitDB(make([]byte, 32))
+	network := types.Network{
+		Name:           "wg0",
+		CIDR:           "10.0.0.0/24",
+		CIDR6:          "fd00::/64",
+		ServerAddress:  "10.0.0.1/24",
+		ServerAddress6: "fd00::1/64",
+	}
+	err = db.InsertNetwork(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = EnsureNetworkPools(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poolCursors = map[string]netip.Addr{}
+}
+
+// Returns the addresses leased to a peer
+func peerLeases(t *testing.T, peerUUID string) []string {
+	t.Helper()
+	leases, err := db.GetActiveLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := []string{}
+	for _, lease := range leases {
+		if lease.PeerUUID == peerUUID {
+			addresses = append(addresses, lease.Address)
+		}
+	}
+	slices.Sort(addresses)
+	return addresses
+}
+
+func TestPoolBounds(t *testing.T) {
+	tests := []struct {
+		prefix string
+		first  string
+		last   string
+	}{
+		{"10.0.0.0/24", "10.0.0.1", "10.0.0.254"},
+		{"10.0.0.0/30", "10.0.0.1", "10.0.0.2"},
+		{"10.0.0.0/31", "10.0.0.0", "10.0.0.1"},
+		{"10.0.0.5/32", "10.0.0.5", "10.0.0.5"},
+		{"fd00::/64", "fd00::1", "fd00::ffff:ffff:ffff:ffff"},
+		{"fd00::/127", "fd00::", "fd00::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			first, last := poolBounds(netip.MustParsePrefix(tt.prefix))
+			if first.String() != tt.first || last.String() != tt.last {
+				t.Errorf("poolBounds(%s) = %s, %s, want %s, %s", tt.prefix, first, last, tt.first, tt.last)
+			}
+		})
+	}
+}
+
+func TestNextFreeAddress(t *testing.T) {
+	addr := netip.MustParseAddr
+	tests := []struct {
+		name    string
+		first   string
+		last    string
+		start   string
+		blocked []addrRange
+		used    []string
+		want    string
+	}{
+		{"first address", "10.0.0.1", "10.0.0.254", "10.0.0.1", nil, nil, "10.0.0.1"},
+		{"from the cursor", "10.0.0.1", "10.0.0.254", "10.0.0.10", nil, nil, "10.0.0.10"},
+		{"skips used", "10.0.0.1", "10.0.0.254", "10.0.0.1", nil, []string{"10.0.0.1", "10.0.0.2"}, "10.0.0.3"},
+		{"skips blocked", "10.0.0.1", "10.0.0.254", "10.0.0.1", []addrRange{{addr("10.0.0.1"), addr("10.0.0.9")}}, nil, "10.0.0.10"},
+		{"skips blocked then used", "10.0.0.1", "10.0.0.254", "10.0.0.1", []addrRange{{addr("10.0.0.1"), addr("10.0.0.4")}}, []string{"10.0.0.5"}, "10.0.0.6"},
+		{"wraps to the start", "10.0.0.1", "10.0.0.6", "10.0.0.5", nil, []string{"10.0.0.5", "10.0.0.6"}, "10.0.0.1"},
+		{"wraps past a block at the end", "10.0.0.1", "10.0.0.6", "10.0.0.5", []addrRange{{addr("10.0.0.5"), addr("10.0.0.6")}}, nil, "10.0.0.1"},
+		{"full", "10.0.0.1", "10.0.0.3", "10.0.0.2", nil, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ""},
+		{"fully blocked", "10.0.0.1", "10.0.0.3", "10.0.0.1", []addrRange{{addr("10.0.0.1"), addr("10.0.0.3")}}, nil, ""},
+		{"IPv6", "fd00::1", "fd00::ffff", "fd00::1", nil, []string{"fd00::1"}, "fd00::2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := map[netip.Addr]bool{}
+			for _, u := range tt.used {
+				used[addr(u)] = true
+			}
+			got, err := nextFreeAddress(addr(tt.first), addr(tt.last), addr(tt.start), tt.blocked, used)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("nextFreeAddress() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil || got.String() != tt.want {
+				t.Errorf("nextFreeAddress() = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChildPrefixes(t *testing.T) {
+	pools := []types.IPPool{
+		{Name: "net", CIDR: "10.0.0.0/16"},
+		{Name: "servers", CIDR: "10.0.1.0/24"},
+		{Name: "db", CIDR: "10.0.1.0/28"},
+		{Name: "clients", CIDR: "10.0.2.0/24"},
+		{Name: "other", CIDR: "10.1.0.0/24"},
+	}
+	tests := []struct {
+		pool string
+		want []netip.Prefix
+	}{
+		{"net", []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24"), netip.MustParsePrefix("10.0.2.0/24")}},
+		{"servers", []netip.Prefix{netip.MustParsePrefix("10.0.1.0/28")}},
+		{"db", nil},
+		{"other", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pool, func(t *testing.T) {
+			var pool types.IPPool
+			for _, p := range pools {
+				if p.Name == tt.pool {
+					pool = p
+				}
+			}
+			if got := childPrefixes(pool, pools); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("childPrefixes(%s) = %v, want %v", tt.pool, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolForAddr(t *testing.T) {
+	pools := []types.IPPool{
+		{Name: "net", CIDR: "10.0.0.0/16"},
+		{Name: "servers", CIDR: "10.0.1.0/24"},
+		{Name: "net6", CIDR: "fd00::/64"},
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.0.0.5", "net"},
+		{"10.0.1.5", "servers"},
+		{"fd00::5", "net6"},
+		{"10.1.0.1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			pool, ok := poolForAddr(pools, netip.MustParseAddr(tt.addr))
+			if pool.Name != tt.want || ok != (tt.want != "") {
+				t.Errorf("poolForAddr(%s) = %s, %v, want %s", tt.addr, pool.Name, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateAddress(t *testing.T) {
+	newTestIPAM(t)
+	pool := NetworkPoolName("wg0", false)
+	pool6 := NetworkPoolName("wg0", true)
+
+	err := db.InsertReservation(types.IPReservation{UUID: "r1", Pool: pool, Type: ReservationExcluded, StartAddress: "10.0.0.3", EndAddress: "10.0.0.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.InsertReservation(types.IPReservation{UUID: "r2", Pool: pool, Type: ReservationStatic, StartAddress: "10.0.0.100", PeerUUID: "static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pool    string
+		network string
+		peer    string
+		want    string
+		wantErr bool
+	}{
+		{"skips the server address", pool, "wg0", "a", "10.0.0.2", false},
+		{"skips excluded addresses", pool, "wg0", "b", "10.0.0.5", false},
+		{"static assignment", pool, "wg0", "static", "10.0.0.100", false},
+		{"continues after the cursor", pool, "wg0", "c", "10.0.0.6", false},
+		{"IPv6 pool", pool6, "wg0", "a", "fd00::2", false},
+		{"unknown pool", "missing", "wg0", "d", "", true},
+		{"pool of another network", pool, "wg1", "d", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lease, err := AllocateAddress(tt.network, tt.pool, tt.peer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AllocateAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (lease.Address != tt.want || lease.Pool != tt.pool || lease.ExpiresUnixMillis == 0) {
+				t.Errorf("AllocateAddress() = %+v, want %s from %s with an expiry", lease, tt.want, tt.pool)
+			}
+		})
+	}
+}
+
+func TestValidateReservation(t *testing.T) {
+	newTestIPAM(t)
+	pool := NetworkPoolName("wg0", false)
+
+	// A peer bound to 10.0.0.10 and a pending init holding 10.0.0.2
+	_, err := ClaimPeerAddresses(types.Peer{UUID: "a", Network: "wg0", RemoteTunAddress: "10.0.0.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = AllocateAddress("wg0", pool, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		r       types.IPReservation
+		wantErr bool
+		inUse   bool
+	}{
+		{"static for the leased peer", types.IPReservation{Pool: pool, Type: ReservationStatic, StartAddress: "10.0.0.10", PeerUUID: "a"}, false, false},
+		{"static for another peer", types.IPReservation{Pool: pool, Type: ReservationStatic, StartAddress: "10.0.0.10", PeerUUID: "c"}, true, true},
+		{"static on a pending lease", types.IPReservation{Pool: pool, Type: ReservationStatic, StartAddress: "10.0.0.2", PeerUUID: "c"}, true, true},
+		{"excluded range over a lease", types.IPReservation{Pool: pool, Type: ReservationExcluded, StartAddress: "10.0.0.5", EndAddress: "10.0.0.20"}, true, true},
+		{"reserved free address", types.IPReservation{Pool: pool, Type: ReservationReserved, StartAddress: "10.0.0.50"}, false, false},
+		{"static range", types.IPReservation{Pool: pool, Type: ReservationStatic, StartAddress: "10.0.0.50", EndAddress: "10.0.0.51", PeerUUID: "c"}, true, false},
+		{"outside the pool", types.IPReservation{Pool: pool, Type: ReservationReserved, StartAddress: "10.9.0.1"}, true, false},
+		{"unknown pool", types.IPReservation{Pool: "missing", Type: ReservationReserved, StartAddress: "10.0.0.50"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateReservation(&tt.r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateReservation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrAddressInUse) != tt.inUse {
+				t.Errorf("ValidateReservation() error = %v, in use %v", err, tt.inUse)
+			}
+		})
+	}
+}
+
+func TestClaimPeerAddresses(t *testing.T) {
+	newTestIPAM(t)
+
+	_, err := AllocateAddress("wg0", NetworkPoolName("wg0", false), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := types.Peer{UUID: "a", Network: "wg0", RemoteTunAddress: "10.0.0.10", RemoteTunAddress6: "fd00::10"}
+	_, err = ClaimPeerAddresses(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := peerLeases(t, "a"); !reflect.DeepEqual(got, []string{"10.0.0.10", "fd00::10"}) {
+		t.Fatalf("leases after claim = %v", got)
+	}
+
+	tests := []struct {
+		name    string
+		addr    string
+		addr6   string
+		wantErr bool
+		inUse   bool
+		want    []string
+	}{
+		{"IPv6 server address leaves both unchanged", "10.0.0.11", "fd00::1", true, true, []string{"10.0.0.10", "fd00::10"}},
+		{"IPv4 held by another peer", "10.0.0.2", "", true, true, []string{"10.0.0.10", "fd00::10"}},
+		{"outside the network", "10.9.0.1", "", true, false, []string{"10.0.0.10", "fd00::10"}},
+		{"IPv6 address as IPv4", "fd00::11", "", true, false, []string{"10.0.0.10", "fd00::10"}},
+		{"moves both addresses", "10.0.0.11", "fd00::11", false, false, []string{"10.0.0.11", "fd00::11"}},
+		{"clearing IPv6 releases it", "10.0.0.11", "", false, false, []string{"10.0.0.11"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer.RemoteTunAddress = tt.addr
+			peer.RemoteTunAddress6 = tt.addr6
+			_, err := ClaimPeerAddresses(peer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ClaimPeerAddresses() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.inUse && !errors.Is(err, ErrAddressInUse) {
+				t.Errorf("ClaimPeerAddresses() error = %v, want %v", err, ErrAddressInUse)
+			}
+			if got := peerLeases(t, "a"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("leases = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreAddresses(t *testing.T) {
+	newTestIPAM(t)
+
+	peer := types.Peer{UUID: "a", Network: "wg0", RemoteTunAddress: "10.0.0.10", RemoteTunAddress6: "fd00::10"}
+	_, err := ClaimPeerAddresses(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer.RemoteTunAddress = "10.0.0.20"
+	peer.RemoteTunAddress6 = ""
+	previous, err := ClaimPeerAddresses(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := peerLeases(t, "a"); !reflect.DeepEqual(got, []string{"10.0.0.20"}) {
+		t.Fatalf("leases after claim = %v", got)
+	}
+
+	err = RestoreAddresses(peer.UUID, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := peerLeases(t, "a"); !reflect.DeepEqual(got, []string{"10.0.0.10", "fd00::10"}) {
+		t.Errorf("leases after restore = %v", got)
+	}
+}
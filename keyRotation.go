@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// How often peers are checked for due rotations
+const KeyRotationCheckInterval = 10 * time.Minute
+
+// How often an unacknowledged rotation is sent to a client again
+const KeyRotationRepushInterval = time.Hour
+
+func KeyRotationScheduler() {
+	for {
+		time.Sleep(KeyRotationCheckInterval)
+		CheckKeyRotations()
+	}
+}
+
+// Starts the rotations that are due, sends pending rotations to their clients
+// and alerts about peers that use stock clients
+func CheckKeyRotations() {
+	now := time.Now()
+
+	err := db.InitPeerRotationTimes(now.UnixMilli())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	peers, err := db.GetPeers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	rotations, err := db.GetKeyRotations()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	pending := map[string]types.KeyRotation{}
+	for _, r := range rotations {
+		pending[r.PeerUUID] = r
+	}
+
+	var stockPeers []types.Peer
+	for _, peer := range peers {
+		if !peer.Enabled {
+			continue
+		}
+
+		r, ok := pending[peer.UUID]
+		if !ok {
+			rotateKey := rotationDue(peer.KeyRotationDays, ENV.KEY_ROTATION_DAYS, peer.KeyRotatedUnixMillis, now)
+			rotatePSK := rotationDue(peer.PSKRotationDays, ENV.PSK_ROTATION_DAYS, peer.PSKRotatedUnixMillis, now)
+
+			// A key pair held by a stock client can only be replaced on the device
+			if !isManagedClient(peer) && peer.PrivateKey == "" {
+				rotateKey = false
+			}
+			if !rotateKey && !rotatePSK {
+				continue
+			}
+
+			r, err = StartKeyRotation(peer, rotateKey, rotatePSK)
+			if err != nil {
+				log.Println("Failed to start key rotation for", peer.Hostname+":", err)
+				continue
+			}
+			log.Println("Key rotation started for", peer.Hostname)
+		}
+
+		if !isManagedClient(peer) {
+			if r.AlertedUnixMillis == 0 {
+				stockPeers = append(stockPeers, peer)
+			}
+			continue
+		}
+		if now.UnixMilli()-r.PushedUnixMillis >= KeyRotationRepushInterval.Milliseconds() {
+			pushKeyRotation(peer, r)
+		}
+	}
+
+	if len(stockPeers) > 0 {
+		keyRotationAlert(stockPeers)
+		for _, peer := range stockPeers {
+			err = db.SetKeyRotationAlerted(peer.UUID, now.UnixMilli())
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// Reports whether a rotation is due. A peer's own interval of 0 falls back to the
+// server default, and an interval below 1 day disables rotation.
+func rotationDue(peerDays int, defaultDays int, rotatedUnixMillis int64, now time.Time) bool {
+	days := peerDays
+	if days == 0 {
+		days = defaultDays
+	}
+	if days <= 0 || rotatedUnixMillis == 0 {
+		return false
+	}
+	return now.Sub(time.UnixMilli(rotatedUnixMillis)) >= time.Duration(days)*24*time.Hour
+}
+
+// Managed clients report their client type and receive rotations over the
+// long poll channel. Stock WireGuard clients need their config re-downloaded.
+func isManagedClient(peer types.Peer) bool {
+	return peer.ClientType != ""
+}
+
+// Generates and stores the new key material of a rotation. A key pair held by
+// the client is generated by the client and sent back with its acknowledgement.
+func StartKeyRotation(peer types.Peer, rotateKey bool, rotatePSK bool) (types.KeyRotation, error) {
+	r := types.KeyRotation{
+		PeerUUID:          peer.UUID,
+		ID:                uuid.New().String(),
+		RotateKey:         rotateKey,
+		RotatePSK:         rotatePSK,
+		CreatedUnixMillis: time.Now().UnixMilli(),
+	}
+
+	var err error
+	if rotateKey && peer.PrivateKey != "" && !ENV.CLIENT_KEYS_ONLY {
+		r.PrivateKey, err = NewWireguardPrivateKey()
+		if err != nil {
+			return types.KeyRotation{}, err
+		}
+		r.PublicKey, err = GetWireguardPublicKey(r.PrivateKey)
+		if err != nil {
+			return types.KeyRotation{}, err
+		}
+	}
+	if rotatePSK {
+		r.PreSharedKey, err = NewWireguardPreSharedKey()
+		if err != nil {
+			return types.KeyRotation{}, err
+		}
+	}
+
+	err = db.InsertKeyRotation(r)
+	if err != nil {
+		return types.KeyRotation{}, err
+	}
+	return r, nil
+}
+
+// Returns the peer with the rotation's new key material applied
+func applyKeyRotation(peer types.Peer, r types.KeyRotation) types.Peer {
+	if r.RotateKey {
+		peer.PrivateKey = r.PrivateKey
+		peer.PublicKey = r.PublicKey
+	}
+	if r.RotatePSK {
+		peer.PreSharedKey = r.PreSharedKey
+	}
+	return peer
+}
+
+// Sends a pending rotation to the client. The client applies the new keys and
+// acknowledges with the rotation ID, generating its own key pair when the
+// "generateKey" attribute is set.
+func pushKeyRotation(peer types.Peer, r types.KeyRotation) {
+	config := applyKeyRotation(peer, r)
+	subnets, err := EffectiveAllowedSubnets(config)
+	if err != nil {
+		log.Println(err)
+	} else {
+		config.AllowedSubnets = subnets
+	}
+
+	msg := LP_Message{
+		Topic: "keyRotation",
+		Data:  r.ID,
+		Attributes: map[string]string{
+			"rotateKey":   strconv.FormatBool(r.RotateKey),
+			"rotatePsk":   strconv.FormatBool(r.RotatePSK),
+			"generateKey": strconv.FormatBool(r.RotateKey && r.PrivateKey == ""),
+		},
+		Config: config,
+	}
+	err = SendClientMessage(peer.UUID, msg)
+	if err != nil {
+		// The client is offline, try again on the next check
+		return
+	}
+
+	err = db.SetKeyRotationPushed(peer.UUID, time.Now().UnixMilli())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func keyRotationAlert(peers []types.Peer) {
+	event := "🔑 Key Rotation"
+	var b strings.Builder
+	b.WriteString("New keys are ready for these clients. Install the new config, then acknowledge the rotation:")
+	for _, peer := range peers {
+		b.WriteString("\n" + peer.Hostname + ": https://" + ENV.PUBLIC_HOST + "/api/v1/peers/" + peer.UUID + "/rotation/config")
+	}
+
+	// Send the alert to Slack
+	if ENV.SLACK_WEBHOOK != "" {
+		msg := NewSlackMessageBody(event, b.String(), "https://"+ENV.PUBLIC_HOST)
+		err := SendSlackMessage(ENV.SLACK_WEBHOOK, msg)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Removes the secrets of a rotation before it is returned by the API
+func redactKeyRotation(r types.KeyRotation) types.KeyRotation {
+	r.PrivateKey = ""
+	r.PreSharedKey = ""
+	return r
+}
+
+func GET_PeerRotation(c *gin.Context) {
+	r, err := db.GetKeyRotation(c.Param("uuid"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{
+			"error": "no pending rotation",
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, redactKeyRotation(r))
+}
+
+// Starts a rotation immediately
+func POST_PeerRotation(c *gin.Context) {
+	var req types.KeyRotationRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if !req.RotateKey && !req.RotatePSK {
+		c.JSON(400, gin.H{
+			"error": "nothing to rotate",
+		})
+		return
+	}
+
+	peer, err := db.GetPeer(c.Param("uuid"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "peer not found",
+		})
+		return
+	}
+	if req.RotateKey && !isManagedClient(peer) && peer.PrivateKey == "" {
+		c.JSON(400, gin.H{
+			"error": "the key pair of a stock client can only be replaced on the device",
+		})
+		return
+	}
+
+	_, err = db.GetKeyRotation(peer.UUID)
+	if err == nil {
+		c.JSON(409, gin.H{
+			"error": "a rotation is already pending",
+		})
+		return
+	}
+
+	r, err := StartKeyRotation(peer, req.RotateKey, req.RotatePSK)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if isManagedClient(peer) {
+		pushKeyRotation(peer, r)
+	}
+
+	log.Println("Key rotation started for", peer.Hostname, "by:", c.GetString("actor"))
+	c.JSON(200, redactKeyRotation(r))
+}
+
+func DELETE_PeerRotation(c *gin.Context) {
+	err := db.DeleteKeyRotation(c.Param("uuid"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{
+			"error": "no pending rotation",
+		})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+// Returns the client config with the pending rotation's keys, for stock clients
+func GET_PeerRotationConfig(c *gin.Context) {
+	peer, err := db.GetPeer(c.Param("uuid"))
+	if err != nil {
+		c.Status(404)
+		return
+	}
+	r, err := db.GetKeyRotation(peer.UUID)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "no pending rotation",
+		})
+		return
+	}
+
+	config, err := GenerateClientConfig(applyKeyRotation(peer, r))
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+peer.Hostname+".conf\"")
+	c.String(200, config)
+}
+
+// Applies a rotation once the client has installed the new keys
+func POST_PeerRotationAck(c *gin.Context) {
+	var ack types.KeyRotationAck
+	err := c.BindJSON(&ack)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	peer, err := db.GetPeer(c.Param("uuid"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "peer not found",
+		})
+		return
+	}
+	r, err := db.GetKeyRotation(peer.UUID)
+	if err != nil || r.ID != ack.ID {
+		c.JSON(409, gin.H{
+			"error": "no matching pending rotation",
+		})
+		return
+	}
+
+	// Take the public key of a key pair generated by the client
+	if r.RotateKey && r.PrivateKey == "" {
+		r.PublicKey = ack.PublicKey
+	}
+	rotated := applyKeyRotation(peer, r)
+	err = ValidatePeerKeys(rotated)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	var keyRotated, pskRotated int64
+	if r.RotateKey {
+		keyRotated = now
+	}
+	if r.RotatePSK {
+		pskRotated = now
+	}
+	err = db.RotatePeerKeys(peer.UUID, rotated.PrivateKey, rotated.PublicKey, rotated.PreSharedKey, keyRotated, pskRotated)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	err = db.DeleteKeyRotation(peer.UUID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Switch the server side to the new keys
+	err = SyncWireguardConfiguration()
+	if err != nil {
+		log.Println(err)
+	}
+	if r.RotateKey {
+		FanoutPeers()
+	}
+
+	log.Println("Key rotation applied for", peer.Hostname)
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
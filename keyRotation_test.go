@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotationDue(t *testing.T) {
+	now := time.Now()
+	daysAgo := func(days int) int64 {
+		return now.Add(-time.Duration(days) * 24 * time.Hour).UnixMilli()
+	}
+
+	tests := []struct {
+		name        string
+		peerDays    int
+		defaultDays int
+		rotated     int64
+		want        bool
+	}{
+		{"peer interval elapsed", 30, 90, daysAgo(30), true},
+		{"peer interval not elapsed", 30, 90, daysAgo(29), false},
+		{"falls back to the default", 0, 90, daysAgo(90), true},
+		{"default not elapsed", 0, 90, daysAgo(60), false},
+		{"peer disables rotation", -1, 90, daysAgo(365), false},
+		{"no default", 0, 0, daysAgo(365), false},
+		{"never rotated", 30, 90, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rotationDue(tt.peerDays, tt.defaultDays, tt.rotated, now); got != tt.want {
+				t.Errorf("rotationDue(%d, %d, %d) = %v, want %v", tt.peerDays, tt.defaultDays, tt.rotated, got, tt.want)
+			}
+		})
+	}
+}
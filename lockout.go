@@ -0,0 +1,256 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Failed logins allowed before an account is locked
+const MaxFailedAttempts = 5
+
+// Failed logins allowed from one IP address before it is locked
+const MaxFailedAttemptsPerIP = 20
+
+// The first lockout lasts LockoutBaseDuration, doubling with every further
+// failure up to LockoutMaxDuration
+const LockoutBaseDuration = time.Minute
+const LockoutMaxDuration = 24 * time.Hour
+
+// IP failure counters are forgotten after this long without a failure
+const IPFailureWindow = time.Hour
+
+type ipLockout struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+var ipLockouts = map[string]*ipLockout{}
+var ipLockoutsMutex sync.Mutex
+
+// Returns how long to lock for after the given number of failed attempts
+func lockoutDuration(failures int, max int) time.Duration {
+	if failures < max {
+		return 0
+	}
+	d := float64(LockoutBaseDuration) * math.Pow(2, float64(failures-max))
+	if d > float64(LockoutMaxDuration) {
+		return LockoutMaxDuration
+	}
+	return time.Duration(d)
+}
+
+// Returns the time until which logins from an IP address are refused
+func ipLockedUntil(ip string) time.Time {
+	ipLockoutsMutex.Lock()
+	defer ipLockoutsMutex.Unlock()
+	if entry, ok := ipLockouts[ip]; ok {
+		return entry.lockedUntil
+	}
+	return time.Time{}
+}
+
+// Counts a failed login from an IP address and locks it once over the limit
+func recordIPFailure(ip string) (lockedUntil time.Time) {
+	ipLockoutsMutex.Lock()
+	defer ipLockoutsMutex.Unlock()
+
+	now := time.Now()
+	entry, ok := ipLockouts[ip]
+	if !ok || now.Sub(entry.lastFailure) > IPFailureWindow {
+		entry = &ipLockout{}
+		ipLockouts[ip] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+
+	if d := lockoutDuration(entry.failures, MaxFailedAttemptsPerIP); d > 0 {
+		entry.lockedUntil = now.Add(d)
+		return entry.lockedUntil
+	}
+	return time.Time{}
+}
+
+// Counts a failed login for an account and locks it once over the limit
+func recordAccountFailure(email string) (lockedUntil time.Time, err error) {
+	failures, err := db.IncrementAccountFailedAttempts(email)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if d := lockoutDuration(failures, MaxFailedAttempts); d > 0 {
+		lockedUntil = time.Now().Add(d)
+		err = db.LockAccount(email, lockedUntil.UnixMilli())
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return lockedUntil, nil
+}
+
+// Removes expired IP counters
+func pruneIPLockouts() {
+	ipLockoutsMutex.Lock()
+	defer ipLockoutsMutex.Unlock()
+	now := time.Now()
+	for ip, entry := range ipLockouts {
+		if now.After(entry.lockedUntil) && now.Sub(entry.lastFailure) > IPFailureWindow {
+			delete(ipLockouts, ip)
+		}
+	}
+}
+
+func IPLockoutsGarbageCollector() {
+	for {
+		time.Sleep(10 * time.Minute)
+		pruneIPLockouts()
+	}
+}
+
+// Refuses a login with 429 and a Retry-After header
+func loginLockedResponse(c *gin.Context, until time.Time) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+	c.JSON(429, gin.H{
+		"error": "too many failed attempts, try again later",
+	})
+}
+
+func accountLockedAlert(subject string, ip string, until time.Time) {
+	event := "🔒 Login Locked"
+	message := subject + " is locked until " + until.Format(time.RFC1123) + " after repeated failed logins from " + ip
+
+	// Send the alert to Slack
+	if ENV.SLACK_WEBHOOK != "" {
+		msg := NewSlackMessageBody(event, message, "https://"+ENV.PUBLIC_HOST)
+		err := SendSlackMessage(ENV.SLACK_WEBHOOK, msg)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Records a failed login against the account (if it exists) and the client IP,
+// raising an alert for any new lockout
+func loginFailed(c *gin.Context, email string, accountExists bool) {
+	RecordAuditEvent(c, "auth.login_failed", email, nil, nil)
+
+	if accountExists {
+		until, err := recordAccountFailure(email)
+		if err != nil {
+			log.Println(err)
+		} else if !until.IsZero() {
+			log.Println("Account locked:", email, "until:", until)
+			RecordAuditEvent(c, "auth.lockout", email, nil, nil)
+			go accountLockedAlert(email, c.ClientIP(), until)
+		}
+	}
+
+	ipFailed(c)
+}
+
+// Counts a failed attempt from the client IP, alerting once it gets locked out
+func ipFailed(c *gin.Context) {
+	if until := recordIPFailure(c.ClientIP()); !until.IsZero() {
+		log.Println("IP locked:", c.ClientIP(), "until:", until)
+		RecordAuditEvent(c, "auth.lockout", c.ClientIP(), nil, nil)
+		go accountLockedAlert("IP "+c.ClientIP(), c.ClientIP(), until)
+	}
+}
+
+// Unlocks an account. Logged in users must be admins.
+func POST_AccountUnlock(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	email := c.Param("email")
+	_, err := db.GetAccount(email)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "account not found",
+		})
+		return
+	}
+
+	err = db.UnlockAccount(email)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	log.Println("Account unlocked:", email, "by:", c.GetString("actor"))
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+// Lists the IP addresses with failed logins. Logged in users must be admins.
+func GET_IPLockouts(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	ipLockoutsMutex.Lock()
+	lockouts := []types.IPLockout{}
+	for ip, entry := range ipLockouts {
+		lockout := types.IPLockout{
+			IP:                    ip,
+			FailedAttempts:        entry.failures,
+			LastFailureUnixMillis: entry.lastFailure.UnixMilli(),
+		}
+		if !entry.lockedUntil.IsZero() {
+			lockout.LockedUntilUnixMillis = entry.lockedUntil.UnixMilli()
+		}
+		lockouts = append(lockouts, lockout)
+	}
+	ipLockoutsMutex.Unlock()
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].IP < lockouts[j].IP
+	})
+
+	c.JSON(200, lockouts)
+}
+
+// Clears the failure counter of an IP address. Logged in users must be admins.
+func DELETE_IPLockout(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	ipLockoutsMutex.Lock()
+	delete(ipLockouts, c.Param("ip"))
+	ipLockoutsMutex.Unlock()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+// Reports whether the request may perform admin actions, responding with 403 if not.
+// API keys are authorized by their attributes instead.
+func requireAdmin(c *gin.Context) bool {
+	if c.GetString("actorType") != "user" {
+		return true
+	}
+
+	account, err := db.GetAccount(c.GetString("actor"))
+	if err != nil || account.Role != "admin" {
+		c.JSON(403, gin.H{
+			"error": "admin role required",
+		})
+		return false
+	}
+	return true
+}
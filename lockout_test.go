@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		failures int
+		max      int
+		want     time.Duration
+	}{
+		{0, 5, 0},
+		{4, 5, 0},
+		{5, 5, LockoutBaseDuration},
+		{6, 5, 2 * LockoutBaseDuration},
+		{8, 5, 8 * LockoutBaseDuration},
+		{40, 5, LockoutMaxDuration},
+		{1, 1, LockoutBaseDuration},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d of %d", tt.failures, tt.max), func(t *testing.T) {
+			if got := lockoutDuration(tt.failures, tt.max); got != tt.want {
+				t.Errorf("lockoutDuration(%d, %d) = %v, want %v", tt.failures, tt.max, got, tt.want)
+			}
+		})
+	}
+}
@@ -12,11 +12,12 @@ import (
 )
 
 type LP_Message struct {
-	Topic      string            `json:"topic"`
-	Data       string            `json:"data"`
-	Attributes map[string]string `json:"attributes"`
-	Config     types.Peer        `json:"config,omitempty"`
-	Peers      []types.Peer      `json:"peers,omitempty"`
+	Topic      string               `json:"topic"`
+	Data       string               `json:"data"`
+	Attributes map[string]string    `json:"attributes"`
+	Config     types.Peer           `json:"config,omitempty"`
+	Peers      []types.Peer         `json:"peers,omitempty"`
+	Mesh       []types.MeshEndpoint `json:"mesh,omitempty"`
 }
 
 type LP_Client struct {
@@ -27,8 +28,14 @@ type LP_Client struct {
 const ExpiryTime = 60 * time.Second
 const PollTimeout = 10 * time.Second
 
+// How long clients are given to collect queued messages during shutdown
+const DrainPeriod = 5 * time.Second
+
 var LP_Clients sync.Map // map[uuid]LP_Client
 
+// Closed when the server is shutting down
+var lpDraining = make(chan struct{})
+
 func InitLongPoll() {
 	go func() {
 		for {
@@ -71,6 +78,7 @@ func GET_LongPoll(c *gin.Context) {
 		}
 		LP_Clients.Store(uuid, lpClient)
 		lpClientInterface = lpClient
+		resetMeshSent(uuid)
 	}
 
 	// Cast the interface once to the pointer
@@ -86,11 +94,40 @@ func GET_LongPoll(c *gin.Context) {
 		lpClient.LastConsumed = time.Now()
 		c.Status(204) // Tells client to start a new poll
 		return
+	case <-lpDraining:
+		// Deliver a queued message before releasing the poll
+		select {
+		case msg := <-lpClient.Ch:
+			lpClient.LastConsumed = time.Now()
+			c.JSON(200, msg)
+		default:
+			c.Status(204)
+		}
+		return
 	case <-c.Request.Context().Done():
 		return
 	}
 }
 
+// Releases every waiting poll, then waits up to the drain period for clients
+// to collect the messages still queued for them
+func DrainLongPoll() {
+	close(lpDraining)
+
+	deadline := time.Now().Add(DrainPeriod)
+	for time.Now().Before(deadline) {
+		queued := 0
+		LP_Clients.Range(func(key, value interface{}) bool {
+			queued += len(value.(*LP_Client).Ch)
+			return true
+		})
+		if queued == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 // Sends a message to the long poll client with the given UUID
 func SendClientMessage(uuid string, msg LP_Message) error {
 	lpClient, ok := LP_Clients.Load(uuid)
@@ -102,13 +139,31 @@ func SendClientMessage(uuid string, msg LP_Message) error {
 }
 
 func PushPeerConfig(Peer types.Peer) {
+	// Include the destinations granted by group policies
+	subnets, err := EffectiveAllowedSubnets(Peer)
+	if err != nil {
+		log.Println(err)
+	} else {
+		Peer.AllowedSubnets = subnets
+	}
+
+	// Tell the client whether it routes its internet traffic through the tunnel
+	egress, err := EffectiveEgress(Peer)
+	if err != nil {
+		log.Println(err)
+	}
+
 	msg := LP_Message{
-		Topic:  "peerConfig",
+		Topic: "peerConfig",
+		Attributes: map[string]string{
+			"egress": egress,
+		},
 		Config: Peer,
 	}
 	SendClientMessage(Peer.UUID, msg)
 }
 
+// Sends every client the list of peers in its network
 func FanoutPeers() {
 	// Get peers from DB
 	peers, err := db.GetPeers()
@@ -117,14 +172,32 @@ func FanoutPeers() {
 		return
 	}
 
-	// Create new message
-	msg := LP_Message{
-		Topic: "peers",
-		Peers: peers,
+	// Group peers by network
+	networkPeers := map[string][]types.Peer{}
+	peerNetworks := map[string]string{}
+	for _, peer := range peers {
+		// Other clients only need the peer's public information
+		peer.PrivateKey = ""
+		peer.PreSharedKey = ""
+
+		network := PeerNetworkName(peer)
+		networkPeers[network] = append(networkPeers[network], peer)
+		peerNetworks[peer.UUID] = network
 	}
 
 	// Send to all clients
 	LP_Clients.Range(func(key, value interface{}) bool {
+		network, ok := peerNetworks[key.(string)]
+		if !ok {
+			return true
+		}
+
+		// Create new message
+		msg := LP_Message{
+			Topic: "peers",
+			Peers: networkPeers[network],
+		}
+
 		client := value.(*LP_Client)
 		client.Ch <- msg
 		return true
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/wg-controller/wg-controller/db"
@@ -12,6 +15,9 @@ import (
 // Version
 var IMAGE_TAG string
 
+// How long in-flight API requests are given to finish during shutdown
+const ShutdownTimeout = 15 * time.Second
+
 var ENV Env
 
 func main() {
@@ -46,18 +52,39 @@ func main() {
 	// Load environment variables
 	LoadEnvVars()
 
-	// Start wireguard
-	StartWireguard()
-	defer StopWireguard()
-
 	// Initialize the database
 	db.InitDB([]byte(ENV.DB_AES_KEY))
 
+	// Remove any server-held peer private keys
+	if ENV.CLIENT_KEYS_ONLY {
+		n, err := db.ClearPeerPrivateKeys()
+		if err != nil {
+			log.Fatal("Error removing peer private keys:", err)
+		}
+		if n > 0 {
+			log.Println("Removed", n, "server-held peer private keys")
+		}
+	}
+
+	// Initialize the default network
+	InitNetworks()
+
+	// Start wireguard
+	StartWireguard()
+
 	// Initialize the admin account
 	InitAdminAccount()
 
-	// Sleep to allow wireguard to start
-	time.Sleep(2 * time.Second)
+	// Initialize IP address management
+	InitIPAM()
+
+	// Wait for the interfaces to start
+	for iface := range WireguardBackends() {
+		err := WaitForWireguardInterface(iface)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Sync wireguard configuration
 	err := SyncWireguardConfiguration()
@@ -65,8 +92,8 @@ func main() {
 		log.Fatal("Error syncing wireguard configuration:", err)
 	}
 
-	// Init the wireguard kernel interface
-	SetWireguardInterface()
+	// Init the wireguard kernel interfaces
+	SetWireguardInterfaces()
 
 	// Init networking
 	InitNetworking()
@@ -77,7 +104,7 @@ func main() {
 	// Sync routing table
 	err = SyncRoutingTable()
 	if err != nil {
-		log.Fatal("Error syncing routing table:", err)
+		log.Println("Error syncing routing table:", err)
 	}
 
 	// Init ping monitoring
@@ -88,8 +115,46 @@ func main() {
 	// Init long polling
 	InitLongPoll()
 
+	// Init login lockout garbage collector
+	go IPLockoutsGarbageCollector()
+
+	// Start the key rotation scheduler
+	go KeyRotationScheduler()
+	go ServerKeyRotationMonitor()
+	go MeshMonitor()
+	go RouteMonitor()
+
 	// Start the API
 	StartAPI()
+
+	// Run until asked to stop
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Println("Received", sig.String()+", shutting down")
+	Shutdown()
+}
+
+// Stops serving clients and removes the network state created by the controller
+func Shutdown() {
+	// Let long poll clients collect their queued messages
+	DrainLongPoll()
+
+	// Stop the API
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	StopAPI(ctx)
+
+	// Stop DNS
+	stopDNS()
+
+	// Remove routes, NAT rules and firewall chains
+	TeardownNetworking()
+
+	// Remove the wireguard interfaces
+	StopWireguard()
+
+	log.Println("Shutdown complete")
 }
 
 // Creates the admin account as specified in the environment variables
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// How often the endpoints of mesh peers are checked for changes
+const MeshCheckInterval = 15 * time.Second
+
+// A session without a handshake for this long is considered down. WireGuard
+// renews the handshake of a session in use every 2 minutes.
+const MeshHandshakeTimeout = 3 * time.Minute
+
+// Paths between two peers of a mesh network
+const MeshDirect = "direct"
+const MeshRelayed = "relayed"
+
+var meshMutex sync.Mutex
+var meshPSKs = map[string]string{}              // Pre-shared key of each direct session, keyed by meshPairKey
+var meshSent = map[string]string{}              // Fingerprint of the endpoints last sent to each client
+var meshReports = map[string]map[string]int64{} // Direct handshakes reported by each client, keyed by the remote peer
+
+// Everything needed to decide which peers can connect directly
+type meshState struct {
+	Networks  map[string]types.Network
+	Peers     map[string]types.Peer
+	Endpoints map[string]string // Public endpoint of each peer with a recent handshake, keyed by public key
+	Protected map[string]bool   // Peers that are destinations of group policies
+	Rules     []types.ACLRule
+	ACL       aclState
+}
+
+func loadMeshState() (meshState, error) {
+	state := meshState{
+		Networks:  map[string]types.Network{},
+		Peers:     map[string]types.Peer{},
+		Endpoints: map[string]string{},
+		Protected: map[string]bool{},
+	}
+
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return state, err
+	}
+	interfaces, err := NetworkInterfaces(networks)
+	if err != nil {
+		return state, err
+	}
+	for _, network := range networks {
+		state.Networks[network.Name] = network
+		if !network.Mesh {
+			continue
+		}
+
+		// Use the endpoint of the most recent handshake across the network's interfaces
+		lastHandshake := map[string]time.Time{}
+		for _, iface := range interfaces[network.Name] {
+			device, err := wg.Device(iface)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			for _, wgPeer := range device.Peers {
+				key := wgPeer.PublicKey.String()
+				if wgPeer.Endpoint == nil || time.Since(wgPeer.LastHandshakeTime) > MeshHandshakeTimeout {
+					continue
+				}
+				if wgPeer.LastHandshakeTime.After(lastHandshake[key]) {
+					lastHandshake[key] = wgPeer.LastHandshakeTime
+					state.Endpoints[key] = wgPeer.Endpoint.String()
+				}
+			}
+		}
+	}
+
+	peers, err := db.GetPeers()
+	if err != nil {
+		return state, err
+	}
+	for _, peer := range peers {
+		state.Peers[peer.UUID] = peer
+	}
+
+	// Direct sessions bypass the server's firewall, so peers that group
+	// policies or the ACL restrict are always relayed
+	groups, err := db.GetGroups()
+	if err != nil {
+		return state, err
+	}
+	policies, err := db.GetPolicies()
+	if err != nil {
+		return state, err
+	}
+	for _, policy := range policies {
+		for _, group := range groups {
+			if group.Name != policy.DestinationGroup {
+				continue
+			}
+			for _, member := range group.Members {
+				state.Protected[member] = true
+			}
+		}
+	}
+	state.Rules, err = db.GetACLRules()
+	if err != nil {
+		return state, err
+	}
+	state.ACL, err = loadACLState()
+	if err != nil {
+		return state, err
+	}
+
+	return state, nil
+}
+
+// Returns why traffic between two peers passes through the server, or an
+// empty string when they can connect directly
+func (s meshState) restriction(a types.Peer, b types.Peer) string {
+	network, ok := s.Networks[PeerNetworkName(a)]
+	if !ok || !network.Mesh {
+		return "mesh mode is off for the network"
+	}
+	if PeerNetworkName(b) != network.Name {
+		return "peers are in different networks"
+	}
+	for _, peer := range []types.Peer{a, b} {
+		switch {
+		case !peer.Enabled:
+			return peer.Hostname + " is disabled"
+		case !isManagedClient(peer):
+			return peer.Hostname + " is not a managed client"
+		case s.Protected[peer.UUID]:
+			return peer.Hostname + " is protected by a group policy"
+		case s.Endpoints[peer.PublicKey] == "":
+			return peer.Hostname + " has no recent handshake with the server"
+		}
+	}
+	for _, pair := range [][2]types.Peer{{a, b}, {b, a}} {
+		for _, addresses := range [][2]string{
+			{pair[0].RemoteTunAddress, pair[1].RemoteTunAddress},
+			{pair[0].RemoteTunAddress6, pair[1].RemoteTunAddress6},
+		} {
+			src, err := netip.ParseAddr(addresses[0])
+			if err != nil {
+				continue
+			}
+			dst, err := netip.ParseAddr(addresses[1])
+			if err != nil {
+				continue
+			}
+			if !s.ACL.allowsAll(s.Rules, src, dst) {
+				return fmt.Sprintf("traffic from %s to %s is restricted by the ACL", pair[0].Hostname, pair[1].Hostname)
+			}
+		}
+	}
+	return ""
+}
+
+// Returns the peers a client can reach directly, sorted by UUID
+func (s meshState) endpointsFor(peer types.Peer) []types.MeshEndpoint {
+	var endpoints []types.MeshEndpoint
+	for _, remote := range s.Peers {
+		if remote.UUID == peer.UUID || s.restriction(peer, remote) != "" {
+			continue
+		}
+		allowedIPs := []string{remote.RemoteTunAddress + "/32"}
+		if remote.RemoteTunAddress6 != "" {
+			allowedIPs = append(allowedIPs, remote.RemoteTunAddress6+"/128")
+		}
+		psk, err := meshPSK(peer.UUID, remote.UUID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		endpoints = append(endpoints, types.MeshEndpoint{
+			PeerUUID:     remote.UUID,
+			PublicKey:    remote.PublicKey,
+			PreSharedKey: psk,
+			Endpoint:     s.Endpoints[remote.PublicKey],
+			AllowedIPs:   allowedIPs,
+		})
+	}
+	slices.SortFunc(endpoints, func(a, b types.MeshEndpoint) int {
+		return strings.Compare(a.PeerUUID, b.PeerUUID)
+	})
+	return endpoints
+}
+
+// Identifies the direct session of two peers regardless of their order
+func meshPairKey(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "|" + b
+}
+
+// Returns the pre-shared key of the direct session of two peers. The keys are
+// only held in memory and replaced on restart, when every client is sent its
+// endpoints again.
+func meshPSK(a string, b string) (string, error) {
+	meshMutex.Lock()
+	defer meshMutex.Unlock()
+
+	key := meshPairKey(a, b)
+	psk, ok := meshPSKs[key]
+	if !ok {
+		var err error
+		psk, err = NewWireguardPreSharedKey()
+		if err != nil {
+			return "", err
+		}
+		meshPSKs[key] = psk
+	}
+	return psk, nil
+}
+
+func MeshMonitor() {
+	for {
+		time.Sleep(MeshCheckInterval)
+		FanoutMesh()
+	}
+}
+
+// Sends every connected client the peers it can reach directly when they
+// change. The "mesh" message carries the complete set, so the client removes
+// direct sessions that are missing from it and relays that traffic through
+// the server.
+func FanoutMesh() {
+	state, err := loadMeshState()
+	if err != nil {
+		log.Println("Failed to load mesh state:", err)
+		return
+	}
+
+	LP_Clients.Range(func(key, value interface{}) bool {
+		uuid := key.(string)
+		var endpoints []types.MeshEndpoint
+		if peer, ok := state.Peers[uuid]; ok {
+			endpoints = state.endpointsFor(peer)
+		}
+
+		fingerprint := ""
+		if len(endpoints) > 0 {
+			b, _ := json.Marshal(endpoints)
+			fingerprint = string(b)
+		}
+		meshMutex.Lock()
+		changed := meshSent[uuid] != fingerprint
+		meshMutex.Unlock()
+		if !changed {
+			return true
+		}
+
+		// Don't wait on a client that isn't reading. Its last sent endpoints are
+		// kept, so the next fanout tries again.
+		msg := LP_Message{
+			Topic: "mesh",
+			Mesh:  endpoints,
+		}
+		select {
+		case value.(*LP_Client).Ch <- msg:
+			meshMutex.Lock()
+			meshSent[uuid] = fingerprint
+			meshMutex.Unlock()
+		default:
+			log.Println("Dropped mesh update for busy client", uuid)
+		}
+		return true
+	})
+}
+
+// Forgets the endpoints sent to a client, so a reconnected client is sent them again
+func resetMeshSent(uuid string) {
+	meshMutex.Lock()
+	delete(meshSent, uuid)
+	meshMutex.Unlock()
+}
+
+// Returns the path between every pair of enabled peers in a network
+func MeshLinks(network types.Network) ([]types.MeshLink, error) {
+	state, err := loadMeshState()
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []types.Peer
+	for _, peer := range state.Peers {
+		if peer.Enabled && PeerNetworkName(peer) == network.Name {
+			peers = append(peers, peer)
+		}
+	}
+	slices.SortFunc(peers, func(a, b types.Peer) int {
+		return strings.Compare(a.Hostname, b.Hostname)
+	})
+
+	meshMutex.Lock()
+	defer meshMutex.Unlock()
+
+	links := []types.MeshLink{}
+	for i, a := range peers {
+		for _, b := range peers[i+1:] {
+			link := types.MeshLink{
+				Peer:           a.UUID,
+				PeerHostname:   a.Hostname,
+				Remote:         b.UUID,
+				RemoteHostname: b.Hostname,
+				Status:         MeshRelayed,
+			}
+
+			// A handshake is seen by both peers, so a report from either side will do
+			link.LastHandshakeUnixMillis = max(meshReports[a.UUID][b.UUID], meshReports[b.UUID][a.UUID])
+			link.Reason = state.restriction(a, b)
+			if link.Reason == "" {
+				if time.Since(time.UnixMilli(link.LastHandshakeUnixMillis)) <= MeshHandshakeTimeout {
+					link.Status = MeshDirect
+				} else {
+					link.Reason = "no recent direct handshake"
+				}
+			}
+			links = append(links, link)
+		}
+	}
+
+	return links, nil
+}
+
+func GET_NetworkMesh(c *gin.Context) {
+	network, err := db.GetNetwork(c.Param("name"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "network not found",
+		})
+		return
+	}
+
+	links, err := MeshLinks(network)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, links)
+}
+
+// Records the direct sessions a client has, replacing its previous report
+func PUT_PeerMesh(c *gin.Context) {
+	var reports []types.MeshLinkReport
+	err := c.BindJSON(&reports)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	peer, err := db.GetPeer(c.Param("uuid"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "peer not found",
+		})
+		return
+	}
+
+	handshakes := map[string]int64{}
+	for _, report := range reports {
+		handshakes[report.PeerUUID] = report.LastHandshakeUnixMillis
+	}
+	meshMutex.Lock()
+	meshReports[peer.UUID] = handshakes
+	meshMutex.Unlock()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
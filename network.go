@@ -5,94 +5,16 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os/exec"
 	"runtime"
+	"strings"
 
 	"github.com/vishvananda/netlink"
 	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
 )
 
-func GetUniqueAddress(usedAddresses []string, serverNetwork string) (string, error) {
-	// Parse the network
-	_, network, err := net.ParseCIDR(serverNetwork)
-	if err != nil {
-		return "", err
-	}
-
-	// Convert the network IP to a string
-	address := network.IP.String()
-
-	// Increment the IP to the first available address
-	address, err = nextIP(address, serverNetwork)
-	if err != nil {
-		return "", err
-	}
-
-	// Loop through the addresses in the network
-	safetyCounter := 0
-	for {
-		// Check if the address is used
-		used := false
-		for _, usedAddress := range usedAddresses {
-			if address == usedAddress {
-				used = true
-				break
-			}
-		}
-
-		// Return the address if it is not used
-		if !used {
-			return address, nil
-		}
-
-		// Increment the IP
-		address, err = nextIP(address, serverNetwork)
-		if err != nil {
-			return "", err
-		}
-
-		// Ensure we don't loop forever
-		safetyCounter++
-		if safetyCounter > 1000 {
-			return "", fmt.Errorf("unable to find a unique address")
-		}
-	}
-}
-
-func nextIP(ipStr string, cidrStr string) (string, error) {
-	// Parse the CIDR
-	_, ipNet, err := net.ParseCIDR(cidrStr)
-	if err != nil {
-		return "", fmt.Errorf("invalid CIDR: %v", err)
-	}
-
-	// Parse the IP address
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return "", fmt.Errorf("invalid IP: %v", err)
-	}
-
-	// Convert the IP to a 4-byte array
-	ipBytes := ip.To4()
-	if ipBytes == nil {
-		return "", fmt.Errorf("invalid IPv4 address")
-	}
-
-	// Increment the IP address by 1 (next IP)
-	for i := 3; i >= 0; i-- {
-		ipBytes[i]++
-		if ipBytes[i] != 0 {
-			break
-		}
-	}
-
-	// Ensure the incremented IP is still within the CIDR network
-	if ipNet.Contains(ipBytes) {
-		return ipBytes.String(), nil
-	}
-	return "", fmt.Errorf("next IP is outside the CIDR range")
-}
-
 func HighestIP(networkCIDR string) (ip string, mask string, err error) {
 	// Parse the CIDR
 	_, ipNet, err := net.ParseCIDR(networkCIDR)
@@ -138,29 +60,80 @@ func GetMask(networkCIDR string) (string, error) {
 	return mask, nil
 }
 
-func SetWireguardInterface() {
+// Assigns the server addresses to a network's wireguard interface and brings it up
+func SetWireguardInterface(network types.Network) error {
 	// Set the interface IP address
-	cmd1 := exec.Command("ip", "address", "add", ENV.SERVER_ADDRESS, "dev", ENV.WG_INTERFACE)
+	cmd1 := exec.Command("ip", "address", "replace", network.ServerAddress, "dev", network.Interface)
 	err := cmd1.Run()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("%s: ip address replace: %w", network.Interface, err)
+	}
+
+	// Set the interface IPv6 address
+	if network.ServerAddress6 != "" {
+		cmd := exec.Command("ip", "-6", "address", "replace", network.ServerAddress6, "dev", network.Interface)
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("%s: ip -6 address replace: %w", network.Interface, err)
+		}
 	}
 
 	// Set the interface up
-	cmd2 := exec.Command("ip", "link", "set", "dev", ENV.WG_INTERFACE, "up")
+	cmd2 := exec.Command("ip", "link", "set", "dev", network.Interface, "up")
 	err = cmd2.Run()
+	if err != nil {
+		return fmt.Errorf("%s: ip link set up: %w", network.Interface, err)
+	}
+	return nil
+}
+
+// Sets up the wireguard interfaces of every network
+func SetWireguardInterfaces() {
+	networks, err := db.GetNetworks()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rotations, err := db.GetActiveServerKeyRotations()
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	for _, network := range networks {
+		err = SetWireguardInterface(network)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if r, ok := rotations[network.Name]; ok {
+			err = SetWireguardInterface(rotationNetwork(network, r))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 }
 
 func InitNetworking() {
-	// Create masquerade rule for everything leaving the server
-	cmd1 := exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", ENV.EGRESS_INTERFACE, "-j", "MASQUERADE")
-	err := cmd1.Run()
+	// Select the firewall backend
+	err := InitFirewall()
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Enforce the ACL, block forwarding between networks, enforce group policies and translate tunnel traffic
+	err = SyncFirewall()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Reports whether a CIDR belongs to the IPv6 family when is6 is set, or IPv4 otherwise
+func sameFamily(cidr string, is6 bool) bool {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return false
+	}
+	return prefix.Addr().Is6() == is6
 }
 
 func SyncRoutingTable() error {
@@ -170,42 +143,128 @@ func SyncRoutingTable() error {
 		return err
 	}
 
+	// A failed step does not stop the routes of the others from being added
+	var errs []error
+
 	// Cleanup old routes
 	err = CleanupRoutes()
 	if err != nil {
-		return err
+		errs = append(errs, err)
 	}
 
-	// Add new routes
+	// Route peers that migrated to a new server key through its interface
+	migrated, err := migratedPeers()
+	if err != nil {
+		errs = append(errs, err)
+	}
 	for _, peer := range peers {
-		if peer.Enabled {
-			for _, network := range peer.RemoteSubnets {
-				err = AddRoute(network, peer.RemoteTunAddress)
-				if err != nil {
-					return err
-				}
+		r, ok := migrated[peer.UUID]
+		if !ok || !peer.Enabled {
+			continue
+		}
+		addresses := []string{peer.RemoteTunAddress + "/32"}
+		if peer.RemoteTunAddress6 != "" {
+			addresses = append(addresses, peer.RemoteTunAddress6+"/128")
+		}
+		for _, address := range addresses {
+			err = AddInterfaceRoute(address, r.Interface)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("route %s to %s: %w", address, peer.Hostname, err))
 			}
 		}
 	}
 
-	return nil
+	// Route each advertised subnet through the peer selected for it. Exit
+	// peers are routed through their own tables.
+	peersByUUID := map[string]types.Peer{}
+	for _, peer := range peers {
+		peersByUUID[peer.UUID] = peer
+	}
+	routes := CompileSiteRoutes(peers)
+	routeErrs := map[string]string{}
+	for _, route := range routes {
+		if !routesThrough(route) {
+			continue
+		}
+
+		// Route through the tunnel address of the same family
+		peer := peersByUUID[route.PeerUUID]
+		gateway := peer.RemoteTunAddress
+		if strings.Contains(route.Subnet, ":") {
+			gateway = peer.RemoteTunAddress6
+		}
+
+		err = AddRoute(route.Subnet, gateway)
+		if err != nil {
+			routeErrs[routeKey(route.Subnet, route.PeerUUID)] = err.Error()
+			errs = append(errs, fmt.Errorf("route %s to %s: %w", route.Subnet, route.Hostname, err))
+		}
+	}
+	recordRouteSync(routes, routeErrs)
+
+	// Route internet traffic of peers using an exit peer
+	exits, err := compileExitRoutes()
+	if err == nil {
+		err = syncExitRouting(exits)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
+// Removes the routes, NAT rules and firewall chains created by the controller
+func TeardownNetworking() {
+	err := CleanupRoutes()
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = RemoveFirewall()
+	if err != nil {
+		log.Println(err)
+	}
+	log.Println("Removed network configuration")
+}
+
+// Removes the controller's routes from every table and the exit peer rules
 func CleanupRoutes() error {
 	cleanCount := 0
 	switch runtime.GOOS {
 	case "linux", "darwin":
-		routes, _ := netlink.RouteList(nil, 2)
+		// Table 0 with the table filter lists the routes of every table, including the exit tables
+		routes, _ := netlink.RouteListFiltered(0, &netlink.Route{Protocol: 171}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
 		for _, route := range routes {
-			if route.Protocol == 171 {
-				err := netlink.RouteDel(&route)
-				if err == nil {
-					cleanCount++
-				}
+			err := netlink.RouteDel(&route)
+			if err == nil {
+				cleanCount++
 			}
 		}
 		log.Println("Cleaned up", cleanCount, "routes")
-		return nil
+		return removeExitRules()
+	default:
+		return errors.New("unsupported OS")
+	}
+}
+
+func AddInterfaceRoute(destination string, iface string) error {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		_, dst, err := net.ParseCIDR(destination)
+		if err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(iface)
+		if err != nil {
+			return err
+		}
+		route := netlink.Route{
+			Dst:       dst,
+			LinkIndex: link.Attrs().Index,
+			Protocol:  171, // Identifies the route as a WireGuard route
+		}
+		return netlink.RouteReplace(&route)
 	default:
 		return errors.New("unsupported OS")
 	}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// The network configured from the environment
+const DefaultNetworkName = "default"
+
+var networkNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Creates or updates the default network from the environment variables. The
+// server key is only taken from WG_PRIVATE_KEY when the network is created,
+// after that it is changed by key rotations.
+func InitNetworks() {
+	port, err := strconv.Atoi(ENV.WG_PORT)
+	if err != nil {
+		log.Fatal("Invalid WG_PORT")
+	}
+
+	network := types.Network{
+		Name:           DefaultNetworkName,
+		Description:    "Default network",
+		Interface:      ENV.WG_INTERFACE,
+		ListenPort:     port,
+		PrivateKey:     ENV.WG_PRIVATE_KEY,
+		CIDR:           ENV.SERVER_CIDR,
+		CIDR6:          ENV.SERVER_CIDR6,
+		ServerAddress:  withMask(ENV.SERVER_ADDRESS, ENV.SERVER_CIDR),
+		ServerAddress6: withMask(ENV.SERVER_ADDRESS6, ENV.SERVER_CIDR6),
+	}
+	if ENV.DNS_ZONE != "" {
+		network.DNSZone = ENV.DNS_ZONE
+	}
+
+	existing, err := db.GetNetwork(DefaultNetworkName)
+	if err != nil {
+		if network.PrivateKey == "" {
+			network.PrivateKey, err = NewWireguardPrivateKey()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Println("Generated a new server key for the default network")
+		}
+		network.PublicKey, err = GetWireguardPublicKey(network.PrivateKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = db.InsertNetwork(network)
+	} else {
+		// Description and DNS zone are managed through the API unless DNS_ZONE is set
+		network.Description = existing.Description
+		if ENV.DNS_ZONE == "" {
+			network.DNSZone = existing.DNSZone
+		}
+
+		// The stored key is kept
+		if network.PrivateKey != "" && network.PrivateKey != existing.PrivateKey {
+			log.Println("WG_PRIVATE_KEY differs from the stored server key and is ignored, use a key rotation to change it")
+		}
+		network.PrivateKey = existing.PrivateKey
+		network.PublicKey = existing.PublicKey
+
+		// A key rotation moves the network to a new interface and port
+		rotated, err := db.HasCompletedServerKeyRotation(DefaultNetworkName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rotated {
+			if network.Interface != existing.Interface || network.ListenPort != existing.ListenPort {
+				log.Println("WG_INTERFACE and WG_PORT are superseded by a key rotation, the default network uses", existing.Interface, "port", existing.ListenPort)
+			}
+			network.Interface = existing.Interface
+			network.ListenPort = existing.ListenPort
+		}
+
+		err = db.UpdateNetwork(network)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Returns the name of the network a peer belongs to
+func PeerNetworkName(peer types.Peer) string {
+	if peer.Network == "" {
+		return DefaultNetworkName
+	}
+	return peer.Network
+}
+
+func GetPeerNetwork(peer types.Peer) (types.Network, error) {
+	return db.GetNetwork(PeerNetworkName(peer))
+}
+
+// Fills in defaults and checks a network does not clash with the others
+func ValidateNetwork(network *types.Network) error {
+	if !networkNameRegex.MatchString(network.Name) {
+		return errors.New("network name must be lowercase letters, numbers and dashes")
+	}
+	if network.Interface == "" || len(network.Interface) > 15 {
+		return errors.New("interface must be between 1 and 15 characters")
+	}
+	if network.ListenPort < 1 || network.ListenPort > 65535 {
+		return errors.New("invalid listen port")
+	}
+
+	// Tunnel networks
+	cidr, err := netip.ParsePrefix(network.CIDR)
+	if err != nil || !cidr.Addr().Is4() || !cidr.Addr().IsPrivate() {
+		return errors.New("cidr must be a private IPv4 network")
+	}
+	network.CIDR = cidr.Masked().String()
+	var cidr6 netip.Prefix
+	if network.CIDR6 != "" {
+		cidr6, err = netip.ParsePrefix(network.CIDR6)
+		if err != nil || !cidr6.Addr().Is6() || !cidr6.Addr().IsPrivate() {
+			return errors.New("cidr6 must be a unique local (fc00::/7) prefix")
+		}
+		network.CIDR6 = cidr6.Masked().String()
+	}
+
+	// Server addresses default to the highest address in each network
+	if network.ServerAddress == "" {
+		addr, mask, err := HighestIP(network.CIDR)
+		if err != nil {
+			return err
+		}
+		network.ServerAddress = addr + mask
+	}
+	network.ServerAddress = withMask(network.ServerAddress, network.CIDR)
+	if addr, err := netip.ParsePrefix(network.ServerAddress); err != nil || !cidr.Contains(addr.Addr()) {
+		return errors.New("serverAddress must be within cidr")
+	}
+	if network.CIDR6 != "" {
+		if network.ServerAddress6 == "" {
+			addr, mask, err := HighestIP(network.CIDR6)
+			if err != nil {
+				return err
+			}
+			network.ServerAddress6 = addr + mask
+		}
+		network.ServerAddress6 = withMask(network.ServerAddress6, network.CIDR6)
+		if addr, err := netip.ParsePrefix(network.ServerAddress6); err != nil || !cidr6.Contains(addr.Addr()) {
+			return errors.New("serverAddress6 must be within cidr6")
+		}
+	} else {
+		network.ServerAddress6 = ""
+	}
+
+	// DNS zone
+	network.DNSZone = strings.ToLower(strings.Trim(network.DNSZone, "."))
+	if _, ok := dns.IsDomainName(network.DNSZone); network.DNSZone != "" && !ok {
+		return errors.New("invalid dnsZone")
+	}
+
+	// Keys
+	if network.PrivateKey == "" {
+		network.PrivateKey, err = NewWireguardPrivateKey()
+		if err != nil {
+			return err
+		}
+	}
+	network.PublicKey, err = GetWireguardPublicKey(network.PrivateKey)
+	if err != nil {
+		return errors.New("invalid private key")
+	}
+
+	// Check for clashes with other networks and the interfaces of key rotations
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return err
+	}
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		return err
+	}
+	for _, r := range rotations {
+		if r.Interface == network.Interface {
+			return fmt.Errorf("interface %s is used by the key rotation of network %s", network.Interface, r.Network)
+		}
+		if r.ListenPort == network.ListenPort {
+			return fmt.Errorf("port %d is used by the key rotation of network %s", network.ListenPort, r.Network)
+		}
+	}
+	for _, other := range networks {
+		if other.Name == network.Name {
+			continue
+		}
+		if other.Interface == network.Interface {
+			return fmt.Errorf("interface %s is used by network %s", network.Interface, other.Name)
+		}
+		if other.ListenPort == network.ListenPort {
+			return fmt.Errorf("port %d is used by network %s", network.ListenPort, other.Name)
+		}
+		if p, err := netip.ParsePrefix(other.CIDR); err == nil && p.Overlaps(cidr) {
+			return fmt.Errorf("cidr overlaps network %s", other.Name)
+		}
+		if p, err := netip.ParsePrefix(other.CIDR6); err == nil && cidr6.IsValid() && p.Overlaps(cidr6) {
+			return fmt.Errorf("cidr6 overlaps network %s", other.Name)
+		}
+	}
+
+	return nil
+}
+
+// Starts and configures the wireguard interface of a newly created network
+func ApplyNetwork(network types.Network) error {
+	err := StartWireguardInterface(network.Interface)
+	if err != nil {
+		return err
+	}
+
+	err = WaitForWireguardInterface(network.Interface)
+	if err != nil {
+		return err
+	}
+
+	peers, err := db.GetPeers()
+	if err != nil {
+		return err
+	}
+	err = SyncWireguardNetwork(network, peers)
+	if err != nil {
+		return err
+	}
+
+	err = SetWireguardInterface(network)
+	if err != nil {
+		return err
+	}
+
+	// The ACL covers every tunnel interface
+	err = SyncFirewall()
+	if err != nil {
+		return err
+	}
+
+	return ReloadDNS()
+}
+
+// Removes a network that failed to come up, so creating it can be retried
+func removeNetwork(network types.Network) {
+	err := db.DeleteNetwork(network.Name)
+	if err != nil {
+		log.Println(err)
+	}
+
+	StopWireguardInterface(network.Interface)
+
+	err = SyncFirewall()
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = ReloadDNS()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Appends the CIDR mask to an address that has none
+func withMask(address string, cidr string) string {
+	if address == "" || strings.Contains(address, "/") {
+		return address
+	}
+	mask, err := GetMask(cidr)
+	if err != nil {
+		return address
+	}
+	return address + mask
+}
+
+func GET_Networks(c *gin.Context) {
+	networks, err := db.GetNetworks()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Never expose server private keys
+	for i := range networks {
+		networks[i].PrivateKey = ""
+	}
+
+	c.JSON(200, networks)
+}
+
+func PUT_Network(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	// Parse the network request body
+	var network types.Network
+	err := c.BindJSON(&network)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	network.Name = name
+
+	err = ValidateNetwork(&network)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Insert network into database
+	err = db.InsertNetwork(network)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Create the network's address pools
+	err = EnsureNetworkPools(network)
+	if err != nil {
+		log.Println(err)
+		removeNetwork(network)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Bring up the network
+	err = ApplyNetwork(network)
+	if err != nil {
+		log.Println(err)
+		removeNetwork(network)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func PATCH_Network(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	// Parse the network request body
+	var patch types.Network
+	err := c.BindJSON(&patch)
+	if err != nil {
+		log.Println(err)
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	network, err := db.GetNetwork(name)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+
+	// Interfaces and address ranges are fixed once peers have been assigned
+	network.Description = patch.Description
+	network.DNSZone = patch.DNSZone
+	network.Mesh = patch.Mesh
+	if patch.ListenPort != 0 && patch.ListenPort != network.ListenPort {
+		if name == DefaultNetworkName {
+			c.JSON(400, gin.H{
+				"error": "the default network port is set by WG_PORT",
+			})
+			return
+		}
+		network.ListenPort = patch.ListenPort
+	}
+
+	err = ValidateNetwork(&network)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = db.UpdateNetwork(network)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Resync wireguard configuration
+	err = SyncWireguardConfiguration()
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Resync peers DNS entries
+	err = SyncPeersDNS()
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Start or stop direct sessions
+	FanoutMesh()
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_Network(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(400, gin.H{
+			"error": "name is required",
+		})
+		return
+	}
+
+	if name == DefaultNetworkName {
+		c.JSON(400, gin.H{
+			"error": "cannot delete the default network",
+		})
+		return
+	}
+
+	network, err := db.GetNetwork(name)
+	if err != nil {
+		log.Println(err)
+		c.Status(404)
+		return
+	}
+
+	// Refuse to delete networks that still have peers
+	peers, err := db.GetPeers()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	for _, peer := range peers {
+		if PeerNetworkName(peer) == name {
+			c.JSON(409, gin.H{
+				"error": "network has peers",
+			})
+			return
+		}
+	}
+
+	// Refuse to delete networks with a key rotation in progress
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if _, ok := rotations[name]; ok {
+		c.JSON(409, gin.H{
+			"error": "network has a key rotation in progress",
+		})
+		return
+	}
+
+	err = db.DeleteNetwork(name)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Tear down the interface
+	StopWireguardInterface(network.Interface)
+
+	err = SyncFirewall()
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = ReloadDNS()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
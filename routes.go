@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// How often the handshakes of peers advertising subnets are checked for failover
+const RouteCheckInterval = 15 * time.Second
+
+// A peer without a handshake for this long hands its subnets to a backup.
+// Advertising peers need a keepalive so that idle tunnels keep handshaking.
+const RouteFailoverTimeout = 3 * time.Minute
+
+// Statuses of an advertised subnet
+const RouteActive = "active"   // Routed through the peer
+const RouteStale = "stale"     // Routed through the peer, which has no recent handshake and no healthy backup
+const RouteStandby = "standby" // A backup for the peer the subnet is routed through
+const RouteFailed = "failed"   // The subnet could not be routed through the peer
+
+var routesMutex sync.Mutex
+var routeErrors = map[string]string{} // Errors of the last routing table sync, keyed by routeKey
+var routeAssignments string           // Peers the subnets were last routed through, see assignmentFingerprint
+
+// Identifies the advertisement of a subnet by a peer
+func routeKey(subnet string, peerUUID string) string {
+	return subnet + "|" + peerUUID
+}
+
+// Checks the subnets a peer advertises. Subnets overlapping a tunnel network
+// are rejected, as they would take over the routes of the tunnel addresses.
+func ValidateRemoteSubnets(peer *types.Peer) error {
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return err
+	}
+
+	for _, subnet := range peer.RemoteSubnets {
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			return fmt.Errorf("invalid remote subnet %s", subnet)
+		}
+		if prefix.Bits() == 0 {
+			continue
+		}
+		for _, network := range networks {
+			for _, cidr := range []string{network.CIDR, network.CIDR6} {
+				tunnel, err := netip.ParsePrefix(cidr)
+				if err == nil && tunnel.Overlaps(prefix) {
+					return fmt.Errorf("remote subnet %s overlaps the tunnel network %s of network %s", subnet, cidr, network.Name)
+				}
+			}
+		}
+	}
+
+	if peer.RouteMetrics == nil {
+		peer.RouteMetrics = map[string]int{}
+	}
+	for subnet, metric := range peer.RouteMetrics {
+		if !slices.Contains(peer.RemoteSubnets, subnet) {
+			return fmt.Errorf("route metric set for %s, which is not a remote subnet", subnet)
+		}
+		if metric < 0 {
+			return errors.New("route metrics must not be negative")
+		}
+	}
+
+	return nil
+}
+
+// Returns the time of the most recent handshake of each peer, keyed by public key
+func peerHandshakes() map[string]time.Time {
+	handshakes := map[string]time.Time{}
+	networks, err := db.GetNetworks()
+	if err != nil {
+		log.Println(err)
+		return handshakes
+	}
+	interfaces, err := NetworkInterfaces(networks)
+	if err != nil {
+		log.Println(err)
+		return handshakes
+	}
+	for _, ifaces := range interfaces {
+		for _, iface := range ifaces {
+			device, err := wg.Device(iface)
+			if err != nil {
+				continue // The interface may not be up yet
+			}
+			for _, wgPeer := range device.Peers {
+				key := wgPeer.PublicKey.String()
+				if wgPeer.LastHandshakeTime.After(handshakes[key]) {
+					handshakes[key] = wgPeer.LastHandshakeTime
+				}
+			}
+		}
+	}
+	return handshakes
+}
+
+// Subnet advertised within a network
+type siteRouteKey struct {
+	Network string
+	Prefix  netip.Prefix
+}
+
+// Decides which peer each advertised subnet is routed through. Subnets
+// advertised by several peers of a network are routed through the one with the
+// lowest metric that has a recent handshake, the others stand by. A subnet
+// advertised in several networks can only be routed into one of them: the
+// first network by name keeps it and the others fail. Default routes are left
+// to the egress settings.
+func CompileSiteRoutes(peers []types.Peer) []types.SiteRoute {
+	return compileSiteRoutes(peers, peerHandshakes())
+}
+
+func compileSiteRoutes(peers []types.Peer, handshakes map[string]time.Time) []types.SiteRoute {
+	candidates := map[siteRouteKey][]types.SiteRoute{}
+	var routes []types.SiteRoute
+	for _, peer := range peers {
+		if !peer.Enabled {
+			continue
+		}
+		for _, subnet := range peer.RemoteSubnets {
+			prefix, err := netip.ParsePrefix(subnet)
+			if err != nil || prefix.Bits() == 0 {
+				continue
+			}
+			prefix = prefix.Masked()
+
+			route := types.SiteRoute{
+				Subnet:   prefix.String(),
+				PeerUUID: peer.UUID,
+				Hostname: peer.Hostname,
+				Network:  PeerNetworkName(peer),
+				Metric:   peer.RouteMetrics[subnet],
+				Overlaps: []string{},
+			}
+			if handshake, ok := handshakes[peer.PublicKey]; ok && !handshake.IsZero() {
+				route.LastHandshakeUnixMillis = handshake.UnixMilli()
+			}
+
+			// Route through the tunnel address of the same family
+			if prefix.Addr().Is6() && peer.RemoteTunAddress6 == "" {
+				route.Status = RouteFailed
+				route.Error = "the peer has no IPv6 tunnel address"
+				routes = append(routes, route)
+				continue
+			}
+			key := siteRouteKey{route.Network, prefix}
+			candidates[key] = append(candidates[key], route)
+		}
+	}
+
+	// Networks advertising each subnet, the first by name is routed
+	networks := map[netip.Prefix][]string{}
+	for key := range candidates {
+		networks[key.Prefix] = append(networks[key.Prefix], key.Network)
+	}
+	for _, names := range networks {
+		slices.Sort(names)
+	}
+
+	for key, group := range candidates {
+		if owner := networks[key.Prefix][0]; owner != key.Network {
+			for i := range group {
+				group[i].Status = RouteFailed
+				group[i].Error = "the subnet is already routed in network " + owner
+			}
+			routes = append(routes, group...)
+			continue
+		}
+
+		slices.SortFunc(group, func(a, b types.SiteRoute) int {
+			if a.Metric != b.Metric {
+				return a.Metric - b.Metric
+			}
+			return strings.Compare(a.PeerUUID, b.PeerUUID)
+		})
+
+		// Fall back to the preferred peer when none is healthy
+		active := 0
+		for i, route := range group {
+			if time.Since(time.UnixMilli(route.LastHandshakeUnixMillis)) <= RouteFailoverTimeout {
+				active = i
+				break
+			}
+			if i == len(group)-1 {
+				group[0].Status = RouteStale
+			}
+		}
+		for i := range group {
+			if i == active {
+				if group[i].Status == "" {
+					group[i].Status = RouteActive
+				}
+			} else {
+				group[i].Status = RouteStandby
+			}
+		}
+		routes = append(routes, group...)
+	}
+
+	// Mark subnets of different peers that overlap without being equal, or that
+	// are equal but in different networks. Overlapping subnets are both routed,
+	// and the longest prefix wins.
+	for i := range routes {
+		a := netip.MustParsePrefix(routes[i].Subnet)
+		for j := range routes {
+			b := netip.MustParsePrefix(routes[j].Subnet)
+			if routes[i].PeerUUID != routes[j].PeerUUID && (a != b || routes[i].Network != routes[j].Network) && a.Overlaps(b) {
+				routes[i].Overlaps = append(routes[i].Overlaps, routes[j].Subnet+" ("+routes[j].Hostname+")")
+			}
+		}
+	}
+
+	slices.SortFunc(routes, func(a, b types.SiteRoute) int {
+		if a.Subnet != b.Subnet {
+			return strings.Compare(a.Subnet, b.Subnet)
+		}
+		if a.Network != b.Network {
+			return strings.Compare(a.Network, b.Network)
+		}
+		if a.Metric != b.Metric {
+			return a.Metric - b.Metric
+		}
+		return strings.Compare(a.PeerUUID, b.PeerUUID)
+	})
+	return routes
+}
+
+// Reports whether a subnet is routed through the peer
+func routesThrough(route types.SiteRoute) bool {
+	return route.Status == RouteActive || route.Status == RouteStale
+}
+
+// Returns the subnets each peer is routed, keyed by peer UUID
+func activeSubnets(routes []types.SiteRoute) map[string][]string {
+	subnets := map[string][]string{}
+	for _, route := range routes {
+		if routesThrough(route) {
+			subnets[route.PeerUUID] = append(subnets[route.PeerUUID], route.Subnet)
+		}
+	}
+	return subnets
+}
+
+// Summarises which peer each subnet is routed through
+func assignmentFingerprint(routes []types.SiteRoute) string {
+	var b strings.Builder
+	for _, route := range routes {
+		if routesThrough(route) {
+			b.WriteString(routeKey(route.Subnet, route.PeerUUID) + ",")
+		}
+	}
+	return b.String()
+}
+
+// Records the outcome of a routing table sync
+func recordRouteSync(routes []types.SiteRoute, errs map[string]string) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	routeErrors = errs
+	routeAssignments = assignmentFingerprint(routes)
+}
+
+func RouteMonitor() {
+	for {
+		time.Sleep(RouteCheckInterval)
+		CheckRouteFailover()
+	}
+}
+
+// Moves subnets to a backup peer when the peer they are routed through stops
+// handshaking, and back once it recovers
+func CheckRouteFailover() {
+	peers, err := db.GetPeers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	routes := CompileSiteRoutes(peers)
+
+	routesMutex.Lock()
+	previous := routeAssignments
+	routesMutex.Unlock()
+	if assignmentFingerprint(routes) == previous {
+		return
+	}
+
+	for _, route := range routes {
+		if routesThrough(route) && !strings.Contains(previous, routeKey(route.Subnet, route.PeerUUID)+",") {
+			log.Println("Routing", route.Subnet, "through", route.Hostname)
+		}
+	}
+
+	// The subnets move between the peers' allowed IPs and routes
+	err = SyncWireguardConfiguration()
+	if err != nil {
+		log.Println(err)
+	}
+	err = SyncRoutingTable()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Returns every advertised subnet with its status and the errors of the last sync
+func GetSiteRoutes() ([]types.SiteRoute, error) {
+	peers, err := db.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	routes := CompileSiteRoutes(peers)
+
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	for i, route := range routes {
+		if e, ok := routeErrors[routeKey(route.Subnet, route.PeerUUID)]; ok && routesThrough(route) {
+			routes[i].Status = RouteFailed
+			routes[i].Error = e
+		}
+	}
+	return routes, nil
+}
+
+func GET_Routes(c *gin.Context) {
+	routes, err := GetSiteRoutes()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, routes)
+}
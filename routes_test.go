@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+func TestCompileSiteRoutes(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-time.Minute)
+	stale := now.Add(-2 * RouteFailoverTimeout)
+
+	peer := func(uuid string, network string, subnets map[string]int) types.Peer {
+		p := types.Peer{
+			UUID:             uuid,
+			Hostname:         uuid,
+			Network:          network,
+			PublicKey:        uuid + "-key",
+			Enabled:          true,
+			RemoteTunAddress: "10.0.0.1",
+			RouteMetrics:     subnets,
+		}
+		for subnet := range subnets {
+			p.RemoteSubnets = append(p.RemoteSubnets, subnet)
+		}
+		return p
+	}
+
+	// Subnet, peer, status and error of each compiled route
+	type result struct {
+		Subnet string
+		Peer   string
+		Status string
+		Error  string
+	}
+
+	tests := []struct {
+		name       string
+		peers      []types.Peer
+		handshakes map[string]time.Time
+		want       []result
+	}{
+		{
+			name:       "single peer",
+			peers:      []types.Peer{peer("a", "", map[string]int{"192.168.1.0/24": 0})},
+			handshakes: map[string]time.Time{"a-key": recent},
+			want:       []result{{"192.168.1.0/24", "a", RouteActive, ""}},
+		},
+		{
+			name: "lowest metric wins",
+			peers: []types.Peer{
+				peer("a", "", map[string]int{"192.168.1.0/24": 20}),
+				peer("b", "", map[string]int{"192.168.1.0/24": 10}),
+			},
+			handshakes: map[string]time.Time{"a-key": recent, "b-key": recent},
+			want: []result{
+				{"192.168.1.0/24", "b", RouteActive, ""},
+				{"192.168.1.0/24", "a", RouteStandby, ""},
+			},
+		},
+		{
+			name: "fails over from a stale peer",
+			peers: []types.Peer{
+				peer("a", "", map[string]int{"192.168.1.0/24": 20}),
+				peer("b", "", map[string]int{"192.168.1.0/24": 10}),
+			},
+			handshakes: map[string]time.Time{"a-key": recent, "b-key": stale},
+			want: []result{
+				{"192.168.1.0/24", "b", RouteStandby, ""},
+				{"192.168.1.0/24", "a", RouteActive, ""},
+			},
+		},
+		{
+			name: "keeps the preferred peer when none is healthy",
+			peers: []types.Peer{
+				peer("a", "", map[string]int{"192.168.1.0/24": 20}),
+				peer("b", "", map[string]int{"192.168.1.0/24": 10}),
+			},
+			handshakes: map[string]time.Time{},
+			want: []result{
+				{"192.168.1.0/24", "b", RouteStale, ""},
+				{"192.168.1.0/24", "a", RouteStandby, ""},
+			},
+		},
+		{
+			name: "equal metrics are ordered by uuid",
+			peers: []types.Peer{
+				peer("b", "", map[string]int{"192.168.1.0/24": 0}),
+				peer("a", "", map[string]int{"192.168.1.0/24": 0}),
+			},
+			handshakes: map[string]time.Time{"a-key": recent, "b-key": recent},
+			want: []result{
+				{"192.168.1.0/24", "a", RouteActive, ""},
+				{"192.168.1.0/24", "b", RouteStandby, ""},
+			},
+		},
+		{
+			name: "the same subnet in two networks is not a standby",
+			peers: []types.Peer{
+				peer("a", "office", map[string]int{"192.168.1.0/24": 0}),
+				peer("b", "branch", map[string]int{"192.168.1.0/24": 10}),
+			},
+			handshakes: map[string]time.Time{"a-key": recent, "b-key": recent},
+			want: []result{
+				{"192.168.1.0/24", "b", RouteActive, ""},
+				{"192.168.1.0/24", "a", RouteFailed, "the subnet is already routed in network branch"},
+			},
+		},
+		{
+			name:       "IPv6 subnet without an IPv6 tunnel address",
+			peers:      []types.Peer{peer("a", "", map[string]int{"fd00:1::/64": 0})},
+			handshakes: map[string]time.Time{"a-key": recent},
+			want:       []result{{"fd00:1::/64", "a", RouteFailed, "the peer has no IPv6 tunnel address"}},
+		},
+		{
+			name:       "default routes are left to egress",
+			peers:      []types.Peer{peer("a", "", map[string]int{"0.0.0.0/0": 0})},
+			handshakes: map[string]time.Time{"a-key": recent},
+			want:       []result{},
+		},
+		{
+			name: "disabled peers are skipped",
+			peers: []types.Peer{
+				peer("a", "", map[string]int{"192.168.1.0/24": 0}),
+				{UUID: "b", RemoteSubnets: []string{"192.168.1.0/24"}},
+			},
+			handshakes: map[string]time.Time{"a-key": recent},
+			want:       []result{{"192.168.1.0/24", "a", RouteActive, ""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []result{}
+			for _, route := range compileSiteRoutes(tt.peers, tt.handshakes) {
+				got = append(got, result{route.Subnet, route.PeerUUID, route.Status, route.Error})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compileSiteRoutes() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileSiteRoutesOverlaps(t *testing.T) {
+	peers := []types.Peer{
+		{UUID: "a", Hostname: "a", Enabled: true, RemoteTunAddress: "10.0.0.2", RemoteSubnets: []string{"192.168.0.0/16"}},
+		{UUID: "b", Hostname: "b", Enabled: true, RemoteTunAddress: "10.0.0.3", RemoteSubnets: []string{"192.168.1.0/24"}},
+		{UUID: "c", Hostname: "c", Enabled: true, RemoteTunAddress: "10.0.0.4", RemoteSubnets: []string{"172.16.0.0/12"}},
+		{UUID: "d", Hostname: "d", Network: "branch", Enabled: true, RemoteTunAddress: "10.1.0.2", RemoteSubnets: []string{"172.16.0.0/12"}},
+	}
+	want := map[string][]string{
+		"a": {"192.168.1.0/24 (b)"},
+		"b": {"192.168.0.0/16 (a)"},
+		"c": {"172.16.0.0/12 (d)"},
+		"d": {"172.16.0.0/12 (c)"},
+	}
+
+	for _, route := range compileSiteRoutes(peers, map[string]time.Time{}) {
+		if !reflect.DeepEqual(route.Overlaps, want[route.PeerUUID]) {
+			t.Errorf("overlaps of %s via %s = %v, want %v", route.Subnet, route.PeerUUID, route.Overlaps, want[route.PeerUUID])
+		}
+	}
+}
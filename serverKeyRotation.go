@@ -0,0 +1,561 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// How often the interfaces of rotations in progress are checked for migrated peers
+const ServerKeyMigrationCheckInterval = 15 * time.Second
+
+// How often clients that have not migrated are told about the new key again
+const ServerKeyRepushInterval = time.Hour
+
+var serverKeyRotationMutex sync.Mutex
+var serverKeyPushed = map[int64]time.Time{} // Last push of each rotation
+
+// Returns the interfaces of each network, keyed by network name. A network with
+// a rotation in progress also has the interface serving its new key.
+func NetworkInterfaces(networks []types.Network) (map[string][]string, error) {
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := map[string][]string{}
+	for _, network := range networks {
+		interfaces[network.Name] = []string{network.Interface}
+		if r, ok := rotations[network.Name]; ok {
+			interfaces[network.Name] = append(interfaces[network.Name], r.Interface)
+		}
+	}
+	return interfaces, nil
+}
+
+// Returns the network as served on the interface of its rotation
+func rotationNetwork(network types.Network, r types.ServerKeyRotation) types.Network {
+	network.Interface = r.Interface
+	network.ListenPort = r.ListenPort
+	network.PrivateKey = r.PrivateKey
+	network.PublicKey = r.PublicKey
+	return network
+}
+
+// Checks the interface and port of a new rotation are free
+func validateServerKeyRotation(network types.Network, req *types.ServerKeyRotationRequest) error {
+	if req.Interface == "" {
+		if strings.HasSuffix(network.Interface, "k") {
+			req.Interface = strings.TrimSuffix(network.Interface, "k")
+		} else {
+			req.Interface = network.Interface + "k"
+		}
+	}
+	if req.ListenPort == 0 {
+		req.ListenPort = network.ListenPort + 1
+	}
+	if len(req.Interface) > 15 {
+		return errors.New("interface must be between 1 and 15 characters")
+	}
+	if req.ListenPort < 1 || req.ListenPort > 65535 {
+		return errors.New("invalid listen port")
+	}
+
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return err
+	}
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		return err
+	}
+	if _, ok := rotations[network.Name]; ok {
+		return errors.New("a rotation is already in progress")
+	}
+	for _, other := range networks {
+		if other.Interface == req.Interface {
+			return fmt.Errorf("interface %s is used by network %s", req.Interface, other.Name)
+		}
+		if other.ListenPort == req.ListenPort {
+			return fmt.Errorf("port %d is used by network %s", req.ListenPort, other.Name)
+		}
+	}
+	for _, r := range rotations {
+		if r.Interface == req.Interface {
+			return fmt.Errorf("interface %s is used by the key rotation of network %s", req.Interface, r.Network)
+		}
+		if r.ListenPort == req.ListenPort {
+			return fmt.Errorf("port %d is used by the key rotation of network %s", req.ListenPort, r.Network)
+		}
+	}
+
+	return nil
+}
+
+// Generates a new server key and serves it on a second interface
+func StartServerKeyRotation(network types.Network, req types.ServerKeyRotationRequest) (types.ServerKeyRotation, error) {
+	r := types.ServerKeyRotation{
+		Network:           network.Name,
+		Interface:         req.Interface,
+		ListenPort:        req.ListenPort,
+		StartedUnixMillis: time.Now().UnixMilli(),
+	}
+
+	var err error
+	r.PrivateKey, err = NewWireguardPrivateKey()
+	if err != nil {
+		return types.ServerKeyRotation{}, err
+	}
+	r.PublicKey, err = GetWireguardPublicKey(r.PrivateKey)
+	if err != nil {
+		return types.ServerKeyRotation{}, err
+	}
+
+	r.ID, err = db.InsertServerKeyRotation(r)
+	if err != nil {
+		return types.ServerKeyRotation{}, err
+	}
+
+	// Bring up the new interface with the network's peers
+	err = ApplyNetwork(rotationNetwork(network, r))
+	if err != nil {
+		return r, err
+	}
+	err = SyncFirewall()
+	if err != nil {
+		return r, err
+	}
+
+	pushServerKey(network, r)
+	return r, nil
+}
+
+// Tells the managed clients of a network that have not migrated about the new key
+func pushServerKey(network types.Network, r types.ServerKeyRotation) {
+	serverInfo, err := GetServerInfo(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	migrations, err := db.GetServerKeyMigrations(r.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	peers, err := db.GetPeers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	msg := LP_Message{
+		Topic: "serverKey",
+		Data:  r.PublicKey,
+		Attributes: map[string]string{
+			"network":        network.Name,
+			"publicKey":      r.PublicKey,
+			"publicEndpoint": serverInfo.PublicEndpoint,
+		},
+	}
+	for _, peer := range peers {
+		if PeerNetworkName(peer) != network.Name || !isManagedClient(peer) || migrations[peer.UUID] != 0 {
+			continue
+		}
+		SendClientMessage(peer.UUID, msg)
+	}
+
+	serverKeyRotationMutex.Lock()
+	serverKeyPushed[r.ID] = time.Now()
+	serverKeyRotationMutex.Unlock()
+}
+
+func ServerKeyRotationMonitor() {
+	for {
+		time.Sleep(ServerKeyMigrationCheckInterval)
+		CheckServerKeyRotations()
+	}
+}
+
+// Records peers that have completed a handshake with a new key, and retires
+// the old key once every enabled peer in the network has migrated
+func CheckServerKeyRotations() {
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, r := range rotations {
+		network, err := db.GetNetwork(r.Network)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		migrated, err := recordServerKeyMigrations(r)
+		if err != nil {
+			log.Println("Key rotation of network", r.Network+":", err)
+			continue
+		}
+		if migrated {
+			err = SyncRoutingTable()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		status, err := serverKeyRotationStatus(r)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if status.MigratedCount == len(status.Peers) {
+			err = RetireServerKey(network, r)
+			if err != nil {
+				log.Println("Failed to retire the old key of network", r.Network+":", err)
+			}
+			continue
+		}
+
+		serverKeyRotationMutex.Lock()
+		pushed := serverKeyPushed[r.ID]
+		serverKeyRotationMutex.Unlock()
+		if time.Since(pushed) >= ServerKeyRepushInterval {
+			pushServerKey(network, r)
+		}
+	}
+}
+
+// Records every peer with a handshake on the rotation's interface as migrated.
+// Reports whether any peer migrated since the last check.
+func recordServerKeyMigrations(r types.ServerKeyRotation) (bool, error) {
+	device, err := wg.Device(r.Interface)
+	if err != nil {
+		return false, err
+	}
+	migrations, err := db.GetServerKeyMigrations(r.ID)
+	if err != nil {
+		return false, err
+	}
+	peers, err := db.GetPeers()
+	if err != nil {
+		return false, err
+	}
+	peersByKey := map[string]types.Peer{}
+	for _, peer := range peers {
+		peersByKey[peer.PublicKey] = peer
+	}
+
+	migrated := false
+	for _, wgPeer := range device.Peers {
+		if wgPeer.LastHandshakeTime.IsZero() {
+			continue
+		}
+		peer, ok := peersByKey[wgPeer.PublicKey.String()]
+		if !ok || migrations[peer.UUID] != 0 {
+			continue
+		}
+		err = db.InsertServerKeyMigration(r.ID, peer.UUID, wgPeer.LastHandshakeTime.UnixMilli())
+		if err != nil {
+			return migrated, err
+		}
+		log.Println("Peer", peer.Hostname, "migrated to the new key of network", r.Network)
+		migrated = true
+	}
+
+	return migrated, nil
+}
+
+// Fills in the migration status of the network's enabled peers
+func serverKeyRotationStatus(r types.ServerKeyRotation) (types.ServerKeyRotation, error) {
+	migrations, err := db.GetServerKeyMigrations(r.ID)
+	if err != nil {
+		return r, err
+	}
+	peers, err := db.GetPeers()
+	if err != nil {
+		return r, err
+	}
+
+	r.Peers = []types.ServerKeyMigration{}
+	r.MigratedCount = 0
+	for _, peer := range peers {
+		if !peer.Enabled || PeerNetworkName(peer) != r.Network {
+			continue
+		}
+		m := types.ServerKeyMigration{
+			PeerUUID:           peer.UUID,
+			Hostname:           peer.Hostname,
+			Managed:            isManagedClient(peer),
+			MigratedUnixMillis: migrations[peer.UUID],
+		}
+		if r.CompletedUnixMillis == 0 && r.AbortedUnixMillis == 0 && m.MigratedUnixMillis != 0 {
+			r.MigratedCount++
+		}
+		r.Peers = append(r.Peers, m)
+	}
+
+	return r, nil
+}
+
+// Returns the UUIDs of the peers that have migrated to the new keys of the
+// rotations in progress
+func migratedPeers() (map[string]types.ServerKeyRotation, error) {
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		return nil, err
+	}
+
+	peers := map[string]types.ServerKeyRotation{}
+	for _, r := range rotations {
+		migrations, err := db.GetServerKeyMigrations(r.ID)
+		if err != nil {
+			return nil, err
+		}
+		for uuid := range migrations {
+			peers[uuid] = r
+		}
+	}
+	return peers, nil
+}
+
+// Moves the network to the new key, interface and port, and removes the old interface
+func RetireServerKey(network types.Network, r types.ServerKeyRotation) error {
+	status, err := serverKeyRotationStatus(r)
+	if err != nil {
+		return err
+	}
+
+	err = db.CompleteServerKeyRotation(r, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	StopWireguardInterface(network.Interface)
+	resyncNetworking()
+
+	var stranded []string
+	for _, m := range status.Peers {
+		if m.MigratedUnixMillis == 0 {
+			stranded = append(stranded, m.Hostname)
+		}
+	}
+	log.Println("Retired the old key of network", network.Name, "now served on", r.Interface, "port", r.ListenPort)
+	go serverKeyRetiredAlert(network.Name, r, stranded)
+	return nil
+}
+
+// Ends a rotation, removing the interface serving the new key
+func AbortServerKeyRotation(r types.ServerKeyRotation) error {
+	err := db.AbortServerKeyRotation(r.ID, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	StopWireguardInterface(r.Interface)
+	resyncNetworking()
+
+	log.Println("Aborted the key rotation of network", r.Network)
+	return nil
+}
+
+// Rebuilds the routes, firewall and DNS after the interfaces of a network change
+func resyncNetworking() {
+	for _, sync := range []func() error{
+		SyncWireguardConfiguration,
+		SyncRoutingTable,
+		SyncFirewall,
+		ReloadDNS,
+	} {
+		err := sync()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func serverKeyRetiredAlert(network string, r types.ServerKeyRotation, stranded []string) {
+	event := "🔑 Server Key Rotated"
+	message := "The old server key of network " + network + " has been retired. The network is now served on port " + strconv.Itoa(r.ListenPort) + "."
+	if len(stranded) > 0 {
+		message += " These clients had not migrated and need a new config: " + strings.Join(stranded, ", ")
+	}
+
+	// Send the alert to Slack
+	if ENV.SLACK_WEBHOOK != "" {
+		msg := NewSlackMessageBody(event, message, "https://"+ENV.PUBLIC_HOST)
+		err := SendSlackMessage(ENV.SLACK_WEBHOOK, msg)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Returns the active rotation of a network with its migration status,
+// responding with 404 if there is none
+func activeServerKeyRotation(c *gin.Context) (types.Network, types.ServerKeyRotation, bool) {
+	network, err := db.GetNetwork(c.Param("name"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "network not found",
+		})
+		return types.Network{}, types.ServerKeyRotation{}, false
+	}
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return types.Network{}, types.ServerKeyRotation{}, false
+	}
+	r, ok := rotations[network.Name]
+	if !ok {
+		c.JSON(404, gin.H{
+			"error": "no rotation in progress",
+		})
+		return types.Network{}, types.ServerKeyRotation{}, false
+	}
+	r, err = serverKeyRotationStatus(r)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return types.Network{}, types.ServerKeyRotation{}, false
+	}
+	return network, r, true
+}
+
+// Returns a network's rotations, newest first, with the migration status of
+// the rotation in progress
+func GET_ServerKeyRotations(c *gin.Context) {
+	rotations, err := db.GetServerKeyRotations(c.Param("name"))
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	for i := range rotations {
+		rotations[i].PrivateKey = ""
+		if rotations[i].CompletedUnixMillis == 0 && rotations[i].AbortedUnixMillis == 0 {
+			rotations[i], err = serverKeyRotationStatus(rotations[i])
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	c.JSON(200, rotations)
+}
+
+func POST_ServerKeyRotation(c *gin.Context) {
+	var req types.ServerKeyRotationRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	network, err := db.GetNetwork(c.Param("name"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": "network not found",
+		})
+		return
+	}
+
+	err = validateServerKeyRotation(network, &req)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	r, err := StartServerKeyRotation(network, req)
+	if err != nil {
+		log.Println(err)
+		if r.ID != 0 {
+			// Undo the partly applied rotation
+			abortErr := AbortServerKeyRotation(r)
+			if abortErr != nil {
+				log.Println(abortErr)
+			}
+		}
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	log.Println("Started the key rotation of network", network.Name, "on", r.Interface, "port", r.ListenPort)
+	r.PrivateKey = ""
+	c.JSON(200, r)
+}
+
+// Retires the old key before every peer has migrated. Requires "force=true"
+// while peers are still using the old key.
+func POST_ServerKeyRotationComplete(c *gin.Context) {
+	network, r, ok := activeServerKeyRotation(c)
+	if !ok {
+		return
+	}
+	if r.MigratedCount < len(r.Peers) && c.Query("force") != "true" {
+		c.JSON(409, gin.H{
+			"error": fmt.Sprintf("%d of %d peers have not migrated, use force=true to retire the old key anyway", len(r.Peers)-r.MigratedCount, len(r.Peers)),
+		})
+		return
+	}
+
+	err := RetireServerKey(network, r)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+// Aborts a rotation. Requires "force=true" once peers have migrated to the new key.
+func DELETE_ServerKeyRotation(c *gin.Context) {
+	_, r, ok := activeServerKeyRotation(c)
+	if !ok {
+		return
+	}
+	if r.MigratedCount > 0 && c.Query("force") != "true" {
+		c.JSON(409, gin.H{
+			"error": fmt.Sprintf("%d peers already use the new key, use force=true to abort anyway", r.MigratedCount),
+		})
+		return
+	}
+
+	err := AbortServerKeyRotation(r)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
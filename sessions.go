@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wg-controller/wg-controller/db"
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Header that cookie authenticated writes must carry the CSRF token in
+const CSRFHeader = "X-CSRF-Token"
+
+// How often a session's activity is written to the database
+const SessionRefreshInterval = time.Minute
+
+var ErrSessionExpired = errors.New("session expired")
+
+// Looks up the session of the sessionId cookie and checks that it has not expired
+func loadSession(c *gin.Context) (hash []byte, session types.Session, csrfHash []byte, err error) {
+	cookie, err := c.Cookie("sessionId")
+	if err != nil {
+		return nil, types.Session{}, nil, err
+	}
+
+	// Decode Base64
+	tokenBytes, err := base64.URLEncoding.DecodeString(cookie)
+	if err != nil {
+		return nil, types.Session{}, nil, err
+	}
+
+	// Hash the session token
+	hash, err = GenerateDeterministicHash(tokenBytes, []byte{})
+	if err != nil {
+		return nil, types.Session{}, nil, err
+	}
+
+	// Check for the hashed session token in the DB
+	session, csrfHash, err = db.GetSession(hash)
+	if err != nil {
+		return nil, types.Session{}, nil, err
+	}
+
+	// Check the absolute and idle expiry
+	now := time.Now().UnixMilli()
+	if session.ExpiresUnixMillis < now || session.IdleExpiresUnixMillis < now {
+		return nil, types.Session{}, nil, ErrSessionExpired
+	}
+
+	return hash, session, csrfHash, nil
+}
+
+// Slides the idle expiry of a session forward, at most once per refresh interval
+func refreshSession(c *gin.Context, hash []byte, session types.Session) {
+	now := time.Now()
+	if now.UnixMilli()-session.LastActiveUnixMillis < SessionRefreshInterval.Milliseconds() && session.IP == c.ClientIP() {
+		return
+	}
+
+	err := db.TouchSession(hash, c.ClientIP(), now.UnixMilli(), now.Add(ENV.SESSION_IDLE_TIMEOUT).UnixMilli())
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Update last active time for user
+	err = db.UpdateAccountLastActive(session.Email, now.UnixMilli())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Reports whether a cookie authenticated request carries the session's CSRF token.
+// Safe methods don't need one.
+func checkCSRF(c *gin.Context, csrfHash []byte) bool {
+	switch c.Request.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+
+	token := c.GetHeader(CSRFHeader)
+	if token == "" || len(csrfHash) == 0 {
+		return false
+	}
+	hash, err := GenerateDeterministicHash([]byte(token), []byte{})
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, csrfHash) == 1
+}
+
+// Reports whether the client connected over HTTPS, either directly or through a trusted proxy
+func requestIsSecure(c *gin.Context) bool {
+	if c.Request.TLS != nil {
+		return true
+	}
+	if c.GetHeader("X-Forwarded-Proto") != "https" {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(host)
+	for _, proxy := range ENV.TRUSTED_PROXIES {
+		if ip := net.ParseIP(proxy); ip != nil && ip.Equal(remote) {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(proxy); err == nil && cidr.Contains(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the session and CSRF cookies on the root path. The CSRF cookie is readable by the web
+// interface, which echoes it in the X-CSRF-Token header. A negative maxAge clears both.
+func setSessionCookies(c *gin.Context, token string, csrfToken string, maxAge int) {
+	secure := requestIsSecure(c)
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie("sessionId", token, maxAge, "/", "", secure, true)
+	c.SetCookie("csrfToken", csrfToken, maxAge, "/", "", secure, false)
+
+	// Earlier versions left the session cookie on the path of the login endpoint,
+	// where it would be sent ahead of the current one
+	c.SetCookie("sessionId", "", -1, "/api/v1", "", secure, true)
+}
+
+// Generates a public session ID
+func newSessionID() (string, error) {
+	b, err := GenerateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Returns the email of the logged in user, or false for API key requests
+func sessionUser(c *gin.Context) (string, bool) {
+	if c.GetString("actorType") != "user" {
+		c.JSON(400, gin.H{
+			"error": "sessions are only available to logged in users",
+		})
+		return "", false
+	}
+	return c.GetString("actor"), true
+}
+
+func GET_Sessions(c *gin.Context) {
+	email, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := db.GetUserSessions(email)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Mark the session making the request
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == c.GetString("sessionId")
+	}
+
+	c.JSON(200, sessions)
+}
+
+// Revokes all of the user's sessions except the current one
+func DELETE_Sessions(c *gin.Context) {
+	email, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+
+	err := db.DeleteOtherUserSessions(email, c.GetString("sessionId"))
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+func DELETE_Session(c *gin.Context) {
+	email, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+
+	id := c.Param("id")
+	err := db.DeleteUserSession(email, id)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Clear the cookies when revoking the current session
+	if id == c.GetString("sessionId") {
+		setSessionCookies(c, "", "", -1)
+	}
+
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wg-controller/wg-controller/types"
+)
+
+// Restarts are delayed by SupervisorMinBackoff, doubling with every failure up
+// to SupervisorMaxBackoff. The delay is reset once a child has been running
+// for SupervisorResetAfter.
+const SupervisorMinBackoff = time.Second
+const SupervisorMaxBackoff = time.Minute
+const SupervisorResetAfter = time.Minute
+
+// Supervised child states
+const (
+	ChildStarting   = "starting"
+	ChildRunning    = "running"
+	ChildRestarting = "restarting"
+)
+
+// A child supervised by the controller, such as a wireguard-go process or a DNS listener
+type Supervised struct {
+	Name string
+
+	// Starts the child and returns once it is ready. The returned function
+	// blocks until the child exits.
+	start func() (wait func() error, err error)
+
+	// Makes a running child exit
+	stop func()
+
+	// Called after the child has been restarted, to reapply its configuration
+	onRestart func()
+
+	mutex     sync.Mutex
+	state     string
+	restarts  int
+	lastError string
+	since     time.Time
+	stopped   bool
+	stopCh    chan struct{}
+}
+
+var supervised sync.Map // map[name]*Supervised
+
+// Starts a child and keeps it running until Stop is called. Returns once the
+// child is first ready, or with the error of its first start while restarts
+// continue in the background.
+func Supervise(name string, start func() (func() error, error), stop func(), onRestart func()) (*Supervised, error) {
+	s := &Supervised{
+		Name:      name,
+		start:     start,
+		stop:      stop,
+		onRestart: onRestart,
+		state:     ChildStarting,
+		since:     time.Now(),
+		stopCh:    make(chan struct{}),
+	}
+	supervised.Store(name, s)
+
+	first := make(chan error, 1)
+	go s.run(first)
+	return s, <-first
+}
+
+func (s *Supervised) run(first chan error) {
+	backoff := SupervisorMinBackoff
+	for attempt := 0; ; attempt++ {
+		startedAt := time.Now()
+		wait, err := s.start()
+		if err == nil && s.isStopped() {
+			// Stopped while starting
+			s.stop()
+			wait()
+			return
+		}
+		if err == nil {
+			s.setState(ChildRunning, "")
+			if attempt == 0 {
+				first <- nil
+			} else {
+				log.Println("[supervisor]", s.Name, "restarted")
+				if s.onRestart != nil {
+					s.onRestart()
+				}
+			}
+			err = wait()
+		} else if attempt == 0 {
+			first <- err
+		}
+
+		if s.isStopped() {
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		var delay time.Duration
+		delay, backoff = restartBackoff(backoff, time.Since(startedAt))
+		log.Println("[supervisor]", s.Name, "failed:", err, "- restarting in", delay)
+		s.setState(ChildRestarting, err.Error())
+
+		select {
+		case <-time.After(delay):
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// Returns the delay before the next restart of a child that ran for ran, and
+// the backoff to carry into the restart after that
+func restartBackoff(backoff time.Duration, ran time.Duration) (delay time.Duration, next time.Duration) {
+	if ran > SupervisorResetAfter {
+		backoff = SupervisorMinBackoff
+	}
+	return backoff, min(backoff*2, SupervisorMaxBackoff)
+}
+
+// Stops the child without restarting it
+func (s *Supervised) Stop() {
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.stopCh)
+	s.mutex.Unlock()
+
+	supervised.CompareAndDelete(s.Name, s)
+	s.stop()
+}
+
+func (s *Supervised) isStopped() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stopped
+}
+
+func (s *Supervised) setState(state string, lastError string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if state == ChildRestarting {
+		s.restarts++
+	}
+	if lastError != "" {
+		s.lastError = lastError
+	}
+	s.state = state
+	s.since = time.Now()
+}
+
+// Returns the status of every supervised child, sorted by name
+func SupervisedStatus() []types.ChildStatus {
+	statuses := []types.ChildStatus{}
+	supervised.Range(func(key, value interface{}) bool {
+		s := value.(*Supervised)
+		s.mutex.Lock()
+		statuses = append(statuses, types.ChildStatus{
+			Name:            s.Name,
+			State:           s.state,
+			Restarts:        s.restarts,
+			LastError:       s.lastError,
+			SinceUnixMillis: s.since.UnixMilli(),
+		})
+		s.mutex.Unlock()
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// Returns a writer that logs each line written to it with the child's name as a prefix
+func prefixedLogWriter(name string) io.WriteCloser {
+	r, w := io.Pipe()
+	go func() {
+		// Lines of any length are read, so a long line never stops the child's output
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				log.Println("["+name+"]", strings.TrimRight(line, "\r\n"))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return w
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		backoff   time.Duration
+		ran       time.Duration
+		wantDelay time.Duration
+		wantNext  time.Duration
+	}{
+		{"first failure", SupervisorMinBackoff, 0, SupervisorMinBackoff, 2 * SupervisorMinBackoff},
+		{"doubles", 4 * time.Second, time.Second, 4 * time.Second, 8 * time.Second},
+		{"capped", 40 * time.Second, time.Second, 40 * time.Second, SupervisorMaxBackoff},
+		{"stays at the cap", SupervisorMaxBackoff, time.Second, SupervisorMaxBackoff, SupervisorMaxBackoff},
+		{"resets after a long run", SupervisorMaxBackoff, 2 * SupervisorResetAfter, SupervisorMinBackoff, 2 * SupervisorMinBackoff},
+		{"no reset at the threshold", 8 * time.Second, SupervisorResetAfter, 8 * time.Second, 16 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, next := restartBackoff(tt.backoff, tt.ran)
+			if delay != tt.wantDelay || next != tt.wantNext {
+				t.Errorf("restartBackoff(%v, %v) = %v, %v, want %v, %v", tt.backoff, tt.ran, delay, next, tt.wantDelay, tt.wantNext)
+			}
+		})
+	}
+}
+
+// Passes each log message to a channel
+type logRecorder chan string
+
+func (r logRecorder) Write(p []byte) (int, error) {
+	r <- string(p)
+	return len(p), nil
+}
+
+func TestPrefixedLogWriter(t *testing.T) {
+	messages := make(logRecorder, 2)
+	log.SetOutput(messages)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	w := prefixedLogWriter("child")
+	defer w.Close()
+	long := strings.Repeat("x", 100000)
+	go w.Write([]byte(long + "\nshort\r\n"))
+
+	for _, want := range []string{"[child] " + long + "\n", "[child] short\n"} {
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Errorf("logged %.40q (%d bytes), want %.40q (%d bytes)", got, len(got), want, len(want))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("line not logged")
+		}
+	}
+}
@@ -1,42 +1,85 @@
 package types
 
 type Peer struct {
-	UUID               string   `json:"uuid"`
-	Hostname           string   `json:"hostname"`
-	Enabled            bool     `json:"enabled"`
-	PrivateKey         string   `json:"privateKey"`       // Wireguard private key (stored encrypted with AES256)
-	PublicKey          string   `json:"publicKey"`        // Wireguard public key
-	PreSharedKey       string   `json:"preSharedKey"`     // Wireguard pre-shared key (stored encrypted with AES256)
-	KeepAliveSeconds   int      `json:"keepAliveSeconds"` // Wireguard keep-alive interval in seconds
-	LocalTunAddress    string   `json:"localTunAddress"`  // The IP address of the server's tunnel interface (future use)
-	RemoteTunAddress   string   `json:"remoteTunAddress"` // The IP address of the peer's tunnel interface
-	RemoteSubnets      []string `json:"remoteSubnets"`    // A list of CIDR subnets that the peer can provide access to
-	AllowedSubnets     []string `json:"allowedSubnets"`   // A list of CIDR subnets that the peer is allowed to access
-	LastSeenUnixMillis int64    `json:"lastSeenUnixMillis"`
-	LastIPAddress      string   `json:"lastIPAddress"`
-	TransmitBytes      int64    `json:"transmitBytes"`
-	ReceiveBytes       int64    `json:"receiveBytes"`
-	OS                 string   `json:"os"`
-	ClientVersion      string   `json:"clientVersion"`
-	ClientType         string   `json:"clientType"`
-	Attributes         []string `json:"attributes"`
+	UUID                 string         `json:"uuid"`
+	Hostname             string         `json:"hostname"`
+	Enabled              bool           `json:"enabled"`
+	Network              string         `json:"network"`           // Name of the network the peer belongs to
+	PrivateKey           string         `json:"privateKey"`        // Wireguard private key (stored encrypted with AES256)
+	PublicKey            string         `json:"publicKey"`         // Wireguard public key
+	PreSharedKey         string         `json:"preSharedKey"`      // Wireguard pre-shared key (stored encrypted with AES256)
+	KeepAliveSeconds     int            `json:"keepAliveSeconds"`  // Wireguard keep-alive interval in seconds
+	LocalTunAddress      string         `json:"localTunAddress"`   // The IP address of the server's tunnel interface (future use)
+	RemoteTunAddress     string         `json:"remoteTunAddress"`  // The IP address of the peer's tunnel interface
+	RemoteTunAddress6    string         `json:"remoteTunAddress6"` // The IPv6 address of the peer's tunnel interface (dual-stack only)
+	RemoteSubnets        []string       `json:"remoteSubnets"`     // A list of CIDR subnets that the peer can provide access to
+	AllowedSubnets       []string       `json:"allowedSubnets"`    // A list of CIDR subnets that the peer is allowed to access
+	LastSeenUnixMillis   int64          `json:"lastSeenUnixMillis"`
+	LastIPAddress        string         `json:"lastIPAddress"`
+	TransmitBytes        int64          `json:"transmitBytes"`
+	ReceiveBytes         int64          `json:"receiveBytes"`
+	OS                   string         `json:"os"`
+	ClientVersion        string         `json:"clientVersion"`
+	ClientType           string         `json:"clientType"`
+	Attributes           []string       `json:"attributes"`
+	DNSForwardDomains    []string       `json:"dnsForwardDomains"`  // Domains resolved by a DNS server behind the peer
+	DNSForwardResolver   string         `json:"dnsForwardResolver"` // IP address of that DNS server, within the peer's remote subnets
+	DNSQueryLogging      bool           `json:"dnsQueryLogging"`    // Record the peer's DNS queries in the query log
+	Aliases              []string       `json:"aliases"`            // Additional DNS names of the peer, e.g. "git" or "*.dev-box"
+	KeyRotationDays      int            `json:"keyRotationDays"`    // Days between key pair rotations, 0 for the server default, -1 for never
+	PSKRotationDays      int            `json:"pskRotationDays"`    // Days between pre-shared key rotations, 0 for the server default, -1 for never
+	KeyRotatedUnixMillis int64          `json:"keyRotatedUnixMillis"`
+	PSKRotatedUnixMillis int64          `json:"pskRotatedUnixMillis"`
+	Egress               string         `json:"egress"`       // "split", "controller", "exit", or empty to inherit from the peer's groups
+	ExitPeer             string         `json:"exitPeer"`     // UUID of the exit peer when Egress is "exit"
+	RouteMetrics         map[string]int `json:"routeMetrics"` // Metric of each remote subnet, the lowest is preferred when several peers advertise a subnet
+}
+
+// New key material waiting to be acknowledged by a peer
+type KeyRotation struct {
+	PeerUUID          string `json:"peerUuid"`
+	ID                string `json:"id"`
+	RotateKey         bool   `json:"rotateKey"`
+	RotatePSK         bool   `json:"rotatePsk"`
+	PrivateKey        string `json:"privateKey"`   // Empty when the client generates its own key pair
+	PublicKey         string `json:"publicKey"`    // Empty until a client-generated key pair is acknowledged
+	PreSharedKey      string `json:"preSharedKey"` // Empty when only the key pair is rotated
+	CreatedUnixMillis int64  `json:"createdUnixMillis"`
+	PushedUnixMillis  int64  `json:"pushedUnixMillis"`  // Last time the rotation was sent to the client
+	AlertedUnixMillis int64  `json:"alertedUnixMillis"` // Time an alert was raised for a stock client
+}
+
+type KeyRotationRequest struct {
+	RotateKey bool `json:"rotateKey"`
+	RotatePSK bool `json:"rotatePsk"`
+}
+
+type KeyRotationAck struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"` // The new public key of a client-generated key pair
 }
 
 type PeerInit struct {
-	UUID             string `json:"uuid"`
-	PrivateKey       string `json:"privateKey"`
-	PublicKey        string `json:"publicKey"`
-	PreSharedKey     string `json:"preSharedKey"`
-	LocalTunAddress  string `json:"localTunAddress"`
-	RemoteTunAddress string `json:"remoteTunAddress"`
-	ServerCIDR       string `json:"serverCIDR"`
+	UUID              string `json:"uuid"`
+	Network           string `json:"network"`
+	PrivateKey        string `json:"privateKey"` // Empty when the client generates its own key pair
+	PublicKey         string `json:"publicKey"`
+	PreSharedKey      string `json:"preSharedKey"`
+	LocalTunAddress   string `json:"localTunAddress"`
+	RemoteTunAddress  string `json:"remoteTunAddress"`
+	RemoteTunAddress6 string `json:"remoteTunAddress6"`
+	ServerCIDR        string `json:"serverCIDR"`
+	ServerCIDR6       string `json:"serverCIDR6"`
+	Pool              string `json:"pool"`                   // IPAM pool the address was allocated from
+	LeaseExpires      int64  `json:"leaseExpiresUnixMillis"` // The address is held until the peer is created or the lease expires
 }
 
 type UserAccount struct {
-	Email                string `json:"email"`
-	Role                 string `json:"role"` // "user", "admin"
-	FailedAttempts       int    `json:"failedAttempts"`
-	LastActiveUnixMillis int64  `json:"lastActiveUnixMillis"`
+	Email                 string `json:"email"`
+	Role                  string `json:"role"` // "user", "admin"
+	FailedAttempts        int    `json:"failedAttempts"`
+	LockedUntilUnixMillis int64  `json:"lockedUntilUnixMillis"` // Logins are refused until this time
+	LastActiveUnixMillis  int64  `json:"lastActiveUnixMillis"`
 }
 
 type UserAccountWithPass struct {
@@ -52,10 +95,13 @@ type LoginBody struct {
 }
 
 type APIKey struct {
-	UUID              string   `json:"uuid"`
-	Name              string   `json:"name"`
-	ExpiresUnixMillis int64    `json:"expiresUnixMillis"`
-	Attributes        []string `json:"attributes"`
+	UUID                      string   `json:"uuid"`
+	Name                      string   `json:"name"`
+	ExpiresUnixMillis         int64    `json:"expiresUnixMillis"`
+	Attributes                []string `json:"attributes"`                // Scopes, "<operation>-<topic>[:<resource id>]", or "wg-client"
+	LastUsedUnixMillis        int64    `json:"lastUsedUnixMillis"`        // Read only
+	LastUsedIP                string   `json:"lastUsedIp"`                // Read only
+	PreviousExpiresUnixMillis int64    `json:"previousExpiresUnixMillis"` // End of the grace period of the token replaced by the last rotation, read only
 }
 
 type APIKeyWithToken struct {
@@ -71,16 +117,299 @@ type APIKeyInit struct {
 	Token string `json:"token"`
 }
 
+type APIKeyRotation struct {
+	UUID                      string `json:"uuid"`
+	Token                     string `json:"token"`                     // The new token
+	PreviousExpiresUnixMillis int64  `json:"previousExpiresUnixMillis"` // The old token is accepted until this time
+}
+
 type ServerInfo struct {
 	PublicKey          string   `json:"publicKey"`
 	PublicEndpoint     string   `json:"publicEndpoint"`
 	PublicHost         string   `json:"publicHost"`
 	NameServers        []string `json:"nameServers"`
+	SearchDomains      []string `json:"searchDomains"` // The network's DNS zone, if any
 	Netmask            string   `json:"netmask"`
+	Netmask6           string   `json:"netmask6"` // Empty unless dual-stack is enabled
 	ServerInternalIP   string   `json:"serverInternalIP"`
+	ServerInternalIP6  string   `json:"serverInternalIP6"`
 	ServerInternalName string   `json:"serverInternalName"`
 }
 
 type Password struct {
 	Password string `json:"password"`
 }
+
+type IPPool struct {
+	Name        string `json:"name"`
+	Network     string `json:"network"`
+	CIDR        string `json:"cidr"`
+	Description string `json:"description"`
+}
+
+type IPReservation struct {
+	UUID         string `json:"uuid"`
+	Pool         string `json:"pool"`
+	StartAddress string `json:"startAddress"`
+	EndAddress   string `json:"endAddress"` // Same as StartAddress for a single address
+	Type         string `json:"type"`       // "reserved", "excluded", "static"
+	PeerUUID     string `json:"peerUUID"`   // Peer that owns a static assignment
+	Description  string `json:"description"`
+}
+
+type IPLease struct {
+	Address           string `json:"address"`
+	Pool              string `json:"pool"`
+	PeerUUID          string `json:"peerUUID"`
+	ExpiresUnixMillis int64  `json:"expiresUnixMillis"` // 0 once the address is bound to a created peer
+}
+
+type IPPoolUtilization struct {
+	Name     string `json:"name"`
+	CIDR     string `json:"cidr"`
+	Total    uint64 `json:"total"`    // Usable addresses in the pool
+	Used     uint64 `json:"used"`     // Addresses bound to peers
+	Leased   uint64 `json:"leased"`   // Addresses held by pending peer inits
+	Reserved uint64 `json:"reserved"` // Reserved, excluded and static addresses not in use
+	Free     uint64 `json:"free"`
+}
+
+type Network struct {
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	Interface      string `json:"interface"`      // Wireguard interface name
+	ListenPort     int    `json:"listenPort"`     // Wireguard UDP port
+	PrivateKey     string `json:"privateKey"`     // Wireguard private key (stored encrypted with AES256)
+	PublicKey      string `json:"publicKey"`      // Wireguard public key
+	CIDR           string `json:"cidr"`           // Tunnel network
+	CIDR6          string `json:"cidr6"`          // IPv6 ULA tunnel network (optional)
+	ServerAddress  string `json:"serverAddress"`  // Server tunnel address with mask
+	ServerAddress6 string `json:"serverAddress6"` // Server IPv6 tunnel address with mask (optional)
+	DNSZone        string `json:"dnsZone"`        // Peers resolve as <hostname>.<zone> (optional)
+	Mesh           bool   `json:"mesh"`           // Managed clients connect directly to each other, with the server as fallback
+}
+
+// A change of a network's server key. The new key is served on a second
+// interface and port until every peer has moved to it.
+type ServerKeyRotation struct {
+	ID                  int64                `json:"id"`
+	Network             string               `json:"network"`
+	PrivateKey          string               `json:"privateKey"` // New server private key (stored encrypted with AES256)
+	PublicKey           string               `json:"publicKey"`  // New server public key
+	Interface           string               `json:"interface"`  // Interface serving the new key
+	ListenPort          int                  `json:"listenPort"` // Port serving the new key
+	StartedUnixMillis   int64                `json:"startedUnixMillis"`
+	CompletedUnixMillis int64                `json:"completedUnixMillis"` // The old key was retired
+	AbortedUnixMillis   int64                `json:"abortedUnixMillis"`
+	Peers               []ServerKeyMigration `json:"peers"` // Migration status of the network's enabled peers
+	MigratedCount       int                  `json:"migratedCount"`
+}
+
+type ServerKeyMigration struct {
+	PeerUUID           string `json:"peerUuid"`
+	Hostname           string `json:"hostname"`
+	Managed            bool   `json:"managed"`            // Told about the new key over the long poll channel
+	MigratedUnixMillis int64  `json:"migratedUnixMillis"` // First handshake with the new key, 0 if not migrated
+}
+
+type ServerKeyRotationRequest struct {
+	Interface  string `json:"interface"`  // Defaults to the current interface name with a "k" suffix added or removed
+	ListenPort int    `json:"listenPort"` // Defaults to the next port after the current one
+}
+
+// A peer a managed client can reach directly in a mesh network
+type MeshEndpoint struct {
+	PeerUUID     string   `json:"peerUuid"`
+	PublicKey    string   `json:"publicKey"`
+	PreSharedKey string   `json:"preSharedKey"` // Shared by the two peers of the direct session only
+	Endpoint     string   `json:"endpoint"`     // Public address and port the server last saw the peer at
+	AllowedIPs   []string `json:"allowedIPs"`   // Tunnel addresses routed over the direct session
+}
+
+// A client's report of a direct session with another peer
+type MeshLinkReport struct {
+	PeerUUID                string `json:"peerUuid"`
+	LastHandshakeUnixMillis int64  `json:"lastHandshakeUnixMillis"`
+}
+
+// The path traffic between two peers of a mesh network takes
+type MeshLink struct {
+	Peer                    string `json:"peer"`
+	PeerHostname            string `json:"peerHostname"`
+	Remote                  string `json:"remote"`
+	RemoteHostname          string `json:"remoteHostname"`
+	Status                  string `json:"status"` // "direct" or "relayed"
+	Reason                  string `json:"reason"` // Why the pair is relayed
+	LastHandshakeUnixMillis int64  `json:"lastHandshakeUnixMillis"`
+}
+
+// A remote subnet advertised by a peer
+type SiteRoute struct {
+	Subnet                  string   `json:"subnet"`
+	PeerUUID                string   `json:"peerUuid"`
+	Hostname                string   `json:"hostname"`
+	Network                 string   `json:"network"`
+	Metric                  int      `json:"metric"`
+	Status                  string   `json:"status"`   // "active", "stale", "standby" or "failed"
+	Overlaps                []string `json:"overlaps"` // Overlapping subnets advertised by other peers, as "<subnet> (<hostname>)"
+	Error                   string   `json:"error"`
+	LastHandshakeUnixMillis int64    `json:"lastHandshakeUnixMillis"`
+}
+
+type PeerGroup struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []string `json:"members"`  // Peer UUIDs
+	Egress      string   `json:"egress"`   // Egress of members without their own, "split", "controller", "exit" or empty
+	ExitPeer    string   `json:"exitPeer"` // UUID of the exit peer when Egress is "exit"
+}
+
+type GroupPolicy struct {
+	UUID             string   `json:"uuid"`
+	SourceGroup      string   `json:"sourceGroup"`
+	DestinationGroup string   `json:"destinationGroup"`
+	Protocol         string   `json:"protocol"` // "tcp", "udp", "icmp", "any"
+	Ports            []string `json:"ports"`    // Ports or ranges such as "22" or "8000-8100" (tcp and udp only)
+	Description      string   `json:"description"`
+}
+
+type ACLRule struct {
+	UUID         string   `json:"uuid"`
+	Priority     int      `json:"priority"`     // Rules are evaluated in ascending priority order
+	Action       string   `json:"action"`       // "allow" or "deny"
+	Sources      []string `json:"sources"`      // "peer:<uuid>", "group:<name>", a CIDR, or "any"
+	Destinations []string `json:"destinations"` // "peer:<uuid>", "group:<name>", a CIDR, or "any"
+	Protocol     string   `json:"protocol"`     // "tcp", "udp", "icmp", "any"
+	Ports        []string `json:"ports"`        // Destination ports or ranges such as "22" or "8000-8100" (tcp and udp only)
+	Description  string   `json:"description"`
+}
+
+type ACLTestRequest struct {
+	Source      string `json:"source"`      // An IP address or "peer:<uuid>"
+	Destination string `json:"destination"` // An IP address or "peer:<uuid>"
+	Protocol    string `json:"protocol"`    // "tcp", "udp", "icmp"
+	Port        int    `json:"port"`
+}
+
+type ACLTestResult struct {
+	Allowed  bool   `json:"allowed"`
+	RuleUUID string `json:"ruleUuid"` // The matched rule, empty when the default action applied
+	Reason   string `json:"reason"`
+}
+
+type DNSRecord struct {
+	UUID        string `json:"uuid"`
+	Name        string `json:"name"`  // Fully qualified name, e.g. "git.vpn.corp"
+	Type        string `json:"type"`  // "A", "AAAA", "CNAME", "SRV", "TXT"
+	Value       string `json:"value"` // Record data in zone file format, e.g. "10 5 443 git.vpn.corp." for SRV
+	TTL         int    `json:"ttl"`
+	Description string `json:"description"`
+}
+
+type DNSUpstreamStatus struct {
+	Address             string `json:"address"`
+	Protocol            string `json:"protocol"` // "udp", "tls" (DNS over TLS), "https" (DNS over HTTPS)
+	Healthy             bool   `json:"healthy"`
+	LastCheckUnixMillis int64  `json:"lastCheckUnixMillis"`
+	LastError           string `json:"lastError"`
+}
+
+type DNSQueryLogEntry struct {
+	PeerUUID            string `json:"peerUuid"`
+	Name                string `json:"name"`
+	Type                string `json:"type"`
+	Rcode               string `json:"rcode"`
+	Result              string `json:"result"` // "local", "blocked", "forwarded", "upstream", "cached", "failed"
+	TimestampUnixMillis int64  `json:"timestampUnixMillis"`
+}
+
+type AuditEvent struct {
+	ID                  int64         `json:"id"`
+	TimestampUnixMillis int64         `json:"timestampUnixMillis"`
+	Actor               string        `json:"actor"`     // Session email or API key UUID
+	ActorType           string        `json:"actorType"` // "user", "apikey", "anonymous"
+	IP                  string        `json:"ip"`
+	Action              string        `json:"action"` // e.g. "peer.update"
+	Target              string        `json:"target"`
+	Status              int           `json:"status"` // HTTP status of the request
+	Changes             []AuditChange `json:"changes"`
+}
+
+type AuditChange struct {
+	Field  string `json:"field"`
+	Before any    `json:"before"`
+	After  any    `json:"after"`
+}
+
+type Session struct {
+	ID                    string `json:"id"`
+	Email                 string `json:"email"`
+	IP                    string `json:"ip"` // Client IP of the most recent request
+	UserAgent             string `json:"userAgent"`
+	CreatedUnixMillis     int64  `json:"createdUnixMillis"`
+	LastActiveUnixMillis  int64  `json:"lastActiveUnixMillis"`
+	ExpiresUnixMillis     int64  `json:"expiresUnixMillis"`     // Absolute expiry
+	IdleExpiresUnixMillis int64  `json:"idleExpiresUnixMillis"` // Expiry if the session stays idle
+	Current               bool   `json:"current"`               // Session making the request
+}
+
+type IPLockout struct {
+	IP                    string `json:"ip"`
+	FailedAttempts        int    `json:"failedAttempts"`
+	LastFailureUnixMillis int64  `json:"lastFailureUnixMillis"`
+	LockedUntilUnixMillis int64  `json:"lockedUntilUnixMillis"`
+}
+
+// Settings of a peer created by an enrollment
+type PeerTemplate struct {
+	Network          string   `json:"network"`          // Defaults to the default network
+	Pool             string   `json:"pool"`             // IPAM pool for the tunnel address, defaults to the network's pool
+	Pool6            string   `json:"pool6"`            // IPAM pool for the IPv6 tunnel address (dual-stack only)
+	KeepAliveSeconds int      `json:"keepAliveSeconds"` // Defaults to 25
+	AllowedSubnets   []string `json:"allowedSubnets"`   // Defaults to the network's tunnel ranges
+	Groups           []string `json:"groups"`           // Groups the peer is added to
+}
+
+type Enrollment struct {
+	UUID              string       `json:"uuid"`
+	Description       string       `json:"description"`
+	PeerUUID          string       `json:"peerUuid"` // Pre-created peer the code enrolls, or empty to create one from the template
+	Template          PeerTemplate `json:"template"`
+	CreatedBy         string       `json:"createdBy"`
+	CreatedUnixMillis int64        `json:"createdUnixMillis"`
+	ExpiresUnixMillis int64        `json:"expiresUnixMillis"`
+	UsedUnixMillis    int64        `json:"usedUnixMillis"` // 0 until the code is exchanged
+	UsedIP            string       `json:"usedIp"`
+	UsedByPeerUUID    string       `json:"usedByPeerUuid"` // Peer enrolled by the code
+}
+
+type EnrollmentWithCode struct {
+	Enrollment Enrollment `json:"enrollment"`
+	Code       string     `json:"code"` // Only returned when the code is created
+}
+
+type EnrollRequest struct {
+	Code          string `json:"code"`
+	Hostname      string `json:"hostname"`  // Required when enrolling from a template
+	PublicKey     string `json:"publicKey"` // Public key of a key pair generated by the device
+	OS            string `json:"os"`
+	ClientType    string `json:"clientType"`
+	ClientVersion string `json:"clientVersion"`
+}
+
+type EnrollResponse struct {
+	Peer       Peer       `json:"peer"`
+	ServerInfo ServerInfo `json:"serverInfo"`
+	Config     string     `json:"config"`     // wg-quick configuration
+	APIKeyUUID string     `json:"apiKeyUuid"` // Credential scoped to the peer
+	Token      string     `json:"token"`
+}
+
+// Status of a supervised child such as a wireguard-go process or a DNS listener
+type ChildStatus struct {
+	Name            string `json:"name"`
+	State           string `json:"state"` // starting, running or restarting
+	Restarts        int    `json:"restarts"`
+	LastError       string `json:"lastError"`
+	SinceUnixMillis int64  `json:"sinceUnixMillis"` // When the child entered its current state
+}
@@ -10,8 +10,25 @@ import type {
   APIKeyWithToken
 } from "@/types/shared";
 
+// Reads the CSRF token set by the server at login
+function csrfToken(): string {
+  const match = document.cookie.match(/(?:^|;\s*)csrfToken=([^;]*)/);
+  return match ? decodeURIComponent(match[1]) : "";
+}
+
+// Wraps fetch, adding the CSRF token header to state changing requests
+function apiFetch(input: string, init: RequestInit = {}): Promise<Response> {
+  const method = (init.method || "GET").toUpperCase();
+  if (method !== "GET" && method !== "HEAD") {
+    const headers = new Headers(init.headers);
+    headers.set("X-CSRF-Token", csrfToken());
+    init = { ...init, headers };
+  }
+  return fetch(input, init);
+}
+
 export async function POST_PreLogin(): Promise<Response> {
-  const response = await fetch("/api/v1/prelogin", {
+  const response = await apiFetch("/api/v1/prelogin", {
     method: "POST"
   });
   if (!response.ok) {
@@ -23,7 +40,7 @@ export async function POST_PreLogin(): Promise<Response> {
 }
 
 export async function POST_Login(body: LoginBody): Promise<Response> {
-  const response = await fetch("/api/v1/login", {
+  const response = await apiFetch("/api/v1/login", {
     method: "POST",
     headers: {
       "Content-Type": "application/json"
@@ -39,7 +56,7 @@ export async function POST_Login(body: LoginBody): Promise<Response> {
 }
 
 export async function POST_Logout(): Promise<void> {
-  const response = await fetch("/api/v1/logout", {
+  const response = await apiFetch("/api/v1/logout", {
     method: "POST"
   });
   if (!response.ok) {
@@ -51,7 +68,7 @@ export async function POST_Logout(): Promise<void> {
 }
 
 export async function GET_Peers(): Promise<Peer[]> {
-  const response = await fetch("/api/v1/peers");
+  const response = await apiFetch("/api/v1/peers");
   if (!response.ok) {
     const err = await response.text();
     throw new Error(err);
@@ -61,7 +78,7 @@ export async function GET_Peers(): Promise<Peer[]> {
 }
 
 export async function GET_Peer(uuid: string): Promise<Peer> {
-  const response = await fetch("/api/v1/peers/" + uuid);
+  const response = await apiFetch("/api/v1/peers/" + uuid);
   if (!response.ok) {
     const err = await response.text();
     throw new Error(err);
@@ -71,7 +88,7 @@ export async function GET_Peer(uuid: string): Promise<Peer> {
 }
 
 export async function PUT_Peer(peer: Peer): Promise<void> {
-  const response = await fetch("/api/v1/peers/" + peer.uuid, {
+  const response = await apiFetch("/api/v1/peers/" + peer.uuid, {
     method: "PUT",
     headers: {
       "Content-Type": "application/json"
@@ -87,7 +104,7 @@ export async function PUT_Peer(peer: Peer): Promise<void> {
 }
 
 export async function PATCH_Peer(peer: Peer): Promise<void> {
-  const response = await fetch("/api/v1/peers/" + peer.uuid, {
+  const response = await apiFetch("/api/v1/peers/" + peer.uuid, {
     method: "PATCH",
     headers: {
       "Content-Type": "application/json"
@@ -103,7 +120,7 @@ export async function PATCH_Peer(peer: Peer): Promise<void> {
 }
 
 export async function DELETE_Peer(uuid: string): Promise<void> {
-  const response = await fetch("/api/v1/peers/" + uuid, {
+  const response = await apiFetch("/api/v1/peers/" + uuid, {
     method: "DELETE"
   });
   if (!response.ok) {
@@ -115,7 +132,7 @@ export async function DELETE_Peer(uuid: string): Promise<void> {
 }
 
 export async function GET_PeerInit(): Promise<PeerInit> {
-  const response = await fetch("/api/v1/peers/init");
+  const response = await apiFetch("/api/v1/peers/init");
   if (!response.ok) {
     const err = await response.text();
     throw new Error(err);
@@ -125,7 +142,7 @@ export async function GET_PeerInit(): Promise<PeerInit> {
 }
 
 export async function GET_Accounts(): Promise<UserAccount[]> {
-  const response = await fetch("/api/v1/accounts");
+  const response = await apiFetch("/api/v1/accounts");
   if (!response.ok) {
     const err = await response.text();
     throw new Error(err);
@@ -135,7 +152,7 @@ export async function GET_Accounts(): Promise<UserAccount[]> {
 }
 
 export async function PUT_Account(account: UserAccountWithPass): Promise<void> {
-  const response = await fetch("/api/v1/accounts/" + account.email, {
+  const response = await apiFetch("/api/v1/accounts/" + account.email, {
     method: "PUT",
     headers: {
       "Content-Type": "application/json"
@@ -151,7 +168,7 @@ export async function PUT_Account(account: UserAccountWithPass): Promise<void> {
 }
 
 export async function PATCH_Account(account: UserAccount): Promise<void> {
-  const response = await fetch("/api/v1/accounts/" + account.email, {
+  const response = await apiFetch("/api/v1/accounts/" + account.email, {
     method: "PATCH",
     headers: {
       "Content-Type": "application/json"
@@ -167,7 +184,7 @@ export async function PATCH_Account(account: UserAccount): Promise<void> {
 }
 
 export async function PATCH_AccountPassword(email: string, password: string): Promise<void> {
-  const response = await fetch("/api/v1/accounts/" + email + "/password", {
+  const response = await apiFetch("/api/v1/accounts/" + email + "/password", {
     method: "PATCH",
     headers: {
       "Content-Type": "application/json"
@@ -183,7 +200,7 @@ export async function PATCH_AccountPassword(email: string, password: string): Pr
 }
 
 export async function DELETE_Account(email: string): Promise<void> {
-  const response = await fetch("/api/v1/accounts/" + email, {
+  const response = await apiFetch("/api/v1/accounts/" + email, {
     method: "DELETE"
   });
   if (!response.ok) {
@@ -194,8 +211,20 @@ export async function DELETE_Account(email: string): Promise<void> {
   return;
 }
 
+export async function POST_AccountUnlock(email: string): Promise<void> {
+  const response = await apiFetch("/api/v1/accounts/" + email + "/unlock", {
+    method: "POST"
+  });
+  if (!response.ok) {
+    const err = await response.text();
+    throw new Error(err);
+  }
+
+  return;
+}
+
 export async function GET_APIKeys(): Promise<APIKey[]> {
-  const response = await fetch("/api/v1/apikeys");
+  const response = await apiFetch("/api/v1/apikeys");
   if (!response.ok) {
     const err = await response.text();
     throw new Error(err);
@@ -205,7 +234,7 @@ export async function GET_APIKeys(): Promise<APIKey[]> {
 }
 
 export async function PUT_APIKey(key: APIKeyWithToken): Promise<void> {
-  const response = await fetch("/api/v1/apikeys/" + key.uuid, {
+  const response = await apiFetch("/api/v1/apikeys/" + key.uuid, {
     method: "PUT",
     headers: {
       "Content-Type": "application/json"
@@ -221,7 +250,7 @@ export async function PUT_APIKey(key: APIKeyWithToken): Promise<void> {
 }
 
 export async function PATCH_APIKey(key: APIKey): Promise<void> {
-  const response = await fetch("/api/v1/apikeys/" + key.uuid, {
+  const response = await apiFetch("/api/v1/apikeys/" + key.uuid, {
     method: "PATCH",
     headers: {
       "Content-Type": "application/json"
@@ -237,7 +266,7 @@ export async function PATCH_APIKey(key: APIKey): Promise<void> {
 }
 
 export async function DELETE_APIKey(uuid: string): Promise<void> {
-  const response = await fetch("/api/v1/apikeys/" + uuid, {
+  const response = await apiFetch("/api/v1/apikeys/" + uuid, {
     method: "DELETE"
   });
   if (!response.ok) {
@@ -249,7 +278,7 @@ export async function DELETE_APIKey(uuid: string): Promise<void> {
 }
 
 export async function GET_APIKeyInit(): Promise<APIKeyInit> {
-  const response = await fetch("/api/v1/apikeys/init");
+  const response = await apiFetch("/api/v1/apikeys/init");
   if (!response.ok) {
     const err = await response.text();
     throw new Error(err);
@@ -259,7 +288,7 @@ export async function GET_APIKeyInit(): Promise<APIKeyInit> {
 }
 
 export async function GET_ServerInfo(): Promise<ServerInfo> {
-  const response = await fetch("/api/v1/serverinfo");
+  const response = await apiFetch("/api/v1/serverinfo");
   if (!response.ok) {
     const err = await response.text();
     throw new Error(err);
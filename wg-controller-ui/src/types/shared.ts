@@ -7,12 +7,14 @@ export interface Peer {
   uuid: string;
   hostname: string;
   enabled: boolean;
+  network: string; // Name of the network the peer belongs to
   privateKey: string; // Wireguard private key (stored encrypted with AES256)
   publicKey: string; // Wireguard public key
   preSharedKey: string; // Wireguard pre-shared key (stored encrypted with AES256)
   keepAliveSeconds: number /* int */; // Wireguard keep-alive interval in seconds
   localTunAddress: string; // The IP address of the server's tunnel interface (future use)
   remoteTunAddress: string; // The IP address of the peer's tunnel interface
+  remoteTunAddress6: string; // The IPv6 address of the peer's tunnel interface (dual-stack only)
   remoteSubnets: string[]; // A list of CIDR subnets that the peer can provide access to
   allowedSubnets: string[]; // A list of CIDR subnets that the peer is allowed to access
   lastSeenUnixMillis: number /* int64 */;
@@ -23,20 +25,60 @@ export interface Peer {
   clientVersion: string;
   clientType: string;
   attributes: string[];
+  dnsForwardDomains: string[]; // Domains resolved by a DNS server behind the peer
+  dnsForwardResolver: string; // IP address of that DNS server, within the peer's remote subnets
+  dnsQueryLogging: boolean; // Record the peer's DNS queries in the query log
+  aliases: string[]; // Additional DNS names of the peer, e.g. "git" or "*.dev-box"
+  keyRotationDays: number /* int */; // Days between key pair rotations, 0 for the server default, -1 for never
+  pskRotationDays: number /* int */; // Days between pre-shared key rotations, 0 for the server default, -1 for never
+  keyRotatedUnixMillis: number /* int64 */;
+  pskRotatedUnixMillis: number /* int64 */;
+  egress: string; // "split", "controller", "exit", or empty to inherit from the peer's groups
+  exitPeer: string; // UUID of the exit peer when Egress is "exit"
+  routeMetrics: { [key: string]: number /* int */}; // Metric of each remote subnet, the lowest is preferred when several peers advertise a subnet
+}
+/**
+ * New key material waiting to be acknowledged by a peer
+ */
+export interface KeyRotation {
+  peerUuid: string;
+  id: string;
+  rotateKey: boolean;
+  rotatePsk: boolean;
+  privateKey: string; // Empty when the client generates its own key pair
+  publicKey: string; // Empty until a client-generated key pair is acknowledged
+  preSharedKey: string; // Empty when only the key pair is rotated
+  createdUnixMillis: number /* int64 */;
+  pushedUnixMillis: number /* int64 */; // Last time the rotation was sent to the client
+  alertedUnixMillis: number /* int64 */; // Time an alert was raised for a stock client
+}
+export interface KeyRotationRequest {
+  rotateKey: boolean;
+  rotatePsk: boolean;
+}
+export interface KeyRotationAck {
+  id: string;
+  publicKey: string; // The new public key of a client-generated key pair
 }
 export interface PeerInit {
   uuid: string;
-  privateKey: string;
+  network: string;
+  privateKey: string; // Empty when the client generates its own key pair
   publicKey: string;
   preSharedKey: string;
   localTunAddress: string;
   remoteTunAddress: string;
+  remoteTunAddress6: string;
   serverCIDR: string;
+  serverCIDR6: string;
+  pool: string; // IPAM pool the address was allocated from
+  leaseExpiresUnixMillis: number /* int64 */; // The address is held until the peer is created or the lease expires
 }
 export interface UserAccount {
   email: string;
   role: string; // "user", "admin"
   failedAttempts: number /* int */;
+  lockedUntilUnixMillis: number /* int64 */; // Logins are refused until this time
   lastActiveUnixMillis: number /* int64 */;
 }
 export interface UserAccountWithPass {
@@ -53,7 +95,10 @@ export interface APIKey {
   uuid: string;
   name: string;
   expiresUnixMillis: number /* int64 */;
-  attributes: string[];
+  attributes: string[]; // Scopes, "<operation>-<topic>[:<resource id>]", or "wg-client"
+  lastUsedUnixMillis: number /* int64 */; // Read only
+  lastUsedIp: string; // Read only
+  previousExpiresUnixMillis: number /* int64 */; // End of the grace period of the token replaced by the last rotation, read only
 }
 export interface APIKeyWithToken {
   uuid: string;
@@ -66,15 +111,281 @@ export interface APIKeyInit {
   uuid: string;
   token: string;
 }
+export interface APIKeyRotation {
+  uuid: string;
+  token: string; // The new token
+  previousExpiresUnixMillis: number /* int64 */; // The old token is accepted until this time
+}
 export interface ServerInfo {
   publicKey: string;
   publicEndpoint: string;
   publicHost: string;
   nameServers: string[];
+  searchDomains: string[]; // The network's DNS zone, if any
   netmask: string;
+  netmask6: string; // Empty unless dual-stack is enabled
   serverInternalIP: string;
+  serverInternalIP6: string;
   serverInternalName: string;
 }
 export interface Password {
   password: string;
 }
+export interface IPPool {
+  name: string;
+  network: string;
+  cidr: string;
+  description: string;
+}
+export interface IPReservation {
+  uuid: string;
+  pool: string;
+  startAddress: string;
+  endAddress: string; // Same as StartAddress for a single address
+  type: string; // "reserved", "excluded", "static"
+  peerUUID: string; // Peer that owns a static assignment
+  description: string;
+}
+export interface IPLease {
+  address: string;
+  pool: string;
+  peerUUID: string;
+  expiresUnixMillis: number /* int64 */; // 0 once the address is bound to a created peer
+}
+export interface IPPoolUtilization {
+  name: string;
+  cidr: string;
+  total: number /* uint64 */; // Usable addresses in the pool
+  used: number /* uint64 */; // Addresses bound to peers
+  leased: number /* uint64 */; // Addresses held by pending peer inits
+  reserved: number /* uint64 */; // Reserved, excluded and static addresses not in use
+  free: number /* uint64 */;
+}
+export interface Network {
+  name: string;
+  description: string;
+  interface: string; // Wireguard interface name
+  listenPort: number /* int */; // Wireguard UDP port
+  privateKey: string; // Wireguard private key (stored encrypted with AES256)
+  publicKey: string; // Wireguard public key
+  cidr: string; // Tunnel network
+  cidr6: string; // IPv6 ULA tunnel network (optional)
+  serverAddress: string; // Server tunnel address with mask
+  serverAddress6: string; // Server IPv6 tunnel address with mask (optional)
+  dnsZone: string; // Peers resolve as <hostname>.<zone> (optional)
+  mesh: boolean; // Managed clients connect directly to each other, with the server as fallback
+}
+/**
+ * A change of a network's server key. The new key is served on a second
+ * interface and port until every peer has moved to it.
+ */
+export interface ServerKeyRotation {
+  id: number /* int64 */;
+  network: string;
+  privateKey: string; // New server private key (stored encrypted with AES256)
+  publicKey: string; // New server public key
+  interface: string; // Interface serving the new key
+  listenPort: number /* int */; // Port serving the new key
+  startedUnixMillis: number /* int64 */;
+  completedUnixMillis: number /* int64 */; // The old key was retired
+  abortedUnixMillis: number /* int64 */;
+  peers: ServerKeyMigration[]; // Migration status of the network's enabled peers
+  migratedCount: number /* int */;
+}
+export interface ServerKeyMigration {
+  peerUuid: string;
+  hostname: string;
+  managed: boolean; // Told about the new key over the long poll channel
+  migratedUnixMillis: number /* int64 */; // First handshake with the new key, 0 if not migrated
+}
+export interface ServerKeyRotationRequest {
+  interface: string; // Defaults to the current interface name with a "k" suffix added or removed
+  listenPort: number /* int */; // Defaults to the next port after the current one
+}
+/**
+ * A peer a managed client can reach directly in a mesh network
+ */
+export interface MeshEndpoint {
+  peerUuid: string;
+  publicKey: string;
+  preSharedKey: string; // Shared by the two peers of the direct session only
+  endpoint: string; // Public address and port the server last saw the peer at
+  allowedIPs: string[]; // Tunnel addresses routed over the direct session
+}
+/**
+ * A client's report of a direct session with another peer
+ */
+export interface MeshLinkReport {
+  peerUuid: string;
+  lastHandshakeUnixMillis: number /* int64 */;
+}
+/**
+ * The path traffic between two peers of a mesh network takes
+ */
+export interface MeshLink {
+  peer: string;
+  peerHostname: string;
+  remote: string;
+  remoteHostname: string;
+  status: string; // "direct" or "relayed"
+  reason: string; // Why the pair is relayed
+  lastHandshakeUnixMillis: number /* int64 */;
+}
+/**
+ * A remote subnet advertised by a peer
+ */
+export interface SiteRoute {
+  subnet: string;
+  peerUuid: string;
+  hostname: string;
+  network: string;
+  metric: number /* int */;
+  status: string; // "active", "stale", "standby" or "failed"
+  overlaps: string[]; // Overlapping subnets advertised by other peers, as "<subnet> (<hostname>)"
+  error: string;
+  lastHandshakeUnixMillis: number /* int64 */;
+}
+export interface PeerGroup {
+  name: string;
+  description: string;
+  members: string[]; // Peer UUIDs
+  egress: string; // Egress of members without their own, "split", "controller", "exit" or empty
+  exitPeer: string; // UUID of the exit peer when Egress is "exit"
+}
+export interface GroupPolicy {
+  uuid: string;
+  sourceGroup: string;
+  destinationGroup: string;
+  protocol: string; // "tcp", "udp", "icmp", "any"
+  ports: string[]; // Ports or ranges such as "22" or "8000-8100" (tcp and udp only)
+  description: string;
+}
+export interface ACLRule {
+  uuid: string;
+  priority: number /* int */; // Rules are evaluated in ascending priority order
+  action: string; // "allow" or "deny"
+  sources: string[]; // "peer:<uuid>", "group:<name>", a CIDR, or "any"
+  destinations: string[]; // "peer:<uuid>", "group:<name>", a CIDR, or "any"
+  protocol: string; // "tcp", "udp", "icmp", "any"
+  ports: string[]; // Destination ports or ranges such as "22" or "8000-8100" (tcp and udp only)
+  description: string;
+}
+export interface ACLTestRequest {
+  source: string; // An IP address or "peer:<uuid>"
+  destination: string; // An IP address or "peer:<uuid>"
+  protocol: string; // "tcp", "udp", "icmp"
+  port: number /* int */;
+}
+export interface ACLTestResult {
+  allowed: boolean;
+  ruleUuid: string; // The matched rule, empty when the default action applied
+  reason: string;
+}
+export interface DNSRecord {
+  uuid: string;
+  name: string; // Fully qualified name, e.g. "git.vpn.corp"
+  type: string; // "A", "AAAA", "CNAME", "SRV", "TXT"
+  value: string; // Record data in zone file format, e.g. "10 5 443 git.vpn.corp." for SRV
+  ttl: number /* int */;
+  description: string;
+}
+export interface DNSUpstreamStatus {
+  address: string;
+  protocol: string; // "udp", "tls" (DNS over TLS), "https" (DNS over HTTPS)
+  healthy: boolean;
+  lastCheckUnixMillis: number /* int64 */;
+  lastError: string;
+}
+export interface DNSQueryLogEntry {
+  peerUuid: string;
+  name: string;
+  type: string;
+  rcode: string;
+  result: string; // "local", "blocked", "forwarded", "upstream", "cached", "failed"
+  timestampUnixMillis: number /* int64 */;
+}
+export interface AuditEvent {
+  id: number /* int64 */;
+  timestampUnixMillis: number /* int64 */;
+  actor: string; // Session email or API key UUID
+  actorType: string; // "user", "apikey", "anonymous"
+  ip: string;
+  action: string; // e.g. "peer.update"
+  target: string;
+  status: number /* int */; // HTTP status of the request
+  changes: AuditChange[];
+}
+export interface AuditChange {
+  field: string;
+  before: any;
+  after: any;
+}
+export interface Session {
+  id: string;
+  email: string;
+  ip: string; // Client IP of the most recent request
+  userAgent: string;
+  createdUnixMillis: number /* int64 */;
+  lastActiveUnixMillis: number /* int64 */;
+  expiresUnixMillis: number /* int64 */; // Absolute expiry
+  idleExpiresUnixMillis: number /* int64 */; // Expiry if the session stays idle
+  current: boolean; // Session making the request
+}
+export interface IPLockout {
+  ip: string;
+  failedAttempts: number /* int */;
+  lastFailureUnixMillis: number /* int64 */;
+  lockedUntilUnixMillis: number /* int64 */;
+}
+/**
+ * Settings of a peer created by an enrollment
+ */
+export interface PeerTemplate {
+  network: string; // Defaults to the default network
+  pool: string; // IPAM pool for the tunnel address, defaults to the network's pool
+  pool6: string; // IPAM pool for the IPv6 tunnel address (dual-stack only)
+  keepAliveSeconds: number /* int */; // Defaults to 25
+  allowedSubnets: string[]; // Defaults to the network's tunnel ranges
+  groups: string[]; // Groups the peer is added to
+}
+export interface Enrollment {
+  uuid: string;
+  description: string;
+  peerUuid: string; // Pre-created peer the code enrolls, or empty to create one from the template
+  template: PeerTemplate;
+  createdBy: string;
+  createdUnixMillis: number /* int64 */;
+  expiresUnixMillis: number /* int64 */;
+  usedUnixMillis: number /* int64 */; // 0 until the code is exchanged
+  usedIp: string;
+  usedByPeerUuid: string; // Peer enrolled by the code
+}
+export interface EnrollmentWithCode {
+  enrollment: Enrollment;
+  code: string; // Only returned when the code is created
+}
+export interface EnrollRequest {
+  code: string;
+  hostname: string; // Required when enrolling from a template
+  publicKey: string; // Public key of a key pair generated by the device
+  os: string;
+  clientType: string;
+  clientVersion: string;
+}
+export interface EnrollResponse {
+  peer: Peer;
+  serverInfo: ServerInfo;
+  config: string; // wg-quick configuration
+  apiKeyUuid: string; // Credential scoped to the peer
+  token: string;
+}
+/**
+ * Status of a supervised child such as a wireguard-go process or a DNS listener
+ */
+export interface ChildStatus {
+  name: string;
+  state: string; // starting, running or restarting
+  restarts: number /* int */;
+  lastError: string;
+  sinceUnixMillis: number /* int64 */; // When the child entered its current state
+}
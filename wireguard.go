@@ -7,31 +7,59 @@ import (
 	"net"
 	"os"
 	"os/exec"
-	"strconv"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/vishvananda/netlink"
 	"github.com/wg-controller/wg-controller/db"
 	"github.com/wg-controller/wg-controller/types"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-var wireguard_cmd *exec.Cmd
+// WireGuard backends
+const BackendAuto = "auto"
+const BackendKernel = "kernel"
+const BackendUserspace = "wireguard-go"
+
+// How long to wait for a new interface to accept configuration
+const WireguardStartTimeout = 5 * time.Second
+
+// Directory of the UAPI sockets created by wireguard-go
+const WireguardSocketDir = "/var/run/wireguard"
+
+var wireguardProcesses sync.Map // map[interface]*Supervised
+var wireguardBackends sync.Map  // map[interface]backend
 var wg *wgctrl.Client
 
-// Starts wireguard-go with a goroutine attached
+// Starts the interface of every network and connects the wireguard client
 func StartWireguard() {
-	cmd := exec.Command("wireguard-go", "-f", ENV.WG_INTERFACE)
-	wireguard_cmd = cmd
+	networks, err := db.GetNetworks()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	go func() {
-		log.Println("Starting wireguard-go")
-		op, err := cmd.Output()
+	for _, network := range networks {
+		err = StartWireguardInterface(network.Interface)
 		if err != nil {
-			fmt.Println(string(op))
-			os.Exit(1)
+			log.Fatal(err)
 		}
-	}()
+	}
+
+	// Start the interfaces serving the new keys of rotations in progress
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range rotations {
+		err = StartWireguardInterface(r.Interface)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Create wireguard client
 	client, err := wgctrl.New()
@@ -41,17 +69,186 @@ func StartWireguard() {
 	wg = client
 }
 
-// Kills wireguard-go
+// Starts a single interface. Kernel WireGuard is used when available,
+// otherwise a supervised wireguard-go process is started.
+func StartWireguardInterface(iface string) error {
+	if ENV.WG_BACKEND != BackendUserspace {
+		err := startKernelInterface(iface)
+		if err == nil {
+			wireguardBackends.Store(iface, BackendKernel)
+			log.Println("Created kernel wireguard interface", iface)
+			return nil
+		}
+		if ENV.WG_BACKEND == BackendKernel {
+			return fmt.Errorf("unable to create kernel wireguard interface %s: %w", iface, err)
+		}
+		log.Println("Kernel wireguard unavailable for", iface+", falling back to wireguard-go:", err)
+	}
+
+	wireguardBackends.Store(iface, BackendUserspace)
+	log.Println("Starting wireguard-go for", iface)
+	process, err := superviseWireguardGo(iface)
+	wireguardProcesses.Store(iface, process)
+	return err
+}
+
+// Runs wireguard-go for an interface, restarting it if it exits. The process
+// is ready once its UAPI socket accepts connections.
+func superviseWireguardGo(iface string) (*Supervised, error) {
+	name := "wireguard-go " + iface
+	var current atomic.Pointer[exec.Cmd]
+
+	start := func() (func() error, error) {
+		output := prefixedLogWriter(name)
+		cmd := exec.Command("wireguard-go", "-f", iface)
+		cmd.Stdout = output
+		cmd.Stderr = output
+		err := cmd.Start()
+		if err != nil {
+			output.Close()
+			return nil, err
+		}
+		current.Store(cmd)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+			output.Close()
+		}()
+
+		deadline := time.After(WireguardStartTimeout)
+		for {
+			conn, err := net.Dial("unix", filepath.Join(WireguardSocketDir, iface+".sock"))
+			if err == nil {
+				conn.Close()
+				return func() error { return <-done }, nil
+			}
+
+			select {
+			case err := <-done:
+				if err == nil {
+					err = errors.New("exited before its UAPI socket was ready")
+				}
+				return nil, err
+			case <-deadline:
+				cmd.Process.Kill()
+				<-done
+				return nil, fmt.Errorf("UAPI socket was not ready after %s", WireguardStartTimeout)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+
+	stop := func() {
+		cmd := current.Load()
+		if cmd != nil && cmd.Process != nil {
+			err := cmd.Process.Kill()
+			if err != nil && !errors.Is(err, os.ErrProcessDone) {
+				log.Println("Error stopping wireguard-go:", err)
+			}
+		}
+	}
+
+	return Supervise(name, start, stop, func() { resyncWireguardInterface(iface) })
+}
+
+// Reapplies the configuration lost when the wireguard-go process of an interface restarts
+func resyncWireguardInterface(iface string) {
+	networks, err := db.GetNetworks()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	rotations, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, network := range networks {
+		if r, ok := rotations[network.Name]; ok && r.Interface == iface {
+			network = rotationNetwork(network, r)
+		} else if network.Interface != iface {
+			continue
+		}
+		err = SetWireguardInterface(network)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	resyncNetworking()
+}
+
+// Creates a kernel wireguard interface through netlink
+func startKernelInterface(iface string) error {
+	// Remove an interface left over from a previous run
+	if link, err := netlink.LinkByName(iface); err == nil {
+		if link.Type() != "wireguard" {
+			return fmt.Errorf("%s exists and is not a wireguard interface", iface)
+		}
+		err = netlink.LinkDel(link)
+		if err != nil {
+			return err
+		}
+	}
+
+	return netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: iface}})
+}
+
+// Waits until an interface accepts configuration
+func WaitForWireguardInterface(iface string) error {
+	var err error
+	deadline := time.Now().Add(WireguardStartTimeout)
+	for time.Now().Before(deadline) {
+		_, err = wg.Device(iface)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("wireguard interface %s did not start: %w", iface, err)
+}
+
+// Returns the backend of every started interface
+func WireguardBackends() map[string]string {
+	backends := map[string]string{}
+	wireguardBackends.Range(func(key, value interface{}) bool {
+		backends[key.(string)] = value.(string)
+		return true
+	})
+	return backends
+}
+
+// Stops every interface
 func StopWireguard() {
-	if wireguard_cmd != nil {
-		err := wireguard_cmd.Process.Kill()
+	wireguardBackends.Range(func(key, value interface{}) bool {
+		StopWireguardInterface(key.(string))
+		return true
+	})
+}
+
+// Removes a kernel interface, or kills the wireguard-go process for an interface
+func StopWireguardInterface(iface string) {
+	backend, _ := wireguardBackends.LoadAndDelete(iface)
+	if backend == BackendKernel {
+		link, err := netlink.LinkByName(iface)
+		if err == nil {
+			err = netlink.LinkDel(link)
+		}
 		if err != nil {
-			log.Fatal("Error stopping wireguard-go:", err)
+			log.Println("Error removing wireguard interface:", err)
 		}
+		return
+	}
+
+	process, ok := wireguardProcesses.LoadAndDelete(iface)
+	if ok {
+		process.(*Supervised).Stop()
 	}
 }
 
-func PruneWireguardPeers(peerPublicKeys []string) error {
+func PruneWireguardPeers(iface string, peerPublicKeys []string) error {
 	var wgPeers []wgtypes.PeerConfig
 	for _, pk := range peerPublicKeys {
 		// Parse PublicKey
@@ -69,22 +266,50 @@ func PruneWireguardPeers(peerPublicKeys []string) error {
 	}
 
 	// Append the wireguard-go configuration
-	return wg.ConfigureDevice(ENV.WG_INTERFACE, wgtypes.Config{
+	return wg.ConfigureDevice(iface, wgtypes.Config{
 		ReplacePeers: false,
 		Peers:        wgPeers,
 	})
 }
 
+// Syncs the wireguard configuration of every network
 func SyncWireguardConfiguration() error {
+	networks, err := db.GetNetworks()
+	if err != nil {
+		return err
+	}
+
 	// Get all peers from the database
 	peers, err := db.GetPeers()
 	if err != nil {
 		return err
 	}
 
+	for _, network := range networks {
+		err = SyncWireguardNetwork(network, peers)
+		if err != nil {
+			return fmt.Errorf("network %s: %w", network.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Syncs a network's wireguard interfaces with the peers that belong to it.
+// During a server key rotation the peers are served on both interfaces.
+func SyncWireguardNetwork(network types.Network, peers []types.Peer) error {
+	// A subnet advertised by several peers is only allowed for the peer it is routed through
+	routed := activeSubnets(CompileSiteRoutes(peers))
+
 	// Convert peers to wireguard-go peer configurations
 	var wgPeers []wgtypes.PeerConfig
+	members := map[string]bool{}
 	for _, peer := range peers {
+		if PeerNetworkName(peer) != network.Name {
+			continue
+		}
+		members[peer.PublicKey] = true
+
 		// Convert KeepAliveSeconds to time.Duration
 		keepAliveDuration := time.Duration(peer.KeepAliveSeconds) * time.Second
 
@@ -107,6 +332,10 @@ func SyncWireguardConfiguration() error {
 			if err != nil {
 				break
 			}
+			ones, _ := ipNet.Mask.Size()
+			if ones > 0 && !slices.Contains(routed[peer.UUID], ipNet.String()) {
+				continue
+			}
 			allowedIPs = append(allowedIPs, *ipNet)
 		}
 		// Append peer's own subnet
@@ -116,6 +345,15 @@ func SyncWireguardConfiguration() error {
 		} else {
 			allowedIPs = append(allowedIPs, *ipNet)
 		}
+		// Append peer's own IPv6 subnet
+		if peer.RemoteTunAddress6 != "" {
+			_, ipNet, err := net.ParseCIDR(peer.RemoteTunAddress6 + "/128")
+			if err != nil {
+				log.Println("Error parsing peer's own IPv6 subnet:", err)
+			} else {
+				allowedIPs = append(allowedIPs, *ipNet)
+			}
+		}
 
 		// Create wireguard-go peer configuration
 		wgPeer := wgtypes.PeerConfig{
@@ -129,49 +367,95 @@ func SyncWireguardConfiguration() error {
 		wgPeers = append(wgPeers, wgPeer)
 	}
 
-	// Parse ENV.WG_PRIVATE_KEY
-	privateKey, err := wgtypes.ParseKey(ENV.WG_PRIVATE_KEY)
+	err := configureWireguardDevice(network.Interface, network.PrivateKey, network.ListenPort, wgPeers, members)
 	if err != nil {
 		return err
 	}
 
-	// Convert ENV.WG_PORT to int
-	wgPort, err := strconv.Atoi(ENV.WG_PORT)
+	rotation, err := db.GetActiveServerKeyRotations()
+	if err != nil {
+		return err
+	}
+	if r, ok := rotation[network.Name]; ok {
+		return configureWireguardDevice(r.Interface, r.PrivateKey, r.ListenPort, wgPeers, members)
+	}
+	return nil
+}
+
+// Applies a key, port and peers to a wireguard interface, removing peers that
+// moved to another network or no longer exist
+func configureWireguardDevice(iface string, key string, port int, wgPeers []wgtypes.PeerConfig, members map[string]bool) error {
+	device, err := wg.Device(iface)
+	if err != nil {
+		return err
+	}
+	for _, wgPeer := range device.Peers {
+		if !members[wgPeer.PublicKey.String()] {
+			wgPeers = append(wgPeers, wgtypes.PeerConfig{
+				PublicKey: wgPeer.PublicKey,
+				Remove:    true,
+			})
+		}
+	}
+
+	// Parse the private key
+	privateKey, err := wgtypes.ParseKey(key)
 	if err != nil {
 		return err
 	}
 
 	// Append the wireguard-go configuration
-	return wg.ConfigureDevice(ENV.WG_INTERFACE, wgtypes.Config{
+	return wg.ConfigureDevice(iface, wgtypes.Config{
 		ReplacePeers: false,
 		Peers:        wgPeers,
 		PrivateKey:   &privateKey,
-		ListenPort:   &wgPort,
+		ListenPort:   &port,
 	})
 }
 
 func GetWireguardPeer(storedPeer types.Peer) (types.Peer, error) {
-	// Get wireguard data
-	device, err := wg.Device(ENV.WG_INTERFACE)
+	// Get the peer's network
+	network, err := GetPeerNetwork(storedPeer)
 	if err != nil {
 		return types.Peer{}, err
 	}
 
-	// Find stored peer in wireguard peers
-	for _, wgPeer := range device.Peers {
-		if wgPeer.PresharedKey.String() == storedPeer.PreSharedKey {
-			// Create extended peer
-			storedPeer.TransmitBytes = wgPeer.TransmitBytes
-			storedPeer.ReceiveBytes = wgPeer.ReceiveBytes
-			storedPeer.LastSeenUnixMillis = wgPeer.LastHandshakeTime.UnixMilli()
-			if wgPeer.Endpoint != nil {
-				storedPeer.LastIPAddress = wgPeer.Endpoint.IP.String()
+	interfaces, err := NetworkInterfaces([]types.Network{network})
+	if err != nil {
+		return types.Peer{}, err
+	}
+
+	// Find stored peer in the wireguard peers of each of the network's
+	// interfaces, using the endpoint of the most recent handshake
+	found := false
+	var lastHandshake time.Time
+	for _, iface := range interfaces[network.Name] {
+		device, err := wg.Device(iface)
+		if err != nil {
+			return types.Peer{}, err
+		}
+
+		for _, wgPeer := range device.Peers {
+			if wgPeer.PresharedKey.String() != storedPeer.PreSharedKey {
+				continue
+			}
+			found = true
+			storedPeer.TransmitBytes += wgPeer.TransmitBytes
+			storedPeer.ReceiveBytes += wgPeer.ReceiveBytes
+			if wgPeer.LastHandshakeTime.After(lastHandshake) || lastHandshake.IsZero() {
+				lastHandshake = wgPeer.LastHandshakeTime
+				storedPeer.LastSeenUnixMillis = wgPeer.LastHandshakeTime.UnixMilli()
+				if wgPeer.Endpoint != nil {
+					storedPeer.LastIPAddress = wgPeer.Endpoint.IP.String()
+				}
 			}
-			return storedPeer, nil
 		}
 	}
+	if !found {
+		return types.Peer{}, errors.New("peer not found in wireguard-go")
+	}
 
-	return types.Peer{}, errors.New("peer not found in wireguard-go")
+	return storedPeer, nil
 }
 
 func NewWireguardPrivateKey() (privKey string, err error) {
@@ -201,3 +485,28 @@ func GetWireguardPublicKey(privateKey string) (pubKey string, err error) {
 
 	return key.PublicKey().String(), nil
 }
+
+// Checks a peer's public key, and that any server-held private key matches it
+func ValidatePeerKeys(peer types.Peer) error {
+	if peer.PublicKey == "" {
+		return errors.New("public key is required")
+	}
+	if _, err := wgtypes.ParseKey(peer.PublicKey); err != nil {
+		return errors.New("invalid public key")
+	}
+
+	if peer.PrivateKey == "" {
+		return nil
+	}
+	if ENV.CLIENT_KEYS_ONLY {
+		return errors.New("server-held private keys are disabled, send only the public key")
+	}
+	pubKey, err := GetWireguardPublicKey(peer.PrivateKey)
+	if err != nil {
+		return errors.New("invalid private key")
+	}
+	if pubKey != peer.PublicKey {
+		return errors.New("private key does not match public key")
+	}
+	return nil
+}